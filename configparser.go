@@ -19,12 +19,16 @@ package main
 
 import (
 	"code.google.com/p/goconf/conf"
+	"fmt"
 	. "github.com/rafaelbandeira3/uniqush-push/db"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
+	. "github.com/rafaelbandeira3/uniqush-push/srv"
 	. "github.com/uniqush/log"
 	"io"
+	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -96,6 +100,10 @@ func LoadDatabaseConfig(cf *conf.ConfigFile) (*DatabaseConfig, error) {
 	if err != nil || c.Host == "" {
 		c.Host = "localhost"
 	}
+	c.User, err = cf.GetString("Database", "user")
+	if err != nil {
+		c.User = ""
+	}
 	c.Password, err = cf.GetString("Database", "password")
 	if err != nil {
 		c.Password = ""
@@ -109,14 +117,62 @@ func LoadDatabaseConfig(cf *conf.ConfigFile) (*DatabaseConfig, error) {
 	if err != nil || c.LeastDirty < 0 {
 		c.LeastDirty = 10
 	}
+	// Without cache by default: it must be the only writer
 	c.CacheSize, err = cf.GetInt("Database", "cachesize")
 	if err != nil || c.CacheSize < 0 {
-		c.CacheSize = 1024
+		c.CacheSize = 0
+	}
+
+	// Redis: Sentinel, or cluster
+	c.Sentinels = loadAddresses(cf, "Database", "sentinels")
+	c.MasterName, err = cf.GetString("Database", "mastername")
+	if err != nil {
+		c.MasterName = ""
+	}
+	c.ClusterNodes = loadAddresses(cf, "Database", "cluster")
+	c.Shards = loadAddresses(cf, "Database", "shards")
+	c.MaxIdle, err = cf.GetInt("Database", "maxidle")
+	if err != nil || c.MaxIdle <= 0 {
+		c.MaxIdle = 16
+	}
+	c.MaxActive, err = cf.GetInt("Database", "maxactive")
+	if err != nil || c.MaxActive < 0 {
+		c.MaxActive = 0
 	}
+	c.IdleTimeout = loadDuration(cf, "Database", "idletimeout", time.Second, 240*time.Second)
+	c.ConnectTimeout = loadDuration(cf, "Database", "connecttimeout", time.Millisecond, 5*time.Second)
+	c.ReadTimeout = loadDuration(cf, "Database", "readtimeout", time.Millisecond, 0)
+	c.WriteTimeout = loadDuration(cf, "Database", "writetimeout", time.Millisecond, 0)
 
 	return c, nil
 }
 
+// loadAddresses reads a comma separated list of addresses, if any.
+func loadAddresses(cf *conf.ConfigFile, section, option string) []string {
+	value, err := cf.GetString(section, option)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
+
+// loadDuration reads a number of units, or returns def if missing or
+// negative.
+func loadDuration(cf *conf.ConfigFile, section, option string, unit, def time.Duration) time.Duration {
+	n, err := cf.GetInt(section, option)
+	if err != nil || n < 0 {
+		return def
+	}
+	return time.Duration(n) * unit
+}
+
 var (
 	defaultConfigFilePath string = "/etc/uniqush/uniqush.conf"
 )
@@ -193,6 +249,110 @@ func LoadRestAddr(c *conf.ConfigFile) (string, error) {
 	return addr, err
 }
 
+// LoadPlugins installs the out-of-process push service types listed in
+// the Plugins section. Each plugin is configured in its own section,
+// named Plugin.<name>.
+func LoadPlugins(c *conf.ConfigFile) error {
+	names, err := c.GetString("Plugins", "names")
+	if err != nil || names == "" {
+		return nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		section := "Plugin." + name
+		path, err := c.GetString(section, "exec")
+		if err != nil || path == "" {
+			return fmt.Errorf("Plugin %v: no executable specified", name)
+		}
+		var args []string
+		argstr, err := c.GetString(section, "args")
+		if err == nil && argstr != "" {
+			args = strings.Fields(argstr)
+		}
+		maxConcurrency, err := c.GetInt(section, "maxconcurrency")
+		if err != nil || maxConcurrency <= 0 {
+			maxConcurrency = 10
+		}
+		// The keys of the secret data of the push service providers,
+		// also returned by the plugin when building them
+		var credentials []string
+		fields, err := c.GetString(section, "credentials")
+		if err == nil && fields != "" {
+			for _, field := range strings.Split(fields, ",") {
+				if field = strings.TrimSpace(field); field != "" {
+					credentials = append(credentials, field)
+				}
+			}
+		}
+		InstallPlugin(name, path, args, maxConcurrency, credentials)
+	}
+	return nil
+}
+
+// LoadCredentialKey sets the key encrypting the inline credentials of
+// push service providers, e.g. the certificates of APNS.
+func LoadCredentialKey(c *conf.ConfigFile) error {
+	key, err := c.GetString("Credentials", "key")
+	if err != nil || key == "" {
+		key = os.Getenv("UNIQUSH_CREDENTIAL_KEY")
+	}
+	SetCredentialKey(key)
+	return nil
+}
+
+// LoadLiveKey sets the secret signing the ids of live connections. See
+// SetLiveKey()
+func LoadLiveKey(c *conf.ConfigFile) error {
+	key, err := c.GetString("Live", "key")
+	if err != nil || key == "" {
+		key = os.Getenv("UNIQUSH_LIVE_KEY")
+	}
+	SetLiveKey(key)
+	return nil
+}
+
+// LoadEndpoints reads the Endpoints section, which overrides the
+// endpoints of the push services. See SetEndpoint()
+func LoadEndpoints(c *conf.ConfigFile) error {
+	names, err := c.GetOptions("Endpoints")
+	if err != nil {
+		return nil
+	}
+	for _, name := range names {
+		addr, err := c.GetString("Endpoints", name)
+		if err != nil {
+			return err
+		}
+		err = SetEndpoint(name, strings.TrimSpace(addr))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadCredentialMonitor reads the CredentialMonitor section: warndays
+// is how many days before expiry warnings start, checkperiod is in
+// hours and webhook is an URL receiving the warnings as JSON.
+func LoadCredentialMonitor(c *conf.ConfigFile, psm *PushServiceManager, db PushDatabase, logger Logger) (*CredentialMonitor, error) {
+	warnDays, err := c.GetInt("CredentialMonitor", "warndays")
+	if err != nil || warnDays < 0 {
+		warnDays = 30
+	}
+	period, err := c.GetInt("CredentialMonitor", "checkperiod")
+	if err != nil || period <= 0 {
+		period = 12
+	}
+	webhook, err := c.GetString("CredentialMonitor", "webhook")
+	if err != nil {
+		webhook = ""
+	}
+	return NewCredentialMonitor(psm, db, logger, warnDays, time.Duration(period)*time.Hour, webhook), nil
+}
+
 func Run(conf, version string) error {
 	c, err := OpenConfig(conf)
 	if err != nil {
@@ -202,6 +362,22 @@ func Run(conf, version string) error {
 	if err != nil {
 		return err
 	}
+	err = LoadPlugins(c)
+	if err != nil {
+		return err
+	}
+	err = LoadCredentialKey(c)
+	if err != nil {
+		return err
+	}
+	err = LoadLiveKey(c)
+	if err != nil {
+		return err
+	}
+	err = LoadEndpoints(c)
+	if err != nil {
+		return err
+	}
 	dbconf, err := LoadDatabaseConfig(c)
 	if err != nil {
 		return err
@@ -212,12 +388,17 @@ func Run(conf, version string) error {
 	}
 	psm := GetPushServiceManager()
 
-	db, err := NewPushDatabaseWithoutCache(dbconf)
+	db, err := NewPushDatabaseOpts(dbconf)
 	if err != nil {
 		return err
 	}
 
 	backend := NewPushBackEnd(psm, db, loggers)
+	monitor, err := LoadCredentialMonitor(c, psm, db, loggers[LOGGER_ADDPSP])
+	if err != nil {
+		return err
+	}
+	backend.MonitorCredentials(monitor)
 	rest := NewRestAPI(psm, loggers, version, backend)
 	stopChan := make(chan bool)
 	go rest.signalSetup()
@@ -225,3 +406,97 @@ func Run(conf, version string) error {
 	<-stopChan
 	return nil
 }
+
+// openDatabase opens the database configured in conf, for the commands
+// run instead of the server.
+func openDatabase(conf string) (PushDatabase, error) {
+	c, err := OpenConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	err = LoadPlugins(c)
+	if err != nil {
+		return nil, err
+	}
+	err = LoadCredentialKey(c)
+	if err != nil {
+		return nil, err
+	}
+	dbconf, err := LoadDatabaseConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	// The changes cached by a running server are not in the database
+	// yet: checking it could "fix" them, and exporting would miss them.
+	if dbconf.CacheSize > 0 {
+		addr, err := LoadRestAddr(c)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("uniqush-push is running at %v with a cache: use its REST API or stop it first", addr)
+		}
+	}
+	return NewPushDatabaseWithoutCache(dbconf)
+}
+
+// Fsck checks the database configured in conf, writes the problems to
+// out and returns their number. Problems are fixed if fix is true.
+func Fsck(conf string, fix bool, out io.Writer) (int, error) {
+	db, err := openDatabase(conf)
+	if err != nil {
+		return 0, err
+	}
+	problems, err := db.Check(fix)
+	for _, p := range problems {
+		fmt.Fprintf(out, "%v\n", p)
+	}
+	if err != nil || !fix {
+		return len(problems), err
+	}
+	return len(problems), db.FlushCache()
+}
+
+// Rebalance moves the subscriptions of the shards of the database
+// configured in conf, writes what was done to out and returns its size.
+// See ShardedPushDatabase.Rebalance()
+func Rebalance(conf string, out io.Writer) (int, error) {
+	db, err := openDatabase(conf)
+	if err != nil {
+		return 0, err
+	}
+	sharded, ok := db.(ShardedPushDatabase)
+	if !ok {
+		return 0, fmt.Errorf("No shards in %v", conf)
+	}
+	problems, err := sharded.Rebalance()
+	for _, p := range problems {
+		fmt.Fprintf(out, "%v\n", p)
+	}
+	return len(problems), err
+}
+
+// Export writes the data of services in the database configured in conf
+// to out. See PushDatabase.Export()
+func Export(conf string, services []string, redactCredentials bool, out io.Writer) (int, error) {
+	db, err := openDatabase(conf)
+	if err != nil {
+		return 0, err
+	}
+	return db.Export(out, services, redactCredentials)
+}
+
+// Import reads an export from in into the database configured in conf.
+// See PushDatabase.Import()
+func Import(conf string, services []string, dryRun bool, in io.Reader) (*ImportStats, error) {
+	db, err := openDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := db.Import(in, services, dryRun)
+	if err != nil {
+		return stats, err
+	}
+	return stats, db.FlushCache()
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/db"
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+	. "github.com/uniqush/log"
+)
+
+type CredentialStatus struct {
+	PushServiceProvider string     `json:"pushserviceprovider"`
+	Service             string     `json:"service"`
+	PushServiceType     string     `json:"pushservicetype"`
+	Expiry              *time.Time `json:"expiry,omitempty"`
+	DaysToExpiry        *int       `json:"daystoexpiry,omitempty"`
+	LastError           string     `json:"lasterror,omitempty"`
+	LastChecked         time.Time  `json:"lastchecked"`
+}
+
+// Sent to the webhook as a JSON object
+type CredentialEvent struct {
+	// credential.expiring, credential.expired or credential.failed
+	Event string `json:"event"`
+	CredentialStatus
+}
+
+// CredentialMonitor inspects the credentials of push service providers
+// when they are added and periodically afterwards. It warns about the
+// ones which expire within warnDays and about the ones rejected by the
+// push service.
+type CredentialMonitor struct {
+	psm      *PushServiceManager
+	db       PushDatabase
+	logger   Logger
+	warnDays int
+	period   time.Duration
+	webhook  string
+	client   *http.Client
+
+	lock   sync.Mutex
+	status map[string]*CredentialStatus
+}
+
+var credentialMetricsOnce sync.Once
+
+func NewCredentialMonitor(psm *PushServiceManager, db PushDatabase, logger Logger, warnDays int, period time.Duration, webhook string) *CredentialMonitor {
+	ret := new(CredentialMonitor)
+	ret.psm = psm
+	ret.db = db
+	ret.logger = logger
+	ret.warnDays = warnDays
+	ret.period = period
+	ret.webhook = webhook
+	ret.client = &http.Client{Timeout: 10 * time.Second}
+	ret.status = make(map[string]*CredentialStatus, 16)
+	credentialMetricsOnce.Do(func() {
+		// Exported on /debug/vars
+		expvar.Publish("uniqush.credentials.daystoexpiry", expvar.Func(ret.daysToExpiry))
+	})
+	return ret
+}
+
+func (self *CredentialMonitor) daysToExpiry() interface{} {
+	ret := make(map[string]int)
+	for _, st := range self.Status() {
+		if st.DaysToExpiry != nil {
+			ret[st.PushServiceProvider] = *st.DaysToExpiry
+		}
+	}
+	return ret
+}
+
+// Run checks every push service provider in the database
+// periodically. It never returns.
+func (self *CredentialMonitor) Run() {
+	for {
+		self.CheckAll()
+		time.Sleep(self.period)
+	}
+}
+
+func (self *CredentialMonitor) CheckAll() {
+	psps, err := self.db.GetPushServiceProviders()
+	if err != nil {
+		self.logger.Errorf("Cannot check credentials: Database Error %v", err)
+		return
+	}
+	for _, psp := range psps {
+		self.Check(psp)
+	}
+}
+
+// Check inspects the credentials of psp. Push service types which do
+// not know when their credentials expire are only reported by
+// ReportFailure().
+func (self *CredentialMonitor) Check(psp *PushServiceProvider) {
+	expiry, ok, err := self.psm.CredentialExpiry(psp)
+	now := time.Now()
+
+	self.lock.Lock()
+	st := self.statusOf(psp)
+	st.LastChecked = now
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	if ok && err == nil {
+		days := int(expiry.Sub(now).Hours() / 24)
+		st.Expiry = &expiry
+		st.DaysToExpiry = &days
+	}
+	ev := *st
+	self.lock.Unlock()
+
+	if err != nil {
+		self.emit("credential.failed", &ev)
+	} else if ev.DaysToExpiry != nil {
+		if now.After(*ev.Expiry) {
+			self.emit("credential.expired", &ev)
+		} else if *ev.DaysToExpiry <= self.warnDays {
+			self.emit("credential.expiring", &ev)
+		}
+	}
+}
+
+// ReportFailure records that the push service rejected the credentials
+// of psp, e.g. ADM or GCM refused the client secret or the API key.
+// It is reported once until the psp is checked again.
+func (self *CredentialMonitor) ReportFailure(psp *PushServiceProvider, err error) {
+	if psp == nil || err == nil {
+		return
+	}
+	self.lock.Lock()
+	st := self.statusOf(psp)
+	first := st.LastError == ""
+	st.LastError = err.Error()
+	ev := *st
+	self.lock.Unlock()
+	if first {
+		self.emit("credential.failed", &ev)
+	}
+}
+
+// Forget removes psp from the monitor, e.g. once it is removed from
+// the database.
+func (self *CredentialMonitor) Forget(psp *PushServiceProvider) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.status, psp.Name())
+}
+
+// Status returns the status of all known push service providers,
+// sorted by name.
+func (self *CredentialMonitor) Status() []*CredentialStatus {
+	self.lock.Lock()
+	ret := make([]*CredentialStatus, 0, len(self.status))
+	for _, st := range self.status {
+		copied := *st
+		ret = append(ret, &copied)
+	}
+	self.lock.Unlock()
+	sort.Sort(credentialStatusByName(ret))
+	return ret
+}
+
+type credentialStatusByName []*CredentialStatus
+
+func (s credentialStatusByName) Len() int      { return len(s) }
+func (s credentialStatusByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s credentialStatusByName) Less(i, j int) bool {
+	return s[i].PushServiceProvider < s[j].PushServiceProvider
+}
+
+// Must be called with the lock held
+func (self *CredentialMonitor) statusOf(psp *PushServiceProvider) *CredentialStatus {
+	st, ok := self.status[psp.Name()]
+	if !ok {
+		st = &CredentialStatus{
+			PushServiceProvider: psp.Name(),
+			Service:             psp.FixedData["service"],
+			PushServiceType:     psp.PushServiceName(),
+		}
+		self.status[psp.Name()] = st
+	}
+	return st
+}
+
+func (self *CredentialMonitor) emit(event string, st *CredentialStatus) {
+	switch event {
+	case "credential.expiring":
+		self.logger.Warnf("Service=%v PushServiceProvider=%v Credentials expire in %v days (%v)", st.Service, st.PushServiceProvider, *st.DaysToExpiry, st.Expiry)
+	case "credential.expired":
+		self.logger.Errorf("Service=%v PushServiceProvider=%v Credentials expired on %v", st.Service, st.PushServiceProvider, st.Expiry)
+	default:
+		self.logger.Errorf("Service=%v PushServiceProvider=%v Bad credentials: %v", st.Service, st.PushServiceProvider, st.LastError)
+	}
+	if self.webhook == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(&CredentialEvent{Event: event, CredentialStatus: *st})
+		if err != nil {
+			return
+		}
+		resp, err := self.client.Post(self.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			self.logger.Errorf("Webhook %v failed: %v", self.webhook, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// Push service type whose credentials expire at expiry, or cannot be
+// read if err is set.
+type expiringPushServiceType struct {
+	lock   sync.Mutex
+	expiry time.Time
+	err    error
+}
+
+func (self *expiringPushServiceType) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	psp.FixedData["service"] = kv["service"]
+	psp.FixedData["name"] = kv["name"]
+	return nil
+}
+
+func (self *expiringPushServiceType) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	return errors.New("NoDeliveryPoint")
+}
+
+func (self *expiringPushServiceType) Name() string {
+	return "expiringtest"
+}
+
+func (self *expiringPushServiceType) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	for _ = range dpQueue {
+	}
+	close(resQueue)
+}
+
+func (self *expiringPushServiceType) SetErrorReportChan(errChan chan<- error) {}
+func (self *expiringPushServiceType) Finalize()                               {}
+
+func (self *expiringPushServiceType) CredentialExpiry(psp *PushServiceProvider) (time.Time, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.expiry, self.err
+}
+
+func (self *expiringPushServiceType) set(expiry time.Time, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.expiry = expiry
+	self.err = err
+}
+
+func TestCredentialMonitor(t *testing.T) {
+	events := make(chan *CredentialEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := new(CredentialEvent)
+		if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
+			t.Errorf("Bad event: %v", err)
+			return
+		}
+		events <- ev
+	}))
+	defer server.Close()
+	nextEvent := func() *CredentialEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event sent to the webhook")
+		}
+		return nil
+	}
+
+	pst := new(expiringPushServiceType)
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(pst)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": pst.Name(),
+		"service":         "test",
+		"name":            "cert",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := new(testLogger)
+	monitor := NewCredentialMonitor(psm, nil, logger, 30, time.Hour, server.URL)
+
+	pst.set(time.Now().Add(10*24*time.Hour+time.Hour), nil)
+	monitor.Check(psp)
+	ev := nextEvent()
+	if ev.Event != "credential.expiring" || ev.Service != "test" || ev.DaysToExpiry == nil || *ev.DaysToExpiry != 10 {
+		t.Errorf("Bad event: %+v", ev)
+	}
+
+	pst.set(time.Now().Add(-time.Hour), nil)
+	monitor.Check(psp)
+	if ev = nextEvent(); ev.Event != "credential.expired" {
+		t.Errorf("Expected credential.expired, got %v", ev.Event)
+	}
+
+	pst.set(time.Time{}, errors.New("bad certificate"))
+	monitor.Check(psp)
+	if ev = nextEvent(); ev.Event != "credential.failed" || ev.LastError != "bad certificate" {
+		t.Errorf("Bad event: %+v", ev)
+	}
+
+	// Failures are reported once until the psp is checked again
+	pst.set(time.Now().Add(365*24*time.Hour), nil)
+	monitor.Check(psp)
+	monitor.ReportFailure(psp, errors.New("InvalidApiKey"))
+	monitor.ReportFailure(psp, errors.New("InvalidApiKey"))
+	if ev = nextEvent(); ev.Event != "credential.failed" || ev.LastError != "InvalidApiKey" {
+		t.Errorf("Bad event: %+v", ev)
+	}
+	select {
+	case ev = <-events:
+		t.Errorf("Failure reported twice: %+v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := logger.count("Bad credentials: InvalidApiKey"); n != 1 {
+		t.Errorf("Failure logged %v times", n)
+	}
+
+	status := monitor.Status()
+	if len(status) != 1 || status[0].PushServiceProvider != psp.Name() || status[0].LastError != "InvalidApiKey" {
+		t.Errorf("Bad status: %+v", status)
+	}
+	monitor.Forget(psp)
+	if status = monitor.Status(); len(status) != 0 {
+		t.Errorf("Forgotten psp still monitored: %+v", status)
+	}
+}
@@ -20,6 +20,7 @@ package db
 import (
 	"fmt"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
+	"time"
 )
 
 type DatabaseConfig struct {
@@ -37,6 +38,29 @@ type DatabaseConfig struct {
 	EverySec   int64
 	LeastDirty int
 
+	/* Redis only: instead of Host and Port, the addresses of the
+	 * Sentinels monitoring the master MasterName, or of some nodes
+	 * of a cluster.
+	 */
+	Sentinels    []string
+	MasterName   string
+	ClusterNodes []string
+
+	/* Instead of Host and Port, the host:port of several servers
+	 * sharing the subscriptions. See shardedPushDatabase
+	 */
+	Shards []string
+
+	/* Redis only: the pool of connections of each server, and their
+	 * timeouts. No timeout if 0.
+	 */
+	MaxIdle        int
+	MaxActive      int
+	IdleTimeout    time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
 	PushServiceManager *PushServiceManager
 }
 
@@ -64,6 +88,15 @@ func LoadDatabaseConfig(filename string) (conf *DatabaseConfig, err os.Error) {
 func (c *DatabaseConfig) String() string {
 	ret := fmt.Sprintf("engine: %v;\nname: %v;\nuser: %v;\npassowrd: %v;\nhost: %v\nport: %d\n",
 		c.Engine, c.Name, c.User, c.Password, c.Host, c.Port)
+	if len(c.Sentinels) > 0 {
+		ret += fmt.Sprintf("sentinels: %v\nmaster name: %v\n", c.Sentinels, c.MasterName)
+	}
+	if len(c.ClusterNodes) > 0 {
+		ret += fmt.Sprintf("cluster: %v\n", c.ClusterNodes)
+	}
+	if len(c.Shards) > 0 {
+		ret += fmt.Sprintf("shards: %v\n", c.Shards)
+	}
 
 	return ret
 }
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const nrLockStripes = 64
+
+// keyLocks serializes the changes of the same service, delivery point or
+// push service provider, so that the subscriptions of different
+// subscribers are written in parallel. Keys share a lock when they hash
+// to the same stripe.
+type keyLocks struct {
+	services [nrLockStripes]sync.RWMutex
+	peers    [nrLockStripes]sync.Mutex
+}
+
+func lockStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % nrLockStripes)
+}
+
+// lock locks the service srv, exclusively or not, then the peers given by
+// their names, and returns the function unlocking them. srv may be empty.
+func (self *keyLocks) lock(srv string, exclusive bool, peers ...string) func() {
+	var srvLock *sync.RWMutex
+	if srv != "" {
+		srvLock = &self.services[lockStripe(srv)]
+		if exclusive {
+			srvLock.Lock()
+		} else {
+			srvLock.RLock()
+		}
+	}
+	// Always in the same order, to avoid deadlocks
+	stripes := make([]int, 0, len(peers))
+	for _, name := range peers {
+		stripes = append(stripes, lockStripe(name))
+	}
+	sort.Ints(stripes)
+	locked := stripes[:0]
+	for i, s := range stripes {
+		if i > 0 && s == stripes[i-1] {
+			continue
+		}
+		self.peers[s].Lock()
+		locked = append(locked, s)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			self.peers[locked[i]].Unlock()
+		}
+		if srvLock == nil {
+			return
+		}
+		if exclusive {
+			srvLock.Unlock()
+		} else {
+			srvLock.RUnlock()
+		}
+	}
+}
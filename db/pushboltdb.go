@@ -0,0 +1,492 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltValuesBucket   = []byte("values")
+	boltSetsBucket     = []byte("sets")
+	boltCountersBucket = []byte("counters")
+)
+
+// PushBoltDB stores everything in one file with bbolt, with the same keys
+// as PushRedisDB. The Name of its config is the path of the file.
+//
+// Each method runs in its own transaction. Transaction() runs several
+// of them in one.
+type PushBoltDB struct {
+	db *bolt.DB
+	// Set within Transaction()
+	tx  *bolt.Tx
+	psm *PushServiceManager
+}
+
+func newPushBoltDB(c *DatabaseConfig) (*PushBoltDB, error) {
+	if c == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	if strings.ToLower(c.Engine) != "bolt" {
+		return nil, errors.New("Unsupported Database Engine")
+	}
+	// Name defaults to the database number of redis
+	if c.Name == "" || c.Name == "0" {
+		return nil, errors.New("NoDatabaseFile")
+	}
+	db, err := bolt.Open(c.Name, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltValuesBucket, boltSetsBucket, boltCountersBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ret := new(PushBoltDB)
+	ret.db = db
+	ret.psm = c.PushServiceManager
+	if ret.psm == nil {
+		ret.psm = GetPushServiceManager()
+	}
+	return ret, nil
+}
+
+func (r *PushBoltDB) Close() error {
+	return r.db.Close()
+}
+
+func (r *PushBoltDB) update(fn func(tx *bolt.Tx) error) error {
+	if r.tx != nil {
+		return fn(r.tx)
+	}
+	return r.db.Update(fn)
+}
+
+func (r *PushBoltDB) view(fn func(tx *bolt.Tx) error) error {
+	if r.tx != nil {
+		return fn(r.tx)
+	}
+	return r.db.View(fn)
+}
+
+// Transaction runs fn in one transaction. Nothing is written if fn
+// returns an error.
+func (r *PushBoltDB) Transaction(fn func(db pushRawDatabase) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return fn(&PushBoltDB{db: r.db, tx: tx, psm: r.psm})
+	})
+}
+
+// Backup writes a consistent copy of the database file to w. Writes are
+// not blocked meanwhile.
+func (r *PushBoltDB) Backup(w io.Writer) (n int64, err error) {
+	err = r.view(func(tx *bolt.Tx) error {
+		var e error
+		n, e = tx.WriteTo(w)
+		return e
+	})
+	return
+}
+
+// Every transaction is already on disk once committed.
+func (r *PushBoltDB) FlushCache() error {
+	return nil
+}
+
+// The value is copied, as it is only valid within the transaction.
+func boltGet(tx *bolt.Tx, key string) []byte {
+	v := tx.Bucket(boltValuesBucket).Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func boltSet(tx *bolt.Tx, key string, value []byte) error {
+	return tx.Bucket(boltValuesBucket).Put([]byte(key), value)
+}
+
+func boltDel(tx *bolt.Tx, key string) error {
+	return tx.Bucket(boltValuesBucket).Delete([]byte(key))
+}
+
+// Members of a set are the keys of its own bucket.
+func boltSadd(tx *bolt.Tx, key, member string) (bool, error) {
+	set, err := tx.Bucket(boltSetsBucket).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return false, err
+	}
+	if set.Get([]byte(member)) != nil {
+		return false, nil
+	}
+	return true, set.Put([]byte(member), []byte{1})
+}
+
+// Empty sets are deleted, like in redis.
+func boltSrem(tx *bolt.Tx, key, member string) (bool, error) {
+	sets := tx.Bucket(boltSetsBucket)
+	set := sets.Bucket([]byte(key))
+	if set == nil || set.Get([]byte(member)) == nil {
+		return false, nil
+	}
+	err := set.Delete([]byte(member))
+	if err != nil {
+		return false, err
+	}
+	if k, _ := set.Cursor().First(); k == nil {
+		err = sets.DeleteBucket([]byte(key))
+	}
+	return true, err
+}
+
+func boltSmembers(tx *bolt.Tx, key string) ([]string, error) {
+	set := tx.Bucket(boltSetsBucket).Bucket([]byte(key))
+	if set == nil {
+		return nil, nil
+	}
+	ret := make([]string, 0, 8)
+	err := set.ForEach(func(k, v []byte) error {
+		ret = append(ret, string(k))
+		return nil
+	})
+	return ret, err
+}
+
+// boltIncr adds delta to the counter and returns its new value. The
+// counter is deleted once it reaches 0.
+func boltIncr(tx *bolt.Tx, key string, delta int) (int, error) {
+	counters := tx.Bucket(boltCountersBucket)
+	n := 0
+	if v := counters.Get([]byte(key)); v != nil {
+		var err error
+		n, err = strconv.Atoi(string(v))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n += delta
+	if n <= 0 {
+		return n, counters.Delete([]byte(key))
+	}
+	return n, counters.Put([]byte(key), []byte(strconv.Itoa(n)))
+}
+
+func (r *PushBoltDB) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
+	var v []byte
+	err := r.view(func(tx *bolt.Tx) error {
+		v = boltGet(tx, DELIVERY_POINT_PREFIX+name)
+		return nil
+	})
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return r.psm.BuildDeliveryPointFromBytes(v)
+}
+
+func (r *PushBoltDB) SetDeliveryPoint(dp *DeliveryPoint) error {
+	return r.update(func(tx *bolt.Tx) error {
+		return boltSet(tx, DELIVERY_POINT_PREFIX+dp.Name(), deliveryPointToValue(dp))
+	})
+}
+
+func (r *PushBoltDB) GetPushServiceProvider(name string) (*PushServiceProvider, error) {
+	var v []byte
+	err := r.view(func(tx *bolt.Tx) error {
+		v = boltGet(tx, PUSH_SERVICE_PROVIDER_PREFIX+name)
+		return nil
+	})
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return r.psm.BuildPushServiceProviderFromBytes(v)
+}
+
+func (r *PushBoltDB) SetPushServiceProvider(psp *PushServiceProvider) error {
+	return r.update(func(tx *bolt.Tx) error {
+		return boltSet(tx, PUSH_SERVICE_PROVIDER_PREFIX+psp.Name(), pushServiceProviderToValue(psp))
+	})
+}
+
+func (r *PushBoltDB) RemoveDeliveryPoint(dp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		return boltDel(tx, DELIVERY_POINT_PREFIX+dp)
+	})
+}
+
+func (r *PushBoltDB) RemovePushServiceProvider(psp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		return boltDel(tx, PUSH_SERVICE_PROVIDER_PREFIX+psp)
+	})
+}
+
+// Like PushRedisDB, srv and sub may contain wildcards.
+func (r *PushBoltDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	pattern := SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + sub
+	ret := make(map[string][]string, 1)
+	err := r.view(func(tx *bolt.Tx) error {
+		if !strings.Contains(sub, "*") && !strings.Contains(srv, "*") {
+			dps, err := boltSmembers(tx, pattern)
+			if len(dps) > 0 {
+				ret[srv] = dps
+			}
+			return err
+		}
+		// Only the sets starting like the pattern may match it
+		prefix := pattern[:strings.Index(pattern, "*")]
+		c := tx.Bucket(boltSetsBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			key := string(k)
+			if ok, _ := path.Match(pattern, key); !ok {
+				continue
+			}
+			dps, err := boltSmembers(tx, key)
+			if err != nil {
+				return err
+			}
+			s := strings.Split(key, ":")[1]
+			ret[s] = append(ret[s], dps...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *PushBoltDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
+	var v []byte
+	err := r.view(func(tx *bolt.Tx) error {
+		v = boltGet(tx, SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX+srv+":"+dp)
+		return nil
+	})
+	return string(v), err
+}
+
+func (r *PushBoltDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		added, err := boltSadd(tx, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, dp)
+		if err != nil || !added {
+			return err
+		}
+		_, err = boltIncr(tx, DELIVERY_POINT_COUNTER_PREFIX+dp, 1)
+		return err
+	})
+}
+
+// The delivery point is removed once no subscriber uses it.
+func (r *PushBoltDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		removed, err := boltSrem(tx, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, dp)
+		if err != nil || !removed {
+			return err
+		}
+		n, err := boltIncr(tx, DELIVERY_POINT_COUNTER_PREFIX+dp, -1)
+		if err != nil || n > 0 {
+			return err
+		}
+		return boltDel(tx, DELIVERY_POINT_PREFIX+dp)
+	})
+}
+
+func (r *PushBoltDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		return boltSet(tx, SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX+srv+":"+dp, []byte(psp))
+	})
+}
+
+func (r *PushBoltDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		return boltDel(tx, SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX+srv+":"+dp)
+	})
+}
+
+func (r *PushBoltDB) GetPushServiceProvidersByService(srv string) (ret []string, err error) {
+	err = r.view(func(tx *bolt.Tx) error {
+		ret, err = boltSmembers(tx, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv)
+		return err
+	})
+	return
+}
+
+func (r *PushBoltDB) GetAllPushServiceProviders() ([]string, error) {
+	ret := make([]string, 0, 16)
+	err := r.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltValuesBucket).Cursor()
+		prefix := []byte(PUSH_SERVICE_PROVIDER_PREFIX)
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), PUSH_SERVICE_PROVIDER_PREFIX); k, _ = c.Next() {
+			ret = append(ret, strings.TrimPrefix(string(k), PUSH_SERVICE_PROVIDER_PREFIX))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *PushBoltDB) RemovePushServiceProviderFromService(srv, psp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		_, err := boltSrem(tx, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, psp)
+		return err
+	})
+}
+
+func (r *PushBoltDB) AddPushServiceProviderToService(srv, psp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		_, err := boltSadd(tx, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, psp)
+		return err
+	})
+}
+
+func (r *PushBoltDB) AddDeliveryPointToKey(key, dp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		_, err := boltSadd(tx, KEY_TO_DELIVERY_POINTS_PREFIX+key, dp)
+		return err
+	})
+}
+
+func (r *PushBoltDB) RemoveDeliveryPointFromKey(key, dp string) error {
+	return r.update(func(tx *bolt.Tx) error {
+		_, err := boltSrem(tx, KEY_TO_DELIVERY_POINTS_PREFIX+key, dp)
+		return err
+	})
+}
+
+func (r *PushBoltDB) GetDeliveryPointsNameByKey(key string) (ret []string, err error) {
+	err = r.view(func(tx *bolt.Tx) error {
+		ret, err = boltSmembers(tx, KEY_TO_DELIVERY_POINTS_PREFIX+key)
+		return err
+	})
+	return
+}
+
+// boltScan calls fn with the keys of the bucket starting with prefix,
+// without the prefix.
+func boltScan(b *bolt.Bucket, prefix string, fn func(key string, value []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+		err := fn(strings.TrimPrefix(string(k), prefix), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PushBoltDB) GetAllDeliveryPoints() ([]string, error) {
+	ret := make([]string, 0, 16)
+	err := r.view(func(tx *bolt.Tx) error {
+		return boltScan(tx.Bucket(boltValuesBucket), DELIVERY_POINT_PREFIX, func(dp string, v []byte) error {
+			ret = append(ret, dp)
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (r *PushBoltDB) GetAllSubscriptions() ([]rawSubscription, error) {
+	ret := make([]rawSubscription, 0, 16)
+	err := r.view(func(tx *bolt.Tx) error {
+		return boltScan(tx.Bucket(boltSetsBucket), SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, func(k string, v []byte) error {
+			srv, sub, ok := splitServiceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+k, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX)
+			if !ok {
+				return nil
+			}
+			dps, err := boltSmembers(tx, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+k)
+			for _, dp := range dps {
+				ret = append(ret, rawSubscription{Service: srv, Subscriber: sub, DeliveryPoint: dp})
+			}
+			return err
+		})
+	})
+	return ret, err
+}
+
+func (r *PushBoltDB) GetAllPushServiceProvidersOfDeliveryPoints() (map[string]map[string]string, error) {
+	ret := make(map[string]map[string]string, 4)
+	err := r.view(func(tx *bolt.Tx) error {
+		return boltScan(tx.Bucket(boltValuesBucket), SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX, func(k string, v []byte) error {
+			srv, dp, ok := splitServiceKey(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX+k, SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX)
+			if !ok {
+				return nil
+			}
+			if ret[srv] == nil {
+				ret[srv] = make(map[string]string, 16)
+			}
+			ret[srv][dp] = string(v)
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (r *PushBoltDB) GetAllServices() (map[string][]string, error) {
+	ret := make(map[string][]string, 4)
+	err := r.view(func(tx *bolt.Tx) error {
+		return boltScan(tx.Bucket(boltSetsBucket), SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX, func(srv string, v []byte) error {
+			psps, err := boltSmembers(tx, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv)
+			ret[srv] = psps
+			return err
+		})
+	})
+	return ret, err
+}
+
+func (r *PushBoltDB) GetDeliveryPointCounters() (map[string]int, error) {
+	ret := make(map[string]int, 16)
+	err := r.view(func(tx *bolt.Tx) error {
+		return boltScan(tx.Bucket(boltCountersBucket), DELIVERY_POINT_COUNTER_PREFIX, func(dp string, v []byte) error {
+			n, err := strconv.Atoi(string(v))
+			ret[dp] = n
+			return err
+		})
+	})
+	return ret, err
+}
+
+func (r *PushBoltDB) SetDeliveryPointCounter(dp string, n int) error {
+	return r.update(func(tx *bolt.Tx) error {
+		counters := tx.Bucket(boltCountersBucket)
+		if n <= 0 {
+			return counters.Delete([]byte(DELIVERY_POINT_COUNTER_PREFIX + dp))
+		}
+		return counters.Put([]byte(DELIVERY_POINT_COUNTER_PREFIX+dp), []byte(strconv.Itoa(n)))
+	})
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func TestBoltDatabase(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+
+	dir, err := ioutil.TempDir("", "uniqush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &DatabaseConfig{
+		Engine:             "bolt",
+		Name:               filepath.Join(dir, "uniqush.db"),
+		PushServiceManager: psm,
+	}
+	db, err := NewPushDatabaseWithoutCache(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := db.(*pushDatabaseOpts).db.(*PushBoltDB)
+	defer raw.Close()
+
+	psp, dp := newMemTestPeers(t, psm)
+	// Two services share the delivery point
+	for _, srv := range []string{"srv", "other"} {
+		err = db.AddPushServiceProviderToService(srv, psp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.AddDeliveryPointToService(srv, "sub", dp)
+		if err != nil {
+			t.Fatalf("Cannot subscribe: %v", err)
+		}
+	}
+
+	// Nothing is written by a failed transaction
+	failed := errors.New("failed")
+	err = raw.Transaction(func(tx pushRawDatabase) error {
+		err := tx.RemoveDeliveryPointFromServiceSubscriber("srv", "sub", dp.Name())
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairs("srv", "sub")
+	if err != nil || len(pairs) != 1 {
+		t.Fatalf("Transaction not rolled back: %v (%v)", pairs, err)
+	}
+
+	err = db.RemoveDeliveryPointFromService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d == nil {
+		t.Fatalf("Delivery point deleted while still used")
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	f, err := os.Create(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Backup(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	err = db.RemoveDeliveryPointFromService("other", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d != nil {
+		t.Errorf("Unused delivery point not deleted")
+	}
+
+	// The backup has the state before the last unsubscription
+	conf.Name = backup
+	db, err = NewPushDatabaseWithoutCache(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.(*pushDatabaseOpts).db.(*PushBoltDB).Close()
+	pairs, err = db.GetPushServiceProviderDeliveryPointPairs("*", "sub")
+	if err != nil || len(pairs) != 1 {
+		t.Fatalf("Expected 1 delivery point in the backup, got %v (%v)", len(pairs), err)
+	}
+	if pairs[0].DeliveryPoint.Name() != dp.Name() || pairs[0].PushServiceProvider.Name() != psp.Name() {
+		t.Errorf("Bad delivery point or push service provider: %+v", pairs[0])
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"errors"
 	"fmt"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
+	"io"
+	"strings"
 	"sync"
 )
 
@@ -64,41 +66,150 @@ type PushDatabase interface {
 	GetPushServiceProviderDeliveryPointPairs(service string,
 		subscriber string) ([]PushServiceProviderDeliveryPointPair, error)
 
+	// Like GetPushServiceProviderDeliveryPointPairs for each subscriber,
+	// in a few round trips to the database.
+	GetPushServiceProviderDeliveryPointPairsBySubscribers(service string,
+		subscribers []string) (map[string][]PushServiceProviderDeliveryPointPair, error)
+
+	// All push service providers of all services
+	GetPushServiceProviders() ([]*PushServiceProvider, error)
+
+	// Delivery points of the push service type with the key.
+	// See DeliveryPoint.Key()
+	GetDeliveryPointsByKey(pushServiceType, key string) ([]*DeliveryPoint, error)
+
+	// Looks for inconsistencies, and repairs them if fix is true.
+	// See DatabaseProblem.
+	Check(fix bool) ([]*DatabaseProblem, error)
+
+	// Writes the data of services, or of all of them if services is
+	// empty, to w as JSON Lines. See ExportRecord. Service names may
+	// contain wildcards. Returns the number of records written.
+	Export(w io.Writer, services []string, redactCredentials bool) (int, error)
+
+	// Reads records written by Export(), keeping those of services. In a
+	// dry run, records are checked but nothing is written.
+	Import(r io.Reader, services []string, dryRun bool) (*ImportStats, error)
+
+	// Statistics of the cache, or nil without cache
+	CacheStats() *CacheStats
+
+	// Writes a copy of the whole database to w, if the engine can.
+	// Returns the number of bytes written.
+	Backup(w io.Writer) (int64, error)
+
 	FlushCache() error
 }
 
 type pushDatabaseOpts struct {
-	db pushRawDatabase
-	/* TODO Fine grained locks */
+	db  pushRawDatabase
+	psm *PushServiceManager
+	// In front of the engine if not nil, and then db too
+	cache *pushRawDatabaseCache
+	// Changes hold it shared, and their own locks. Operations on the
+	// whole database, e.g. Check(), hold it exclusively. Reads take no
+	// lock: each read of the engines is atomic.
 	dblock sync.RWMutex
+	locks  keyLocks
 }
 
-/*
+// NewPushDatabaseOpts opens the database of conf behind a cache of
+// conf.CacheSize entries, or without cache if it is 0.
+// See pushRawDatabaseCache
 func NewPushDatabaseOpts(conf *DatabaseConfig) (PushDatabase, error) {
-	var err error
-	f := new(pushDatabaseOpts)
-	udb, err := newPushRedisDB(conf)
-	if udb == nil || err != nil {
-		return nil, err
+	if conf != nil && len(conf.Shards) > 0 {
+		return newShardedPushDatabase(conf, NewPushDatabaseOpts)
 	}
-	f.db = NewCachedUniqushDatabase(udb, udb, conf)
-	if f.db == nil {
-		return nil, errors.New("Cannot create cached database")
+	db, err := NewPushDatabaseWithoutCache(conf)
+	if err != nil || conf.CacheSize <= 0 {
+		return db, err
 	}
+	f := db.(*pushDatabaseOpts)
+	f.cache = newPushRawDatabaseCache(conf, f.db)
+	f.db = f.cache
 	return f, nil
 }
-*/
+
+// newPushRawDatabase opens the engine of conf: redis, memory, bolt, or
+// one of the SQL databases: postgres, mysql or sqlite
+func newPushRawDatabase(conf *DatabaseConfig) (pushRawDatabase, error) {
+	if conf == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	switch strings.ToLower(conf.Engine) {
+	case "redis":
+		return newPushRedisDB(conf)
+	case "memory":
+		return newPushMemoryDB(conf)
+	case "bolt":
+		return newPushBoltDB(conf)
+	case "postgres", "mysql", "sqlite":
+		return newPushSQLDB(conf)
+	}
+	return nil, errors.New("Unsupported Database Engine")
+}
 
 func NewPushDatabaseWithoutCache(conf *DatabaseConfig) (PushDatabase, error) {
+	if conf != nil && len(conf.Shards) > 0 {
+		return newShardedPushDatabase(conf, NewPushDatabaseWithoutCache)
+	}
 	var err error
 	f := new(pushDatabaseOpts)
-	f.db, err = newPushRedisDB(conf)
-	if f.db == nil || err != nil {
+	f.db, err = newPushRawDatabase(conf)
+	if err != nil {
 		return nil, err
 	}
+	f.psm = conf.PushServiceManager
+	if f.psm == nil {
+		f.psm = GetPushServiceManager()
+	}
 	return f, nil
 }
 
+// transaction runs fn in one transaction, if the engine supports them.
+// Otherwise, the changes are only protected by the locks.
+func (f *pushDatabaseOpts) transaction(fn func(db pushRawDatabase) error) error {
+	if t, ok := f.db.(pushRawDatabaseTransactor); ok {
+		return t.Transaction(fn)
+	}
+	return fn(f.db)
+}
+
+// engine returns the database behind the cache, once the dirty data of
+// the cache is written. The cache must be purged after changing the
+// engine directly.
+func (f *pushDatabaseOpts) engine() (pushRawDatabase, error) {
+	if f.cache == nil {
+		return f.db, nil
+	}
+	return f.cache.db, f.cache.flushDirty()
+}
+
+func (f *pushDatabaseOpts) CacheStats() *CacheStats {
+	if f.cache == nil {
+		return nil
+	}
+	return f.cache.Stats()
+}
+
+func (f *pushDatabaseOpts) Backup(w io.Writer) (int64, error) {
+	db, err := f.engine()
+	if err != nil {
+		return 0, err
+	}
+	b, ok := db.(pushRawDatabaseBackup)
+	if !ok {
+		return 0, errors.New("BackupNotSupported")
+	}
+	// Without transactions, a copy taken in the middle of a
+	// subscription would be inconsistent.
+	if _, ok := db.(pushRawDatabaseTransactor); !ok {
+		f.dblock.Lock()
+		defer f.dblock.Unlock()
+	}
+	return b.Backup(w)
+}
+
 func (f *pushDatabaseOpts) FlushCache() error {
 	f.dblock.Lock()
 	defer f.dblock.Unlock()
@@ -110,18 +221,16 @@ func (f *pushDatabaseOpts) RemovePushServiceProviderFromService(service string,
 	if name == "" {
 		return errors.New("InvalidPushServiceProvider")
 	}
-	db := f.db
-	f.dblock.Lock()
-	defer f.dblock.Unlock()
-	err := db.RemovePushServiceProviderFromService(service, name)
-	if err != nil {
-		return err
-	}
-	err = db.RemovePushServiceProvider(name)
-	if err != nil {
-		return err
-	}
-	return nil
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock(service, true, name)()
+	return f.transaction(func(db pushRawDatabase) error {
+		err := db.RemovePushServiceProviderFromService(service, name)
+		if err != nil {
+			return err
+		}
+		return db.RemovePushServiceProvider(name)
+	})
 }
 
 func (f *pushDatabaseOpts) AddPushServiceProviderToService(service string,
@@ -133,13 +242,16 @@ func (f *pushDatabaseOpts) AddPushServiceProviderToService(service string,
 	if len(name) == 0 {
 		return errors.New("InvalidPushServiceProvider")
 	}
-	f.dblock.Lock()
-	defer f.dblock.Unlock()
-	e := f.db.SetPushServiceProvider(push_service_provider)
-	if e != nil {
-		return e
-	}
-	return f.db.AddPushServiceProviderToService(service, push_service_provider.Name())
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock(service, true, name)()
+	return f.transaction(func(db pushRawDatabase) error {
+		e := db.SetPushServiceProvider(push_service_provider)
+		if e != nil {
+			return e
+		}
+		return db.AddPushServiceProviderToService(service, push_service_provider.Name())
+	})
 }
 
 func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
@@ -148,8 +260,9 @@ func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
 	if delivery_point == nil {
 		return nil, nil
 	}
-	f.dblock.Lock()
-	defer f.dblock.Unlock()
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock(service, false, delivery_point.Name())()
 	pspnames, err := f.db.GetPushServiceProvidersByService(service)
 	if err != nil {
 		return nil, err
@@ -170,15 +283,24 @@ func (f *pushDatabaseOpts) AddDeliveryPointToService(service string,
 			continue
 		}
 		if psp.PushServiceName() == delivery_point.PushServiceName() {
-			err = f.db.SetDeliveryPoint(delivery_point)
-			if err != nil {
-				return nil, err
-			}
-			err = f.db.AddDeliveryPointToServiceSubscriber(service, subscriber, delivery_point.Name())
-			if err != nil {
-				return nil, err
-			}
-			err = f.db.SetPushServiceProviderOfServiceDeliveryPoint(service, delivery_point.Name(), psp.Name())
+			err = f.transaction(func(db pushRawDatabase) error {
+				err := db.SetDeliveryPoint(delivery_point)
+				if err != nil {
+					return err
+				}
+				err = db.AddDeliveryPointToServiceSubscriber(service, subscriber, delivery_point.Name())
+				if err != nil {
+					return err
+				}
+				err = db.SetPushServiceProviderOfServiceDeliveryPoint(service, delivery_point.Name(), psp.Name())
+				if err != nil {
+					return err
+				}
+				if key := delivery_point.Key(); key != "" {
+					return db.AddDeliveryPointToKey(deliveryPointKey(delivery_point.PushServiceName(), key), delivery_point.Name())
+				}
+				return nil
+			})
 			if err != nil {
 				return nil, err
 			}
@@ -194,20 +316,64 @@ func (f *pushDatabaseOpts) RemoveDeliveryPointFromService(service string,
 	if delivery_point.Name() == "" {
 		return errors.New("InvalidDeliveryPoint")
 	}
-	f.dblock.Lock()
-	defer f.dblock.Unlock()
-	err := f.db.RemoveDeliveryPointFromServiceSubscriber(service, subscriber, delivery_point.Name())
-	if err != nil {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock(service, false, delivery_point.Name())()
+	return f.transaction(func(db pushRawDatabase) error {
+		err := db.RemoveDeliveryPointFromServiceSubscriber(service, subscriber, delivery_point.Name())
+		if err != nil {
+			return err
+		}
+		err = db.RemovePushServiceProviderOfServiceDeliveryPoint(service, delivery_point.Name())
+		if err != nil {
+			return err
+		}
+		if key := delivery_point.Key(); key != "" {
+			err = db.RemoveDeliveryPointFromKey(deliveryPointKey(delivery_point.PushServiceName(), key), delivery_point.Name())
+		}
 		return err
+	})
+}
+
+func deliveryPointKey(pushServiceType, key string) string {
+	return pushServiceType + ":" + key
+}
+
+func (f *pushDatabaseOpts) GetDeliveryPointsByKey(pushServiceType, key string) ([]*DeliveryPoint, error) {
+	names, err := f.db.GetDeliveryPointsNameByKey(deliveryPointKey(pushServiceType, key))
+	if err != nil {
+		return nil, err
 	}
-	err = f.db.RemovePushServiceProviderOfServiceDeliveryPoint(service, delivery_point.Name())
-	return err
+	ret := make([]*DeliveryPoint, 0, len(names))
+	for _, name := range names {
+		dp, err := f.db.GetDeliveryPoint(name)
+		if err != nil {
+			return nil, err
+		}
+		if dp == nil {
+			continue
+		}
+		ret = append(ret, dp)
+	}
+	return ret, nil
 }
 
 func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairs(service string,
 	subscriber string) ([]PushServiceProviderDeliveryPointPair, error) {
-	f.dblock.RLock()
-	defer f.dblock.RUnlock()
+	if strings.Contains(service, "*") || strings.Contains(subscriber, "*") {
+		return f.getPairsByPattern(service, subscriber)
+	}
+	pairs, err := f.GetPushServiceProviderDeliveryPointPairsBySubscribers(service, []string{subscriber})
+	if err != nil {
+		return nil, err
+	}
+	return pairs[subscriber], nil
+}
+
+// getPairsByPattern reads the pairs of subscribers matching subscriber
+// in the services matching service, one by one.
+func (f *pushDatabaseOpts) getPairsByPattern(service string,
+	subscriber string) ([]PushServiceProviderDeliveryPointPair, error) {
 	dpnames, err := f.db.GetDeliveryPointsNameByServiceSubscriber(service, subscriber)
 	if err != nil {
 		return nil, err
@@ -251,12 +417,32 @@ func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairs(service stri
 	return ret, nil
 }
 
+func (f *pushDatabaseOpts) GetPushServiceProviders() ([]*PushServiceProvider, error) {
+	names, err := f.db.GetAllPushServiceProviders()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*PushServiceProvider, 0, len(names))
+	for _, name := range names {
+		psp, err := f.db.GetPushServiceProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		if psp == nil {
+			continue
+		}
+		ret = append(ret, psp)
+	}
+	return ret, nil
+}
+
 func (f *pushDatabaseOpts) ModifyPushServiceProvider(psp *PushServiceProvider) error {
 	if len(psp.Name()) == 0 {
 		return nil
 	}
-	f.dblock.Lock()
-	defer f.dblock.Unlock()
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock("", false, psp.Name())()
 	return f.db.SetPushServiceProvider(psp)
 }
 
@@ -264,7 +450,8 @@ func (f *pushDatabaseOpts) ModifyDeliveryPoint(dp *DeliveryPoint) error {
 	if len(dp.Name()) == 0 {
 		return nil
 	}
-	f.dblock.Lock()
-	defer f.dblock.Unlock()
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock("", false, dp.Name())()
 	return f.db.SetDeliveryPoint(dp)
 }
@@ -19,8 +19,7 @@ package db
 
 import (
 	"fmt"
-	redis "github.com/monnand/goredis"
-	. "github.com/rafaelbandeira3/uniqush-push/push"
+	"github.com/gomodule/redigo/redis"
 	"strconv"
 	"testing"
 )
@@ -41,7 +40,6 @@ func connectDatabase() (db PushDatabase, err error) {
 }
 
 func clearData() {
-	var client redis.Client
 	c := dbconf
 	if c.Host == "" {
 		c.Host = "localhost"
@@ -52,14 +50,16 @@ func clearData() {
 	if c.Name == "" {
 		c.Name = "0"
 	}
-	client.Addr = fmt.Sprintf("%s:%d", c.Host, c.Port)
-	client.Password = c.Password
-	var err error
-	client.Db, err = strconv.Atoi(c.Name)
+	db, err := strconv.Atoi(c.Name)
 	if err != nil {
-		client.Db = 0
+		db = 0
 	}
-	client.Flush(true)
+	conn, err := redis.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port), redis.DialPassword(c.Password), redis.DialDatabase(db))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Do("FLUSHALL")
 }
 
 func TestConnectAndDelete(t *testing.T) {
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"strings"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// sequentialBatchReader reads the keys one by one, for the engines
+// without batches, where reads are cheap anyway.
+type sequentialBatchReader struct {
+	db pushRawDatabaseReader
+}
+
+func (self *sequentialBatchReader) GetDeliveryPointsNameByServiceSubscribers(srv string, subs []string) ([][]string, error) {
+	ret := make([][]string, len(subs))
+	for i, sub := range subs {
+		dps, err := self.db.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = dps[srv]
+	}
+	return ret, nil
+}
+
+func (self *sequentialBatchReader) GetDeliveryPointsByNames(names []string) ([]*DeliveryPoint, error) {
+	ret := make([]*DeliveryPoint, len(names))
+	for i, name := range names {
+		dp, err := self.db.GetDeliveryPoint(name)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = dp
+	}
+	return ret, nil
+}
+
+func (self *sequentialBatchReader) GetPushServiceProvidersByNames(names []string) ([]*PushServiceProvider, error) {
+	ret := make([]*PushServiceProvider, len(names))
+	for i, name := range names {
+		psp, err := self.db.GetPushServiceProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = psp
+	}
+	return ret, nil
+}
+
+func (self *sequentialBatchReader) GetPushServiceProviderNamesByServiceDeliveryPoints(srv string, dps []string) ([]string, error) {
+	ret := make([]string, len(dps))
+	for i, dp := range dps {
+		psp, err := self.db.GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = psp
+	}
+	return ret, nil
+}
+
+func batchReaderOf(db pushRawDatabaseReader) pushRawDatabaseBatchReader {
+	if br, ok := db.(pushRawDatabaseBatchReader); ok {
+		return br
+	}
+	return &sequentialBatchReader{db: db}
+}
+
+// uniqueStrings returns the strings of lists, each one once.
+func uniqueStrings(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0, len(lists))
+	for _, list := range lists {
+		for _, s := range list {
+			if s != "" && !seen[s] {
+				seen[s] = true
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+// GetPushServiceProviderDeliveryPointPairsBySubscribers reads the data
+// of all the subscribers in a few batches: the delivery points of the
+// subscribers, then the delivery points with their push service
+// providers, then the push service providers.
+func (f *pushDatabaseOpts) GetPushServiceProviderDeliveryPointPairsBySubscribers(service string,
+	subscribers []string) (map[string][]PushServiceProviderDeliveryPointPair, error) {
+	ret := make(map[string][]PushServiceProviderDeliveryPointPair, len(subscribers))
+	if strings.Contains(service, "*") {
+		for _, sub := range subscribers {
+			pairs, err := f.getPairsByPattern(service, sub)
+			if err != nil {
+				return nil, err
+			}
+			ret[sub] = pairs
+		}
+		return ret, nil
+	}
+	var subs []string
+	for _, sub := range subscribers {
+		if strings.Contains(sub, "*") {
+			pairs, err := f.getPairsByPattern(service, sub)
+			if err != nil {
+				return nil, err
+			}
+			ret[sub] = pairs
+		} else {
+			subs = append(subs, sub)
+		}
+	}
+	if len(subs) == 0 {
+		return ret, nil
+	}
+
+	br := batchReaderOf(f.db)
+	dpsOfSubs, err := br.GetDeliveryPointsNameByServiceSubscribers(service, subs)
+	if err != nil {
+		return nil, err
+	}
+	dpNames := uniqueStrings(dpsOfSubs...)
+	dpList, err := br.GetDeliveryPointsByNames(dpNames)
+	if err != nil {
+		return nil, err
+	}
+	pspNamesOfDps, err := br.GetPushServiceProviderNamesByServiceDeliveryPoints(service, dpNames)
+	if err != nil {
+		return nil, err
+	}
+	pspNames := uniqueStrings(pspNamesOfDps)
+	pspList, err := br.GetPushServiceProvidersByNames(pspNames)
+	if err != nil {
+		return nil, err
+	}
+
+	psps := make(map[string]*PushServiceProvider, len(pspNames))
+	for i, name := range pspNames {
+		if pspList[i] != nil {
+			psps[name] = pspList[i]
+		}
+	}
+	pairs := make(map[string]PushServiceProviderDeliveryPointPair, len(dpNames))
+	for i, name := range dpNames {
+		psp := psps[pspNamesOfDps[i]]
+		if dpList[i] == nil || psp == nil {
+			continue
+		}
+		pairs[name] = PushServiceProviderDeliveryPointPair{psp, dpList[i]}
+	}
+	for i, sub := range subs {
+		var subPairs []PushServiceProviderDeliveryPointPair
+		for _, name := range dpsOfSubs[i] {
+			if pair, ok := pairs[name]; ok {
+				subPairs = append(subPairs, pair)
+			}
+		}
+		ret[sub] = subPairs
+	}
+	return ret, nil
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// slowDatabase adds the latency of a round trip to every read, like a
+// remote database.
+type slowDatabase struct {
+	pushRawDatabase
+	latency time.Duration
+}
+
+func (self *slowDatabase) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
+	time.Sleep(self.latency)
+	return self.pushRawDatabase.GetDeliveryPoint(name)
+}
+
+func (self *slowDatabase) GetPushServiceProvider(name string) (*PushServiceProvider, error) {
+	time.Sleep(self.latency)
+	return self.pushRawDatabase.GetPushServiceProvider(name)
+}
+
+func (self *slowDatabase) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	time.Sleep(self.latency)
+	return self.pushRawDatabase.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+}
+
+func (self *slowDatabase) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
+	time.Sleep(self.latency)
+	return self.pushRawDatabase.GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp)
+}
+
+// slowBatchDatabase reads a batch in one round trip.
+type slowBatchDatabase struct {
+	slowDatabase
+}
+
+func (self *slowBatchDatabase) GetDeliveryPointsNameByServiceSubscribers(srv string, subs []string) ([][]string, error) {
+	time.Sleep(self.latency)
+	return batchReaderOf(self.pushRawDatabase).GetDeliveryPointsNameByServiceSubscribers(srv, subs)
+}
+
+func (self *slowBatchDatabase) GetDeliveryPointsByNames(names []string) ([]*DeliveryPoint, error) {
+	time.Sleep(self.latency)
+	return batchReaderOf(self.pushRawDatabase).GetDeliveryPointsByNames(names)
+}
+
+func (self *slowBatchDatabase) GetPushServiceProvidersByNames(names []string) ([]*PushServiceProvider, error) {
+	time.Sleep(self.latency)
+	return batchReaderOf(self.pushRawDatabase).GetPushServiceProvidersByNames(names)
+}
+
+func (self *slowBatchDatabase) GetPushServiceProviderNamesByServiceDeliveryPoints(srv string, dps []string) ([]string, error) {
+	time.Sleep(self.latency)
+	return batchReaderOf(self.pushRawDatabase).GetPushServiceProviderNamesByServiceDeliveryPoints(srv, dps)
+}
+
+func subscriberNames(n int) []string {
+	ret := make([]string, n)
+	for i := range ret {
+		ret[i] = fmt.Sprintf("sub%v", i)
+	}
+	return ret
+}
+
+// subscribe subscribes subs to srv in parallel, with one delivery point
+// each.
+func subscribe(db PushDatabase, psm *PushServiceManager, srv string, subs []string) error {
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "memtest",
+		"service":         srv,
+		"account":         "acc",
+	})
+	if err != nil {
+		return err
+	}
+	err = db.AddPushServiceProviderToService(srv, psp)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subs))
+	for _, sub := range subs {
+		wg.Add(1)
+		go func(sub string) {
+			defer wg.Done()
+			dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+				"pushservicetype": "memtest",
+				"service":         srv,
+				"subscriber":      sub,
+				"token":           "tok-" + sub,
+			})
+			if err == nil {
+				_, err = db.AddDeliveryPointToService(srv, sub, dp)
+			}
+			errs <- err
+		}(sub)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPairsBySubscribers(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	for _, cacheSize := range []int{0, 10} {
+		db, err := NewPushDatabaseOpts(&DatabaseConfig{
+			Engine:             "memory",
+			CacheSize:          cacheSize,
+			PushServiceManager: psm,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs := subscriberNames(50)
+		err = subscribe(db, psm, "srv", subs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pairs, err := db.GetPushServiceProviderDeliveryPointPairsBySubscribers("srv", append(subs, "nobody", "sub1*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range subs {
+			if len(pairs[sub]) != 1 {
+				t.Fatalf("CacheSize=%v: %v has %v delivery points", cacheSize, sub, len(pairs[sub]))
+			}
+			if s := pairs[sub][0].DeliveryPoint.FixedData["subscriber"]; s != sub {
+				t.Errorf("CacheSize=%v: %v got the delivery point of %v", cacheSize, sub, s)
+			}
+		}
+		if len(pairs["nobody"]) != 0 {
+			t.Errorf("CacheSize=%v: Unknown subscriber has delivery points", cacheSize)
+		}
+		// sub1 and sub10 to sub19
+		if len(pairs["sub1*"]) != 11 {
+			t.Errorf("CacheSize=%v: Expected 11 delivery points, got %v", cacheSize, len(pairs["sub1*"]))
+		}
+		if numberOfPairs(t, db, "srv", "sub7") != 1 {
+			t.Errorf("CacheSize=%v: Single subscriber not found", cacheSize)
+		}
+	}
+}
+
+func newSlowTestDatabase(b *testing.B, batch bool) (*pushDatabaseOpts, []string) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	db, err := NewPushDatabaseWithoutCache(&DatabaseConfig{Engine: "memory", PushServiceManager: psm})
+	if err != nil {
+		b.Fatal(err)
+	}
+	f := db.(*pushDatabaseOpts)
+	subs := subscriberNames(100)
+	err = subscribe(f, psm, "srv", subs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	slow := slowDatabase{f.db, 100 * time.Microsecond}
+	if batch {
+		f.db = &slowBatchDatabase{slow}
+	} else {
+		f.db = &slow
+	}
+	return f, subs
+}
+
+// The delivery points of 100 subscribers, each read costing 100us, as
+// before: subscriber by subscriber.
+func BenchmarkPairsSequential(b *testing.B) {
+	f, subs := newSlowTestDatabase(b, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sub := range subs {
+			_, err := f.getPairsByPattern("srv", sub)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// The same ones in 4 batches
+func BenchmarkPairsBatched(b *testing.B) {
+	f, subs := newSlowTestDatabase(b, true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.GetPushServiceProviderDeliveryPointPairsBySubscribers("srv", subs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newRedisBenchmarkDatabase(b *testing.B) (*pushDatabaseOpts, []string) {
+	conn, err := redis.Dial("tcp", "localhost:6379")
+	if err != nil {
+		b.Skipf("No redis server: %v", err)
+	}
+	conn.Close()
+	clearData()
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	db, err := connectDatabase()
+	if err != nil {
+		b.Fatal(err)
+	}
+	f := db.(*pushDatabaseOpts)
+	subs := subscriberNames(100)
+	err = subscribe(f, psm, "srv", subs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return f, subs
+}
+
+func BenchmarkRedisPairsSequential(b *testing.B) {
+	f, subs := newRedisBenchmarkDatabase(b)
+	defer clearData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sub := range subs {
+			_, err := f.getPairsByPattern("srv", sub)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRedisPairsBatched(b *testing.B) {
+	f, subs := newRedisBenchmarkDatabase(b)
+	defer clearData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.GetPushServiceProviderDeliveryPointPairsBySubscribers("srv", subs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
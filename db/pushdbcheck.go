@@ -0,0 +1,392 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of DatabaseProblem
+const (
+	// A push service provider of a push service type which is not
+	// installed. Fixing it removes the push service provider.
+	UNKNOWN_PUSH_SERVICE_TYPE = "UnknownPushServiceType"
+	// A delivery point of a service uses a push service provider which
+	// does not exist. Fixing it uses another push service provider of the
+	// service with the same push service type, if any.
+	MISSING_PUSH_SERVICE_PROVIDER = "MissingPushServiceProvider"
+	// A subscriber is subscribed to a delivery point which does not
+	// exist. Fixing it removes the subscription.
+	MISSING_DELIVERY_POINT = "MissingDeliveryPoint"
+	// The reference counter of a delivery point is not its number of
+	// subscriptions. Fixing it sets the counter.
+	BAD_DELIVERY_POINT_COUNTER = "BadDeliveryPointCounter"
+	// A delivery point without subscriber. Fixing it removes the delivery
+	// point.
+	UNUSED_DELIVERY_POINT = "UnusedDeliveryPoint"
+	// A delivery point missing from the index of the keys used by the
+	// push service, e.g. subscribed before the index existed, so that
+	// its feedback is ignored. Fixing it adds it to the index.
+	MISSING_DELIVERY_POINT_KEY = "MissingDeliveryPointKey"
+
+	// With shards: a push service provider of a shard differing from
+	// the one of the first shard. Fixing it copies the first shard.
+	UNREPLICATED_PUSH_SERVICE_PROVIDER = "UnreplicatedPushServiceProvider"
+	// With shards: a subscription on another shard than the one of its
+	// subscriber, e.g. after adding a shard. Fixing it moves the
+	// subscription.
+	MISPLACED_SUBSCRIPTION = "MisplacedSubscription"
+)
+
+// DatabaseProblem is an inconsistency found by PushDatabase.Check()
+type DatabaseProblem struct {
+	Kind string `json:"kind"`
+	// The delivery point or push service provider
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+	Fixed  bool   `json:"fixed"`
+}
+
+func (self *DatabaseProblem) String() string {
+	ret := fmt.Sprintf("%v %v: %v", self.Kind, self.Name, self.Detail)
+	if self.Fixed {
+		ret += " (fixed)"
+	}
+	return ret
+}
+
+// dbChecker runs the checks of pushDatabaseOpts.Check() one after the
+// other, so that each one sees the fixes of the previous ones.
+type dbChecker struct {
+	db       pushRawDatabase
+	scanner  pushRawDatabaseScanner
+	fix      bool
+	problems []*DatabaseProblem
+}
+
+// found records a problem, and calls repair if problems are fixed.
+func (self *dbChecker) found(kind, name, detail string, repair func() error) error {
+	p := &DatabaseProblem{Kind: kind, Name: name, Detail: detail}
+	self.problems = append(self.problems, p)
+	if !self.fix || repair == nil {
+		return nil
+	}
+	err := repair()
+	if err != nil {
+		return fmt.Errorf("Cannot fix %v: %v", p, err)
+	}
+	p.Fixed = true
+	return nil
+}
+
+// Names of delivery points and push service providers start with their
+// push service type, see PushPeer.Name()
+func pushServiceTypeOfName(name string) string {
+	return strings.SplitN(name, ":", 2)[0]
+}
+
+// Check only holds dblock, and blocks changes, to fix the problems.
+// Otherwise it may also report the changes made meanwhile, e.g. a
+// subscription whose delivery point is not written yet.
+func (f *pushDatabaseOpts) Check(fix bool) ([]*DatabaseProblem, error) {
+	if fix {
+		f.dblock.Lock()
+		defer f.dblock.Unlock()
+	}
+	db, err := f.engine()
+	if err != nil {
+		return nil, err
+	}
+	scanner, ok := db.(pushRawDatabaseScanner)
+	if !ok {
+		return nil, errors.New("CheckNotSupported")
+	}
+	if fix && f.cache != nil {
+		defer f.cache.purge()
+	}
+	c := &dbChecker{db: db, scanner: scanner, fix: fix}
+	checks := []func() error{
+		func() error { return f.checkPushServiceTypes(c) },
+		c.checkPushServiceProvidersOfDeliveryPoints,
+		c.checkSubscriptions,
+		c.checkCounters,
+		c.checkUnusedDeliveryPoints,
+		c.checkDeliveryPointKeys,
+	}
+	for _, check := range checks {
+		err := check()
+		if err != nil {
+			return c.problems, err
+		}
+	}
+	return c.problems, nil
+}
+
+func (f *pushDatabaseOpts) checkPushServiceTypes(c *dbChecker) error {
+	services, err := c.scanner.GetAllServices()
+	if err != nil {
+		return err
+	}
+	names, err := c.db.GetAllPushServiceProviders()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		pst := pushServiceTypeOfName(name)
+		if f.psm.IsRegistered(pst) {
+			continue
+		}
+		psp := name
+		err = c.found(UNKNOWN_PUSH_SERVICE_TYPE, psp, fmt.Sprintf("Push service type %v is not installed", pst), func() error {
+			for srv, psps := range services {
+				for _, p := range psps {
+					if p != psp {
+						continue
+					}
+					err := c.db.RemovePushServiceProviderFromService(srv, psp)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return c.db.RemovePushServiceProvider(psp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *dbChecker) checkPushServiceProvidersOfDeliveryPoints() error {
+	services, err := self.scanner.GetAllServices()
+	if err != nil {
+		return err
+	}
+	names, err := self.db.GetAllPushServiceProviders()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(names))
+	for _, name := range names {
+		exists[name] = true
+	}
+	mapping, err := self.scanner.GetAllPushServiceProvidersOfDeliveryPoints()
+	if err != nil {
+		return err
+	}
+	for srv, dps := range mapping {
+		for dp, psp := range dps {
+			if exists[psp] {
+				continue
+			}
+			// Another push service provider of the service may do
+			replacement := ""
+			for _, p := range services[srv] {
+				if exists[p] && pushServiceTypeOfName(p) == pushServiceTypeOfName(dp) {
+					replacement = p
+					break
+				}
+			}
+			srv, dp := srv, dp
+			detail := fmt.Sprintf("Service %v uses the push service provider %v, which does not exist", srv, psp)
+			err = self.found(MISSING_PUSH_SERVICE_PROVIDER, dp, detail, func() error {
+				if replacement != "" {
+					return self.db.SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, replacement)
+				}
+				return self.db.RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *dbChecker) checkSubscriptions() error {
+	names, err := self.scanner.GetAllDeliveryPoints()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(names))
+	for _, name := range names {
+		exists[name] = true
+	}
+	subs, err := self.scanner.GetAllSubscriptions()
+	if err != nil {
+		return err
+	}
+	// Subscriptions of each delivery point of each service, to know
+	// when srv.dp-2-psp: is no longer used.
+	used := make(map[string]int, len(subs))
+	for _, s := range subs {
+		used[s.Service+":"+s.DeliveryPoint]++
+	}
+	for _, s := range subs {
+		if exists[s.DeliveryPoint] {
+			continue
+		}
+		s := s
+		detail := fmt.Sprintf("Subscriber %v of service %v uses a delivery point which does not exist", s.Subscriber, s.Service)
+		err = self.found(MISSING_DELIVERY_POINT, s.DeliveryPoint, detail, func() error {
+			err := self.db.RemoveDeliveryPointFromServiceSubscriber(s.Service, s.Subscriber, s.DeliveryPoint)
+			if err != nil {
+				return err
+			}
+			used[s.Service+":"+s.DeliveryPoint]--
+			if used[s.Service+":"+s.DeliveryPoint] > 0 {
+				return nil
+			}
+			return self.db.RemovePushServiceProviderOfServiceDeliveryPoint(s.Service, s.DeliveryPoint)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Only for the engines with reference counters
+func (self *dbChecker) checkCounters() error {
+	counter, ok := self.db.(pushRawDatabaseCounter)
+	if !ok {
+		return nil
+	}
+	counters, err := counter.GetDeliveryPointCounters()
+	if err != nil {
+		return err
+	}
+	subs, err := self.scanner.GetAllSubscriptions()
+	if err != nil {
+		return err
+	}
+	expected := make(map[string]int, len(counters))
+	for _, s := range subs {
+		expected[s.DeliveryPoint]++
+	}
+	for dp := range counters {
+		if _, ok := expected[dp]; !ok {
+			expected[dp] = 0
+		}
+	}
+	for dp, n := range expected {
+		if counters[dp] == n {
+			continue
+		}
+		dp, n := dp, n
+		detail := fmt.Sprintf("Counter is %v, but there are %v subscriptions", counters[dp], n)
+		err = self.found(BAD_DELIVERY_POINT_COUNTER, dp, detail, func() error {
+			return counter.SetDeliveryPointCounter(dp, n)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *dbChecker) checkUnusedDeliveryPoints() error {
+	names, err := self.scanner.GetAllDeliveryPoints()
+	if err != nil {
+		return err
+	}
+	subs, err := self.scanner.GetAllSubscriptions()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool, len(subs))
+	for _, s := range subs {
+		used[s.DeliveryPoint] = true
+	}
+	for _, name := range names {
+		if used[name] {
+			continue
+		}
+		dp := name
+		err = self.found(UNUSED_DELIVERY_POINT, dp, "No subscriber uses this delivery point", func() error {
+			// Unreadable delivery points are removed all the same
+			if d, _ := self.db.GetDeliveryPoint(dp); d != nil {
+				if key := d.Key(); key != "" {
+					err := self.db.RemoveDeliveryPointFromKey(deliveryPointKey(d.PushServiceName(), key), dp)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if counter, ok := self.db.(pushRawDatabaseCounter); ok {
+				err := counter.SetDeliveryPointCounter(dp, 0)
+				if err != nil {
+					return err
+				}
+			}
+			return self.db.RemoveDeliveryPoint(dp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *dbChecker) checkDeliveryPointKeys() error {
+	subs, err := self.scanner.GetAllSubscriptions()
+	if err != nil {
+		return err
+	}
+	// Unused delivery points are already reported
+	used := make(map[string]bool, len(subs))
+	for _, s := range subs {
+		used[s.DeliveryPoint] = true
+	}
+	for name := range used {
+		d, err := self.db.GetDeliveryPoint(name)
+		if err != nil || d == nil {
+			continue
+		}
+		key := d.Key()
+		if key == "" {
+			continue
+		}
+		key = deliveryPointKey(d.PushServiceName(), key)
+		names, err := self.db.GetDeliveryPointsNameByKey(key)
+		if err != nil {
+			return err
+		}
+		indexed := false
+		for _, n := range names {
+			if n == name {
+				indexed = true
+				break
+			}
+		}
+		if indexed {
+			continue
+		}
+		dp := name
+		err = self.found(MISSING_DELIVERY_POINT_KEY, dp, fmt.Sprintf("Not in the index of %v", key), func() error {
+			return self.db.AddDeliveryPointToKey(key, dp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"sort"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func problemKinds(problems []*DatabaseProblem, fixed bool) []string {
+	ret := make([]string, 0, len(problems))
+	for _, p := range problems {
+		if p.Fixed == fixed {
+			ret = append(ret, p.Kind)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestCheckDatabase(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	db, err := NewPushDatabaseWithoutCache(&DatabaseConfig{Engine: "memory", PushServiceManager: psm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	psp, dp := newMemTestPeers(t, psm)
+	err = db.AddPushServiceProviderToService("srv", psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddDeliveryPointToService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := db.Check(false)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Problems in a consistent database: %v %v", problems, err)
+	}
+
+	// Corrupt the database behind its back
+	raw := db.(*pushDatabaseOpts).db.(*PushMemoryDB)
+	raw.set(PUSH_SERVICE_PROVIDER_PREFIX+"uninstalled:0", "{}")
+	raw.AddPushServiceProviderToService("srv", "uninstalled:0")
+	raw.AddDeliveryPointToServiceSubscriber("other", "sub", dp.Name())
+	raw.SetPushServiceProviderOfServiceDeliveryPoint("other", dp.Name(), "memtest:deleted")
+	raw.AddDeliveryPointToServiceSubscriber("srv", "ghost", "memtest:missing")
+	raw.SetDeliveryPointCounter(dp.Name(), 5)
+	_, orphan := newMemTestPeers(t, psm)
+	orphan.FixedData["token"] = "orphan"
+	raw.SetDeliveryPoint(orphan)
+
+	expected := []string{
+		BAD_DELIVERY_POINT_COUNTER,
+		MISSING_DELIVERY_POINT,
+		MISSING_PUSH_SERVICE_PROVIDER,
+		UNKNOWN_PUSH_SERVICE_TYPE,
+		UNUSED_DELIVERY_POINT,
+	}
+	problems, err = db.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds := problemKinds(problems, false); len(kinds) != len(expected) || len(problemKinds(problems, true)) != 0 {
+		t.Fatalf("Found %v, expected %v", problems, expected)
+	}
+	for i, kind := range problemKinds(problems, false) {
+		if kind != expected[i] {
+			t.Errorf("Found %v, expected %v", kind, expected[i])
+		}
+	}
+
+	problems, err = db.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds := problemKinds(problems, true); len(kinds) != len(expected) {
+		t.Errorf("Fixed %v, expected %v", problems, expected)
+	}
+	problems, err = db.Check(false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Problems left after fixing: %v %v", problems, err)
+	}
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairs("srv", "sub")
+	if err != nil || len(pairs) != 1 {
+		t.Errorf("Subscription lost: %v %v", pairs, err)
+	}
+}
+
+// Push service type whose delivery points are known by their token
+type keyedTestPushServiceType struct {
+	memTestPushServiceType
+}
+
+func (self *keyedTestPushServiceType) Name() string {
+	return "keyedtest"
+}
+
+func (self *keyedTestPushServiceType) DeliveryPointKey(dp *DeliveryPoint) string {
+	return dp.FixedData["token"]
+}
+
+func TestCheckDeliveryPointKeys(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&keyedTestPushServiceType{})
+	db, err := NewPushDatabaseWithoutCache(&DatabaseConfig{Engine: "memory", PushServiceManager: psm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "keyedtest",
+		"service":         "srv",
+		"account":         "acc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+		"pushservicetype": "keyedtest",
+		"service":         "srv",
+		"subscriber":      "sub",
+		"token":           "tok",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddPushServiceProviderToService("srv", psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddDeliveryPointToService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribed before the index existed: its feedback finds nothing
+	raw := db.(*pushDatabaseOpts).db.(*PushMemoryDB)
+	raw.RemoveDeliveryPointFromKey(deliveryPointKey("keyedtest", "tok"), dp.Name())
+	if dps, err := db.GetDeliveryPointsByKey("keyedtest", "tok"); err != nil || len(dps) != 0 {
+		t.Fatalf("Delivery point still indexed: %v %v", dps, err)
+	}
+
+	problems, err := db.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds := problemKinds(problems, true); len(kinds) != 1 || kinds[0] != MISSING_DELIVERY_POINT_KEY {
+		t.Errorf("Expected the index to be fixed, got %v", problems)
+	}
+	dps, err := db.GetDeliveryPointsByKey("keyedtest", "tok")
+	if err != nil || len(dps) != 1 || dps[0].Name() != dp.Name() {
+		t.Errorf("Feedback cannot find the delivery point: %v %v", dps, err)
+	}
+}
@@ -0,0 +1,522 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// Types of ExportRecord
+const (
+	EXPORT_PUSH_SERVICE_PROVIDER = "psp"
+	EXPORT_DELIVERY_POINT        = "dp"
+	EXPORT_SUBSCRIPTION          = "sub"
+)
+
+// An export is made of one JSON encoded ExportRecord per line: the push
+// service providers first, then each delivery point followed by its
+// subscriptions.
+type ExportRecord struct {
+	Type string `json:"type"`
+
+	// Push service providers and delivery points
+	Name            string            `json:"name,omitempty"`
+	PushServiceType string            `json:"pushservicetype,omitempty"`
+	FixedData       map[string]string `json:"fixed,omitempty"`
+	VolatileData    map[string]string `json:"volatile,omitempty"`
+	// The services using the push service provider or the delivery point
+	Services []string `json:"services,omitempty"`
+	// Credentials left out of the push service provider. It can then
+	// only be imported into a database where it already exists.
+	Redacted []string `json:"redacted,omitempty"`
+
+	// Subscriptions
+	Service             string `json:"service,omitempty"`
+	Subscriber          string `json:"subscriber,omitempty"`
+	DeliveryPoint       string `json:"dp,omitempty"`
+	PushServiceProvider string `json:"psp,omitempty"`
+}
+
+// ImportStats counts the records of an import. In a dry run, they are
+// the records which would have been imported.
+type ImportStats struct {
+	PushServiceProviders int `json:"psps"`
+	DeliveryPoints       int `json:"dps"`
+	Subscriptions        int `json:"subscriptions"`
+	// Records of services which were not selected
+	Skipped int `json:"skipped"`
+}
+
+// Exported lines may hold certificates
+const maxExportLineSize = 16 * 1024 * 1024
+
+// matchServices tells if srv is one of services, which may contain
+// wildcards. No services means all of them.
+func matchServices(services []string, srv string) bool {
+	if len(services) == 0 {
+		return true
+	}
+	for _, pattern := range services {
+		if ok, _ := path.Match(pattern, srv); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func filterServices(services []string, names []string) []string {
+	ret := make([]string, 0, len(names))
+	for _, srv := range names {
+		if matchServices(services, srv) {
+			ret = append(ret, srv)
+		}
+	}
+	return ret
+}
+
+func peerRecord(typ string, name string, p *PushPeer, services []string) *ExportRecord {
+	sort.Strings(services)
+	return &ExportRecord{
+		Type:            typ,
+		Name:            name,
+		PushServiceType: p.PushServiceName(),
+		FixedData:       p.FixedData,
+		VolatileData:    p.VolatileData,
+		Services:        services,
+	}
+}
+
+// peerValue is how the peer of rec is stored, see PushPeer.Marshal()
+func peerValue(rec *ExportRecord) []byte {
+	fixed, volatile := rec.FixedData, rec.VolatileData
+	if fixed == nil {
+		fixed = map[string]string{}
+	}
+	if volatile == nil {
+		volatile = map[string]string{}
+	}
+	b, _ := json.Marshal([]map[string]string{fixed, volatile})
+	return []byte(rec.PushServiceType + ":" + string(b))
+}
+
+func redact(rec *ExportRecord, fields []string) {
+	for _, field := range fields {
+		_, fixed := rec.FixedData[field]
+		_, volatile := rec.VolatileData[field]
+		if !fixed && !volatile {
+			continue
+		}
+		delete(rec.FixedData, field)
+		delete(rec.VolatileData, field)
+		rec.Redacted = append(rec.Redacted, field)
+	}
+}
+
+func (f *pushDatabaseOpts) Export(w io.Writer, services []string, redactCredentials bool) (int, error) {
+	return exportSnapshot(w, func(enc *json.Encoder) (int, error) {
+		// No change may happen during the export
+		f.dblock.Lock()
+		defer f.dblock.Unlock()
+		return f.export(enc, services, redactCredentials, true, true)
+	})
+}
+
+// exportSnapshot runs export on a temporary file, then copies the file
+// to w, so that changes are not blocked by a slow reader of w.
+func exportSnapshot(w io.Writer, export func(enc *json.Encoder) (int, error)) (int, error) {
+	tmp, err := ioutil.TempFile("", "uniqush-export")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buf := bufio.NewWriter(tmp)
+	n, err := export(json.NewEncoder(buf))
+	if err != nil {
+		return n, err
+	}
+	err = buf.Flush()
+	if err != nil {
+		return n, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.Copy(w, tmp)
+	return n, err
+}
+
+// export writes the records of the push service providers if psps is
+// true, and those of the delivery points with their subscriptions if dps
+// is true. dblock must be held.
+func (f *pushDatabaseOpts) export(enc *json.Encoder, services []string, redactCredentials bool, psps, dps bool) (int, error) {
+	db, err := f.engine()
+	if err != nil {
+		return 0, err
+	}
+	scanner, ok := db.(pushRawDatabaseScanner)
+	if !ok {
+		return 0, errors.New("ExportNotSupported")
+	}
+
+	pspsOfServices, err := scanner.GetAllServices()
+	if err != nil {
+		return 0, err
+	}
+	mapping, err := scanner.GetAllPushServiceProvidersOfDeliveryPoints()
+	if err != nil {
+		return 0, err
+	}
+	subs, err := scanner.GetAllSubscriptions()
+	if err != nil {
+		return 0, err
+	}
+
+	pspServices := make(map[string][]string, len(pspsOfServices))
+	for srv, psps := range pspsOfServices {
+		if !matchServices(services, srv) {
+			continue
+		}
+		for _, psp := range psps {
+			pspServices[psp] = append(pspServices[psp], srv)
+		}
+	}
+	dpSubs := make(map[string][]rawSubscription, len(subs))
+	for _, s := range subs {
+		if matchServices(services, s.Service) {
+			dpSubs[s.DeliveryPoint] = append(dpSubs[s.DeliveryPoint], s)
+		}
+	}
+
+	pspNames := make([]string, 0, len(pspServices))
+	for name := range pspServices {
+		pspNames = append(pspNames, name)
+	}
+	sort.Strings(pspNames)
+	dpNames := make([]string, 0, len(dpSubs))
+	for name := range dpSubs {
+		dpNames = append(dpNames, name)
+	}
+	sort.Strings(dpNames)
+
+	if !psps {
+		pspNames = nil
+	}
+	if !dps {
+		dpNames = nil
+	}
+	n := 0
+	for _, name := range pspNames {
+		psp, err := db.GetPushServiceProvider(name)
+		if err != nil {
+			return n, fmt.Errorf("Push service provider %v: %v", name, err)
+		}
+		if psp == nil {
+			continue
+		}
+		rec := peerRecord(EXPORT_PUSH_SERVICE_PROVIDER, name, &psp.PushPeer, pspServices[name])
+		if redactCredentials {
+			redact(rec, psp.CredentialFields())
+		}
+		err = enc.Encode(rec)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	for _, name := range dpNames {
+		dp, err := db.GetDeliveryPoint(name)
+		if err != nil {
+			return n, fmt.Errorf("Delivery point %v: %v", name, err)
+		}
+		if dp == nil {
+			continue
+		}
+		subs := dpSubs[name]
+		sort.Slice(subs, func(i, j int) bool {
+			if subs[i].Service != subs[j].Service {
+				return subs[i].Service < subs[j].Service
+			}
+			return subs[i].Subscriber < subs[j].Subscriber
+		})
+		dpServices := make([]string, 0, 1)
+		for i, s := range subs {
+			if i == 0 || s.Service != subs[i-1].Service {
+				dpServices = append(dpServices, s.Service)
+			}
+		}
+		err = enc.Encode(peerRecord(EXPORT_DELIVERY_POINT, name, &dp.PushPeer, dpServices))
+		if err != nil {
+			return n, err
+		}
+		n++
+		for _, s := range subs {
+			err = enc.Encode(&ExportRecord{
+				Type:                EXPORT_SUBSCRIPTION,
+				Service:             s.Service,
+				Subscriber:          s.Subscriber,
+				DeliveryPoint:       name,
+				PushServiceProvider: mapping[s.Service][name],
+			})
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// importer keeps track of the push service providers and delivery
+// points already imported, so that subscriptions can be checked even
+// in a dry run.
+type importer struct {
+	f      *pushDatabaseOpts
+	filter []string
+	dryRun bool
+	psps   map[string]bool
+	dps    map[string]bool
+	stats  *ImportStats
+	// Push service providers are written to these databases too. See
+	// shardedPushDatabase.Import()
+	replicas []*pushDatabaseOpts
+}
+
+func (self *importer) exists(names map[string]bool, name string, get func(string) (bool, error)) (bool, error) {
+	if names[name] {
+		return true, nil
+	}
+	found, err := get(name)
+	if err != nil || !found {
+		return false, err
+	}
+	names[name] = true
+	return true, nil
+}
+
+func (self *importer) pspExists(name string) (bool, error) {
+	return self.exists(self.psps, name, func(name string) (bool, error) {
+		psp, err := self.f.db.GetPushServiceProvider(name)
+		return psp != nil, err
+	})
+}
+
+func (self *importer) dpExists(name string) (bool, error) {
+	return self.exists(self.dps, name, func(name string) (bool, error) {
+		dp, err := self.f.db.GetDeliveryPoint(name)
+		return dp != nil, err
+	})
+}
+
+// write runs fn, unless in a dry run.
+func (self *importer) write(fn func(db pushRawDatabase) error) error {
+	return self.writeTo(self.f, fn)
+}
+
+func (self *importer) writeTo(f *pushDatabaseOpts, fn func(db pushRawDatabase) error) error {
+	if self.dryRun {
+		return nil
+	}
+	f.dblock.Lock()
+	defer f.dblock.Unlock()
+	return f.transaction(fn)
+}
+
+func (self *importer) importPushServiceProvider(rec *ExportRecord) error {
+	services := filterServices(self.filter, rec.Services)
+	if len(services) == 0 {
+		self.stats.Skipped++
+		return nil
+	}
+	var psp *PushServiceProvider
+	if len(rec.Redacted) > 0 {
+		// Credentials cannot be restored: keep those of the database
+		found, err := self.pspExists(rec.Name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("Redacted push service provider %v does not exist", rec.Name)
+		}
+	} else {
+		var err error
+		psp, err = self.f.psm.BuildPushServiceProviderFromBytes(peerValue(rec))
+		if err != nil {
+			return err
+		}
+		if psp.Name() != rec.Name {
+			return fmt.Errorf("Push service provider %v is named %v", rec.Name, psp.Name())
+		}
+	}
+	write := func(db pushRawDatabase) error {
+		if psp != nil {
+			err := db.SetPushServiceProvider(psp)
+			if err != nil {
+				return err
+			}
+		}
+		for _, srv := range services {
+			err := db.AddPushServiceProviderToService(srv, rec.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := self.write(write)
+	for _, f := range self.replicas {
+		if err != nil {
+			return err
+		}
+		err = self.writeTo(f, write)
+	}
+	if err != nil {
+		return err
+	}
+	self.psps[rec.Name] = true
+	self.stats.PushServiceProviders++
+	return nil
+}
+
+func (self *importer) importDeliveryPoint(rec *ExportRecord) error {
+	if len(filterServices(self.filter, rec.Services)) == 0 {
+		self.stats.Skipped++
+		return nil
+	}
+	dp, err := self.f.psm.BuildDeliveryPointFromBytes(peerValue(rec))
+	if err != nil {
+		return err
+	}
+	if dp.Name() != rec.Name {
+		return fmt.Errorf("Delivery point %v is named %v", rec.Name, dp.Name())
+	}
+	err = self.write(func(db pushRawDatabase) error {
+		err := db.SetDeliveryPoint(dp)
+		if err != nil {
+			return err
+		}
+		if key := dp.Key(); key != "" {
+			return db.AddDeliveryPointToKey(deliveryPointKey(dp.PushServiceName(), key), dp.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	self.dps[rec.Name] = true
+	self.stats.DeliveryPoints++
+	return nil
+}
+
+func (self *importer) importSubscription(rec *ExportRecord) error {
+	if !matchServices(self.filter, rec.Service) {
+		self.stats.Skipped++
+		return nil
+	}
+	if rec.Service == "" || rec.Subscriber == "" || rec.DeliveryPoint == "" {
+		return errors.New("Incomplete subscription")
+	}
+	found, err := self.dpExists(rec.DeliveryPoint)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Delivery point %v does not exist", rec.DeliveryPoint)
+	}
+	if rec.PushServiceProvider != "" {
+		found, err = self.pspExists(rec.PushServiceProvider)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("Push service provider %v does not exist", rec.PushServiceProvider)
+		}
+	}
+	err = self.write(func(db pushRawDatabase) error {
+		err := db.AddDeliveryPointToServiceSubscriber(rec.Service, rec.Subscriber, rec.DeliveryPoint)
+		if err != nil || rec.PushServiceProvider == "" {
+			return err
+		}
+		return db.SetPushServiceProviderOfServiceDeliveryPoint(rec.Service, rec.DeliveryPoint, rec.PushServiceProvider)
+	})
+	if err != nil {
+		return err
+	}
+	self.stats.Subscriptions++
+	return nil
+}
+
+// Import reads an export line by line. Importing the same records again
+// changes nothing. Each record is written on its own, so an error leaves
+// the records before it imported.
+func (f *pushDatabaseOpts) Import(r io.Reader, services []string, dryRun bool) (*ImportStats, error) {
+	self := &importer{
+		f:      f,
+		filter: services,
+		dryRun: dryRun,
+		psps:   make(map[string]bool),
+		dps:    make(map[string]bool),
+		stats:  new(ImportStats),
+	}
+	err := readExport(r, func(rec *ExportRecord) error {
+		switch rec.Type {
+		case EXPORT_PUSH_SERVICE_PROVIDER:
+			return self.importPushServiceProvider(rec)
+		case EXPORT_DELIVERY_POINT:
+			return self.importDeliveryPoint(rec)
+		case EXPORT_SUBSCRIPTION:
+			return self.importSubscription(rec)
+		}
+		return fmt.Errorf("Unknown record type %v", rec.Type)
+	})
+	return self.stats, err
+}
+
+// readExport calls fn with each record of an export, until an error.
+func readExport(r io.Reader, fn func(rec *ExportRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxExportLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := new(ExportRecord)
+		err := json.Unmarshal(scanner.Bytes(), rec)
+		if err == nil {
+			err = fn(rec)
+		}
+		if err != nil {
+			return fmt.Errorf("Line %v: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
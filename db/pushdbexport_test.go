@@ -0,0 +1,160 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func newMemTestDatabase(t *testing.T, psm *PushServiceManager) PushDatabase {
+	db, err := NewPushDatabaseWithoutCache(&DatabaseConfig{Engine: "memory", PushServiceManager: psm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func numberOfPairs(t *testing.T, db PushDatabase, srv, sub string) int {
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairs(srv, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pairs)
+}
+
+func TestExportImport(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	src := newMemTestDatabase(t, psm)
+	psp, dp := newMemTestPeers(t, psm)
+	for _, srv := range []string{"srv", "other"} {
+		err := src.AddPushServiceProviderToService(srv, psp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = src.AddDeliveryPointToService(srv, "sub", dp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	n, err := src.Export(buf, nil, false)
+	if err != nil || n != 4 {
+		t.Fatalf("Exported %v records: %v", n, err)
+	}
+	export := buf.String()
+
+	dst := newMemTestDatabase(t, psm)
+	stats, err := dst.Import(strings.NewReader(export), nil, true)
+	if err != nil || *stats != (ImportStats{1, 1, 2, 0}) {
+		t.Fatalf("Dry run: %+v %v", stats, err)
+	}
+	if numberOfPairs(t, dst, "srv", "sub") != 0 {
+		t.Errorf("Dry run wrote to the database")
+	}
+	// Twice: the second import must change nothing
+	for i := 0; i < 2; i++ {
+		stats, err = dst.Import(strings.NewReader(export), nil, false)
+		if err != nil || *stats != (ImportStats{1, 1, 2, 0}) {
+			t.Fatalf("Import: %+v %v", stats, err)
+		}
+	}
+	for _, srv := range []string{"srv", "other"} {
+		if numberOfPairs(t, dst, srv, "sub") != 1 {
+			t.Errorf("Subscription of %v not imported", srv)
+		}
+	}
+	problems, err := dst.Check(false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Imported database is inconsistent: %v %v", problems, err)
+	}
+
+	filtered := newMemTestDatabase(t, psm)
+	stats, err = filtered.Import(strings.NewReader(export), []string{"s*"}, false)
+	if err != nil || *stats != (ImportStats{1, 1, 1, 1}) {
+		t.Fatalf("Filtered import: %+v %v", stats, err)
+	}
+	if numberOfPairs(t, filtered, "srv", "sub") != 1 || numberOfPairs(t, filtered, "other", "sub") != 0 {
+		t.Errorf("Service filter ignored")
+	}
+
+	buf.Reset()
+	_, err = src.Export(buf, []string{"srv"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(ExportRecord)
+	json.Unmarshal([]byte(strings.SplitN(buf.String(), "\n", 2)[0]), rec)
+	if _, ok := rec.FixedData["account"]; ok || len(rec.Redacted) != 1 || rec.Name != psp.Name() {
+		t.Errorf("Credentials not redacted: %+v", rec)
+	}
+	_, err = newMemTestDatabase(t, psm).Import(bytes.NewReader(buf.Bytes()), nil, false)
+	if err == nil {
+		t.Errorf("Imported a redacted push service provider")
+	}
+	_, err = dst.Import(bytes.NewReader(buf.Bytes()), nil, false)
+	if err != nil {
+		t.Errorf("Cannot import a redacted push service provider which exists: %v", err)
+	}
+}
+
+// blockedWriter checks that the changes of db are not blocked while
+// the export is written.
+type blockedWriter struct {
+	f       *pushDatabaseOpts
+	blocked bool
+}
+
+func (self *blockedWriter) Write(p []byte) (int, error) {
+	if self.f.dblock.TryLock() {
+		self.f.dblock.Unlock()
+	} else {
+		self.blocked = true
+	}
+	return len(p), nil
+}
+
+func TestExportDoesNotBlockChanges(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	db := newMemTestDatabase(t, psm)
+	psp, dp := newMemTestPeers(t, psm)
+	err := db.AddPushServiceProviderToService("srv", psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddDeliveryPointToService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &blockedWriter{f: db.(*pushDatabaseOpts)}
+	n, err := db.Export(w, nil, false)
+	if err != nil || n != 3 {
+		t.Fatalf("Exported %v records: %v", n, err)
+	}
+	if w.blocked {
+		t.Errorf("Changes blocked while writing the export")
+	}
+}
@@ -0,0 +1,467 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// PushMemoryDB keeps everything in memory, with the same keys as
+// PushRedisDB. If the Name of its config is a file name, the data is
+// loaded from this file and saved to it by FlushCache().
+type PushMemoryDB struct {
+	lock     sync.RWMutex
+	values   map[string]string
+	sets     map[string]map[string]bool
+	counters map[string]int
+	snapshot string
+	psm      *PushServiceManager
+}
+
+// Written to the snapshot file as JSON
+type memorySnapshot struct {
+	Values   map[string]string   `json:"values"`
+	Sets     map[string][]string `json:"sets"`
+	Counters map[string]int      `json:"counters"`
+}
+
+func newPushMemoryDB(c *DatabaseConfig) (*PushMemoryDB, error) {
+	if c == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	if strings.ToLower(c.Engine) != "memory" {
+		return nil, errors.New("Unsupported Database Engine")
+	}
+	ret := new(PushMemoryDB)
+	ret.values = make(map[string]string, 1024)
+	ret.sets = make(map[string]map[string]bool, 1024)
+	ret.counters = make(map[string]int, 1024)
+	// Name is the database number of redis, which is meaningless here.
+	if c.Name != "" && c.Name != "0" {
+		ret.snapshot = c.Name
+	}
+	ret.psm = c.PushServiceManager
+	if ret.psm == nil {
+		ret.psm = GetPushServiceManager()
+	}
+	if ret.snapshot != "" {
+		err := ret.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (r *PushMemoryDB) load() error {
+	data, err := ioutil.ReadFile(r.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap memorySnapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return err
+	}
+	for k, v := range snap.Values {
+		r.values[k] = v
+	}
+	for k, members := range snap.Sets {
+		for _, m := range members {
+			r.sadd(k, m)
+		}
+	}
+	for k, n := range snap.Counters {
+		r.counters[k] = n
+	}
+	return nil
+}
+
+func (r *PushMemoryDB) marshal() ([]byte, error) {
+	r.lock.RLock()
+	snap := memorySnapshot{
+		Values:   make(map[string]string, len(r.values)),
+		Sets:     make(map[string][]string, len(r.sets)),
+		Counters: make(map[string]int, len(r.counters)),
+	}
+	for k, v := range r.values {
+		snap.Values[k] = v
+	}
+	for k, set := range r.sets {
+		snap.Sets[k] = setMembers(set)
+	}
+	for k, n := range r.counters {
+		snap.Counters[k] = n
+	}
+	r.lock.RUnlock()
+	return json.Marshal(&snap)
+}
+
+// FlushCache saves the data to the snapshot file, if any. The file is
+// replaced atomically.
+func (r *PushMemoryDB) FlushCache() error {
+	if r.snapshot == "" {
+		return nil
+	}
+	data, err := r.marshal()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.snapshot), filepath.Base(r.snapshot)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.snapshot)
+}
+
+// Backup writes the same data as a snapshot file to w.
+func (r *PushMemoryDB) Backup(w io.Writer) (int64, error) {
+	data, err := r.marshal()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func setMembers(set map[string]bool) []string {
+	ret := make([]string, 0, len(set))
+	for m, _ := range set {
+		ret = append(ret, m)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Must be called with the lock held
+func (r *PushMemoryDB) sadd(key, member string) bool {
+	set, ok := r.sets[key]
+	if !ok {
+		set = make(map[string]bool, 4)
+		r.sets[key] = set
+	}
+	if set[member] {
+		return false
+	}
+	set[member] = true
+	return true
+}
+
+// Must be called with the lock held
+func (r *PushMemoryDB) srem(key, member string) bool {
+	set, ok := r.sets[key]
+	if !ok || !set[member] {
+		return false
+	}
+	delete(set, member)
+	if len(set) == 0 {
+		delete(r.sets, key)
+	}
+	return true
+}
+
+func (r *PushMemoryDB) smembers(key string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	set, ok := r.sets[key]
+	if !ok {
+		return nil
+	}
+	return setMembers(set)
+}
+
+func (r *PushMemoryDB) get(key string) (string, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	v, ok := r.values[key]
+	return v, ok
+}
+
+func (r *PushMemoryDB) set(key, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.values[key] = value
+}
+
+func (r *PushMemoryDB) del(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.values, key)
+}
+
+func (r *PushMemoryDB) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
+	v, ok := r.get(DELIVERY_POINT_PREFIX + name)
+	if !ok {
+		return nil, nil
+	}
+	dp, err := r.psm.BuildDeliveryPointFromBytes([]byte(v))
+	if err != nil {
+		return nil, err
+	}
+	return dp, nil
+}
+
+func (r *PushMemoryDB) SetDeliveryPoint(dp *DeliveryPoint) error {
+	r.set(DELIVERY_POINT_PREFIX+dp.Name(), string(deliveryPointToValue(dp)))
+	return nil
+}
+
+func (r *PushMemoryDB) GetPushServiceProvider(name string) (*PushServiceProvider, error) {
+	v, ok := r.get(PUSH_SERVICE_PROVIDER_PREFIX + name)
+	if !ok {
+		return nil, nil
+	}
+	psp, err := r.psm.BuildPushServiceProviderFromBytes([]byte(v))
+	if err != nil {
+		return nil, err
+	}
+	return psp, nil
+}
+
+func (r *PushMemoryDB) SetPushServiceProvider(psp *PushServiceProvider) error {
+	r.set(PUSH_SERVICE_PROVIDER_PREFIX+psp.Name(), string(pushServiceProviderToValue(psp)))
+	return nil
+}
+
+func (r *PushMemoryDB) RemoveDeliveryPoint(dp string) error {
+	r.del(DELIVERY_POINT_PREFIX + dp)
+	return nil
+}
+
+func (r *PushMemoryDB) RemovePushServiceProvider(psp string) error {
+	r.del(PUSH_SERVICE_PROVIDER_PREFIX + psp)
+	return nil
+}
+
+// Like PushRedisDB, srv and sub may contain wildcards.
+func (r *PushMemoryDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	pattern := SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + sub
+	ret := make(map[string][]string, 1)
+	if !strings.Contains(sub, "*") && !strings.Contains(srv, "*") {
+		if dps := r.smembers(pattern); len(dps) > 0 {
+			ret[srv] = dps
+		}
+		return ret, nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for k, set := range r.sets {
+		if !strings.HasPrefix(k, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX) {
+			continue
+		}
+		if ok, _ := path.Match(pattern, k); !ok {
+			continue
+		}
+		s := strings.Split(k, ":")[1]
+		ret[s] = append(ret[s], setMembers(set)...)
+	}
+	return ret, nil
+}
+
+func (r *PushMemoryDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
+	v, _ := r.get(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX + srv + ":" + dp)
+	return v, nil
+}
+
+func (r *PushMemoryDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sadd(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, dp) {
+		r.counters[DELIVERY_POINT_COUNTER_PREFIX+dp]++
+	}
+	return nil
+}
+
+// The delivery point is removed once no subscriber uses it.
+func (r *PushMemoryDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.srem(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, dp) {
+		return nil
+	}
+	counter := DELIVERY_POINT_COUNTER_PREFIX + dp
+	r.counters[counter]--
+	if r.counters[counter] <= 0 {
+		delete(r.counters, counter)
+		delete(r.values, DELIVERY_POINT_PREFIX+dp)
+	}
+	return nil
+}
+
+func (r *PushMemoryDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	r.set(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX+srv+":"+dp, psp)
+	return nil
+}
+
+func (r *PushMemoryDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	r.del(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX + srv + ":" + dp)
+	return nil
+}
+
+func (r *PushMemoryDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	return r.smembers(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + srv), nil
+}
+
+func (r *PushMemoryDB) GetAllPushServiceProviders() ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]string, 0, 16)
+	for k, _ := range r.values {
+		if strings.HasPrefix(k, PUSH_SERVICE_PROVIDER_PREFIX) {
+			ret = append(ret, strings.TrimPrefix(k, PUSH_SERVICE_PROVIDER_PREFIX))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (r *PushMemoryDB) RemovePushServiceProviderFromService(srv, psp string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.srem(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, psp)
+	return nil
+}
+
+func (r *PushMemoryDB) AddPushServiceProviderToService(srv, psp string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sadd(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, psp)
+	return nil
+}
+
+func (r *PushMemoryDB) AddDeliveryPointToKey(key, dp string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sadd(KEY_TO_DELIVERY_POINTS_PREFIX+key, dp)
+	return nil
+}
+
+func (r *PushMemoryDB) RemoveDeliveryPointFromKey(key, dp string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.srem(KEY_TO_DELIVERY_POINTS_PREFIX+key, dp)
+	return nil
+}
+
+func (r *PushMemoryDB) GetDeliveryPointsNameByKey(key string) ([]string, error) {
+	return r.smembers(KEY_TO_DELIVERY_POINTS_PREFIX + key), nil
+}
+
+func (r *PushMemoryDB) GetAllDeliveryPoints() ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]string, 0, 16)
+	for k, _ := range r.values {
+		if strings.HasPrefix(k, DELIVERY_POINT_PREFIX) {
+			ret = append(ret, strings.TrimPrefix(k, DELIVERY_POINT_PREFIX))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (r *PushMemoryDB) GetAllSubscriptions() ([]rawSubscription, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]rawSubscription, 0, 16)
+	for k, set := range r.sets {
+		srv, sub, ok := splitServiceKey(k, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX)
+		if !ok {
+			continue
+		}
+		for dp, _ := range set {
+			ret = append(ret, rawSubscription{Service: srv, Subscriber: sub, DeliveryPoint: dp})
+		}
+	}
+	return ret, nil
+}
+
+func (r *PushMemoryDB) GetAllPushServiceProvidersOfDeliveryPoints() (map[string]map[string]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make(map[string]map[string]string, 4)
+	for k, psp := range r.values {
+		srv, dp, ok := splitServiceKey(k, SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX)
+		if !ok {
+			continue
+		}
+		if ret[srv] == nil {
+			ret[srv] = make(map[string]string, 16)
+		}
+		ret[srv][dp] = psp
+	}
+	return ret, nil
+}
+
+func (r *PushMemoryDB) GetAllServices() (map[string][]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make(map[string][]string, 4)
+	for k, set := range r.sets {
+		if strings.HasPrefix(k, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX) {
+			ret[strings.TrimPrefix(k, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX)] = setMembers(set)
+		}
+	}
+	return ret, nil
+}
+
+func (r *PushMemoryDB) GetDeliveryPointCounters() (map[string]int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make(map[string]int, len(r.counters))
+	for k, n := range r.counters {
+		ret[strings.TrimPrefix(k, DELIVERY_POINT_COUNTER_PREFIX)] = n
+	}
+	return ret, nil
+}
+
+func (r *PushMemoryDB) SetDeliveryPointCounter(dp string, n int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n <= 0 {
+		delete(r.counters, DELIVERY_POINT_COUNTER_PREFIX+dp)
+	} else {
+		r.counters[DELIVERY_POINT_COUNTER_PREFIX+dp] = n
+	}
+	return nil
+}
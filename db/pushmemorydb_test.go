@@ -0,0 +1,149 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+type memTestPushServiceType struct{}
+
+func (self *memTestPushServiceType) Name() string {
+	return "memtest"
+}
+
+func (self *memTestPushServiceType) Finalize() {}
+
+func (self *memTestPushServiceType) CredentialFields() []string {
+	return []string{"account"}
+}
+
+func (self *memTestPushServiceType) SetErrorReportChan(errChan chan<- error) {}
+
+func (self *memTestPushServiceType) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	psp.FixedData["service"] = kv["service"]
+	psp.FixedData["account"] = kv["account"]
+	return nil
+}
+
+func (self *memTestPushServiceType) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	if kv["subscriber"] == "" {
+		return errors.New("NoSubscriber")
+	}
+	dp.FixedData["service"] = kv["service"]
+	dp.FixedData["subscriber"] = kv["subscriber"]
+	dp.FixedData["token"] = kv["token"]
+	return nil
+}
+
+func (self *memTestPushServiceType) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	for _ = range dpQueue {
+	}
+	close(resQueue)
+}
+
+func newMemTestPeers(t *testing.T, psm *PushServiceManager) (*PushServiceProvider, *DeliveryPoint) {
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "memtest",
+		"service":         "srv",
+		"account":         "acc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+		"pushservicetype": "memtest",
+		"service":         "srv",
+		"subscriber":      "sub",
+		"token":           "tok",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return psp, dp
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+
+	dir, err := ioutil.TempDir("", "uniqush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &DatabaseConfig{
+		Engine:             "memory",
+		Name:               filepath.Join(dir, "snapshot.json"),
+		PushServiceManager: psm,
+	}
+	db, err := NewPushDatabaseWithoutCache(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	psp, dp := newMemTestPeers(t, psm)
+	err = db.AddPushServiceProviderToService("srv", psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := db.AddDeliveryPointToService("srv", "sub", dp)
+	if err != nil || found.Name() != psp.Name() {
+		t.Fatalf("Cannot subscribe: %v", err)
+	}
+	err = db.FlushCache()
+	if err != nil {
+		t.Fatalf("Cannot save snapshot: %v", err)
+	}
+
+	// Reopen from the snapshot
+	db, err = NewPushDatabaseWithoutCache(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairs("srv", "sub")
+	if err != nil || len(pairs) != 1 {
+		t.Fatalf("Expected 1 delivery point, got %v (%v)", len(pairs), err)
+	}
+	if pairs[0].DeliveryPoint.Name() != dp.Name() || pairs[0].PushServiceProvider.Name() != psp.Name() {
+		t.Errorf("Bad delivery point or push service provider: %+v", pairs[0])
+	}
+	psps, err := db.GetPushServiceProviders()
+	if err != nil || len(psps) != 1 {
+		t.Errorf("Expected 1 push service provider, got %v (%v)", len(psps), err)
+	}
+
+	err = db.RemoveDeliveryPointFromService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err = db.GetPushServiceProviderDeliveryPointPairs("srv", "sub")
+	if err != nil || len(pairs) != 0 {
+		t.Errorf("Delivery point not removed: %v", pairs)
+	}
+	raw := db.(*pushDatabaseOpts).db
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d != nil {
+		t.Errorf("Unused delivery point not deleted")
+	}
+}
@@ -18,135 +18,816 @@
 package db
 
 import (
-	"github.com/uniqush/cache"
-	. "github.com/rafaelbandeira3/uniqush-push/push"
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
 )
 
-type pushRawDatabaseCache struct {
-	pspCache  *cache.Cache
-	dpCache   *cache.Cache
-	srvSub2Dp *cache.Cache
-	srv2Psp   *cache.Cache
-	dbwriter  pushRawDatabaseWriter
-	dbreader  pushRawDatabaseReader
+// lruCache keeps the capacity most recently used entries.
+type lruCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	// Incremented by every change but fill()
+	version uint64
 }
 
-type pspFlusher struct {
-	cdb *pushRawDatabaseCache
+type lruEntry struct {
+	key   string
+	value interface{}
 }
 
-func (self *pspFlusher) Add(key string, value interface{}) {
-	if psp, ok := value.(*PushServiceProvider); ok {
-		self.cdb.dbwriter.SetPushServiceProvider(psp)
+func newLRUCache(capacity int) *lruCache {
+	ret := new(lruCache)
+	ret.capacity = capacity
+	ret.entries = make(map[string]*list.Element, capacity)
+	ret.order = list.New()
+	return ret
+}
+
+func (self *lruCache) get(key string) (interface{}, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	e, ok := self.entries[key]
+	if !ok {
+		return nil, false
 	}
+	self.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
 }
 
-func (self *pspFlusher) Remove(key string) {
-	self.cdb.dbwriter.RemovePushServiceProvider(key)
+func (self *lruCache) set(key string, value interface{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.version++
+	self.put(key, value)
 }
 
-type dpFlusher struct {
-	cdb *pushRawDatabaseCache
+func (self *lruCache) snapshot() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.version
 }
 
-func (self *dpFlusher) Add(key string, value interface{}) {
-	if psp, ok := value.(*DeliveryPoint); ok {
-		self.cdb.dbwriter.SetDeliveryPoint(psp)
+// fill caches a value read from the database after snapshot() returned
+// since, unless the cache changed meanwhile: the value may be outdated.
+func (self *lruCache) fill(key string, value interface{}, since uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.version == since {
+		self.put(key, value)
 	}
 }
 
-func (self *dpFlusher) Remove(key string) {
-	self.cdb.dbwriter.RemoveDeliveryPoint(key)
+func (self *lruCache) put(key string, value interface{}) {
+	if e, ok := self.entries[key]; ok {
+		e.Value.(*lruEntry).value = value
+		self.order.MoveToFront(e)
+		return
+	}
+	self.entries[key] = self.order.PushFront(&lruEntry{key: key, value: value})
+	for self.order.Len() > self.capacity {
+		e := self.order.Back()
+		self.order.Remove(e)
+		delete(self.entries, e.Value.(*lruEntry).key)
+	}
 }
 
-func NewpushRawDatabaseCache(c *DatabaseConfig,
-	dbreader pushRawDatabaseReader,
-	dbwriter pushRawDatabaseWriter) (*pushRawDatabaseCache, error) {
-	cacheSize := 1024
-	flushPeriod := 600
-	leastDirty := 128
-	if c != nil {
-		cacheSize = c.CacheSize
-		flushPeriod = int(c.EverySec)
-		leastDirty = c.LeastDirty
+func (self *lruCache) delete(key string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.version++
+	if e, ok := self.entries[key]; ok {
+		self.order.Remove(e)
+		delete(self.entries, key)
 	}
+}
+
+func (self *lruCache) len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.order.Len()
+}
+
+func (self *lruCache) purge() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.version++
+	self.entries = make(map[string]*list.Element, self.capacity)
+	self.order.Init()
+}
 
+// CacheStats tells how well the cache in front of the database works.
+// See PushDatabase.CacheStats()
+type CacheStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hitratio"`
+	Entries  int     `json:"entries"`
+	// Modified delivery points and push service providers not written
+	// to the database yet
+	Dirty   int   `json:"dirty"`
+	Flushes int64 `json:"flushes"`
+}
+
+// Keys of the cache. Values are stored marshaled, so that callers never
+// share a delivery point or a push service provider.
+const (
+	cacheDeliveryPointPrefix        = "dp:"
+	cachePushServiceProviderPrefix  = "psp:"
+	cacheServiceSubscriberPrefix    = "srv-sub:"
+	cacheServiceDeliveryPointPrefix = "srv-dp:"
+	cacheServicePrefix              = "srv:"
+	cacheKeyPrefix                  = "key:"
+)
+
+// pushRawDatabaseCache keeps the most recently used data of a raw
+// database in memory. Modified delivery points and push service
+// providers, e.g. new canonical ids, are written back every EverySec
+// seconds once there are LeastDirty of them. Every other change is
+// written through, in a transaction if the database supports them.
+//
+// The cache assumes that it is the only writer of the database: other
+// instances of uniqush-push sharing the database must not use one.
+type pushRawDatabaseCache struct {
+	db  pushRawDatabase
+	psm *PushServiceManager
+
+	cache *lruCache
+
+	// Held shared by transactions, exclusively by flushDirty(): dirty
+	// values must not be written back while a transaction removes them.
+	writeLock sync.RWMutex
+	dirtyLock sync.Mutex
+	dirty     map[string][]byte
+	// The dirty values being written by flushDirty()
+	flushing    map[string][]byte
+	flushTimer  *time.Timer
+	flushPeriod time.Duration
+	leastDirty  int
+
+	hits    int64
+	misses  int64
+	flushes int64
+}
+
+func newPushRawDatabaseCache(c *DatabaseConfig, db pushRawDatabase) *pushRawDatabaseCache {
 	cdb := new(pushRawDatabaseCache)
-	cdb.dbreader = dbreader
-	cdb.dbwriter = dbwriter
-	pspflusher := &pspFlusher{cdb: cdb}
-	dpflusher := &dpFlusher{cdb: cdb}
-	cdb.pspCache = cache.New(cacheSize, leastDirty, time.Duration(flushPeriod)*time.Second, pspflusher)
-	cdb.dpCache = cache.New(cacheSize, leastDirty, time.Duration(flushPeriod)*time.Second, dpflusher)
-
-	// We will flush them manually
-	cdb.srvSub2Dp = cache.New(cacheSize, -1, time.Duration(0)*time.Second, nil)
-	cdb.srv2Psp = cache.New(cacheSize, -1, time.Duration(0)*time.Second, nil)
-	return cdb, nil
-}
-
-func (cdb *pushRawDatabaseCache) GetDeliveryPoint(dp string) (ret *DeliveryPoint, err error) {
-	if dpi := cdb.dpCache.Get(dp); dpi == nil {
-		ret, err = cdb.dbreader.GetDeliveryPoint(dp)
+	cdb.db = db
+	cdb.psm = c.PushServiceManager
+	if cdb.psm == nil {
+		cdb.psm = GetPushServiceManager()
+	}
+	cdb.cache = newLRUCache(c.CacheSize)
+	cdb.dirty = make(map[string][]byte, c.LeastDirty)
+	cdb.flushPeriod = time.Duration(c.EverySec) * time.Second
+	if cdb.flushPeriod <= 0 {
+		cdb.flushPeriod = 600 * time.Second
+	}
+	cdb.leastDirty = c.LeastDirty
+	return cdb
+}
+
+func (cdb *pushRawDatabaseCache) Stats() *CacheStats {
+	ret := new(CacheStats)
+	ret.Hits = atomic.LoadInt64(&cdb.hits)
+	ret.Misses = atomic.LoadInt64(&cdb.misses)
+	if ret.Hits+ret.Misses > 0 {
+		ret.HitRatio = float64(ret.Hits) / float64(ret.Hits+ret.Misses)
+	}
+	ret.Entries = cdb.cache.len()
+	cdb.dirtyLock.Lock()
+	ret.Dirty = len(cdb.dirty)
+	cdb.dirtyLock.Unlock()
+	ret.Flushes = atomic.LoadInt64(&cdb.flushes)
+	return ret
+}
+
+// lookup returns the cached value of key, or reads it with load.
+func (cdb *pushRawDatabaseCache) lookup(key string, load func() (interface{}, error)) (interface{}, error) {
+	if v, ok := cdb.cache.get(key); ok {
+		atomic.AddInt64(&cdb.hits, 1)
+		return v, nil
+	}
+	atomic.AddInt64(&cdb.misses, 1)
+	since := cdb.cache.snapshot()
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	cdb.cache.fill(key, v, since)
+	return v, nil
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	ret := make([]string, len(s))
+	copy(ret, s)
+	return ret
+}
+
+// dirtyValue returns the value of key not written to the database yet,
+// if any. Dirty values may have been evicted from the cache.
+func (cdb *pushRawDatabaseCache) dirtyValue(key string) ([]byte, bool) {
+	cdb.dirtyLock.Lock()
+	defer cdb.dirtyLock.Unlock()
+	if v, ok := cdb.dirty[key]; ok {
+		return v, true
+	}
+	v, ok := cdb.flushing[key]
+	return v, ok
+}
+
+func (cdb *pushRawDatabaseCache) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
+	key := cacheDeliveryPointPrefix + name
+	v, err := cdb.lookup(key, func() (interface{}, error) {
+		if v, ok := cdb.dirtyValue(key); ok {
+			return v, nil
+		}
+		dp, err := cdb.db.GetDeliveryPoint(name)
+		if err != nil || dp == nil {
+			return []byte(nil), err
+		}
+		return deliveryPointToValue(dp), nil
+	})
+	if err != nil || v.([]byte) == nil {
+		return nil, err
+	}
+	return cdb.psm.BuildDeliveryPointFromBytes(v.([]byte))
+}
+
+func (cdb *pushRawDatabaseCache) GetPushServiceProvider(name string) (*PushServiceProvider, error) {
+	key := cachePushServiceProviderPrefix + name
+	v, err := cdb.lookup(key, func() (interface{}, error) {
+		if v, ok := cdb.dirtyValue(key); ok {
+			return v, nil
+		}
+		psp, err := cdb.db.GetPushServiceProvider(name)
+		if err != nil || psp == nil {
+			return []byte(nil), err
+		}
+		return pushServiceProviderToValue(psp), nil
+	})
+	if err != nil || v.([]byte) == nil {
+		return nil, err
+	}
+	return cdb.psm.BuildPushServiceProviderFromBytes(v.([]byte))
+}
+
+func (cdb *pushRawDatabaseCache) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	// Wildcards would need to be invalidated by any subscription
+	if strings.Contains(srv, "*") || strings.Contains(sub, "*") {
+		return cdb.db.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+	}
+	v, err := cdb.lookup(cacheServiceSubscriberPrefix+srv+":"+sub, func() (interface{}, error) {
+		return cdb.db.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+	dps := v.(map[string][]string)
+	if dps == nil {
+		return nil, nil
+	}
+	ret := make(map[string][]string, len(dps))
+	for s, names := range dps {
+		ret[s] = copyStrings(names)
+	}
+	return ret, nil
+}
+
+func (cdb *pushRawDatabaseCache) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
+	v, err := cdb.lookup(cacheServiceDeliveryPointPrefix+srv+":"+dp, func() (interface{}, error) {
+		return cdb.db.GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp)
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func (cdb *pushRawDatabaseCache) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	v, err := cdb.lookup(cacheServicePrefix+srv, func() (interface{}, error) {
+		return cdb.db.GetPushServiceProvidersByService(srv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyStrings(v.([]string)), nil
+}
+
+func (cdb *pushRawDatabaseCache) GetDeliveryPointsNameByKey(key string) ([]string, error) {
+	v, err := cdb.lookup(cacheKeyPrefix+key, func() (interface{}, error) {
+		return cdb.db.GetDeliveryPointsNameByKey(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyStrings(v.([]string)), nil
+}
+
+// lookupBatch is lookup() for several keys. The values of the keys not
+// cached are read with a single call to load.
+func (cdb *pushRawDatabaseCache) lookupBatch(keys []string, load func(missing []int) ([]interface{}, error)) ([]interface{}, error) {
+	ret := make([]interface{}, len(keys))
+	var missing []int
+	for i, key := range keys {
+		if v, ok := cdb.cache.get(key); ok {
+			ret[i] = v
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	atomic.AddInt64(&cdb.hits, int64(len(keys)-len(missing)))
+	atomic.AddInt64(&cdb.misses, int64(len(missing)))
+	if len(missing) == 0 {
+		return ret, nil
+	}
+	since := cdb.cache.snapshot()
+	values, err := load(missing)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range missing {
+		ret[i] = values[j]
+		cdb.cache.fill(keys[i], values[j], since)
+	}
+	return ret, nil
+}
+
+func prefixedKeys(prefix string, names []string) []string {
+	ret := make([]string, len(names))
+	for i, name := range names {
+		ret[i] = prefix + name
+	}
+	return ret
+}
+
+func pick(names []string, indices []int) []string {
+	ret := make([]string, len(indices))
+	for j, i := range indices {
+		ret[j] = names[i]
+	}
+	return ret
+}
+
+func (cdb *pushRawDatabaseCache) GetDeliveryPointsNameByServiceSubscribers(srv string, subs []string) ([][]string, error) {
+	values, err := cdb.lookupBatch(prefixedKeys(cacheServiceSubscriberPrefix+srv+":", subs), func(missing []int) ([]interface{}, error) {
+		dps, err := batchReaderOf(cdb.db).GetDeliveryPointsNameByServiceSubscribers(srv, pick(subs, missing))
+		if err != nil {
+			return nil, err
+		}
+		// Cached as by GetDeliveryPointsNameByServiceSubscriber()
+		ret := make([]interface{}, len(dps))
+		for j, names := range dps {
+			m := make(map[string][]string, 1)
+			if len(names) > 0 {
+				m[srv] = names
+			}
+			ret[j] = m
+		}
+		return ret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]string, len(subs))
+	for i, v := range values {
+		ret[i] = copyStrings(v.(map[string][]string)[srv])
+	}
+	return ret, nil
+}
+
+// lookupPeers reads the marshaled delivery points or push service
+// providers prefix+names, with their dirty values. The value of a
+// missing one is nil.
+func (cdb *pushRawDatabaseCache) lookupPeers(prefix string, names []string, load func(names []string) ([][]byte, error)) ([][]byte, error) {
+	keys := prefixedKeys(prefix, names)
+	values, err := cdb.lookupBatch(keys, func(missing []int) ([]interface{}, error) {
+		ret := make([]interface{}, len(missing))
+		var clean []int
+		for j, i := range missing {
+			if v, ok := cdb.dirtyValue(keys[i]); ok {
+				ret[j] = v
+			} else {
+				clean = append(clean, j)
+			}
+		}
+		if len(clean) == 0 {
+			return ret, nil
+		}
+		toLoad := make([]string, len(clean))
+		for k, j := range clean {
+			toLoad[k] = names[missing[j]]
+		}
+		loaded, err := load(toLoad)
 		if err != nil {
 			return nil, err
 		}
-		cdb.dpCache.Set(dp, ret.Name())
-	} else {
-		ret = dpi.(*DeliveryPoint)
+		for k, j := range clean {
+			ret[j] = loaded[k]
+		}
+		return ret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, len(names))
+	for i, v := range values {
+		ret[i] = v.([]byte)
 	}
 	return ret, nil
 }
 
-func (cdb *pushRawDatabaseCache) GetPushServiceProvider(psp string) (ret *PushServiceProvider, err error) {
-	if pspi := cdb.pspCache.Get(psp); pspi == nil {
-		ret, err = cdb.dbreader.GetPushServiceProvider(psp)
+func (cdb *pushRawDatabaseCache) GetDeliveryPointsByNames(names []string) ([]*DeliveryPoint, error) {
+	values, err := cdb.lookupPeers(cacheDeliveryPointPrefix, names, func(names []string) ([][]byte, error) {
+		dps, err := batchReaderOf(cdb.db).GetDeliveryPointsByNames(names)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([][]byte, len(dps))
+		for i, dp := range dps {
+			if dp != nil {
+				ret[i] = deliveryPointToValue(dp)
+			}
+		}
+		return ret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*DeliveryPoint, len(names))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		ret[i], err = cdb.psm.BuildDeliveryPointFromBytes(v)
 		if err != nil {
 			return nil, err
 		}
-		cdb.dpCache.Set(psp, ret.Name())
-	} else {
-		ret = pspi.(*PushServiceProvider)
 	}
 	return ret, nil
 }
 
+func (cdb *pushRawDatabaseCache) GetPushServiceProvidersByNames(names []string) ([]*PushServiceProvider, error) {
+	values, err := cdb.lookupPeers(cachePushServiceProviderPrefix, names, func(names []string) ([][]byte, error) {
+		psps, err := batchReaderOf(cdb.db).GetPushServiceProvidersByNames(names)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([][]byte, len(psps))
+		for i, psp := range psps {
+			if psp != nil {
+				ret[i] = pushServiceProviderToValue(psp)
+			}
+		}
+		return ret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*PushServiceProvider, len(names))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		ret[i], err = cdb.psm.BuildPushServiceProviderFromBytes(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (cdb *pushRawDatabaseCache) GetPushServiceProviderNamesByServiceDeliveryPoints(srv string, dps []string) ([]string, error) {
+	values, err := cdb.lookupBatch(prefixedKeys(cacheServiceDeliveryPointPrefix+srv+":", dps), func(missing []int) ([]interface{}, error) {
+		psps, err := batchReaderOf(cdb.db).GetPushServiceProviderNamesByServiceDeliveryPoints(srv, pick(dps, missing))
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]interface{}, len(psps))
+		for j, psp := range psps {
+			ret[j] = psp
+		}
+		return ret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, len(dps))
+	for i, v := range values {
+		ret[i] = v.(string)
+	}
+	return ret, nil
+}
+
+func (cdb *pushRawDatabaseCache) GetAllPushServiceProviders() ([]string, error) {
+	return cdb.db.GetAllPushServiceProviders()
+}
+
+// SetDeliveryPoint and SetPushServiceProvider are written back later,
+// unless called in a transaction.
 func (cdb *pushRawDatabaseCache) SetDeliveryPoint(dp *DeliveryPoint) error {
-	cdb.dpCache.Set(dp.Name(), dp)
+	cdb.setDirty(cacheDeliveryPointPrefix+dp.Name(), deliveryPointToValue(dp))
 	return nil
 }
 
 func (cdb *pushRawDatabaseCache) SetPushServiceProvider(psp *PushServiceProvider) error {
-	cdb.pspCache.Set(psp.Name(), psp)
+	cdb.setDirty(cachePushServiceProviderPrefix+psp.Name(), pushServiceProviderToValue(psp))
 	return nil
 }
 
-func (cdb *pushRawDatabaseCache) RemoveDeliveryPoint(dp string) error {
-	cdb.dpCache.Delete(dp)
-	return nil
+func (cdb *pushRawDatabaseCache) setDirty(key string, value []byte) {
+	cdb.dirtyLock.Lock()
+	defer cdb.dirtyLock.Unlock()
+	cdb.cache.set(key, value)
+	cdb.dirty[key] = value
+	if cdb.flushTimer == nil {
+		cdb.flushTimer = time.AfterFunc(cdb.flushPeriod, cdb.periodicFlush)
+	}
 }
 
-func (cdb *pushRawDatabaseCache) RemovePushServiceProvider(psp string) error {
-	cdb.pspCache.Delete(psp)
-	return nil
+func (cdb *pushRawDatabaseCache) periodicFlush() {
+	cdb.dirtyLock.Lock()
+	n := len(cdb.dirty)
+	cdb.flushTimer = nil
+	cdb.dirtyLock.Unlock()
+	if n > 0 && n >= cdb.leastDirty {
+		cdb.flushDirty()
+	}
+	cdb.dirtyLock.Lock()
+	if len(cdb.dirty) > 0 && cdb.flushTimer == nil {
+		cdb.flushTimer = time.AfterFunc(cdb.flushPeriod, cdb.periodicFlush)
+	}
+	cdb.dirtyLock.Unlock()
 }
 
-func (cdb *pushRawDatabaseCache) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (dps map[string][]string, err error) {
-	key := srv + ":" + sub
-	if i := cdb.srvSub2Dp.Get(key); i == nil {
-		dps, err = cdb.dbreader.GetDeliveryPointsNameByServiceSubscriber(srv, sub)
+// writeDirty writes the dirty value of key to db, if any.
+func (cdb *pushRawDatabaseCache) writeDirty(db pushRawDatabase, key string, value []byte) error {
+	if strings.HasPrefix(key, cacheDeliveryPointPrefix) {
+		dp, err := cdb.psm.BuildDeliveryPointFromBytes(value)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		cdb.srvSub2Dp.Set(key, dps)
-	} else {
-		dps = i.(map[string][]string)
+		return db.SetDeliveryPoint(dp)
 	}
-	return dps, nil
+	psp, err := cdb.psm.BuildPushServiceProviderFromBytes(value)
+	if err != nil {
+		return err
+	}
+	return db.SetPushServiceProvider(psp)
+}
+
+// takeDirty removes the dirty value of key and returns it.
+func (cdb *pushRawDatabaseCache) takeDirty(key string) []byte {
+	cdb.dirtyLock.Lock()
+	defer cdb.dirtyLock.Unlock()
+	value := cdb.dirty[key]
+	delete(cdb.dirty, key)
+	return value
+}
+
+// flushDirty writes all the dirty values, in one transaction if
+// possible.
+func (cdb *pushRawDatabaseCache) flushDirty() error {
+	cdb.writeLock.Lock()
+	defer cdb.writeLock.Unlock()
+	cdb.dirtyLock.Lock()
+	dirty := cdb.dirty
+	cdb.dirty = make(map[string][]byte, cdb.leastDirty)
+	cdb.flushing = dirty
+	cdb.dirtyLock.Unlock()
+	defer func() {
+		cdb.dirtyLock.Lock()
+		cdb.flushing = nil
+		cdb.dirtyLock.Unlock()
+	}()
+	if len(dirty) == 0 {
+		return nil
+	}
+	err := cdb.transaction(func(db pushRawDatabase) error {
+		for key, value := range dirty {
+			err := cdb.writeDirty(db, key, value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Try again later, unless modified again meanwhile
+		cdb.dirtyLock.Lock()
+		for key, value := range dirty {
+			if _, ok := cdb.dirty[key]; !ok {
+				cdb.dirty[key] = value
+			}
+		}
+		cdb.dirtyLock.Unlock()
+		return err
+	}
+	atomic.AddInt64(&cdb.flushes, 1)
+	return nil
+}
+
+func (cdb *pushRawDatabaseCache) transaction(fn func(db pushRawDatabase) error) error {
+	if t, ok := cdb.db.(pushRawDatabaseTransactor); ok {
+		return t.Transaction(fn)
+	}
+	return fn(cdb.db)
+}
+
+// cacheWriteThrough writes to the database in a transaction, and
+// invalidates what it changes in the cache.
+type cacheWriteThrough struct {
+	pushRawDatabase
+	cdb     *pushRawDatabaseCache
+	touched []string
+}
+
+func (self *cacheWriteThrough) invalidate(key string) {
+	self.cdb.cache.delete(key)
+	self.touched = append(self.touched, key)
+}
+
+// flushFirst writes the dirty value of key before a change which may
+// depend on it, e.g. removing a delivery point once unused.
+func (self *cacheWriteThrough) flushFirst(key string) error {
+	self.invalidate(key)
+	if value := self.cdb.takeDirty(key); value != nil {
+		return self.cdb.writeDirty(self.pushRawDatabase, key, value)
+	}
+	return nil
+}
+
+func (self *cacheWriteThrough) SetDeliveryPoint(dp *DeliveryPoint) error {
+	key := cacheDeliveryPointPrefix + dp.Name()
+	self.cdb.takeDirty(key)
+	self.invalidate(key)
+	return self.pushRawDatabase.SetDeliveryPoint(dp)
+}
+
+func (self *cacheWriteThrough) SetPushServiceProvider(psp *PushServiceProvider) error {
+	key := cachePushServiceProviderPrefix + psp.Name()
+	self.cdb.takeDirty(key)
+	self.invalidate(key)
+	return self.pushRawDatabase.SetPushServiceProvider(psp)
+}
+
+func (self *cacheWriteThrough) RemoveDeliveryPoint(dp string) error {
+	key := cacheDeliveryPointPrefix + dp
+	self.cdb.takeDirty(key)
+	self.invalidate(key)
+	return self.pushRawDatabase.RemoveDeliveryPoint(dp)
+}
+
+func (self *cacheWriteThrough) RemovePushServiceProvider(psp string) error {
+	key := cachePushServiceProviderPrefix + psp
+	self.cdb.takeDirty(key)
+	self.invalidate(key)
+	return self.pushRawDatabase.RemovePushServiceProvider(psp)
+}
+
+func (self *cacheWriteThrough) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	self.invalidate(cacheServiceSubscriberPrefix + srv + ":" + sub)
+	return self.pushRawDatabase.AddDeliveryPointToServiceSubscriber(srv, sub, dp)
+}
+
+// The engine removes the delivery point once unused.
+func (self *cacheWriteThrough) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	self.invalidate(cacheServiceSubscriberPrefix + srv + ":" + sub)
+	err := self.flushFirst(cacheDeliveryPointPrefix + dp)
+	if err != nil {
+		return err
+	}
+	return self.pushRawDatabase.RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp)
+}
+
+func (self *cacheWriteThrough) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	self.invalidate(cacheServiceDeliveryPointPrefix + srv + ":" + dp)
+	return self.pushRawDatabase.SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp)
+}
+
+func (self *cacheWriteThrough) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	self.invalidate(cacheServiceDeliveryPointPrefix + srv + ":" + dp)
+	return self.pushRawDatabase.RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp)
+}
+
+func (self *cacheWriteThrough) AddPushServiceProviderToService(srv, psp string) error {
+	self.invalidate(cacheServicePrefix + srv)
+	return self.pushRawDatabase.AddPushServiceProviderToService(srv, psp)
+}
+
+func (self *cacheWriteThrough) RemovePushServiceProviderFromService(srv, psp string) error {
+	self.invalidate(cacheServicePrefix + srv)
+	return self.pushRawDatabase.RemovePushServiceProviderFromService(srv, psp)
+}
+
+func (self *cacheWriteThrough) AddDeliveryPointToKey(key, dp string) error {
+	self.invalidate(cacheKeyPrefix + key)
+	return self.pushRawDatabase.AddDeliveryPointToKey(key, dp)
+}
+
+func (self *cacheWriteThrough) RemoveDeliveryPointFromKey(key, dp string) error {
+	self.invalidate(cacheKeyPrefix + key)
+	return self.pushRawDatabase.RemoveDeliveryPointFromKey(key, dp)
+}
+
+// Transaction writes the changes of fn through to the database. Reads
+// in fn are not cached.
+func (cdb *pushRawDatabaseCache) Transaction(fn func(db pushRawDatabase) error) error {
+	cdb.writeLock.RLock()
+	defer cdb.writeLock.RUnlock()
+	w := &cacheWriteThrough{cdb: cdb}
+	err := cdb.transaction(func(db pushRawDatabase) error {
+		w.pushRawDatabase = db
+		w.touched = w.touched[:0]
+		return fn(w)
+	})
+	// A reader may have cached the data of before the transaction.
+	for _, key := range w.touched {
+		cdb.cache.delete(key)
+	}
+	return err
+}
+
+func (cdb *pushRawDatabaseCache) RemoveDeliveryPoint(dp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.RemoveDeliveryPoint(dp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) RemovePushServiceProvider(psp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.RemovePushServiceProvider(psp)
+	})
 }
 
-/*
 func (cdb *pushRawDatabaseCache) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.AddDeliveryPointToServiceSubscriber(srv, sub, dp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) AddPushServiceProviderToService(srv, psp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.AddPushServiceProviderToService(srv, psp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) RemovePushServiceProviderFromService(srv, psp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.RemovePushServiceProviderFromService(srv, psp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) AddDeliveryPointToKey(key, dp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.AddDeliveryPointToKey(key, dp)
+	})
+}
+
+func (cdb *pushRawDatabaseCache) RemoveDeliveryPointFromKey(key, dp string) error {
+	return cdb.Transaction(func(db pushRawDatabase) error {
+		return db.RemoveDeliveryPointFromKey(key, dp)
+	})
+}
+
+// FlushCache writes the dirty values, then flushes the database.
+func (cdb *pushRawDatabaseCache) FlushCache() error {
+	err := cdb.flushDirty()
+	if err != nil {
+		return err
+	}
+	return cdb.db.FlushCache()
+}
+
+// purge forgets everything but the dirty values, after the database
+// was changed behind the cache.
+func (cdb *pushRawDatabaseCache) purge() {
+	cdb.cache.purge()
 }
-*/
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2012 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func TestCachedDatabase(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	// One entry: every lookup evicts the previous one
+	db, err := NewPushDatabaseOpts(&DatabaseConfig{
+		Engine:             "memory",
+		CacheSize:          1,
+		LeastDirty:         1,
+		EverySec:           600,
+		PushServiceManager: psm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb := db.(*pushDatabaseOpts).cache
+	raw := cdb.db
+
+	psp, dp := newMemTestPeers(t, psm)
+	for _, srv := range []string{"srv", "other"} {
+		err = db.AddPushServiceProviderToService(srv, psp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.AddDeliveryPointToService(srv, "sub", dp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if numberOfPairs(t, db, "srv", "sub") != 1 {
+		t.Fatalf("Subscription not written through")
+	}
+
+	// Written back
+	dp.VolatileData["regid"] = "new"
+	err = db.ModifyDeliveryPoint(dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d.VolatileData["regid"] != "" {
+		t.Errorf("Modification written through")
+	}
+	if stats := db.CacheStats(); stats.Dirty != 1 {
+		t.Errorf("Modification not dirty: %+v", stats)
+	}
+	// Evicted, but still dirty
+	numberOfPairs(t, db, "other", "sub")
+	if d, _ := cdb.GetDeliveryPoint(dp.Name()); d.VolatileData["regid"] != "new" {
+		t.Errorf("Dirty delivery point lost: %v", d)
+	}
+
+	// Still used by other: the modification must survive
+	err = db.RemoveDeliveryPointFromService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numberOfPairs(t, db, "srv", "sub") != 0 {
+		t.Errorf("Unsubscription not seen")
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d == nil || d.VolatileData["regid"] != "new" {
+		t.Errorf("Modification lost by unsubscribing: %v", d)
+	}
+
+	err = db.ModifyPushServiceProvider(psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb.periodicFlush()
+	stats := db.CacheStats()
+	if stats.Dirty != 0 || stats.Flushes != 1 {
+		t.Errorf("Not flushed: %+v", stats)
+	}
+	for i := 0; i < 10; i++ {
+		db.GetDeliveryPointsByKey("memtest", "none")
+	}
+	if stats := db.CacheStats(); stats.Hits == 0 || stats.HitRatio <= 0 || stats.HitRatio >= 1 {
+		t.Errorf("Bad statistics: %+v", stats)
+	}
+}
@@ -22,14 +22,20 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
-	redis "github.com/monnand/goredis"
+	"github.com/gomodule/redigo/redis"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
 )
 
 type PushRedisDB struct {
-	client *redis.Client
-	psm    *PushServiceManager
+	nodes redisNodes
+	psm   *PushServiceManager
+	// In a cluster, the keys of a service, or of a delivery point, are
+	// tagged to be in the same slot. See tag()
+	tagged bool
+	// Set within Transaction()
+	batch *redisOps
 }
 
 const (
@@ -39,8 +45,102 @@ const (
 	SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX string = "srv.dp-2-psp:"
 	SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX              string = "srv-2-psp:"
 	DELIVERY_POINT_COUNTER_PREFIX                         string = "delivery.point.counter:"
+	KEY_TO_DELIVERY_POINTS_PREFIX                         string = "key-2-dp:"
 )
 
+// redisOpsScript applies a list of writes atomically, so that several
+// uniqush-push may share a database, and a crash never leaves half of a
+// subscription behind. See redisOps for the operations.
+var redisOpsScript = redis.NewScript(-1, `
+local k, a = 1, 1
+while a <= #ARGV do
+	local op = ARGV[a]
+	if op == 'set' then
+		redis.call('SET', KEYS[k], ARGV[a+1])
+		k, a = k+1, a+2
+	elseif op == 'del' then
+		redis.call('DEL', KEYS[k])
+		k, a = k+1, a+1
+	elseif op == 'sadd' then
+		redis.call('SADD', KEYS[k], ARGV[a+1])
+		k, a = k+1, a+2
+	elseif op == 'srem' then
+		redis.call('SREM', KEYS[k], ARGV[a+1])
+		k, a = k+1, a+2
+	elseif op == 'addref' then
+		if redis.call('SADD', KEYS[k], ARGV[a+1]) == 1 then
+			redis.call('INCR', KEYS[k+1])
+		end
+		k, a = k+2, a+2
+	elseif op == 'rmref' then
+		if redis.call('SREM', KEYS[k], ARGV[a+1]) == 1 then
+			if redis.call('DECR', KEYS[k+1]) <= 0 then
+				redis.call('DEL', KEYS[k+1], KEYS[k+2])
+			end
+		end
+		k, a = k+3, a+2
+	elseif op == 'decref' then
+		if redis.call('DECR', KEYS[k]) <= 0 then
+			redis.call('DEL', KEYS[k], KEYS[k+1])
+		end
+		k, a = k+2, a+1
+	else
+		return redis.error_reply('Unknown operation ' .. op)
+	end
+end
+return #ARGV
+`)
+
+// redisOp is an operation of redisOpsScript: its keys go to KEYS, its
+// name and arguments to ARGV.
+type redisOp struct {
+	keys []string
+	args []interface{}
+}
+
+// redisOps is a list of writes for redisOpsScript.
+type redisOps struct {
+	ops []redisOp
+}
+
+func (o *redisOps) add(keys []string, args ...interface{}) {
+	o.ops = append(o.ops, redisOp{keys, args})
+}
+
+func (o *redisOps) set(key string, value []byte) {
+	o.add([]string{key}, "set", value)
+}
+
+func (o *redisOps) del(key string) {
+	o.add([]string{key}, "del")
+}
+
+func (o *redisOps) sadd(key, member string) {
+	o.add([]string{key}, "sadd", member)
+}
+
+func (o *redisOps) srem(key, member string) {
+	o.add([]string{key}, "srem", member)
+}
+
+// addRef adds member to set and increments counter, unless member was
+// already there.
+func (o *redisOps) addRef(set, counter, member string) {
+	o.add([]string{set, counter}, "addref", member)
+}
+
+// rmRef removes member from set and decrements counter, unless member
+// was not there. Both counter and value are deleted once counter
+// reaches 0.
+func (o *redisOps) rmRef(set, counter, value, member string) {
+	o.add([]string{set, counter, value}, "rmref", member)
+}
+
+// decRef is the end of rmRef, once member removed.
+func (o *redisOps) decRef(counter, value string) {
+	o.add([]string{counter, value}, "decref")
+}
+
 func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	if c == nil {
 		return nil, errors.New("Invalid Database Config")
@@ -48,7 +148,6 @@ func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	if strings.ToLower(c.Engine) != "redis" {
 		return nil, errors.New("Unsupported Database Engine")
 	}
-	var client redis.Client
 	if c.Host == "" {
 		c.Host = "localhost"
 	}
@@ -59,16 +158,30 @@ func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 		c.Name = "0"
 	}
 
-	client.Addr = fmt.Sprintf("%s:%d", c.Host, c.Port)
-	client.Password = c.Password
-	var err error
-	client.Db, err = strconv.Atoi(c.Name)
+	if c.MaxIdle <= 0 {
+		c.MaxIdle = 16
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = 4 * time.Minute
+	}
+	db, err := strconv.Atoi(c.Name)
 	if err != nil {
-		client.Db = 0
+		db = 0
 	}
 
 	ret := new(PushRedisDB)
-	ret.client = &client
+	switch {
+	case len(c.ClusterNodes) > 0:
+		ret.nodes = newRedisCluster(c)
+		ret.tagged = true
+	case len(c.Sentinels) > 0:
+		if c.MasterName == "" {
+			return nil, errors.New("NoMasterName")
+		}
+		ret.nodes = newRedisSentinelMaster(c, db)
+	default:
+		ret.nodes = newRedisServer(c, db)
+	}
 	ret.psm = c.PushServiceManager
 	if ret.psm == nil {
 		ret.psm = GetPushServiceManager()
@@ -76,6 +189,328 @@ func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	return ret, nil
 }
 
+// tag returns s as a hash tag in a cluster, so that the keys made of it
+// are in the same slot.
+func (r *PushRedisDB) tag(s string) string {
+	if r.tagged {
+		return "{" + s + "}"
+	}
+	return s
+}
+
+func (r *PushRedisDB) untag(s string) string {
+	if r.tagged {
+		return strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	}
+	return s
+}
+
+// serviceKey returns the key of rest in srv, e.g. a subscriber.
+func (r *PushRedisDB) serviceKey(prefix, srv, rest string) string {
+	return prefix + r.tag(srv) + ":" + rest
+}
+
+func (r *PushRedisDB) splitServiceKey(key, prefix string) (srv, rest string, ok bool) {
+	if !r.tagged {
+		return splitServiceKey(key, prefix)
+	}
+	if !strings.HasPrefix(key, prefix+"{") {
+		return "", "", false
+	}
+	key = key[len(prefix)+1:]
+	i := strings.Index(key, "}:")
+	if i < 0 {
+		return "", "", false
+	}
+	return key[:i], key[i+2:], true
+}
+
+func (r *PushRedisDB) deliveryPointKey(dp string) string {
+	return DELIVERY_POINT_PREFIX + r.tag(dp)
+}
+
+// In the slot of the delivery point
+func (r *PushRedisDB) deliveryPointCounterKey(dp string) string {
+	return DELIVERY_POINT_COUNTER_PREFIX + r.tag(dp)
+}
+
+// run runs fn with a connection to the server of key, again if it failed
+// as the servers changed, e.g. after a failover. Unless idempotent, fn is
+// only run again when redirected, i.e. when it was not run.
+func (r *PushRedisDB) run(key string, idempotent bool, fn func(conn redis.Conn) error) error {
+	addr := r.nodes.node(key)
+	asking := false
+	for i := 0; ; i++ {
+		conn := r.nodes.get(addr)
+		var err error
+		if asking {
+			err = fn(askingConn{conn})
+		} else {
+			err = fn(conn)
+		}
+		conn.Close()
+		if err == nil || i >= redisRetries {
+			return err
+		}
+		_, _, _, redirected := redisRedirection(err)
+		if !redirected && !idempotent {
+			return err
+		}
+		retry, ask := r.nodes.failed(err)
+		if !retry {
+			return err
+		}
+		addr, asking = r.nodes.node(key), false
+		if ask != "" {
+			addr, asking = ask, true
+		}
+	}
+}
+
+// askingConn sends ASKING before each command to the node an ASK
+// redirected us to, e.g. before the EVAL sent by redis.Script when the
+// node does not know the script yet.
+type askingConn struct {
+	redis.Conn
+}
+
+func (c askingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	_, err := c.Conn.Do("ASKING")
+	if err != nil {
+		return nil, err
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+// do runs a command reading or writing the key given as its first
+// argument, or on any server without argument.
+func (r *PushRedisDB) do(cmd string, args ...interface{}) (interface{}, error) {
+	key := ""
+	if len(args) > 0 {
+		key, _ = args[0].(string)
+	}
+	var reply interface{}
+	err := r.run(key, true, func(conn redis.Conn) (err error) {
+		reply, err = conn.Do(cmd, args...)
+		return
+	})
+	return reply, err
+}
+
+// onMasters runs fn on every server.
+func (r *PushRedisDB) onMasters(fn func(conn redis.Conn) error) error {
+	addrs, err := r.nodes.masters()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		conn := r.nodes.get(addr)
+		err = fn(conn)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keys returns the keys matching pattern on every server.
+func (r *PushRedisDB) keys(pattern string) ([]string, error) {
+	var ret []string
+	err := r.onMasters(func(conn redis.Conn) error {
+		keys, err := redis.Strings(conn.Do("KEYS", pattern))
+		ret = append(ret, keys...)
+		return err
+	})
+	return ret, err
+}
+
+// redisCommand reads or writes the key given as its first argument.
+type redisCommand struct {
+	name string
+	args []interface{}
+}
+
+// pipeline sends the commands to their servers at once, and returns
+// their replies in order. Those that fail, e.g. redirected in a
+// cluster, are run again one by one.
+func (r *PushRedisDB) pipeline(cmds []redisCommand) ([]interface{}, error) {
+	var addrs []string
+	byAddr := make(map[string][]int, 1)
+	for i, cmd := range cmds {
+		key, _ := cmd.args[0].(string)
+		addr := r.nodes.node(key)
+		if _, ok := byAddr[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], i)
+	}
+	replies := make([]interface{}, len(cmds))
+	var failed []int
+	for _, addr := range addrs {
+		conn := r.nodes.get(addr)
+		var err error
+		for _, i := range byAddr[addr] {
+			if err == nil {
+				err = conn.Send(cmds[i].name, cmds[i].args...)
+			}
+		}
+		if err == nil {
+			err = conn.Flush()
+		}
+		for _, i := range byAddr[addr] {
+			var e error
+			if err == nil {
+				replies[i], e = conn.Receive()
+			}
+			if err != nil || e != nil {
+				failed = append(failed, i)
+			}
+			if isRedisNetworkError(e) {
+				err = e
+			}
+		}
+		conn.Close()
+	}
+	for _, i := range failed {
+		var err error
+		replies[i], err = r.do(cmds[i].name, cmds[i].args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// write applies the operations added by fn atomically, or adds them to
+// the transaction.
+func (r *PushRedisDB) write(fn func(ops *redisOps)) error {
+	if r.batch != nil {
+		fn(r.batch)
+		return nil
+	}
+	ops := new(redisOps)
+	fn(ops)
+	return r.apply(ops)
+}
+
+// apply applies the operations at once. In a cluster, the operations
+// are applied at once per slot.
+func (r *PushRedisDB) apply(ops *redisOps) error {
+	var group []redisOp
+	slot := -1
+	for _, op := range ops.ops {
+		opSlot, ok := r.opSlot(op)
+		if len(group) > 0 && (!ok || opSlot != slot) {
+			err := r.applyScript(group, true)
+			if err != nil {
+				return err
+			}
+			group = nil
+		}
+		if ok {
+			group = append(group, op)
+			slot = opSlot
+			continue
+		}
+		err := r.applyAcrossSlots(op)
+		if err != nil {
+			return err
+		}
+	}
+	if len(group) == 0 {
+		return nil
+	}
+	return r.applyScript(group, true)
+}
+
+// opSlot returns the slot of the keys of op, unless they are in several
+// slots.
+func (r *PushRedisDB) opSlot(op redisOp) (int, bool) {
+	slot := r.nodes.slot(op.keys[0])
+	for _, key := range op.keys[1:] {
+		if r.nodes.slot(key) != slot {
+			return 0, false
+		}
+	}
+	return slot, true
+}
+
+// applyScript applies ops, whose keys are in the same slot, atomically.
+// All the operations but decref may be applied twice.
+func (r *PushRedisDB) applyScript(ops []redisOp, idempotent bool) error {
+	var keys, args []interface{}
+	for _, op := range ops {
+		for _, key := range op.keys {
+			keys = append(keys, key)
+		}
+		args = append(args, op.args...)
+	}
+	keysAndArgs := make([]interface{}, 0, 1+len(keys)+len(args))
+	keysAndArgs = append(keysAndArgs, len(keys))
+	keysAndArgs = append(keysAndArgs, keys...)
+	keysAndArgs = append(keysAndArgs, args...)
+	return r.run(ops[0].keys[0], idempotent, func(conn redis.Conn) error {
+		_, err := redisOpsScript.Do(conn, keysAndArgs...)
+		return err
+	})
+}
+
+// applyAcrossSlots applies the reference counting of a cluster, where a
+// delivery point and its subscribers are in different slots: the set
+// first, then the counter. If interrupted in between, the counter is
+// wrong until fixed by Check().
+func (r *PushRedisDB) applyAcrossSlots(op redisOp) error {
+	member := op.args[1]
+	switch op.args[0] {
+	case "addref":
+		n, err := redis.Int(r.do("SADD", op.keys[0], member))
+		if err != nil || n == 0 {
+			return err
+		}
+		return r.run(op.keys[1], false, func(conn redis.Conn) error {
+			_, err := conn.Do("INCR", op.keys[1])
+			return err
+		})
+	case "rmref":
+		n, err := redis.Int(r.do("SREM", op.keys[0], member))
+		if err != nil || n == 0 {
+			return err
+		}
+		dec := new(redisOps)
+		dec.decRef(op.keys[1], op.keys[2])
+		return r.applyScript(dec.ops, false)
+	}
+	return fmt.Errorf("Operation %v across slots", op.args[0])
+}
+
+// Transaction applies the writes of fn atomically once fn returns, but
+// in a cluster, where they are atomic per slot. Reads within fn do not
+// see these writes.
+func (r *PushRedisDB) Transaction(fn func(db pushRawDatabase) error) error {
+	if r.batch != nil {
+		return fn(r)
+	}
+	tx := &PushRedisDB{nodes: r.nodes, psm: r.psm, tagged: r.tagged, batch: new(redisOps)}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	return r.apply(tx.batch)
+}
+
+func (r *PushRedisDB) get(key string) ([]byte, error) {
+	b, err := redis.Bytes(r.do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (r *PushRedisDB) smembers(key string) ([]string, error) {
+	return redis.Strings(r.do("SMEMBERS", key))
+}
+
 func (r *PushRedisDB) keyValueToDeliveryPoint(name string, value []byte) (dp *DeliveryPoint, err error) {
 	psm := r.psm
 	dp, err = psm.BuildDeliveryPointFromBytes(value)
@@ -103,7 +538,7 @@ func pushServiceProviderToValue(psp *PushServiceProvider) []byte {
 }
 
 func (r *PushRedisDB) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
-	b, err := r.client.Get(DELIVERY_POINT_PREFIX + name)
+	b, err := r.get(r.deliveryPointKey(name))
 	if err != nil {
 		return nil, err
 	}
@@ -114,12 +549,13 @@ func (r *PushRedisDB) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
 }
 
 func (r *PushRedisDB) SetDeliveryPoint(dp *DeliveryPoint) error {
-	err := r.client.Set(DELIVERY_POINT_PREFIX+dp.Name(), deliveryPointToValue(dp))
-	return err
+	return r.write(func(ops *redisOps) {
+		ops.set(r.deliveryPointKey(dp.Name()), deliveryPointToValue(dp))
+	})
 }
 
 func (r *PushRedisDB) GetPushServiceProvider(name string) (*PushServiceProvider, error) {
-	b, err := r.client.Get(PUSH_SERVICE_PROVIDER_PREFIX + name)
+	b, err := r.get(PUSH_SERVICE_PROVIDER_PREFIX + name)
 	if err != nil {
 		return nil, err
 	}
@@ -130,26 +566,30 @@ func (r *PushRedisDB) GetPushServiceProvider(name string) (*PushServiceProvider,
 }
 
 func (r *PushRedisDB) SetPushServiceProvider(psp *PushServiceProvider) error {
-	return r.client.Set(PUSH_SERVICE_PROVIDER_PREFIX+psp.Name(), pushServiceProviderToValue(psp))
+	return r.write(func(ops *redisOps) {
+		ops.set(PUSH_SERVICE_PROVIDER_PREFIX+psp.Name(), pushServiceProviderToValue(psp))
+	})
 }
 
 func (r *PushRedisDB) RemoveDeliveryPoint(dp string) error {
-	_, err := r.client.Del(DELIVERY_POINT_PREFIX + dp)
-	return err
+	return r.write(func(ops *redisOps) {
+		ops.del(r.deliveryPointKey(dp))
+	})
 }
 
 func (r *PushRedisDB) RemovePushServiceProvider(psp string) error {
-	_, err := r.client.Del(PUSH_SERVICE_PROVIDER_PREFIX + psp)
-	return err
+	return r.write(func(ops *redisOps) {
+		ops.del(PUSH_SERVICE_PROVIDER_PREFIX + psp)
+	})
 }
 
 func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, usr string) (map[string][]string, error) {
 	keys := make([]string, 1)
 	if !strings.Contains(usr, "*") && !strings.Contains(srv, "*") {
-		keys[0] = SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + usr
+		keys[0] = r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, srv, usr)
 	} else {
 		var err error
-		keys, err = r.client.Keys(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + usr)
+		keys, err = r.keys(r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, srv, usr))
 		if err != nil {
 			return nil, err
 		}
@@ -157,111 +597,377 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, usr string)
 
 	ret := make(map[string][]string, len(keys))
 	for _, k := range keys {
-		m, err := r.client.Smembers(k)
+		m, err := r.smembers(k)
 		if err != nil {
 			return nil, err
 		}
-		if m == nil {
+		if len(m) == 0 {
 			continue
 		}
-		elem := strings.Split(k, ":")
-		s := elem[1]
-		if l, ok := ret[s]; !ok || l == nil {
-			ret[s] = make([]string, 0, len(keys))
-		}
-		for _, bm := range m {
-			dpl := ret[s]
-			dpl = append(dpl, string(bm))
-			ret[s] = dpl
-		}
+		s, _, _ := r.splitServiceKey(k, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX)
+		ret[s] = append(ret[s], m...)
 	}
 	return ret, nil
 }
 
 func (r *PushRedisDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
-	b, err := r.client.Get(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX + srv + ":" + dp)
+	b, err := r.get(r.serviceKey(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX, srv, dp))
 	if err != nil {
 		return "", err
 	}
-	if b == nil {
-		return "", nil
-	}
 	return string(b), nil
 }
 
 func (r *PushRedisDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
-	i, err := r.client.Sadd(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, []byte(dp))
+	return r.write(func(ops *redisOps) {
+		ops.addRef(r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, srv, sub), r.deliveryPointCounterKey(dp), dp)
+	})
+}
+
+func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.rmRef(r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, srv, sub), r.deliveryPointCounterKey(dp), r.deliveryPointKey(dp), dp)
+	})
+}
+
+func (r *PushRedisDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.set(r.serviceKey(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX, srv, dp), []byte(psp))
+	})
+}
+
+func (r *PushRedisDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.del(r.serviceKey(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX, srv, dp))
+	})
+}
+
+func (r *PushRedisDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	m, err := r.smembers(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + r.tag(srv))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if i == false {
-		return nil
+	if len(m) == 0 {
+		return nil, nil
 	}
-	_, err = r.client.Incr(DELIVERY_POINT_COUNTER_PREFIX + dp)
+	return m, nil
+}
+
+func (r *PushRedisDB) GetAllPushServiceProviders() ([]string, error) {
+	keys, err := r.scan(PUSH_SERVICE_PROVIDER_PREFIX + "*")
 	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[i] = strings.TrimPrefix(k, PUSH_SERVICE_PROVIDER_PREFIX)
+	}
+	return ret, nil
+}
+
+func (r *PushRedisDB) RemovePushServiceProviderFromService(srv, psp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.srem(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+r.tag(srv), psp)
+	})
+}
+
+func (r *PushRedisDB) AddPushServiceProviderToService(srv, psp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.sadd(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+r.tag(srv), psp)
+	})
+}
+
+func (r *PushRedisDB) AddDeliveryPointToKey(key, dp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.sadd(KEY_TO_DELIVERY_POINTS_PREFIX+key, dp)
+	})
+}
+
+func (r *PushRedisDB) RemoveDeliveryPointFromKey(key, dp string) error {
+	return r.write(func(ops *redisOps) {
+		ops.srem(KEY_TO_DELIVERY_POINTS_PREFIX+key, dp)
+	})
+}
+
+func (r *PushRedisDB) GetDeliveryPointsNameByKey(key string) ([]string, error) {
+	return r.smembers(KEY_TO_DELIVERY_POINTS_PREFIX + key)
+}
+
+func (r *PushRedisDB) FlushCache() error {
+	return r.onMasters(func(conn redis.Conn) error {
+		_, err := conn.Do("SAVE")
 		return err
+	})
+}
+
+// scan returns the keys matching pattern on every server. Unlike KEYS,
+// it does not block the servers.
+func (r *PushRedisDB) scan(pattern string) ([]string, error) {
+	seen := make(map[string]bool, 16)
+	ret := make([]string, 0, 16)
+	err := r.onMasters(func(conn redis.Conn) error {
+		return scanServer(conn, pattern, seen, &ret)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return ret, nil
 }
 
-func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
-	j, err := r.client.Srem(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, []byte(dp))
+func scanServer(conn redis.Conn, pattern string, seen map[string]bool, ret *[]string) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		if len(reply) != 2 {
+			return errors.New("Bad reply of SCAN")
+		}
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		// Keys may be returned more than once
+		for _, k := range keys {
+			if !seen[k] {
+				seen[k] = true
+				*ret = append(*ret, k)
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// mget returns the values of the keys which exist, read with one MGET
+// per slot and per 1000 keys.
+func (r *PushRedisDB) mget(keys []string) (map[string]string, error) {
+	var slots []int
+	bySlot := make(map[int][]interface{}, 1)
+	for _, k := range keys {
+		slot := r.nodes.slot(k)
+		if _, ok := bySlot[slot]; !ok {
+			slots = append(slots, slot)
+		}
+		bySlot[slot] = append(bySlot[slot], k)
+	}
+	var cmds []redisCommand
+	for _, slot := range slots {
+		args := bySlot[slot]
+		for start := 0; start < len(args); start += 1000 {
+			end := start + 1000
+			if end > len(args) {
+				end = len(args)
+			}
+			cmds = append(cmds, redisCommand{"MGET", args[start:end]})
+		}
+	}
+	replies, err := r.pipeline(cmds)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if j == false {
-		return nil
+	ret := make(map[string]string, len(keys))
+	for i, reply := range replies {
+		values, err := redis.ByteSlices(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		for j, v := range values {
+			if v != nil {
+				ret[cmds[i].args[j].(string)] = string(v)
+			}
+		}
 	}
-	i, e := r.client.Decr(DELIVERY_POINT_COUNTER_PREFIX + dp)
-	if e != nil {
-		return e
+	return ret, nil
+}
+
+// The batch reads: one pipeline of SMEMBERS, or MGET
+
+func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscribers(srv string, subs []string) ([][]string, error) {
+	cmds := make([]redisCommand, len(subs))
+	for i, sub := range subs {
+		cmds[i] = redisCommand{"SMEMBERS", []interface{}{r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, srv, sub)}}
+	}
+	replies, err := r.pipeline(cmds)
+	if err != nil {
+		return nil, err
 	}
-	if i <= 0 {
-		_, e0 := r.client.Del(DELIVERY_POINT_COUNTER_PREFIX + dp)
-		if e0 != nil {
-			return e0
+	ret := make([][]string, len(subs))
+	for i, reply := range replies {
+		ret[i], err = redis.Strings(reply, nil)
+		if err != nil {
+			return nil, err
 		}
-		_, e1 := r.client.Del(DELIVERY_POINT_PREFIX + dp)
-		return e1
 	}
-	return e
+	return ret, nil
 }
 
-func (r *PushRedisDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
-	return r.client.Set(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX+srv+":"+dp, []byte(psp))
+// mgetKeys reads the keys made of each name with key().
+func (r *PushRedisDB) mgetKeys(names []string, key func(name string) string) (map[string]string, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = key(name)
+	}
+	return r.mget(keys)
 }
 
-func (r *PushRedisDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
-	_, err := r.client.Del(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX + srv + ":" + dp)
-	return err
+func (r *PushRedisDB) pushServiceProviderKey(psp string) string {
+	return PUSH_SERVICE_PROVIDER_PREFIX + psp
 }
 
-func (r *PushRedisDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
-	m, err := r.client.Smembers(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + srv)
+func (r *PushRedisDB) GetDeliveryPointsByNames(names []string) ([]*DeliveryPoint, error) {
+	values, err := r.mgetKeys(names, r.deliveryPointKey)
 	if err != nil {
 		return nil, err
 	}
-	if m == nil {
-		return nil, nil
+	ret := make([]*DeliveryPoint, len(names))
+	for i, name := range names {
+		if v, ok := values[r.deliveryPointKey(name)]; ok {
+			ret[i], err = r.keyValueToDeliveryPoint(name, []byte(v))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
-	ret := make([]string, len(m))
-	for i, bm := range m {
-		ret[i] = string(bm)
+	return ret, nil
+}
+
+func (r *PushRedisDB) GetPushServiceProvidersByNames(names []string) ([]*PushServiceProvider, error) {
+	values, err := r.mgetKeys(names, r.pushServiceProviderKey)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*PushServiceProvider, len(names))
+	for i, name := range names {
+		if v, ok := values[r.pushServiceProviderKey(name)]; ok {
+			ret[i], err = r.keyValueToPushServiceProvider(name, []byte(v))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
+	return ret, nil
+}
 
+func (r *PushRedisDB) GetPushServiceProviderNamesByServiceDeliveryPoints(srv string, dps []string) ([]string, error) {
+	key := func(dp string) string {
+		return r.serviceKey(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX, srv, dp)
+	}
+	values, err := r.mgetKeys(dps, key)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, len(dps))
+	for i, dp := range dps {
+		ret[i] = values[key(dp)]
+	}
 	return ret, nil
 }
 
-func (r *PushRedisDB) RemovePushServiceProviderFromService(srv, psp string) error {
-	_, err := r.client.Srem(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, []byte(psp))
-	return err
+func (r *PushRedisDB) GetAllDeliveryPoints() ([]string, error) {
+	keys, err := r.scan(DELIVERY_POINT_PREFIX + "*")
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = r.untag(strings.TrimPrefix(k, DELIVERY_POINT_PREFIX))
+	}
+	return keys, nil
 }
 
-func (r *PushRedisDB) AddPushServiceProviderToService(srv, psp string) error {
-	_, err := r.client.Sadd(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, []byte(psp))
-	return err
+func (r *PushRedisDB) GetAllSubscriptions() ([]rawSubscription, error) {
+	keys, err := r.scan(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + "*")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]rawSubscription, 0, len(keys))
+	for _, k := range keys {
+		srv, sub, ok := r.splitServiceKey(k, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX)
+		if !ok {
+			continue
+		}
+		dps, err := r.smembers(k)
+		if err != nil {
+			return nil, err
+		}
+		for _, dp := range dps {
+			ret = append(ret, rawSubscription{Service: srv, Subscriber: sub, DeliveryPoint: dp})
+		}
+	}
+	return ret, nil
 }
 
-func (r *PushRedisDB) FlushCache() error {
-	return r.client.Save()
+func (r *PushRedisDB) GetAllPushServiceProvidersOfDeliveryPoints() (map[string]map[string]string, error) {
+	keys, err := r.scan(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX + "*")
+	if err != nil {
+		return nil, err
+	}
+	values, err := r.mget(keys)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]map[string]string, 4)
+	for k, psp := range values {
+		srv, dp, ok := r.splitServiceKey(k, SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX)
+		if !ok {
+			continue
+		}
+		if ret[srv] == nil {
+			ret[srv] = make(map[string]string, 16)
+		}
+		ret[srv][dp] = psp
+	}
+	return ret, nil
+}
+
+func (r *PushRedisDB) GetAllServices() (map[string][]string, error) {
+	keys, err := r.scan(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + "*")
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]string, len(keys))
+	for _, k := range keys {
+		psps, err := r.smembers(k)
+		if err != nil {
+			return nil, err
+		}
+		ret[r.untag(strings.TrimPrefix(k, SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX))] = psps
+	}
+	return ret, nil
+}
+
+func (r *PushRedisDB) GetDeliveryPointCounters() (map[string]int, error) {
+	keys, err := r.scan(DELIVERY_POINT_COUNTER_PREFIX + "*")
+	if err != nil {
+		return nil, err
+	}
+	values, err := r.mget(keys)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]int, len(values))
+	for k, v := range values {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("Bad counter %v: %v", k, err)
+		}
+		ret[r.untag(strings.TrimPrefix(k, DELIVERY_POINT_COUNTER_PREFIX))] = n
+	}
+	return ret, nil
+}
+
+func (r *PushRedisDB) SetDeliveryPointCounter(dp string, n int) error {
+	return r.write(func(ops *redisOps) {
+		if n <= 0 {
+			ops.del(r.deliveryPointCounterKey(dp))
+		} else {
+			ops.set(r.deliveryPointCounterKey(dp), []byte(strconv.Itoa(n)))
+		}
+	})
 }
@@ -0,0 +1,269 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// Two instances of uniqush-push share the database, and subscribe and
+// unsubscribe the same delivery point concurrently.
+func TestRedisConcurrentInstances(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	clearData()
+	defer clearData()
+
+	instances := make([]PushDatabase, 2)
+	for i := range instances {
+		db, err := connectDatabase()
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i] = db
+	}
+	raw := instances[0].(*pushDatabaseOpts).db.(*PushRedisDB)
+	if _, err := raw.do("PING"); err != nil {
+		t.Skipf("No redis server: %v", err)
+	}
+
+	psp, dp := newMemTestPeers(t, psm)
+	err := instances[0].AddPushServiceProviderToService("srv", psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db := instances[i%2]
+			sub := fmt.Sprintf("sub%v", i/2)
+			_, err := db.AddDeliveryPointToService("srv", sub, dp)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			err = db.RemoveDeliveryPointFromService("srv", sub, dp)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	keys, err := redis.Strings(raw.do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		switch k {
+		case PUSH_SERVICE_PROVIDER_PREFIX + psp.Name(), SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + "srv":
+		default:
+			t.Errorf("Key left after unsubscribing: %v", k)
+		}
+	}
+
+	// Nothing is written by a failed transaction
+	failed := errors.New("failed")
+	err = raw.Transaction(func(tx pushRawDatabase) error {
+		err := tx.SetDeliveryPoint(dp)
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d != nil {
+		t.Errorf("Transaction not rolled back")
+	}
+}
+
+func TestRedisClusterKeys(t *testing.T) {
+	// Examples of the specification of Redis Cluster
+	if slot := redisSlot("123456789"); slot != 12739 {
+		t.Errorf("Bad slot: %v", slot)
+	}
+	if redisSlot("{user1000}.following") != redisSlot("{user1000}.followers") {
+		t.Errorf("Hash tag ignored")
+	}
+	if redisHashTag("foo{}{bar}") != "foo{}{bar}" || redisHashTag("foo{{bar}}zap") != "{bar" {
+		t.Errorf("Bad hash tag")
+	}
+
+	r := &PushRedisDB{nodes: newRedisCluster(&DatabaseConfig{}), tagged: true}
+	slot := redisSlot(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + r.tag("srv"))
+	for _, key := range []string{
+		r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, "srv", "sub"),
+		r.serviceKey(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_RPVIDER_PREFIX, "srv", "apns:123"),
+	} {
+		if redisSlot(key) != slot {
+			t.Errorf("%v not in the slot of its service", key)
+		}
+	}
+	if redisSlot(r.deliveryPointKey("apns:123")) != redisSlot(r.deliveryPointCounterKey("apns:123")) {
+		t.Errorf("Delivery point and counter in different slots")
+	}
+	srv, sub, ok := r.splitServiceKey(r.serviceKey(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, "srv", "a:b"), SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX)
+	if !ok || srv != "srv" || sub != "a:b" {
+		t.Errorf("Bad split: %v %v %v", srv, sub, ok)
+	}
+
+	kind, slot, addr, ok := redisRedirection(redis.Error("MOVED 3999 127.0.0.1:6381"))
+	if !ok || kind != "MOVED" || slot != 3999 || addr != "127.0.0.1:6381" {
+		t.Errorf("Bad redirection: %v %v %v %v", kind, slot, addr, ok)
+	}
+	if _, _, _, ok = redisRedirection(redis.Error("ERR unknown command")); ok {
+		t.Errorf("Not a redirection")
+	}
+
+	slots := make([]string, redisNumberOfSlots)
+	err := parseClusterSlots([]interface{}{
+		[]interface{}{int64(0), int64(5460), []interface{}{[]byte("127.0.0.1"), int64(7000), []byte("id")}},
+		[]interface{}{int64(5461), int64(16383), []interface{}{[]byte("127.0.0.1"), int64(7001)}},
+	}, slots)
+	if err != nil || slots[5460] != "127.0.0.1:7000" || slots[5461] != "127.0.0.1:7001" {
+		t.Errorf("Bad slots: %v %v %v", slots[5460], slots[5461], err)
+	}
+}
+
+// Node of a cluster in the middle of a resharding. The source node
+// redirects with ASK to the node the keys are migrating to, which only
+// serves the commands preceded by ASKING.
+type migratingRedisConn struct {
+	addr   string
+	asking bool
+	log    *[]string
+}
+
+func (c *migratingRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	*c.log = append(*c.log, c.addr+" "+cmd)
+	asking := c.asking
+	c.asking = cmd == "ASKING"
+	switch {
+	case cmd == "ASKING":
+		return "OK", nil
+	case c.addr == "source:7000":
+		return nil, redis.Error("ASK 3999 target:7001")
+	case !asking:
+		return nil, redis.Error("MOVED 3999 source:7000")
+	}
+	return "value", nil
+}
+
+func (c *migratingRedisConn) Close() error { return nil }
+func (c *migratingRedisConn) Err() error   { return nil }
+func (c *migratingRedisConn) Send(cmd string, args ...interface{}) error {
+	return errors.New("NotSupported")
+}
+func (c *migratingRedisConn) Flush() error                  { return nil }
+func (c *migratingRedisConn) Receive() (interface{}, error) { return nil, errors.New("NotSupported") }
+
+type migratingRedisCluster struct {
+	*redisCluster
+	log []string
+}
+
+func (self *migratingRedisCluster) get(addr string) redis.Conn {
+	return &migratingRedisConn{addr: addr, log: &self.log}
+}
+
+func TestRedisClusterAskRedirection(t *testing.T) {
+	nodes := &migratingRedisCluster{redisCluster: newRedisCluster(&DatabaseConfig{})}
+	slot := redisSlot("key")
+	nodes.slots[slot] = "source:7000"
+	r := &PushRedisDB{nodes: nodes, tagged: true}
+
+	// Twice, as redis.Script sends EVAL after EVALSHA
+	err := r.run("key", false, func(conn redis.Conn) error {
+		for i := 0; i < 2; i++ {
+			reply, err := redis.String(conn.Do("GET", "key"))
+			if err != nil {
+				return err
+			}
+			if reply != "value" {
+				return fmt.Errorf("Bad reply: %v", reply)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Command on a migrating slot failed: %v (%v)", err, nodes.log)
+	}
+	expected := "[source:7000 GET target:7001 ASKING target:7001 GET target:7001 ASKING target:7001 GET]"
+	if fmt.Sprint(nodes.log) != expected {
+		t.Errorf("Expected %v, got %v", expected, nodes.log)
+	}
+	// Only this command is redirected
+	if nodes.slots[slot] != "source:7000" {
+		t.Errorf("Slot moved to %v", nodes.slots[slot])
+	}
+}
+
+// Run against a cluster made by redis-cli --cluster create, from 7000
+func TestRedisCluster(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	db, err := NewPushDatabaseWithoutCache(&DatabaseConfig{
+		Engine:             "redis",
+		ClusterNodes:       []string{"localhost:7000", "localhost:7001"},
+		PushServiceManager: psm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := db.(*pushDatabaseOpts).db.(*PushRedisDB)
+	if _, err := raw.nodes.masters(); err != nil {
+		t.Skipf("No redis cluster: %v", err)
+	}
+	defer raw.onMasters(func(conn redis.Conn) error {
+		_, err := conn.Do("FLUSHALL")
+		return err
+	})
+
+	subs := subscriberNames(20)
+	err = subscribe(db, psm, "srv", subs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairsBySubscribers("srv", subs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		if len(pairs[sub]) != 1 {
+			t.Errorf("%v has %v delivery points", sub, len(pairs[sub]))
+		}
+	}
+	if n := numberOfPairs(t, db, "srv", "sub1*"); n != 11 {
+		t.Errorf("Expected 11 delivery points, got %v", n)
+	}
+	problems, err := db.Check(false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Inconsistent cluster: %v (%v)", problems, err)
+	}
+}
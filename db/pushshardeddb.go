@@ -0,0 +1,780 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// A database whose subscriptions are spread over several servers.
+type ShardedPushDatabase interface {
+	PushDatabase
+
+	// Copies the push service providers of the first shard to the
+	// others, and moves the subscriptions to the shards of their
+	// subscribers, e.g. after adding a shard. Returns what was done.
+	Rebalance() ([]*DatabaseProblem, error)
+}
+
+// Points of each shard on the ring: the more, the more evenly keys are
+// spread.
+const shardRingReplicas = 160
+
+// shardRing maps keys to shards by consistent hashing, like ketama: each
+// shard is found at many points of a ring, and a key belongs to the next
+// point. Adding a shard only moves the keys of its points, about 1/n of
+// them. Shards are known by their names, so they may be listed in any
+// order.
+type shardRing struct {
+	points []uint32
+	shards []int
+}
+
+func shardHash(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+func newShardRing(names []string) *shardRing {
+	type point struct {
+		hash  uint32
+		shard int
+	}
+	points := make([]point, 0, len(names)*shardRingReplicas)
+	for i, name := range names {
+		for j := 0; j < shardRingReplicas; j++ {
+			points = append(points, point{shardHash(fmt.Sprintf("%v-%v", name, j)), i})
+		}
+	}
+	sort.Slice(points, func(a, b int) bool {
+		if points[a].hash != points[b].hash {
+			return points[a].hash < points[b].hash
+		}
+		return names[points[a].shard] < names[points[b].shard]
+	})
+	ret := &shardRing{
+		points: make([]uint32, len(points)),
+		shards: make([]int, len(points)),
+	}
+	for i, p := range points {
+		ret.points[i] = p.hash
+		ret.shards[i] = p.shard
+	}
+	return ret
+}
+
+func (self *shardRing) shard(key string) int {
+	h := shardHash(key)
+	i := sort.Search(len(self.points), func(i int) bool { return self.points[i] >= h })
+	if i == len(self.points) {
+		i = 0
+	}
+	return self.shards[i]
+}
+
+// shardedPushDatabase spreads the subscriptions over several databases,
+// each one complete on its own: the delivery points of a subscriber of a
+// service are on the shard of "service:subscriber", together with the
+// subscriptions, and the push service providers are on every shard.
+//
+// After adding a shard, subscribers are found on their previous shard
+// until moved by Rebalance(), and changes go there too. The push service
+// providers of the first shard are the reference: they are written
+// there first, and copied to the others by Rebalance().
+type shardedPushDatabase struct {
+	names  []string
+	shards []*pushDatabaseOpts
+	ring   *shardRing
+}
+
+// newShardedPushDatabase opens each shard of conf with open. Only redis
+// servers are told apart by their addresses: the other engines would
+// all open the same database.
+func newShardedPushDatabase(conf *DatabaseConfig, open func(conf *DatabaseConfig) (PushDatabase, error)) (PushDatabase, error) {
+	if strings.ToLower(conf.Engine) != "redis" {
+		return nil, errors.New("ShardsOnlySupportedWithRedis")
+	}
+	if len(conf.Sentinels) > 0 || len(conf.ClusterNodes) > 0 {
+		return nil, errors.New("ShardsNotSupportedWithSentinelsOrCluster")
+	}
+	ret := new(shardedPushDatabase)
+	seen := make(map[string]bool, len(conf.Shards))
+	for _, addr := range conf.Shards {
+		if seen[addr] {
+			return nil, fmt.Errorf("Duplicate shard %v", addr)
+		}
+		seen[addr] = true
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Shard %v: %v", addr, err)
+		}
+		c := *conf
+		c.Shards = nil
+		c.Host = host
+		c.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("Shard %v: Invalid port", addr)
+		}
+		db, err := open(&c)
+		if err != nil {
+			return nil, fmt.Errorf("Shard %v: %v", addr, err)
+		}
+		ret.names = append(ret.names, addr)
+		ret.shards = append(ret.shards, db.(*pushDatabaseOpts))
+	}
+	ret.ring = newShardRing(ret.names)
+	return ret, nil
+}
+
+// owner returns the shard where the subscriber of service belongs.
+func (self *shardedPushDatabase) owner(service, subscriber string) int {
+	return self.ring.shard(service + ":" + subscriber)
+}
+
+func (self *shardedPushDatabase) subscribed(i int, service, subscriber string) (bool, error) {
+	dps, err := self.shards[i].db.GetDeliveryPointsNameByServiceSubscriber(service, subscriber)
+	return len(dps[service]) > 0, err
+}
+
+// holder returns the shard holding the subscriptions of the subscriber of
+// service: its owner, unless they are still on another shard. The shards
+// are asked in parallel.
+func (self *shardedPushDatabase) holder(service, subscriber string) (int, error) {
+	owner := self.owner(service, subscriber)
+	found := make([]bool, len(self.shards))
+	err := self.each(func(i int, f *pushDatabaseOpts) (err error) {
+		found[i], err = self.subscribed(i, service, subscriber)
+		return
+	})
+	if err != nil || found[owner] {
+		return owner, err
+	}
+	for i := range self.shards {
+		if found[i] {
+			return i, nil
+		}
+	}
+	return owner, nil
+}
+
+// each calls fn for every shard in parallel, and returns the first error.
+func (self *shardedPushDatabase) each(fn func(i int, f *pushDatabaseOpts) error) error {
+	errs := make([]error, len(self.shards))
+	var wg sync.WaitGroup
+	for i, f := range self.shards {
+		wg.Add(1)
+		go func(i int, f *pushDatabaseOpts) {
+			defer wg.Done()
+			errs[i] = fn(i, f)
+		}(i, f)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicate calls fn for the first shard, then for the others if it
+// succeeded.
+func (self *shardedPushDatabase) replicate(fn func(f *pushDatabaseOpts) error) error {
+	err := fn(self.shards[0])
+	if err != nil {
+		return err
+	}
+	return self.each(func(i int, f *pushDatabaseOpts) error {
+		if i == 0 {
+			return nil
+		}
+		return fn(f)
+	})
+}
+
+func (self *shardedPushDatabase) RemovePushServiceProviderFromService(service string, push_service_provider *PushServiceProvider) error {
+	return self.replicate(func(f *pushDatabaseOpts) error {
+		return f.RemovePushServiceProviderFromService(service, push_service_provider)
+	})
+}
+
+func (self *shardedPushDatabase) AddPushServiceProviderToService(service string,
+	push_service_provider *PushServiceProvider) error {
+	return self.replicate(func(f *pushDatabaseOpts) error {
+		return f.AddPushServiceProviderToService(service, push_service_provider)
+	})
+}
+
+func (self *shardedPushDatabase) ModifyPushServiceProvider(psp *PushServiceProvider) error {
+	return self.replicate(func(f *pushDatabaseOpts) error {
+		return f.ModifyPushServiceProvider(psp)
+	})
+}
+
+func (self *shardedPushDatabase) AddDeliveryPointToService(service string,
+	subscriber string,
+	delivery_point *DeliveryPoint) (*PushServiceProvider, error) {
+	if delivery_point == nil {
+		return nil, nil
+	}
+	i, err := self.holder(service, subscriber)
+	if err != nil {
+		return nil, err
+	}
+	return self.shards[i].AddDeliveryPointToService(service, subscriber, delivery_point)
+}
+
+func (self *shardedPushDatabase) RemoveDeliveryPointFromService(service string,
+	subscriber string,
+	delivery_point *DeliveryPoint) error {
+	i, err := self.holder(service, subscriber)
+	if err != nil {
+		return err
+	}
+	return self.shards[i].RemoveDeliveryPointFromService(service, subscriber, delivery_point)
+}
+
+// ModifyDeliveryPoint changes the delivery point on the shards where
+// it is, as the subscribers using it may be on several shards.
+func (self *shardedPushDatabase) ModifyDeliveryPoint(dp *DeliveryPoint) error {
+	if len(dp.Name()) == 0 {
+		return nil
+	}
+	return self.each(func(i int, f *pushDatabaseOpts) error {
+		old, err := f.db.GetDeliveryPoint(dp.Name())
+		if err != nil || old == nil {
+			return err
+		}
+		return f.ModifyDeliveryPoint(dp)
+	})
+}
+
+func (self *shardedPushDatabase) GetPushServiceProviderDeliveryPointPairs(service string,
+	subscriber string) ([]PushServiceProviderDeliveryPointPair, error) {
+	pairs, err := self.GetPushServiceProviderDeliveryPointPairsBySubscribers(service, []string{subscriber})
+	if err != nil {
+		return nil, err
+	}
+	return pairs[subscriber], nil
+}
+
+// GetPushServiceProviderDeliveryPointPairsBySubscribers asks each shard
+// for its subscribers in parallel, and every shard for wildcards. The
+// subscribers not found are then looked for on the other shards.
+func (self *shardedPushDatabase) GetPushServiceProviderDeliveryPointPairsBySubscribers(service string,
+	subscribers []string) (map[string][]PushServiceProviderDeliveryPointPair, error) {
+	subsOfShards := make([][]string, len(self.shards))
+	owners := make(map[string]int, len(subscribers))
+	for _, sub := range uniqueStrings(subscribers) {
+		if strings.Contains(service, "*") || strings.Contains(sub, "*") {
+			for i := range subsOfShards {
+				subsOfShards[i] = append(subsOfShards[i], sub)
+			}
+			continue
+		}
+		i := self.owner(service, sub)
+		owners[sub] = i
+		subsOfShards[i] = append(subsOfShards[i], sub)
+	}
+	ret := make(map[string][]PushServiceProviderDeliveryPointPair, len(subscribers))
+	err := self.gather(service, subsOfShards, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not moved to their shard yet, or unknown
+	missing := make([][]string, len(self.shards))
+	n := 0
+	for sub, owner := range owners {
+		if len(ret[sub]) > 0 {
+			continue
+		}
+		for i := range missing {
+			if i != owner {
+				missing[i] = append(missing[i], sub)
+			}
+		}
+		n++
+	}
+	if n == 0 || len(self.shards) == 1 {
+		return ret, nil
+	}
+	err = self.gather(service, missing, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// gather adds the pairs of the subscribers subs[i] of shard i to ret.
+func (self *shardedPushDatabase) gather(service string, subs [][]string, ret map[string][]PushServiceProviderDeliveryPointPair) error {
+	var lock sync.Mutex
+	return self.each(func(i int, f *pushDatabaseOpts) error {
+		if len(subs[i]) == 0 {
+			return nil
+		}
+		pairs, err := f.GetPushServiceProviderDeliveryPointPairsBySubscribers(service, subs[i])
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for sub, p := range pairs {
+			if len(p) > 0 {
+				ret[sub] = append(ret[sub], p...)
+			}
+		}
+		return nil
+	})
+}
+
+func (self *shardedPushDatabase) GetPushServiceProviders() ([]*PushServiceProvider, error) {
+	return self.shards[0].GetPushServiceProviders()
+}
+
+func (self *shardedPushDatabase) GetDeliveryPointsByKey(pushServiceType, key string) ([]*DeliveryPoint, error) {
+	var lock sync.Mutex
+	seen := make(map[string]bool)
+	var ret []*DeliveryPoint
+	err := self.each(func(i int, f *pushDatabaseOpts) error {
+		dps, err := f.GetDeliveryPointsByKey(pushServiceType, key)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, dp := range dps {
+			if !seen[dp.Name()] {
+				seen[dp.Name()] = true
+				ret = append(ret, dp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Check rebalances the shards, then checks each one.
+func (self *shardedPushDatabase) Check(fix bool) ([]*DatabaseProblem, error) {
+	problems, err := self.rebalance(fix)
+	if err != nil {
+		return problems, err
+	}
+	for i, f := range self.shards {
+		found, err := f.Check(fix)
+		for _, p := range found {
+			p.Detail = fmt.Sprintf("%v (shard %v)", p.Detail, self.names[i])
+		}
+		problems = append(problems, found...)
+		if err != nil {
+			return problems, fmt.Errorf("Shard %v: %v", self.names[i], err)
+		}
+	}
+	return problems, nil
+}
+
+func (self *shardedPushDatabase) Rebalance() ([]*DatabaseProblem, error) {
+	return self.rebalance(true)
+}
+
+func (self *shardedPushDatabase) rebalance(fix bool) ([]*DatabaseProblem, error) {
+	c := &dbChecker{fix: fix}
+	err := self.checkReplicas(c)
+	if err == nil {
+		err = self.checkPlacement(c)
+	}
+	return c.problems, err
+}
+
+// scanner returns the engine of f, able to list its data.
+func (f *pushDatabaseOpts) scanner() (pushRawDatabaseScanner, error) {
+	db, err := f.engine()
+	if err != nil {
+		return nil, err
+	}
+	scanner, ok := db.(pushRawDatabaseScanner)
+	if !ok {
+		return nil, errors.New("CheckNotSupported")
+	}
+	return scanner, nil
+}
+
+// change runs fn in a transaction, with the locks of a change of srv and
+// peers.
+func (f *pushDatabaseOpts) change(srv string, fn func(db pushRawDatabase) error, peers ...string) error {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	defer f.locks.lock(srv, false, peers...)()
+	return f.transaction(fn)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReplicas compares the push service providers of each shard, and
+// the services using them, to those of the first shard.
+func (self *shardedPushDatabase) checkReplicas(c *dbChecker) error {
+	scanner, err := self.shards[0].scanner()
+	if err != nil {
+		return err
+	}
+	services, err := scanner.GetAllServices()
+	if err != nil {
+		return err
+	}
+	psps := make(map[string]*PushServiceProvider)
+	for _, names := range services {
+		for _, name := range names {
+			if _, ok := psps[name]; ok {
+				continue
+			}
+			psp, err := self.shards[0].db.GetPushServiceProvider(name)
+			if err != nil {
+				return err
+			}
+			psps[name] = psp
+		}
+	}
+
+	for i, f := range self.shards[1:] {
+		f := f
+		shard := self.names[i+1]
+		for name, psp := range psps {
+			if psp == nil {
+				continue
+			}
+			psp := psp
+			other, err := f.db.GetPushServiceProvider(name)
+			if err != nil {
+				return err
+			}
+			if other != nil && bytes.Equal(other.Marshal(), psp.Marshal()) {
+				continue
+			}
+			detail := "Missing on shard " + shard
+			if other != nil {
+				detail = "Differs on shard " + shard
+			}
+			err = c.found(UNREPLICATED_PUSH_SERVICE_PROVIDER, name, detail, func() error {
+				return f.ModifyPushServiceProvider(psp)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		scanner, err := f.scanner()
+		if err != nil {
+			return err
+		}
+		shardServices, err := scanner.GetAllServices()
+		if err != nil {
+			return err
+		}
+		for srv, names := range services {
+			for _, name := range names {
+				if containsString(shardServices[srv], name) {
+					continue
+				}
+				srv, name := srv, name
+				err = c.found(UNREPLICATED_PUSH_SERVICE_PROVIDER, name,
+					fmt.Sprintf("Not in service %v on shard %v", srv, shard), func() error {
+						return f.change(srv, func(db pushRawDatabase) error {
+							return db.AddPushServiceProviderToService(srv, name)
+						}, name)
+					})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for srv, names := range shardServices {
+			for _, name := range names {
+				if containsString(services[srv], name) {
+					continue
+				}
+				srv, name := srv, name
+				err = c.found(UNREPLICATED_PUSH_SERVICE_PROVIDER, name,
+					fmt.Sprintf("In service %v on shard %v only", srv, shard), func() error {
+						return f.change(srv, func(db pushRawDatabase) error {
+							err := db.RemovePushServiceProviderFromService(srv, name)
+							if err != nil || psps[name] != nil {
+								return err
+							}
+							return db.RemovePushServiceProvider(name)
+						}, name)
+					})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type serviceDeliveryPoint struct {
+	srv, dp string
+}
+
+// checkPlacement looks for subscriptions on another shard than the one
+// of their subscriber, and moves them.
+func (self *shardedPushDatabase) checkPlacement(c *dbChecker) error {
+	for i, f := range self.shards {
+		scanner, err := f.scanner()
+		if err != nil {
+			return err
+		}
+		subs, err := scanner.GetAllSubscriptions()
+		if err != nil {
+			return err
+		}
+		mapping, err := scanner.GetAllPushServiceProvidersOfDeliveryPoints()
+		if err != nil {
+			return err
+		}
+		// Subscriptions left on the shard, to know when a delivery point
+		// is not used there anymore
+		uses := make(map[string]int, len(subs))
+		srvUses := make(map[serviceDeliveryPoint]int, len(subs))
+		for _, s := range subs {
+			uses[s.DeliveryPoint]++
+			srvUses[serviceDeliveryPoint{s.Service, s.DeliveryPoint}]++
+		}
+		for _, s := range subs {
+			owner := self.owner(s.Service, s.Subscriber)
+			if owner == i {
+				continue
+			}
+			s, from, to := s, f, self.shards[owner]
+			detail := fmt.Sprintf("Subscriber %v of service %v on shard %v instead of %v",
+				s.Subscriber, s.Service, self.names[i], self.names[owner])
+			err = c.found(MISPLACED_SUBSCRIPTION, s.DeliveryPoint, detail, func() error {
+				k := serviceDeliveryPoint{s.Service, s.DeliveryPoint}
+				uses[s.DeliveryPoint]--
+				srvUses[k]--
+				return moveSubscription(s, mapping[s.Service][s.DeliveryPoint], from, to,
+					srvUses[k] > 0, uses[s.DeliveryPoint] > 0)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moveSubscription writes the subscription s, using the push service
+// provider psp, to the shard to, then removes it from the shard from.
+// The delivery point stays there if still used by another subscriber,
+// of the service or not, and is removed otherwise.
+func moveSubscription(s rawSubscription, psp string, from, to *pushDatabaseOpts, usedByService, used bool) error {
+	dp, err := from.db.GetDeliveryPoint(s.DeliveryPoint)
+	if err != nil {
+		return err
+	}
+	// Without its delivery point, the subscription is only removed
+	if dp != nil {
+		err = to.change(s.Service, func(db pushRawDatabase) error {
+			err := db.SetDeliveryPoint(dp)
+			if err != nil {
+				return err
+			}
+			err = db.AddDeliveryPointToServiceSubscriber(s.Service, s.Subscriber, dp.Name())
+			if err != nil {
+				return err
+			}
+			if psp != "" {
+				err = db.SetPushServiceProviderOfServiceDeliveryPoint(s.Service, dp.Name(), psp)
+				if err != nil {
+					return err
+				}
+			}
+			if key := dp.Key(); key != "" {
+				return db.AddDeliveryPointToKey(deliveryPointKey(dp.PushServiceName(), key), dp.Name())
+			}
+			return nil
+		}, dp.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return from.change(s.Service, func(db pushRawDatabase) error {
+		err := db.RemoveDeliveryPointFromServiceSubscriber(s.Service, s.Subscriber, s.DeliveryPoint)
+		if err != nil || usedByService {
+			return err
+		}
+		err = db.RemovePushServiceProviderOfServiceDeliveryPoint(s.Service, s.DeliveryPoint)
+		if err != nil || used {
+			return err
+		}
+		// Like an unused delivery point found by Check(): its counter
+		// is only trusted to drop it when right.
+		if dp != nil {
+			if key := dp.Key(); key != "" {
+				err = db.RemoveDeliveryPointFromKey(deliveryPointKey(dp.PushServiceName(), key), dp.Name())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if counter, ok := db.(pushRawDatabaseCounter); ok {
+			err = counter.SetDeliveryPointCounter(s.DeliveryPoint, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return db.RemoveDeliveryPoint(s.DeliveryPoint)
+	}, s.DeliveryPoint)
+}
+
+// Export writes the push service providers of the first shard, then the
+// delivery points of each shard. A delivery point used on several shards
+// is written with the subscriptions of each one.
+func (self *shardedPushDatabase) Export(w io.Writer, services []string, redactCredentials bool) (int, error) {
+	return exportSnapshot(w, func(enc *json.Encoder) (int, error) {
+		for _, f := range self.shards {
+			f.dblock.Lock()
+			defer f.dblock.Unlock()
+		}
+		n, err := self.shards[0].export(enc, services, redactCredentials, true, false)
+		for i, f := range self.shards {
+			if err != nil {
+				return n, err
+			}
+			var m int
+			m, err = f.export(enc, services, redactCredentials, false, true)
+			n += m
+			if err != nil {
+				err = fmt.Errorf("Shard %v: %v", self.names[i], err)
+			}
+		}
+		return n, err
+	})
+}
+
+// Import writes the push service providers to all shards, and each
+// delivery point to the shards of its subscriptions: it is counted once
+// per shard, and left out without subscription.
+func (self *shardedPushDatabase) Import(r io.Reader, services []string, dryRun bool) (*ImportStats, error) {
+	stats := new(ImportStats)
+	psps := make(map[string]bool)
+	importers := make([]*importer, len(self.shards))
+	for i, f := range self.shards {
+		importers[i] = &importer{
+			f:      f,
+			filter: services,
+			dryRun: dryRun,
+			psps:   psps,
+			dps:    make(map[string]bool),
+			stats:  stats,
+		}
+	}
+	importers[0].replicas = self.shards[1:]
+
+	// The last delivery point, and the shards it was written to
+	var dp *ExportRecord
+	var written []bool
+	err := readExport(r, func(rec *ExportRecord) error {
+		switch rec.Type {
+		case EXPORT_PUSH_SERVICE_PROVIDER:
+			return importers[0].importPushServiceProvider(rec)
+		case EXPORT_DELIVERY_POINT:
+			dp, written = nil, nil
+			if len(filterServices(services, rec.Services)) == 0 {
+				stats.Skipped++
+				return nil
+			}
+			dp, written = rec, make([]bool, len(self.shards))
+			return nil
+		case EXPORT_SUBSCRIPTION:
+			i := 0
+			if matchServices(services, rec.Service) {
+				var err error
+				i, err = self.holder(rec.Service, rec.Subscriber)
+				if err != nil {
+					return err
+				}
+				if dp != nil && dp.Name == rec.DeliveryPoint && !written[i] {
+					err = importers[i].importDeliveryPoint(dp)
+					if err != nil {
+						return err
+					}
+					written[i] = true
+				}
+			}
+			return importers[i].importSubscription(rec)
+		}
+		return fmt.Errorf("Unknown record type %v", rec.Type)
+	})
+	return stats, err
+}
+
+func (self *shardedPushDatabase) CacheStats() *CacheStats {
+	var ret *CacheStats
+	for _, f := range self.shards {
+		s := f.CacheStats()
+		if s == nil {
+			continue
+		}
+		if ret == nil {
+			ret = new(CacheStats)
+		}
+		ret.Hits += s.Hits
+		ret.Misses += s.Misses
+		ret.Entries += s.Entries
+		ret.Dirty += s.Dirty
+		ret.Flushes += s.Flushes
+	}
+	if ret != nil && ret.Hits+ret.Misses > 0 {
+		ret.HitRatio = float64(ret.Hits) / float64(ret.Hits+ret.Misses)
+	}
+	return ret
+}
+
+func (self *shardedPushDatabase) Backup(w io.Writer) (int64, error) {
+	return 0, errors.New("BackupNotSupported")
+}
+
+func (self *shardedPushDatabase) FlushCache() error {
+	return self.each(func(i int, f *pushDatabaseOpts) error {
+		return f.FlushCache()
+	})
+}
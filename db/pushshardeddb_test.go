@@ -0,0 +1,189 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func subscribersOfShard(t *testing.T, f *pushDatabaseOpts) int {
+	scanner, err := f.scanner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := scanner.GetAllSubscriptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(subs)
+}
+
+func checkSubscribers(t *testing.T, db PushDatabase, subs []string) {
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairsBySubscribers("srv", subs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		if len(pairs[sub]) != 1 {
+			t.Fatalf("%v has %v delivery points", sub, len(pairs[sub]))
+		}
+	}
+	// sub1 and sub10 to sub19
+	if n := numberOfPairs(t, db, "srv", "sub1*"); n != 11 {
+		t.Errorf("Expected 11 delivery points, got %v", n)
+	}
+}
+
+// Shards are redis servers, stood in for by memory databases
+func newMemTestShards(t *testing.T, psm *PushServiceManager, names ...string) *shardedPushDatabase {
+	ret := &shardedPushDatabase{names: names, ring: newShardRing(names)}
+	for range names {
+		ret.shards = append(ret.shards, newMemTestDatabase(t, psm).(*pushDatabaseOpts))
+	}
+	return ret
+}
+
+func TestShardedDatabase(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	sharded := newMemTestShards(t, psm, "a:6379", "b:6379")
+	var db PushDatabase = sharded
+	subs := subscriberNames(100)
+	err := subscribe(db, psm, "srv", subs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range sharded.shards {
+		if n := subscribersOfShard(t, f); n < 30 {
+			t.Errorf("Only %v subscribers on shard %v", n, i)
+		}
+	}
+	checkSubscribers(t, db, subs)
+
+	// A new shard, empty
+	names := append(sharded.names, "c:6379")
+	sharded = &shardedPushDatabase{
+		names:  names,
+		shards: append(sharded.shards, newMemTestDatabase(t, psm).(*pushDatabaseOpts)),
+		ring:   newShardRing(names),
+	}
+	checkSubscribers(t, sharded, subs)
+
+	problems, err := sharded.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for _, p := range problems {
+		if !p.Fixed {
+			t.Errorf("Not fixed: %v", p)
+		}
+		if p.Kind == MISPLACED_SUBSCRIPTION {
+			moved++
+		}
+	}
+	if moved < 20 || moved > 50 {
+		t.Errorf("%v subscribers moved to the new shard", moved)
+	}
+	if n := subscribersOfShard(t, sharded.shards[2]); n != moved {
+		t.Errorf("%v subscribers moved, %v on the new shard", moved, n)
+	}
+	checkSubscribers(t, sharded, subs)
+	problems, err = sharded.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Problems after rebalancing: %v", problems)
+	}
+
+	var buf bytes.Buffer
+	_, err = sharded.Export(&buf, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newMemTestShards(t, psm, "d:6379", "e:6379")
+	stats, err := dst.Import(&buf, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Subscriptions != len(subs) {
+		t.Errorf("Imported %v subscriptions", stats.Subscriptions)
+	}
+	checkSubscribers(t, dst, subs)
+}
+
+func TestRebalanceRemovesMovedDeliveryPoints(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+	sharded := newMemTestShards(t, psm, "a:6379", "b:6379")
+	// Subscribed on the wrong shard, with a counter left too high
+	if err := subscribe(sharded, psm, "srv", nil); err != nil {
+		t.Fatal(err)
+	}
+	wrong := sharded.shards[1-sharded.ring.shard("srv:sub1")]
+	if err := subscribe(wrong, psm, "srv", []string{"sub1"}); err != nil {
+		t.Fatal(err)
+	}
+	raw := wrong.db.(*PushMemoryDB)
+	subs, err := raw.GetAllSubscriptions()
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("Subscriptions %v: %v", subs, err)
+	}
+	if err = raw.SetDeliveryPointCounter(subs[0].DeliveryPoint, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = sharded.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	checkDeliveryPoints := func(f *pushDatabaseOpts, n int) {
+		scanner, err := f.scanner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names, _ := scanner.GetAllDeliveryPoints(); len(names) != n {
+			t.Errorf("Expected %v delivery points, got %v", n, names)
+		}
+	}
+	checkDeliveryPoints(wrong, 0)
+	checkDeliveryPoints(sharded.shards[sharded.ring.shard("srv:sub1")], 1)
+	problems, err := sharded.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Problems after rebalancing: %v", problems)
+	}
+}
+
+func TestShardsOnlyWithRedis(t *testing.T) {
+	for _, engine := range []string{"memory", "bolt", "sqlite"} {
+		_, err := NewPushDatabaseWithoutCache(&DatabaseConfig{
+			Engine: engine,
+			Name:   "uniqush.db",
+			Shards: []string{"a:6379", "b:6379"},
+		})
+		if err == nil {
+			t.Errorf("Shards of %v accepted", engine)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// sqlDialect hides the differences between the SQL databases.
+type sqlDialect struct {
+	driver string
+	// Placeholders are $1, $2... instead of ?
+	numbered bool
+	// Appended to CREATE TABLE
+	tableOptions string
+	// ON CONFLICT ... DO UPDATE instead of ON DUPLICATE KEY UPDATE
+	onConflict bool
+	dsn        func(c *DatabaseConfig) string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": &sqlDialect{
+		driver:     "postgres",
+		numbered:   true,
+		onConflict: true,
+		dsn:        postgresDSN,
+	},
+	"mysql": &sqlDialect{
+		driver: "mysql",
+		// Otherwise, names would not be case sensitive
+		tableOptions: " DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin",
+		dsn:          mysqlDSN,
+	},
+	"sqlite": &sqlDialect{
+		driver:     "sqlite",
+		onConflict: true,
+		// Name is the path of the file
+		dsn: func(c *DatabaseConfig) string { return c.Name },
+	},
+}
+
+// Name may be followed by connection parameters, e.g.
+// uniqush?sslmode=disable
+func postgresDSN(c *DatabaseConfig) string {
+	host := c.Host
+	if c.Port > 0 {
+		host += ":" + strconv.Itoa(c.Port)
+	}
+	if c.User == "" {
+		return fmt.Sprintf("postgres://%v/%v", host, c.Name)
+	}
+	user := url.User(c.User)
+	if c.Password != "" {
+		user = url.UserPassword(c.User, c.Password)
+	}
+	return fmt.Sprintf("postgres://%v@%v/%v", user, host, c.Name)
+}
+
+func mysqlDSN(c *DatabaseConfig) string {
+	port := c.Port
+	if port <= 0 {
+		port = 3306
+	}
+	return fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", c.User, c.Password, c.Host, port, c.Name)
+}
+
+// rebind replaces the ? of query by the placeholders of the dialect.
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	buf := make([]string, 0, 2*len(parts))
+	for i, p := range parts {
+		if i > 0 {
+			buf = append(buf, "$"+strconv.Itoa(i))
+		}
+		buf = append(buf, p)
+	}
+	return strings.Join(buf, "")
+}
+
+// upsert inserts a row, or updates the columns of the existing row with
+// the same keys.
+func (d *sqlDialect) upsert(table string, keys, columns []string) string {
+	all := append(append([]string{}, keys...), columns...)
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(all)), ", ")
+	query := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", table, strings.Join(all, ", "), marks)
+	sets := make([]string, len(columns))
+	for i, col := range columns {
+		if d.onConflict {
+			sets[i] = fmt.Sprintf("%v = excluded.%v", col, col)
+		} else {
+			sets[i] = fmt.Sprintf("%v = VALUES(%v)", col, col)
+		}
+	}
+	if d.onConflict {
+		return fmt.Sprintf("%v ON CONFLICT (%v) DO UPDATE SET %v", query, strings.Join(keys, ", "), strings.Join(sets, ", "))
+	}
+	return fmt.Sprintf("%v ON DUPLICATE KEY UPDATE %v", query, strings.Join(sets, ", "))
+}
+
+// insertIgnore inserts a row, unless it already exists.
+func (d *sqlDialect) insertIgnore(table string, columns []string) string {
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if d.onConflict {
+		return fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v) ON CONFLICT DO NOTHING", table, strings.Join(columns, ", "), marks)
+	}
+	return fmt.Sprintf("INSERT IGNORE INTO %v (%v) VALUES (%v)", table, strings.Join(columns, ", "), marks)
+}
+
+// Implemented by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// PushSQLDB stores the data in a relational schema, see sqlMigrations.
+// The engine is either postgres, mysql or sqlite.
+type PushSQLDB struct {
+	db *sql.DB
+	// Set within Transaction()
+	tx      *sql.Tx
+	dialect *sqlDialect
+	psm     *PushServiceManager
+}
+
+func newPushSQLDB(c *DatabaseConfig) (*PushSQLDB, error) {
+	if c == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	dialect, ok := sqlDialects[strings.ToLower(c.Engine)]
+	if !ok {
+		return nil, errors.New("Unsupported Database Engine")
+	}
+	// Name defaults to the database number of redis
+	if c.Name == "" || c.Name == "0" {
+		return nil, errors.New("NoDatabaseName")
+	}
+	db, err := sql.Open(dialect.driver, dialect.dsn(c))
+	if err != nil {
+		return nil, err
+	}
+	if dialect.driver == "sqlite" {
+		// Writers would fail with "database is locked" otherwise
+		db.SetMaxOpenConns(1)
+	}
+	err = migrateSQLSchema(db, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ret := new(PushSQLDB)
+	ret.db = db
+	ret.dialect = dialect
+	ret.psm = c.PushServiceManager
+	if ret.psm == nil {
+		ret.psm = GetPushServiceManager()
+	}
+	return ret, nil
+}
+
+func (r *PushSQLDB) Close() error {
+	return r.db.Close()
+}
+
+func (r *PushSQLDB) q() sqlQueryer {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+func (r *PushSQLDB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.q().Exec(r.dialect.rebind(query), args...)
+}
+
+// list returns the first column of the rows of the query.
+func (r *PushSQLDB) list(query string, args ...interface{}) ([]string, error) {
+	rows, err := r.q().Query(r.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]string, 0, 8)
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+// value returns the first column of the only row of the query, or nil
+// if there is none.
+func (r *PushSQLDB) value(query string, args ...interface{}) ([]byte, error) {
+	var v []byte
+	err := r.q().QueryRow(r.dialect.rebind(query), args...).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+// Transaction runs fn in one transaction. Nothing is written if fn
+// returns an error.
+func (r *PushSQLDB) Transaction(fn func(db pushRawDatabase) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(&PushSQLDB{db: r.db, tx: tx, dialect: r.dialect, psm: r.psm})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Every statement is already committed.
+func (r *PushSQLDB) FlushCache() error {
+	return nil
+}
+
+func (r *PushSQLDB) GetDeliveryPoint(name string) (*DeliveryPoint, error) {
+	v, err := r.value("SELECT value FROM delivery_points WHERE name = ?", name)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return r.psm.BuildDeliveryPointFromBytes(v)
+}
+
+func (r *PushSQLDB) SetDeliveryPoint(dp *DeliveryPoint) error {
+	query := r.dialect.upsert("delivery_points", []string{"name"}, []string{"push_service_type", "value"})
+	_, err := r.exec(query, dp.Name(), dp.PushServiceName(), string(deliveryPointToValue(dp)))
+	return err
+}
+
+func (r *PushSQLDB) GetPushServiceProvider(name string) (*PushServiceProvider, error) {
+	v, err := r.value("SELECT value FROM push_service_providers WHERE name = ?", name)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return r.psm.BuildPushServiceProviderFromBytes(v)
+}
+
+func (r *PushSQLDB) SetPushServiceProvider(psp *PushServiceProvider) error {
+	query := r.dialect.upsert("push_service_providers", []string{"name"}, []string{"push_service_type", "value"})
+	_, err := r.exec(query, psp.Name(), psp.PushServiceName(), string(pushServiceProviderToValue(psp)))
+	return err
+}
+
+func (r *PushSQLDB) RemoveDeliveryPoint(dp string) error {
+	_, err := r.exec("DELETE FROM delivery_points WHERE name = ?", dp)
+	return err
+}
+
+func (r *PushSQLDB) RemovePushServiceProvider(psp string) error {
+	_, err := r.exec("DELETE FROM push_service_providers WHERE name = ?", psp)
+	return err
+}
+
+// sqlLikePattern turns the wildcards of a service or subscriber into a
+// pattern of LIKE, with ! as the escape character.
+func sqlLikePattern(s string) string {
+	s = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+	return strings.Replace(s, "*", "%", -1)
+}
+
+// Like PushRedisDB, srv and sub may contain wildcards.
+func (r *PushSQLDB) GetDeliveryPointsNameByServiceSubscriber(srv, sub string) (map[string][]string, error) {
+	ret := make(map[string][]string, 1)
+	if !strings.Contains(sub, "*") && !strings.Contains(srv, "*") {
+		dps, err := r.list("SELECT delivery_point FROM subscriptions WHERE service = ? AND subscriber = ?", srv, sub)
+		if err != nil {
+			return nil, err
+		}
+		if len(dps) > 0 {
+			ret[srv] = dps
+		}
+		return ret, nil
+	}
+	rows, err := r.q().Query(r.dialect.rebind("SELECT service, subscriber, delivery_point FROM subscriptions WHERE service LIKE ? ESCAPE '!' AND subscriber LIKE ? ESCAPE '!'"),
+		sqlLikePattern(srv), sqlLikePattern(sub))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s, u, dp string
+		err = rows.Scan(&s, &u, &dp)
+		if err != nil {
+			return nil, err
+		}
+		// LIKE may ignore the case, depending on the database.
+		if ok, _ := path.Match(srv+":"+sub, s+":"+u); !ok {
+			continue
+		}
+		ret[s] = append(ret[s], dp)
+	}
+	return ret, rows.Err()
+}
+
+func (r *PushSQLDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
+	v, err := r.value("SELECT psp FROM service_delivery_points WHERE service = ? AND delivery_point = ?", srv, dp)
+	return string(v), err
+}
+
+func (r *PushSQLDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
+	_, err := r.exec(r.dialect.insertIgnore("subscriptions", []string{"service", "subscriber", "delivery_point"}), srv, sub, dp)
+	return err
+}
+
+// The delivery point is removed once no subscriber uses it. The rows of
+// subscriptions are its reference counter.
+func (r *PushSQLDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
+	res, err := r.exec("DELETE FROM subscriptions WHERE service = ? AND subscriber = ? AND delivery_point = ?", srv, sub, dp)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	_, err = r.exec("DELETE FROM delivery_points WHERE name = ? AND NOT EXISTS (SELECT 1 FROM subscriptions WHERE delivery_point = ?)", dp, dp)
+	return err
+}
+
+func (r *PushSQLDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
+	query := r.dialect.upsert("service_delivery_points", []string{"service", "delivery_point"}, []string{"psp"})
+	_, err := r.exec(query, srv, dp, psp)
+	return err
+}
+
+func (r *PushSQLDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
+	_, err := r.exec("DELETE FROM service_delivery_points WHERE service = ? AND delivery_point = ?", srv, dp)
+	return err
+}
+
+func (r *PushSQLDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
+	ret, err := r.list("SELECT psp FROM service_psps WHERE service = ?", srv)
+	if err != nil || len(ret) == 0 {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *PushSQLDB) GetAllPushServiceProviders() ([]string, error) {
+	return r.list("SELECT name FROM push_service_providers ORDER BY name")
+}
+
+// The service is removed with its last push service provider.
+func (r *PushSQLDB) RemovePushServiceProviderFromService(srv, psp string) error {
+	_, err := r.exec("DELETE FROM service_psps WHERE service = ? AND psp = ?", srv, psp)
+	if err != nil {
+		return err
+	}
+	_, err = r.exec("DELETE FROM services WHERE name = ? AND NOT EXISTS (SELECT 1 FROM service_psps WHERE service = ?)", srv, srv)
+	return err
+}
+
+func (r *PushSQLDB) AddPushServiceProviderToService(srv, psp string) error {
+	_, err := r.exec(r.dialect.insertIgnore("services", []string{"name"}), srv)
+	if err != nil {
+		return err
+	}
+	_, err = r.exec(r.dialect.insertIgnore("service_psps", []string{"service", "psp"}), srv, psp)
+	return err
+}
+
+func (r *PushSQLDB) AddDeliveryPointToKey(key, dp string) error {
+	_, err := r.exec(r.dialect.insertIgnore("delivery_point_keys", []string{"dp_key", "delivery_point"}), key, dp)
+	return err
+}
+
+func (r *PushSQLDB) RemoveDeliveryPointFromKey(key, dp string) error {
+	_, err := r.exec("DELETE FROM delivery_point_keys WHERE dp_key = ? AND delivery_point = ?", key, dp)
+	return err
+}
+
+func (r *PushSQLDB) GetDeliveryPointsNameByKey(key string) ([]string, error) {
+	ret, err := r.list("SELECT delivery_point FROM delivery_point_keys WHERE dp_key = ?", key)
+	if err != nil || len(ret) == 0 {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *PushSQLDB) GetAllDeliveryPoints() ([]string, error) {
+	return r.list("SELECT name FROM delivery_points")
+}
+
+func (r *PushSQLDB) GetAllSubscriptions() ([]rawSubscription, error) {
+	rows, err := r.q().Query("SELECT service, subscriber, delivery_point FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]rawSubscription, 0, 16)
+	for rows.Next() {
+		var s rawSubscription
+		err = rows.Scan(&s.Service, &s.Subscriber, &s.DeliveryPoint)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
+
+func (r *PushSQLDB) GetAllPushServiceProvidersOfDeliveryPoints() (map[string]map[string]string, error) {
+	rows, err := r.q().Query("SELECT service, delivery_point, psp FROM service_delivery_points")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string]map[string]string, 4)
+	for rows.Next() {
+		var srv, dp, psp string
+		err = rows.Scan(&srv, &dp, &psp)
+		if err != nil {
+			return nil, err
+		}
+		if ret[srv] == nil {
+			ret[srv] = make(map[string]string, 16)
+		}
+		ret[srv][dp] = psp
+	}
+	return ret, rows.Err()
+}
+
+func (r *PushSQLDB) GetAllServices() (map[string][]string, error) {
+	rows, err := r.q().Query("SELECT service, psp FROM service_psps")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[string][]string, 4)
+	for rows.Next() {
+		var srv, psp string
+		err = rows.Scan(&srv, &psp)
+		if err != nil {
+			return nil, err
+		}
+		ret[srv] = append(ret[srv], psp)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func TestSQLDatabase(t *testing.T) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(&memTestPushServiceType{})
+
+	dir, err := ioutil.TempDir("", "uniqush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &DatabaseConfig{
+		Engine:             "sqlite",
+		Name:               filepath.Join(dir, "uniqush.sqlite"),
+		PushServiceManager: psm,
+	}
+	db, err := NewPushDatabaseWithoutCache(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := db.(*pushDatabaseOpts).db.(*PushSQLDB)
+	defer raw.Close()
+	version, err := sqlSchemaVersion(raw.db, raw.dialect)
+	if err != nil || version != len(sqlMigrations) {
+		t.Fatalf("Schema version %v (%v), expected %v", version, err, len(sqlMigrations))
+	}
+
+	psp, dp := newMemTestPeers(t, psm)
+	// Two services share the delivery point
+	for _, srv := range []string{"srv", "other"} {
+		err = db.AddPushServiceProviderToService(srv, psp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.AddDeliveryPointToService(srv, "sub", dp)
+		if err != nil {
+			t.Fatalf("Cannot subscribe: %v", err)
+		}
+	}
+	// Subscribing twice changes nothing
+	_, err = db.AddDeliveryPointToService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := db.GetPushServiceProviderDeliveryPointPairs("*", "s*")
+	if err != nil || len(pairs) != 2 {
+		t.Fatalf("Expected 2 delivery points, got %v (%v)", len(pairs), err)
+	}
+	if pairs[0].DeliveryPoint.Name() != dp.Name() || pairs[0].PushServiceProvider.Name() != psp.Name() {
+		t.Errorf("Bad delivery point or push service provider: %+v", pairs[0])
+	}
+	if pairs, _ = db.GetPushServiceProviderDeliveryPointPairs("srv", "S*"); len(pairs) != 0 {
+		t.Errorf("Subscribers should be case sensitive")
+	}
+
+	// Nothing is written by a failed transaction
+	failed := errors.New("failed")
+	err = raw.Transaction(func(tx pushRawDatabase) error {
+		err := tx.RemoveDeliveryPointFromServiceSubscriber("srv", "sub", dp.Name())
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pairs, err = db.GetPushServiceProviderDeliveryPointPairs("srv", "sub")
+	if err != nil || len(pairs) != 1 {
+		t.Fatalf("Transaction not rolled back: %v (%v)", pairs, err)
+	}
+
+	err = db.RemoveDeliveryPointFromService("srv", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d == nil {
+		t.Fatalf("Delivery point deleted while still used")
+	}
+	err = db.RemoveDeliveryPointFromService("other", "sub", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := raw.GetDeliveryPoint(dp.Name()); d != nil {
+		t.Errorf("Unused delivery point not deleted")
+	}
+
+	err = db.RemovePushServiceProviderFromService("srv", psp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := raw.GetPushServiceProvidersByService("srv"); names != nil {
+		t.Errorf("Push service provider not removed: %v", names)
+	}
+
+	// Migrations are not applied twice
+	raw.Close()
+	db, err = NewPushDatabaseWithoutCache(conf)
+	if err != nil {
+		t.Fatalf("Cannot reopen: %v", err)
+	}
+	db.(*pushDatabaseOpts).db.(*PushSQLDB).Close()
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Each migration upgrades the schema by one version. They are applied in
+// order, and must never change once released: append a new one instead.
+//
+// No foreign keys: like with redis, data may be written in any order.
+var sqlMigrations = []func(d *sqlDialect) []string{
+	func(d *sqlDialect) []string {
+		return []string{
+			"CREATE TABLE services (" +
+				"name VARCHAR(255) NOT NULL PRIMARY KEY)" + d.tableOptions,
+			"CREATE TABLE push_service_providers (" +
+				"name VARCHAR(255) NOT NULL PRIMARY KEY, " +
+				"push_service_type VARCHAR(64) NOT NULL, " +
+				"value TEXT NOT NULL)" + d.tableOptions,
+			"CREATE TABLE service_psps (" +
+				"service VARCHAR(255) NOT NULL, " +
+				"psp VARCHAR(255) NOT NULL, " +
+				"PRIMARY KEY (service, psp))" + d.tableOptions,
+			"CREATE TABLE delivery_points (" +
+				"name VARCHAR(255) NOT NULL PRIMARY KEY, " +
+				"push_service_type VARCHAR(64) NOT NULL, " +
+				"value TEXT NOT NULL)" + d.tableOptions,
+			"CREATE TABLE subscriptions (" +
+				"service VARCHAR(255) NOT NULL, " +
+				"subscriber VARCHAR(255) NOT NULL, " +
+				"delivery_point VARCHAR(255) NOT NULL, " +
+				"PRIMARY KEY (service, subscriber, delivery_point))" + d.tableOptions,
+			"CREATE INDEX subscriptions_delivery_point ON subscriptions (delivery_point)",
+			"CREATE TABLE service_delivery_points (" +
+				"service VARCHAR(255) NOT NULL, " +
+				"delivery_point VARCHAR(255) NOT NULL, " +
+				"psp VARCHAR(255) NOT NULL, " +
+				"PRIMARY KEY (service, delivery_point))" + d.tableOptions,
+			"CREATE TABLE delivery_point_keys (" +
+				"dp_key VARCHAR(255) NOT NULL, " +
+				"delivery_point VARCHAR(255) NOT NULL, " +
+				"PRIMARY KEY (dp_key, delivery_point))" + d.tableOptions,
+		}
+	},
+}
+
+// sqlSchemaVersion returns the number of migrations applied to db.
+func sqlSchemaVersion(db *sql.DB, d *sqlDialect) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS uniqush_schema_migrations (" +
+		"version INTEGER NOT NULL PRIMARY KEY)" + d.tableOptions)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM uniqush_schema_migrations").Scan(&version)
+	return version, err
+}
+
+// migrateSQLSchema applies the missing migrations, each in its own
+// transaction. MySQL commits each statement, though.
+func migrateSQLSchema(db *sql.DB, d *sqlDialect) error {
+	version, err := sqlSchemaVersion(db, d)
+	if err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("Database schema version %v is newer than this uniqush-push", version)
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqlMigrations[i](d) {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %v failed: %v", i+1, err)
+			}
+		}
+		_, err = tx.Exec(d.rebind("INSERT INTO uniqush_schema_migrations (version) VALUES (?)"), i+1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,6 +18,9 @@
 package db
 
 import (
+	"io"
+	"strings"
+
 	. "github.com/rafaelbandeira3/uniqush-push/push"
 )
 
@@ -59,6 +62,11 @@ type pushRawDatabaseWriter interface {
 	AddPushServiceProviderToService(srv, psp string) error
 	RemovePushServiceProviderFromService(srv, psp string) error
 
+	// key is the push service type and the key of the delivery point,
+	// See DeliveryPoint.Key()
+	AddDeliveryPointToKey(key, dp string) error
+	RemoveDeliveryPointFromKey(key, dp string) error
+
 	FlushCache() error
 }
 
@@ -71,9 +79,77 @@ type pushRawDatabaseReader interface {
 	GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error)
 
 	GetPushServiceProvidersByService(srv string) ([]string, error)
+	GetDeliveryPointsNameByKey(key string) ([]string, error)
+
+	// Names of all push service providers. This one may be slow.
+	GetAllPushServiceProviders() ([]string, error)
 }
 
 type pushRawDatabase interface {
 	pushRawDatabaseReader
 	pushRawDatabaseWriter
 }
+
+// Engines able to write several changes atomically implement this one.
+// The changes made by fn through db are saved together, or not at all
+// if fn returns an error.
+type pushRawDatabaseTransactor interface {
+	Transaction(fn func(db pushRawDatabase) error) error
+}
+
+// Engines able to read many keys in one round trip implement this one.
+// Results are in the order of the arguments, nil or empty if missing.
+// See batchReaderOf()
+type pushRawDatabaseBatchReader interface {
+	// Unlike GetDeliveryPointsNameByServiceSubscriber, without wildcards
+	GetDeliveryPointsNameByServiceSubscribers(srv string, subs []string) ([][]string, error)
+	GetDeliveryPointsByNames(names []string) ([]*DeliveryPoint, error)
+	GetPushServiceProvidersByNames(names []string) ([]*PushServiceProvider, error)
+	GetPushServiceProviderNamesByServiceDeliveryPoints(srv string, dps []string) ([]string, error)
+}
+
+// Engines able to copy their data while in use implement this one.
+type pushRawDatabaseBackup interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+// A delivery point subscribed by a subscriber of a service
+type rawSubscription struct {
+	Service       string
+	Subscriber    string
+	DeliveryPoint string
+}
+
+// Engines able to list all their data implement this one. It is used to
+// check the database, and these methods may be slow.
+type pushRawDatabaseScanner interface {
+	// Names of all delivery points
+	GetAllDeliveryPoints() ([]string, error)
+	GetAllSubscriptions() ([]rawSubscription, error)
+	// The push service provider of each delivery point of each service:
+	// service -> delivery point -> push service provider
+	GetAllPushServiceProvidersOfDeliveryPoints() (map[string]map[string]string, error)
+	// The push service providers of each service
+	GetAllServices() (map[string][]string, error)
+}
+
+// Engines keeping a reference counter per delivery point implement this
+// one. The counter is the number of subscriptions of the delivery point.
+type pushRawDatabaseCounter interface {
+	GetDeliveryPointCounters() (map[string]int, error)
+	// The counter is deleted if n is 0
+	SetDeliveryPointCounter(dp string, n int) error
+}
+
+// splitServiceKey returns the service and the rest of a key made of
+// prefix, service, ":" and the rest. Service names never contain ":".
+func splitServiceKey(key, prefix string) (srv, rest string, ok bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(key[len(prefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -0,0 +1,560 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisNodes are the servers of a Redis database: a single server, the
+// master found by Sentinel, or the masters of a cluster.
+type redisNodes interface {
+	// node returns the address of the server of key
+	node(key string) string
+	// slot returns the hash slot of key, always 0 outside of a cluster
+	slot(key string) int
+	// get returns a connection to the server at addr, given by node()
+	get(addr string) redis.Conn
+	// masters returns the addresses of all the servers, for the commands
+	// on the whole database, e.g. SCAN.
+	masters() ([]string, error)
+	// failed is told that a command failed with err. It tells whether the
+	// command may succeed if run again, e.g. once the failover is over,
+	// and the server to run it on after an ASK redirection, preceded by
+	// ASKING.
+	failed(err error) (retry bool, ask string)
+	close() error
+}
+
+const (
+	redisNumberOfSlots = 16384
+	// Times a command is run again, see failed()
+	redisRetries    = 3
+	redisRetryDelay = 100 * time.Millisecond
+	// Idle connections older than this are checked before being used
+	redisCheckAfter = 10 * time.Second
+)
+
+// isRedisNetworkError tells whether err is an error of the connection,
+// rather than an error replied by the server.
+func isRedisNetworkError(err error) bool {
+	if err == nil || err == redis.ErrNil {
+		return false
+	}
+	_, ok := err.(redis.Error)
+	return !ok
+}
+
+// redisReplyError returns the first word of the error replied by the
+// server, e.g. MOVED, if any.
+func redisReplyError(err error) (kind string, args []string) {
+	e, ok := err.(redis.Error)
+	if !ok {
+		return "", nil
+	}
+	words := strings.Fields(string(e))
+	if len(words) == 0 {
+		return "", nil
+	}
+	return words[0], words[1:]
+}
+
+// redisRedirection returns the slot and the address of the server given
+// by a MOVED or ASK error of a cluster.
+func redisRedirection(err error) (kind string, slot int, addr string, ok bool) {
+	kind, args := redisReplyError(err)
+	if (kind != "MOVED" && kind != "ASK") || len(args) != 2 {
+		return "", 0, "", false
+	}
+	slot, e := strconv.Atoi(args[0])
+	if e != nil || slot < 0 || slot >= redisNumberOfSlots {
+		return "", 0, "", false
+	}
+	return kind, slot, args[1], true
+}
+
+func redisDialOptions(c *DatabaseConfig, db int) []redis.DialOption {
+	return []redis.DialOption{
+		redis.DialPassword(c.Password),
+		redis.DialDatabase(db),
+		redis.DialConnectTimeout(c.ConnectTimeout),
+		redis.DialReadTimeout(c.ReadTimeout),
+		redis.DialWriteTimeout(c.WriteTimeout),
+	}
+}
+
+func newRedisPool(c *DatabaseConfig, dial func() (redis.Conn, error), test func(conn redis.Conn, t time.Time) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:      c.MaxIdle,
+		MaxActive:    c.MaxActive,
+		Wait:         c.MaxActive > 0,
+		IdleTimeout:  c.IdleTimeout,
+		Dial:         dial,
+		TestOnBorrow: test,
+	}
+}
+
+// pingRedis checks the connections idle for a while.
+func pingRedis(conn redis.Conn, t time.Time) error {
+	if time.Since(t) < redisCheckAfter {
+		return nil
+	}
+	_, err := conn.Do("PING")
+	return err
+}
+
+// redisServer is a single server.
+type redisServer struct {
+	pool *redis.Pool
+}
+
+func newRedisServer(c *DatabaseConfig, db int) *redisServer {
+	addr := fmt.Sprintf("%s:%d", c.Host, c.Port)
+	options := redisDialOptions(c, db)
+	ret := new(redisServer)
+	ret.pool = newRedisPool(c, func() (redis.Conn, error) {
+		return redis.Dial("tcp", addr, options...)
+	}, pingRedis)
+	return ret
+}
+
+func (self *redisServer) node(key string) string {
+	return ""
+}
+
+func (self *redisServer) slot(key string) int {
+	return 0
+}
+
+func (self *redisServer) get(addr string) redis.Conn {
+	return self.pool.Get()
+}
+
+func (self *redisServer) masters() ([]string, error) {
+	return []string{""}, nil
+}
+
+// The broken connection is not reused: try again with another one.
+func (self *redisServer) failed(err error) (bool, string) {
+	return isRedisNetworkError(err), ""
+}
+
+func (self *redisServer) close() error {
+	return self.pool.Close()
+}
+
+// redisSentinelConn is a connection to the master of a generation.
+type redisSentinelConn struct {
+	redis.Conn
+	generation uint64
+}
+
+// redisSentinelMaster is the master monitored by Sentinel under a name.
+// Connections are made to the master known to the first Sentinel that
+// answers. Once a command fails as if the master changed, every
+// connection made before is dropped.
+type redisSentinelMaster struct {
+	sentinels  []string
+	masterName string
+	options    []redis.DialOption
+	// Of the Sentinels, without password nor database
+	sentinelOptions []redis.DialOption
+	generation      uint64
+	pool            *redis.Pool
+}
+
+func newRedisSentinelMaster(c *DatabaseConfig, db int) *redisSentinelMaster {
+	ret := new(redisSentinelMaster)
+	ret.sentinels = c.Sentinels
+	ret.masterName = c.MasterName
+	ret.options = redisDialOptions(c, db)
+	ret.sentinelOptions = []redis.DialOption{
+		redis.DialConnectTimeout(c.ConnectTimeout),
+		redis.DialReadTimeout(c.ReadTimeout),
+		redis.DialWriteTimeout(c.WriteTimeout),
+	}
+	ret.pool = newRedisPool(c, ret.dial, ret.test)
+	return ret
+}
+
+// masterAddr asks the Sentinels for the address of the master.
+func (self *redisSentinelMaster) masterAddr() (string, error) {
+	err := errors.New("NoSentinel")
+	for _, sentinel := range self.sentinels {
+		var conn redis.Conn
+		conn, err = redis.Dial("tcp", sentinel, self.sentinelOptions...)
+		if err != nil {
+			continue
+		}
+		var reply []string
+		reply, err = redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", self.masterName))
+		conn.Close()
+		if err == redis.ErrNil {
+			return "", fmt.Errorf("Unknown master %v", self.masterName)
+		}
+		if err != nil {
+			continue
+		}
+		if len(reply) != 2 {
+			return "", errors.New("Bad reply of SENTINEL")
+		}
+		return reply[0] + ":" + reply[1], nil
+	}
+	return "", err
+}
+
+// isMaster tells whether conn is still connected to a master: after a
+// failover, the Sentinels make the old master a replica.
+func isMaster(conn redis.Conn) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("Bad reply of ROLE")
+	}
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("Not a master but a %v", role)
+	}
+	return nil
+}
+
+func (self *redisSentinelMaster) dial() (redis.Conn, error) {
+	generation := atomic.LoadUint64(&self.generation)
+	addr, err := self.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := redis.Dial("tcp", addr, self.options...)
+	if err != nil {
+		return nil, err
+	}
+	// The Sentinels may not know about the failover yet
+	err = isMaster(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &redisSentinelConn{conn, generation}, nil
+}
+
+func (self *redisSentinelMaster) test(conn redis.Conn, t time.Time) error {
+	if c, ok := conn.(*redisSentinelConn); ok && c.generation != atomic.LoadUint64(&self.generation) {
+		return errors.New("MasterChanged")
+	}
+	if time.Since(t) < redisCheckAfter {
+		return nil
+	}
+	return isMaster(conn)
+}
+
+func (self *redisSentinelMaster) node(key string) string {
+	return ""
+}
+
+func (self *redisSentinelMaster) slot(key string) int {
+	return 0
+}
+
+func (self *redisSentinelMaster) get(addr string) redis.Conn {
+	return self.pool.Get()
+}
+
+func (self *redisSentinelMaster) masters() ([]string, error) {
+	return []string{""}, nil
+}
+
+func (self *redisSentinelMaster) failed(err error) (bool, string) {
+	kind, _ := redisReplyError(err)
+	switch {
+	case isRedisNetworkError(err):
+	case kind == "READONLY", kind == "LOADING", kind == "MASTERDOWN":
+	default:
+		return false, ""
+	}
+	atomic.AddUint64(&self.generation, 1)
+	time.Sleep(redisRetryDelay)
+	return true, ""
+}
+
+func (self *redisSentinelMaster) close() error {
+	return self.pool.Close()
+}
+
+// redisHashTag returns the part of key hashed to find its slot: the
+// hash tag between the first { and the next }, or the whole key.
+func redisHashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// crc16 is the CRC-16/XMODEM of Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func redisSlot(key string) int {
+	return int(crc16(redisHashTag(key)) % redisNumberOfSlots)
+}
+
+// redisCluster is a Redis Cluster, found from the addresses of some of
+// its nodes. The slots are read with CLUSTER SLOTS, again each time a
+// node redirects a command.
+type redisCluster struct {
+	config  *DatabaseConfig
+	seeds   []string
+	options []redis.DialOption
+
+	lock sync.RWMutex
+	// Address of the master of each slot
+	slots [redisNumberOfSlots]string
+	pools map[string]*redis.Pool
+	// When the slots were last read
+	updated time.Time
+}
+
+func newRedisCluster(c *DatabaseConfig) *redisCluster {
+	ret := new(redisCluster)
+	ret.config = c
+	ret.seeds = c.ClusterNodes
+	// A cluster has only the database 0
+	ret.options = redisDialOptions(c, 0)
+	ret.pools = make(map[string]*redis.Pool, len(c.ClusterNodes))
+	return ret
+}
+
+func (self *redisCluster) pool(addr string) *redis.Pool {
+	self.lock.RLock()
+	p, ok := self.pools[addr]
+	self.lock.RUnlock()
+	if ok {
+		return p
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if p, ok = self.pools[addr]; ok {
+		return p
+	}
+	p = newRedisPool(self.config, func() (redis.Conn, error) {
+		return redis.Dial("tcp", addr, self.options...)
+	}, pingRedis)
+	self.pools[addr] = p
+	return p
+}
+
+// parseClusterSlots reads the masters of the slot ranges in a reply of
+// CLUSTER SLOTS.
+func parseClusterSlots(reply []interface{}, slots []string) error {
+	for _, r := range reply {
+		slotRange, err := redis.Values(r, nil)
+		if err != nil {
+			return err
+		}
+		if len(slotRange) < 3 {
+			return errors.New("Bad reply of CLUSTER SLOTS")
+		}
+		start, err := redis.Int(slotRange[0], nil)
+		if err != nil {
+			return err
+		}
+		end, err := redis.Int(slotRange[1], nil)
+		if err != nil {
+			return err
+		}
+		master, err := redis.Values(slotRange[2], nil)
+		if err != nil {
+			return err
+		}
+		if len(master) < 2 {
+			return errors.New("Bad reply of CLUSTER SLOTS")
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return err
+		}
+		if start < 0 || end >= len(slots) || start > end {
+			return errors.New("Bad slot range")
+		}
+		for i := start; i <= end; i++ {
+			slots[i] = fmt.Sprintf("%v:%v", host, port)
+		}
+	}
+	return nil
+}
+
+// update reads the slots from the first node that answers, unless they
+// were read less than redisRetryDelay ago.
+func (self *redisCluster) update() error {
+	self.lock.RLock()
+	recent := time.Since(self.updated) < redisRetryDelay
+	addrs := make([]string, 0, len(self.pools)+len(self.seeds))
+	for addr := range self.pools {
+		addrs = append(addrs, addr)
+	}
+	self.lock.RUnlock()
+	if recent {
+		return nil
+	}
+	addrs = append(addrs, self.seeds...)
+
+	err := errors.New("NoClusterNode")
+	for _, addr := range addrs {
+		conn := self.pool(addr).Get()
+		var reply []interface{}
+		reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		slots := make([]string, redisNumberOfSlots)
+		err = parseClusterSlots(reply, slots)
+		if err != nil {
+			continue
+		}
+		self.lock.Lock()
+		copy(self.slots[:], slots)
+		self.updated = time.Now()
+		self.lock.Unlock()
+		return nil
+	}
+	return err
+}
+
+func (self *redisCluster) node(key string) string {
+	slot := redisSlot(key)
+	self.lock.RLock()
+	addr := self.slots[slot]
+	self.lock.RUnlock()
+	if addr != "" {
+		return addr
+	}
+	// Not read yet, or not served. A node will redirect us.
+	self.update()
+	self.lock.RLock()
+	addr = self.slots[slot]
+	self.lock.RUnlock()
+	if addr == "" && len(self.seeds) > 0 {
+		addr = self.seeds[0]
+	}
+	return addr
+}
+
+func (self *redisCluster) slot(key string) int {
+	return redisSlot(key)
+}
+
+func (self *redisCluster) get(addr string) redis.Conn {
+	return self.pool(addr).Get()
+}
+
+func (self *redisCluster) masters() ([]string, error) {
+	self.lock.RLock()
+	empty := self.updated.IsZero()
+	self.lock.RUnlock()
+	if empty {
+		err := self.update()
+		if err != nil {
+			return nil, err
+		}
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	seen := make(map[string]bool, 8)
+	ret := make([]string, 0, 8)
+	for _, addr := range self.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			ret = append(ret, addr)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("NoClusterNode")
+	}
+	return ret, nil
+}
+
+// During a resharding, ASK redirects the commands on the keys already
+// migrated, for this command only: the slot stays where it is.
+func (self *redisCluster) failed(err error) (bool, string) {
+	if kind, slot, addr, ok := redisRedirection(err); ok {
+		if kind == "ASK" {
+			return true, addr
+		}
+		self.lock.Lock()
+		self.slots[slot] = addr
+		self.lock.Unlock()
+		// Others slots probably moved too
+		go self.update()
+		return true, ""
+	}
+	kind, _ := redisReplyError(err)
+	switch {
+	case isRedisNetworkError(err):
+		// The node may have failed over to a replica
+		time.Sleep(redisRetryDelay)
+		self.update()
+	case kind == "TRYAGAIN", kind == "CLUSTERDOWN":
+		time.Sleep(redisRetryDelay)
+	default:
+		return false, ""
+	}
+	return true, ""
+}
+
+func (self *redisCluster) close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, p := range self.pools {
+		p.Close()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package fakeprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+const (
+	admAccessToken     string = "fake-access-token"
+	admMessagesPrefix  string = "/messaging/registrations/"
+	admMessagesSuffix  string = "/messages"
+	admTokenPath       string = "/auth/O2/token"
+	admTokenExpiration int    = 3600
+)
+
+// ADM emulates the token and messaging servers of ADM.
+type ADM struct {
+	recorder
+	server *httptest.Server
+	nextId int
+}
+
+func NewADM() *ADM {
+	ret := new(ADM)
+	ret.recorder = newRecorder()
+	ret.server = httptest.NewServer(http.HandlerFunc(ret.serve))
+	return ret
+}
+
+// TokenURL is the tokenurl of ADM push service providers.
+func (self *ADM) TokenURL() string {
+	return self.server.URL + admTokenPath
+}
+
+// ServiceURL is the serviceurl of ADM push service providers.
+func (self *ADM) ServiceURL() string {
+	return self.server.URL + admMessagesPrefix
+}
+
+func (self *ADM) Close() {
+	self.server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (self *ADM) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == admTokenPath {
+		self.serveToken(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, admMessagesPrefix) || !strings.HasSuffix(r.URL.Path, admMessagesSuffix) {
+		http.NotFound(w, r)
+		return
+	}
+	regid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, admMessagesPrefix), admMessagesSuffix)
+
+	if r.Header.Get("Authorization") != "Bearer "+admAccessToken {
+		writeJSON(w, 401, map[string]string{"reason": "AccessTokenExpired"})
+		return
+	}
+	if status := self.nextFailure(); status != 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(status)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	o := self.receive(regid, body)
+	if o.Error != "" {
+		writeJSON(w, 400, map[string]string{"reason": o.Error})
+		return
+	}
+	self.lock.Lock()
+	self.nextId++
+	w.Header().Set("x-amzn-RequestId", fmt.Sprintf("fake-%d", self.nextId))
+	self.lock.Unlock()
+	if o.CanonicalID != "" {
+		regid = o.CanonicalID
+	}
+	writeJSON(w, 200, map[string]string{"registrationID": regid})
+}
+
+func (self *ADM) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") == "" || r.FormValue("client_secret") == "" {
+		writeJSON(w, 401, map[string]string{
+			"error":             "invalid_client",
+			"error_description": "Client authentication failed",
+		})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"access_token": admAccessToken,
+		"expires_in":   admTokenExpiration,
+		"scope":        "messaging:push",
+		"token_type":   "bearer",
+	})
+}
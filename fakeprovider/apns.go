@@ -0,0 +1,223 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package fakeprovider
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+type apnsFeedback struct {
+	token string
+	at    time.Time
+}
+
+// APNS emulates the gateway and the feedback service of APNS, with the
+// binary protocol. Its certificate is self-signed, so push service
+// providers need skipverify=true.
+type APNS struct {
+	recorder
+	certPEM  []byte
+	keyPEM   []byte
+	gateway  net.Listener
+	feedback net.Listener
+
+	feedbackLock sync.Mutex
+	unsubscribed []*apnsFeedback
+}
+
+func NewAPNS() (*APNS, error) {
+	ret := new(APNS)
+	ret.recorder = newRecorder()
+	var err error
+	ret.certPEM, ret.keyPEM, err = selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(ret.certPEM, ret.keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	ret.gateway, err = tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		return nil, err
+	}
+	ret.feedback, err = tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		ret.gateway.Close()
+		return nil, err
+	}
+	go ret.acceptLoop(ret.gateway, ret.serveGateway)
+	go ret.acceptLoop(ret.feedback, ret.serveFeedback)
+	return ret, nil
+}
+
+// Addr is the addr of APNS push service providers.
+func (self *APNS) Addr() string {
+	return self.gateway.Addr().String()
+}
+
+// FeedbackAddr is the feedbackaddr of APNS push service providers.
+func (self *APNS) FeedbackAddr() string {
+	return self.feedback.Addr().String()
+}
+
+// CertificatePEM returns the certificate and the private key of the
+// fake. Any client certificate is accepted, so they may also be used
+// as the credentials of push service providers.
+func (self *APNS) CertificatePEM() (cert, key string) {
+	return string(self.certPEM), string(self.keyPEM)
+}
+
+// AddFeedback makes the feedback service report token, given in hex,
+// as unreachable since at. It is reported once.
+func (self *APNS) AddFeedback(token string, at time.Time) {
+	self.feedbackLock.Lock()
+	defer self.feedbackLock.Unlock()
+	self.unsubscribed = append(self.unsubscribed, &apnsFeedback{token: token, at: at})
+}
+
+func (self *APNS) Close() {
+	self.gateway.Close()
+	self.feedback.Close()
+}
+
+func (self *APNS) acceptLoop(l net.Listener, serve func(net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go serve(conn)
+	}
+}
+
+// serveGateway reads notifications with command 1 until one fails. It
+// then sends an error frame and closes the connection, like APNS.
+func (self *APNS) serveGateway(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var header struct {
+			Cmd      uint8
+			Id       uint32
+			Expiry   uint32
+			TokenLen uint16
+		}
+		err := binary.Read(conn, binary.BigEndian, &header)
+		if err != nil {
+			return
+		}
+		if header.Cmd != 1 {
+			// Processing error
+			self.writeError(conn, 1, 0)
+			return
+		}
+		token := make([]byte, int(header.TokenLen))
+		_, err = io.ReadFull(conn, token)
+		if err != nil {
+			return
+		}
+		var payloadLen uint16
+		err = binary.Read(conn, binary.BigEndian, &payloadLen)
+		if err != nil {
+			return
+		}
+		payload := make([]byte, int(payloadLen))
+		_, err = io.ReadFull(conn, payload)
+		if err != nil {
+			return
+		}
+		o := self.receive(hex.EncodeToString(token), payload)
+		if o.Status != 0 {
+			self.writeError(conn, o.Status, header.Id)
+			return
+		}
+	}
+}
+
+func (self *APNS) writeError(conn net.Conn, status uint8, id uint32) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint8(8))
+	binary.Write(buf, binary.BigEndian, status)
+	binary.Write(buf, binary.BigEndian, id)
+	conn.Write(buf.Bytes())
+}
+
+func (self *APNS) serveFeedback(conn net.Conn) {
+	defer conn.Close()
+	self.feedbackLock.Lock()
+	unsubscribed := self.unsubscribed
+	self.unsubscribed = nil
+	self.feedbackLock.Unlock()
+
+	buf := new(bytes.Buffer)
+	for _, f := range unsubscribed {
+		token, err := hex.DecodeString(f.token)
+		if err != nil {
+			continue
+		}
+		binary.Write(buf, binary.BigEndian, uint32(f.at.Unix()))
+		binary.Write(buf, binary.BigEndian, uint16(len(token)))
+		buf.Write(token)
+	}
+	conn.Write(buf.Bytes())
+}
+
+func selfSignedCertificate() (certPEM, keyPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fakeprovider"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package fakeprovider emulates the servers of GCM, ADM and APNS on
+// localhost, so that uniqush can be tested end to end offline.
+//
+// Every message is accepted unless an Outcome was set for its token
+// (registration id or device token) or the next requests were told to
+// fail with FailNext(). Point the push service providers to the fakes
+// with serviceurl, tokenurl, addr and feedbackaddr, or with the
+// Endpoints section of the configuration.
+package fakeprovider
+
+import (
+	"sync"
+)
+
+// Outcome of the messages sent to a token
+type Outcome struct {
+	// GCM or ADM error, e.g. NotRegistered or InvalidRegistrationId
+	Error string
+
+	// The new token reported by GCM or ADM, i.e. the canonical id
+	CanonicalID string
+
+	// Status of the error frame sent by APNS, e.g. 8 for an invalid
+	// token. The connection is closed afterwards.
+	Status uint8
+}
+
+// A message received by a fake provider
+type Message struct {
+	Token string
+
+	// The body of the request, or the payload of the APNS notification
+	Payload []byte
+}
+
+type recorder struct {
+	lock     sync.Mutex
+	outcomes map[string]*Outcome
+	failures []int
+	messages []*Message
+}
+
+func newRecorder() recorder {
+	return recorder{outcomes: make(map[string]*Outcome, 10)}
+}
+
+// SetOutcome sets the outcome of the messages sent to token.
+func (self *recorder) SetOutcome(token string, o Outcome) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.outcomes[token] = &o
+}
+
+// FailNext makes the next n requests fail with the HTTP status, e.g.
+// 503. APNS does not use it.
+func (self *recorder) FailNext(n int, status int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i := 0; i < n; i++ {
+		self.failures = append(self.failures, status)
+	}
+}
+
+// Messages returns the messages received so far, including failed
+// ones.
+func (self *recorder) Messages() []*Message {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := make([]*Message, len(self.messages))
+	copy(ret, self.messages)
+	return ret
+}
+
+// nextFailure returns the status of the next failure, or 0.
+func (self *recorder) nextFailure() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.failures) == 0 {
+		return 0
+	}
+	status := self.failures[0]
+	self.failures = self.failures[1:]
+	return status
+}
+
+// receive records a message and returns the outcome of its token.
+func (self *recorder) receive(token string, payload []byte) Outcome {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.messages = append(self.messages, &Message{Token: token, Payload: payload})
+	if o, ok := self.outcomes[token]; ok {
+		return *o
+	}
+	return Outcome{}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package fakeprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// GCM emulates the HTTP server of GCM.
+type GCM struct {
+	recorder
+	server *httptest.Server
+	nextId int
+}
+
+func NewGCM() *GCM {
+	ret := new(GCM)
+	ret.recorder = newRecorder()
+	ret.server = httptest.NewServer(http.HandlerFunc(ret.serve))
+	return ret
+}
+
+// URL is the serviceurl of GCM push service providers.
+func (self *GCM) URL() string {
+	return self.server.URL + "/gcm/send"
+}
+
+func (self *GCM) Close() {
+	self.server.Close()
+}
+
+func (self *GCM) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/gcm/send" {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "key=") {
+		w.WriteHeader(401)
+		return
+	}
+	if status := self.nextFailure(); status != 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(status)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var msg struct {
+		RegIDs []string `json:"registration_ids"`
+	}
+	err = json.Unmarshal(body, &msg)
+	if err != nil || len(msg.RegIDs) == 0 {
+		w.WriteHeader(400)
+		return
+	}
+
+	var result struct {
+		MulticastID  uint64              `json:"multicast_id"`
+		Success      uint                `json:"success"`
+		Failure      uint                `json:"failure"`
+		CanonicalIDs uint                `json:"canonical_ids"`
+		Results      []map[string]string `json:"results"`
+	}
+	for _, regid := range msg.RegIDs {
+		o := self.receive(regid, body)
+		res := make(map[string]string, 2)
+		if o.Error != "" {
+			res["error"] = o.Error
+			result.Failure++
+		} else {
+			self.lock.Lock()
+			self.nextId++
+			res["message_id"] = fmt.Sprintf("0:%d", self.nextId)
+			self.lock.Unlock()
+			result.Success++
+			if o.CanonicalID != "" {
+				res["registration_id"] = o.CanonicalID
+				result.CanonicalIDs++
+			}
+		}
+		result.Results = append(result.Results, res)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&result)
+}
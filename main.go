@@ -21,12 +21,22 @@ import (
 	"flag"
 	"fmt"
 	. "github.com/rafaelbandeira3/uniqush-push/srv"
+	"io"
 	"os"
 	"runtime"
+	"strings"
 )
 
 var uniqushPushConfFlags = flag.String("config", "/etc/uniqush/uniqush-push.conf", "Config file path")
 var uniqushPushShowVersionFlag = flag.Bool("version", false, "Version info")
+var uniqushPushFsckFlag = flag.Bool("fsck", false, "Check the database and exit")
+var uniqushPushFixFlag = flag.Bool("fix", false, "With -fsck, repair the problems found")
+var uniqushPushRebalanceFlag = flag.Bool("rebalance", false, "Move the subscriptions to their shards and exit")
+var uniqushPushExportFlag = flag.String("export", "", "Export the database to this file (- for stdout) and exit")
+var uniqushPushImportFlag = flag.String("import", "", "Import this file (- for stdin) into the database and exit")
+var uniqushPushServicesFlag = flag.String("services", "", "With -export or -import, comma separated services to keep, possibly with wildcards")
+var uniqushPushRedactFlag = flag.Bool("redact", false, "With -export, leave out the credentials of push service providers")
+var uniqushPushDryRunFlag = flag.Bool("dryrun", false, "With -import, check the file without writing anything")
 
 var uniqushPushVersion = "uniqush-push 1.5.2"
 
@@ -35,6 +45,11 @@ func installPushSrvices() {
 	InstallC2DM()
 	InstallAPNS()
 	InstallADM()
+	InstallSMTP()
+	InstallMQTT()
+	InstallLive()
+	InstallHMS()
+	InstallSNS()
 }
 
 func main() {
@@ -46,6 +61,76 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU() + 1)
 	installPushSrvices()
 
+	if *uniqushPushFsckFlag {
+		n, err := Fsck(*uniqushPushConfFlags, *uniqushPushFixFlag, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot check the database: %v\n", err)
+			os.Exit(2)
+		}
+		if n > 0 && !*uniqushPushFixFlag {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *uniqushPushRebalanceFlag {
+		n, err := Rebalance(*uniqushPushConfFlags, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rebalance the database: %v\n", err)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "%v changes\n", n)
+		return
+	}
+
+	var services []string
+	if *uniqushPushServicesFlag != "" {
+		services = strings.Split(*uniqushPushServicesFlag, ",")
+	}
+	if *uniqushPushExportFlag != "" {
+		var out io.WriteCloser = os.Stdout
+		if *uniqushPushExportFlag != "-" {
+			f, err := os.Create(*uniqushPushExportFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot export: %v\n", err)
+				os.Exit(2)
+			}
+			out = f
+		}
+		n, err := Export(*uniqushPushConfFlags, services, *uniqushPushRedactFlag, out)
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot export: %v\n", err)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %v records\n", n)
+		return
+	}
+	if *uniqushPushImportFlag != "" {
+		var in io.ReadCloser = os.Stdin
+		if *uniqushPushImportFlag != "-" {
+			f, err := os.Open(*uniqushPushImportFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot import: %v\n", err)
+				os.Exit(2)
+			}
+			in = f
+		}
+		defer in.Close()
+		stats, err := Import(*uniqushPushConfFlags, services, *uniqushPushDryRunFlag, in)
+		if stats != nil {
+			fmt.Fprintf(os.Stderr, "%v push service providers, %v delivery points, %v subscriptions, %v skipped\n",
+				stats.PushServiceProviders, stats.DeliveryPoints, stats.Subscriptions, stats.Skipped)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot import: %v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	err := Run(*uniqushPushConfFlags, uniqushPushVersion)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot start: %v\n", err)
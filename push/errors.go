@@ -213,3 +213,43 @@ func (e *ConnectionError) Error() string {
 func NewConnectionError(err error) error {
 	return &ConnectionError{Err: err}
 }
+
+/*********************/
+
+// The delivery point is not reachable right now. Unlike RetryError,
+// retrying is pointless until the device comes back, so callers may
+// want to fall back to other delivery points.
+type OfflineError struct {
+	Destination *DeliveryPoint
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("Offline %v", e.Destination.Name())
+}
+
+func NewOfflineError(dp *DeliveryPoint) error {
+	return &OfflineError{Destination: dp}
+}
+
+/*********************/
+
+// Feedback of a push service: the delivery points with the key (See
+// DeliveryPointKeyer) are unreachable through the provider since the
+// timestamp, e.g. the app was uninstalled.
+type FeedbackUpdate struct {
+	Provider  *PushServiceProvider
+	Key       string
+	Timestamp time.Time
+}
+
+func (e *FeedbackUpdate) Error() string {
+	return fmt.Sprintf("Feedback %v: %v unreachable since %v", e.Provider.Name(), e.Key, e.Timestamp)
+}
+
+func NewFeedbackUpdate(psp *PushServiceProvider, key string, timestamp time.Time) error {
+	return &FeedbackUpdate{
+		Provider:  psp,
+		Key:       key,
+		Timestamp: timestamp,
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type PushPeer struct {
+	// Name() is computed once, maybe by several goroutines
+	nameLock        sync.Mutex
 	name            string
 	pushServiceType PushServiceType
 	VolatileData    map[string]string
@@ -72,6 +75,8 @@ func (p *PushPeer) copyPushPeer(dst *PushPeer) {
 }
 
 func (p *PushPeer) Name() string {
+	p.nameLock.Lock()
+	defer p.nameLock.Unlock()
 	if p.name != "" {
 		return p.name
 	}
@@ -95,7 +100,9 @@ func (p *PushPeer) clear() {
 	for k, _ := range p.VolatileData {
 		delete(p.VolatileData, k)
 	}
+	p.nameLock.Lock()
 	p.name = ""
+	p.nameLock.Unlock()
 }
 
 func (p *PushPeer) Marshal() []byte {
@@ -144,6 +151,16 @@ func NewEmptyDeliveryPoint() *DeliveryPoint {
 	return ret
 }
 
+// Key returns how the push service refers to the delivery point, or an
+// empty string if its push service type does not tell.
+// See DeliveryPointKeyer
+func (dp *DeliveryPoint) Key() string {
+	if keyer, ok := dp.pushServiceType.(DeliveryPointKeyer); ok {
+		return keyer.DeliveryPointKey(dp)
+	}
+	return ""
+}
+
 type PushServiceProvider struct {
 	PushPeer
 }
@@ -153,3 +170,13 @@ func NewEmptyPushServiceProvider() *PushServiceProvider {
 	psp.InitPushPeer()
 	return psp
 }
+
+// CredentialFields returns the keys of the data of psp holding
+// secrets, if its push service type tells.
+// See CredentialHolder
+func (psp *PushServiceProvider) CredentialFields() []string {
+	if holder, ok := psp.pushServiceType.(CredentialHolder); ok {
+		return holder.CredentialFields()
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 type serviceType struct {
@@ -70,6 +71,13 @@ func (m *PushServiceManager) RegisterPushServiceType(pt PushServiceType) error {
 	return nil
 }
 
+// IsRegistered tells whether the push service type called name was
+// registered.
+func (m *PushServiceManager) IsRegistered(name string) bool {
+	_, ok := m.serviceTypes[name]
+	return ok
+}
+
 func (m *PushServiceManager) BuildPushServiceProviderFromMap(kv map[string]string) (psp *PushServiceProvider, err error) {
 	if ptname, ok := kv["pushservicetype"]; ok {
 		if pair, ok := m.serviceTypes[ptname]; ok {
@@ -177,6 +185,26 @@ func (m *PushServiceManager) BuildDeliveryPointFromBytes(value []byte) (dp *Deli
 	return nil, errors.New("No Push Service Type Specified")
 }
 
+// CredentialExpiry returns when the credentials of psp expire. ok is
+// false if its push service type cannot tell.
+func (m *PushServiceManager) CredentialExpiry(psp *PushServiceProvider) (expiry time.Time, ok bool, err error) {
+	if inspector, isInspector := psp.pushServiceType.(CredentialInspector); isInspector {
+		expiry, err = inspector.CredentialExpiry(psp)
+		ok = true
+	}
+	return
+}
+
+// CheckFeedback asks the push service which delivery points of psp are
+// unreachable. It returns nothing if its push service type has no
+// feedback.
+func (m *PushServiceManager) CheckFeedback(psp *PushServiceProvider) ([]*FeedbackUpdate, error) {
+	if checker, ok := psp.pushServiceType.(FeedbackChecker); ok {
+		return checker.CheckFeedback(psp)
+	}
+	return nil, nil
+}
+
 func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
 	wg := new(sync.WaitGroup)
 
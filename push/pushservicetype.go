@@ -17,7 +17,10 @@
 
 package push
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type PushResult struct {
 	Provider    *PushServiceProvider
@@ -76,3 +79,33 @@ type PushServiceType interface {
 
 	Finalize()
 }
+
+// A push service type may also implement CredentialInspector if the
+// credentials of its push service providers expire, e.g. the
+// certificates of APNS.
+type CredentialInspector interface {
+	// Returns the time after which the credentials are no longer valid
+	CredentialExpiry(psp *PushServiceProvider) (time.Time, error)
+}
+
+// A push service type may implement DeliveryPointKeyer if the push
+// service refers to delivery points with a key of its own, e.g. the
+// device tokens in the feedback of APNS.
+type DeliveryPointKeyer interface {
+	DeliveryPointKey(dp *DeliveryPoint) string
+}
+
+// A push service type may implement CredentialHolder if its push
+// service providers store secrets, e.g. API keys, so that they can be
+// left out of exports.
+type CredentialHolder interface {
+	// Keys of the fixed or volatile data holding secrets
+	CredentialFields() []string
+}
+
+// A push service type may implement FeedbackChecker if the push service
+// reports unreachable delivery points out of band, e.g. the feedback
+// service of APNS.
+type FeedbackChecker interface {
+	CheckFeedback(psp *PushServiceProvider) ([]*FeedbackUpdate, error)
+}
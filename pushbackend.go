@@ -18,9 +18,12 @@
 package main
 
 import (
+	"io"
+
 	. "github.com/rafaelbandeira3/uniqush-push/db"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
 	. "github.com/uniqush/log"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -30,6 +33,7 @@ type PushBackEnd struct {
 	db      PushDatabase
 	loggers []Logger
 	errChan chan error
+	monitor *CredentialMonitor
 }
 
 func (self *PushBackEnd) Finalize() {
@@ -48,11 +52,28 @@ func NewPushBackEnd(psm *PushServiceManager, database PushDatabase, loggers []Lo
 	return ret
 }
 
+// MonitorCredentials starts to check the credentials of push service
+// providers with m.
+func (self *PushBackEnd) MonitorCredentials(m *CredentialMonitor) {
+	self.monitor = m
+	go m.Run()
+}
+
+func (self *PushBackEnd) CredentialStatus() []*CredentialStatus {
+	if self.monitor == nil {
+		return nil
+	}
+	return self.monitor.Status()
+}
+
 func (self *PushBackEnd) AddPushServiceProvider(service string, psp *PushServiceProvider) error {
 	err := self.db.AddPushServiceProviderToService(service, psp)
 	if err != nil {
 		return err
 	}
+	if self.monitor != nil {
+		self.monitor.Check(psp)
+	}
 	return nil
 }
 
@@ -61,10 +82,15 @@ func (self *PushBackEnd) RemovePushServiceProvider(service string, psp *PushServ
 	if err != nil {
 		return err
 	}
+	if self.monitor != nil {
+		self.monitor.Forget(psp)
+	}
 	return nil
 }
 
 func (self *PushBackEnd) Subscribe(service, sub string, dp *DeliveryPoint) (*PushServiceProvider, error) {
+	// Feedback received before this moment does not apply to dp.
+	dp.VolatileData["subscribedat"] = strconv.FormatInt(time.Now().Unix(), 10)
 	psp, err := self.db.AddDeliveryPointToService(service, sub, dp)
 	if err != nil {
 		return nil, err
@@ -118,9 +144,15 @@ func (self *PushBackEnd) fixError(reqId string, event error, logger Logger, afte
 			logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed after retry", reqId, service, sub, err.Provider.Name(), err.Destination.Name())
 			return nil
 		}
-		logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Retry after %v", reqId, service, sub, err.Provider.Name(), err.Destination.Name(), after)
+		// The push service may ask to wait longer, e.g. with
+		// Retry-After.
+		delay := after
+		if err.After > delay {
+			delay = err.After
+		}
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Retry after %v", reqId, service, sub, err.Provider.Name(), err.Destination.Name(), delay)
 		go func() {
-			<-time.After(after)
+			<-time.After(delay)
 			subs := make([]string, 1)
 			subs[0] = sub
 			after = 2 * after
@@ -171,12 +203,116 @@ func (self *PushBackEnd) fixError(reqId string, event error, logger Logger, afte
 		} else {
 			logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribe success", service, sub, dp.Name())
 		}
+	case *OfflineError:
+		if err.Destination == nil {
+			return nil
+		}
+		if sub, ok = err.Destination.FixedData["subscriber"]; !ok {
+			return nil
+		}
+		service = err.Destination.FixedData["service"]
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v Offline", reqId, service, sub, err.Destination.Name())
+	case *FeedbackUpdate:
+		if err.Provider == nil {
+			return nil
+		}
+		if service, ok = err.Provider.FixedData["service"]; !ok {
+			return nil
+		}
+		self.processFeedback(service, err, logger)
+	case *BadPushServiceProvider:
+		if self.monitor != nil {
+			self.monitor.ReportFailure(err.Provider, err)
+		}
+		return err
 	default:
 		return err
 	}
 	return nil
 }
 
+// processFeedback unsubscribes the delivery points of the service
+// reported unreachable by the feedback, unless they subscribed again
+// after it.
+func (self *PushBackEnd) processFeedback(service string, feedback *FeedbackUpdate, logger Logger) {
+	dps, err := self.db.GetDeliveryPointsByKey(feedback.Provider.PushServiceName(), feedback.Key)
+	if err != nil {
+		logger.Errorf("Service=%v PushServiceProvider=%v Feedback=%v Failed: Database Error %v", service, feedback.Provider.Name(), feedback.Key, err)
+		return
+	}
+	for _, dp := range dps {
+		if dp.FixedData["service"] != service {
+			continue
+		}
+		sub := dp.FixedData["subscriber"]
+		at, e := strconv.ParseInt(dp.VolatileData["subscribedat"], 10, 64)
+		if e == nil && at > feedback.Timestamp.Unix() {
+			logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Subscribed again after the feedback of %v", service, sub, dp.Name(), feedback.Timestamp)
+			continue
+		}
+		e = self.Unsubscribe(service, sub, dp)
+		if e != nil {
+			logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribe failed: %v", service, sub, dp.Name(), e)
+		} else {
+			logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribe success (feedback)", service, sub, dp.Name())
+		}
+	}
+}
+
+// CheckFeedback asks the push services of the service which delivery
+// points are unreachable, and unsubscribes them. It returns the number
+// of feedback entries received.
+func (self *PushBackEnd) CheckFeedback(service string, logger Logger) (int, error) {
+	psps, err := self.db.GetPushServiceProviders()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, psp := range psps {
+		if psp.FixedData["service"] != service {
+			continue
+		}
+		updates, err := self.psm.CheckFeedback(psp)
+		if err != nil {
+			logger.Errorf("Service=%v PushServiceProvider=%v Cannot check feedback: %v", service, psp.Name(), err)
+			continue
+		}
+		for _, update := range updates {
+			self.processFeedback(service, update, logger)
+		}
+		n += len(updates)
+	}
+	return n, nil
+}
+
+// Backup writes a copy of the database to w, while it is in use.
+func (self *PushBackEnd) Backup(w io.Writer) (int64, error) {
+	return self.db.Backup(w)
+}
+
+// CheckDatabase looks for inconsistencies in the database, and repairs
+// them if fix is true.
+func (self *PushBackEnd) CheckDatabase(fix bool) ([]*DatabaseProblem, error) {
+	return self.db.Check(fix)
+}
+
+// CacheStats returns the statistics of the cache in front of the
+// database, or nil if there is none.
+func (self *PushBackEnd) CacheStats() *CacheStats {
+	return self.db.CacheStats()
+}
+
+// ExportDatabase writes the data of services, or of all of them, to w
+// as JSON Lines.
+func (self *PushBackEnd) ExportDatabase(w io.Writer, services []string, redactCredentials bool) (int, error) {
+	return self.db.Export(w, services, redactCredentials)
+}
+
+// ImportDatabase reads what ExportDatabase wrote.
+func (self *PushBackEnd) ImportDatabase(r io.Reader, services []string, dryRun bool) (*ImportStats, error) {
+	return self.db.Import(r, services, dryRun)
+}
+
 func (self *PushBackEnd) collectResult(reqId string, service string, resChan <-chan *PushResult, logger Logger, after time.Duration) {
 	for res := range resChan {
 		var sub string
@@ -219,23 +355,55 @@ func (self *PushBackEnd) Push(reqId string, service string, subs []string, notif
 	self.pushImpl(reqId, service, subs, notif, perdp, logger, nil, nil, 0*time.Second)
 }
 
+// Subscribers whose delivery points are read from the database at once
+const subscribersPerLookup = 1000
+
+// lookupPairs reads the delivery points of subs in one batch. Should the
+// batch fail, they are read subscriber by subscriber, so that one broken
+// subscriber does not fail the others.
+func (self *PushBackEnd) lookupPairs(service string, subs []string) (map[string][]PushServiceProviderDeliveryPointPair, map[string]error) {
+	pairs, err := self.db.GetPushServiceProviderDeliveryPointPairsBySubscribers(service, subs)
+	if err == nil {
+		return pairs, nil
+	}
+	pairs = make(map[string][]PushServiceProviderDeliveryPointPair, len(subs))
+	errs := make(map[string]error)
+	for _, sub := range subs {
+		pspDpList, err := self.db.GetPushServiceProviderDeliveryPointPairs(service, sub)
+		if err != nil {
+			errs[sub] = err
+			continue
+		}
+		pairs[sub] = pspDpList
+	}
+	return pairs, errs
+}
+
 func (self *PushBackEnd) pushImpl(reqId string, service string, subs []string, notif *Notification, perdp map[string][]string, logger Logger, provider *PushServiceProvider, dest *DeliveryPoint, after time.Duration) {
 	dpChanMap := make(map[string]chan *DeliveryPoint)
 	wg := new(sync.WaitGroup)
-	for _, sub := range subs {
+	var pairs map[string][]PushServiceProviderDeliveryPointPair
+	var errs map[string]error
+	for i, sub := range subs {
 		dpidx := 0
 		var pspDpList []PushServiceProviderDeliveryPointPair
 		if provider != nil && dest != nil {
-			pspDpList := make([]PushServiceProviderDeliveryPointPair, 1)
+			pspDpList = make([]PushServiceProviderDeliveryPointPair, 1)
 			pspDpList[0].PushServiceProvider = provider
 			pspDpList[0].DeliveryPoint = dest
 		} else {
-			var err error
-			pspDpList, err = self.db.GetPushServiceProviderDeliveryPointPairs(service, sub)
-			if err != nil {
+			if i%subscribersPerLookup == 0 {
+				end := i + subscribersPerLookup
+				if end > len(subs) {
+					end = len(subs)
+				}
+				pairs, errs = self.lookupPairs(service, subs[i:end])
+			}
+			if err, ok := errs[sub]; ok {
 				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Database Error %v", reqId, service, sub, err)
 				continue
 			}
+			pspDpList = pairs[sub]
 		}
 
 		if len(pspDpList) == 0 {
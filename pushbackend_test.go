@@ -0,0 +1,262 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/db"
+	"github.com/rafaelbandeira3/uniqush-push/fakeprovider"
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+	. "github.com/rafaelbandeira3/uniqush-push/srv"
+	. "github.com/uniqush/log"
+)
+
+type testLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (self *testLogger) logf(format string, v ...interface{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lines = append(self.lines, fmt.Sprintf(format, v...))
+}
+
+func (self *testLogger) Fatalf(format string, v ...interface{})  { self.logf(format, v...) }
+func (self *testLogger) Errorf(format string, v ...interface{})  { self.logf(format, v...) }
+func (self *testLogger) Warnf(format string, v ...interface{})   { self.logf(format, v...) }
+func (self *testLogger) Configf(format string, v ...interface{}) { self.logf(format, v...) }
+func (self *testLogger) Infof(format string, v ...interface{})   { self.logf(format, v...) }
+func (self *testLogger) Debugf(format string, v ...interface{})  { self.logf(format, v...) }
+
+func (self *testLogger) count(substr string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := 0
+	for _, line := range self.lines {
+		if strings.Contains(line, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// regIds returns the registration ids of the delivery points of alice,
+// possibly replaced by canonical ids.
+func regIds(t *testing.T, backend *PushBackEnd) map[string]string {
+	pairs, err := backend.db.GetPushServiceProviderDeliveryPointPairs("test", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		dp := pair.DeliveryPoint
+		if regid, ok := dp.VolatileData["regid"]; ok {
+			ret[dp.FixedData["regid"]] = regid
+		} else {
+			ret[dp.FixedData["regid"]] = dp.FixedData["regid"]
+		}
+	}
+	return ret
+}
+
+var installOnce sync.Once
+
+func newTestBackEnd(t *testing.T, psp map[string]string) (*PushBackEnd, *testLogger) {
+	installOnce.Do(installPushSrvices)
+	psm := GetPushServiceManager()
+	db, err := NewPushDatabaseWithoutCache(&DatabaseConfig{Engine: "memory", PushServiceManager: psm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := new(testLogger)
+	loggers := make([]Logger, LOGGER_NR_LOGGERS)
+	for i := range loggers {
+		loggers[i] = logger
+	}
+	backend := NewPushBackEnd(psm, db, loggers)
+
+	p, err := psm.BuildPushServiceProviderFromMap(psp)
+	if err != nil {
+		t.Fatalf("Cannot build push service provider: %v", err)
+	}
+	err = backend.AddPushServiceProvider("test", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, logger
+}
+
+func subscribe(t *testing.T, backend *PushBackEnd, kv map[string]string) *DeliveryPoint {
+	kv["service"] = "test"
+	kv["subscriber"] = "alice"
+	dp, err := GetPushServiceManager().BuildDeliveryPointFromMap(kv)
+	if err != nil {
+		t.Fatalf("Cannot build delivery point: %v", err)
+	}
+	_, err = backend.Subscribe("test", "alice", dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dp
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPushWithFakeGCM(t *testing.T) {
+	gcm := fakeprovider.NewGCM()
+	defer gcm.Close()
+	gcm.SetOutcome("gone", fakeprovider.Outcome{Error: "NotRegistered"})
+	gcm.SetOutcome("old", fakeprovider.Outcome{CanonicalID: "new"})
+
+	backend, logger := newTestBackEnd(t, map[string]string{
+		"pushservicetype": "gcm",
+		"service":         "test",
+		"projectid":       "test",
+		"apikey":          "key",
+		"serviceurl":      gcm.URL(),
+	})
+	subscribe(t, backend, map[string]string{"pushservicetype": "gcm", "regid": "ok"})
+	subscribe(t, backend, map[string]string{"pushservicetype": "gcm", "regid": "gone"})
+	subscribe(t, backend, map[string]string{"pushservicetype": "gcm", "regid": "old"})
+
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	backend.Push("req", "test", []string{"alice"}, notif, nil, logger)
+
+	if n := len(gcm.Messages()); n != 3 {
+		t.Errorf("%v messages received, expected 3", n)
+	}
+	if n := logger.count("Success!"); n != 2 {
+		t.Errorf("%v messages sent, expected 2", n)
+	}
+	if n := backend.NumberOfDeliveryPoints("test", "alice", logger); n != 2 {
+		t.Errorf("NotRegistered delivery point not unsubscribed: %v left", n)
+	}
+	if regid := regIds(t, backend)["old"]; regid != "new" {
+		t.Errorf("Canonical id not saved: %v", regid)
+	}
+
+	gcm.FailNext(1, 503)
+	backend.Push("req", "test", []string{"alice"}, notif, nil, logger)
+	if n := logger.count("Retry after"); n != 2 {
+		t.Errorf("%v retries, expected 2", n)
+	}
+}
+
+func TestPushWithFakeADM(t *testing.T) {
+	adm := fakeprovider.NewADM()
+	defer adm.Close()
+	adm.SetOutcome("bad", fakeprovider.Outcome{Error: "InvalidRegistrationId"})
+	adm.SetOutcome("old", fakeprovider.Outcome{CanonicalID: "new"})
+
+	backend, logger := newTestBackEnd(t, map[string]string{
+		"pushservicetype": "adm",
+		"service":         "test",
+		"clientid":        "id",
+		"clientsecret":    "secret",
+		"tokenurl":        adm.TokenURL(),
+		"serviceurl":      adm.ServiceURL(),
+	})
+	subscribe(t, backend, map[string]string{"pushservicetype": "adm", "regid": "ok"})
+	subscribe(t, backend, map[string]string{"pushservicetype": "adm", "regid": "bad"})
+	subscribe(t, backend, map[string]string{"pushservicetype": "adm", "regid": "old"})
+
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	backend.Push("req", "test", []string{"alice"}, notif, nil, logger)
+
+	if n := len(adm.Messages()); n != 3 {
+		t.Errorf("%v messages received, expected 3", n)
+	}
+	if n := logger.count("Success!"); n != 2 {
+		t.Errorf("%v messages sent, expected 2", n)
+	}
+	if n := logger.count("InvalidRegistrationId"); n != 1 {
+		t.Errorf("Bad registration id not reported")
+	}
+	if regid := regIds(t, backend)["old"]; regid != "new" {
+		t.Errorf("Canonical id not saved: %v", regid)
+	}
+
+	adm.FailNext(3, 429)
+	backend.Push("req", "test", []string{"alice"}, notif, nil, logger)
+	if n := logger.count("Retry after"); n != 3 {
+		t.Errorf("%v retries, expected 3", n)
+	}
+}
+
+func TestPushWithFakeAPNS(t *testing.T) {
+	apns, err := fakeprovider.NewAPNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apns.Close()
+	SetCredentialKey("secret")
+	defer SetCredentialKey("")
+
+	good := strings.Repeat("ab", 32)
+	bad := strings.Repeat("cd", 32)
+	gone := strings.Repeat("ef", 32)
+	apns.SetOutcome(bad, fakeprovider.Outcome{Status: 8})
+
+	cert, key := apns.CertificatePEM()
+	backend, logger := newTestBackEnd(t, map[string]string{
+		"pushservicetype": "apns",
+		"service":         "test",
+		"cert":            cert,
+		"key":             key,
+		"addr":            apns.Addr(),
+		"feedbackaddr":    apns.FeedbackAddr(),
+		"skipverify":      "true",
+	})
+	subscribe(t, backend, map[string]string{"pushservicetype": "apns", "devtoken": good})
+	subscribe(t, backend, map[string]string{"pushservicetype": "apns", "devtoken": bad})
+	subscribe(t, backend, map[string]string{"pushservicetype": "apns", "devtoken": gone})
+
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	backend.Push("req", "test", []string{"alice"}, notif, nil, logger)
+
+	// The error frame is received asynchronously
+	if !waitFor(func() bool { return backend.NumberOfDeliveryPoints("test", "alice", logger) == 2 }) {
+		t.Errorf("Invalid token not unsubscribed")
+	}
+
+	apns.AddFeedback(gone, time.Now().Add(time.Hour))
+	n, err := backend.CheckFeedback("test", logger)
+	if err != nil || n != 1 {
+		t.Errorf("Feedback: %v entries, %v", n, err)
+	}
+	if backend.NumberOfDeliveryPoints("test", "alice", logger) != 1 {
+		t.Errorf("Unreachable token not unsubscribed")
+	}
+}
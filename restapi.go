@@ -20,6 +20,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -29,7 +30,9 @@ import (
 	"sync"
 	"time"
 
+	. "github.com/rafaelbandeira3/uniqush-push/db"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
+	. "github.com/rafaelbandeira3/uniqush-push/srv"
 	"github.com/uniqush/log"
 )
 
@@ -68,6 +71,14 @@ const (
 	STOP_PROGRAM_URL                            = "/stop"
 	VERSION_INFO_URL                            = "/version"
 	QUERY_NUMBER_OF_DELIVERY_POINTS_URL         = "/nrdp"
+	LIVE_CONNECTION_URL                         = "/live"
+	QUERY_CREDENTIAL_STATUS_URL                 = "/credentials"
+	CHECK_FEEDBACK_URL                          = "/feedback"
+	BACKUP_DATABASE_URL                         = "/backup"
+	CHECK_DATABASE_URL                          = "/fsck"
+	EXPORT_DATABASE_URL                         = "/export"
+	IMPORT_DATABASE_URL                         = "/import"
+	CACHE_STATS_URL                             = "/cachestats"
 )
 
 var validServicePattern *regexp.Regexp
@@ -275,6 +286,20 @@ func (self *RestAPI) pushNotification(reqId string, kv map[string]string, perdp
 	return
 }
 
+// splitServices reads service parameters, each of them possibly a
+// comma separated list.
+func splitServices(params []string) []string {
+	var ret []string
+	for _, param := range params {
+		for _, srv := range strings.Split(param, ",") {
+			if srv = strings.TrimSpace(srv); srv != "" {
+				ret = append(ret, srv)
+			}
+		}
+	}
+	return ret
+}
+
 func (self *RestAPI) stop(w io.Writer, remoteAddr string) {
 	self.waitGroup.Wait()
 	self.backend.Finalize()
@@ -317,6 +342,122 @@ func (self *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		n := self.numberOfDeliveryPoints(r.Form, self.loggers[LOGGER_WEB], remoteAddr)
 		fmt.Fprintf(w, "%v\r\n", n)
 		return
+	case QUERY_CREDENTIAL_STATUS_URL:
+		status := self.backend.CredentialStatus()
+		if status == nil {
+			status = make([]*CredentialStatus, 0)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	case CHECK_FEEDBACK_URL:
+		r.ParseForm()
+		service := r.Form.Get("service")
+		if service == "" {
+			fmt.Fprintf(w, "NoService\r\n")
+			return
+		}
+		weblogger := log.NewLogger(w, "[Feedback]", log.LOGLEVEL_INFO)
+		logger := log.MultiLogger(weblogger, self.loggers[LOGGER_UNSUB])
+		n, err := self.backend.CheckFeedback(service, logger)
+		if err != nil {
+			logger.Errorf("From=%v Service=%v Failed: %v", remoteAddr, service, err)
+			return
+		}
+		logger.Infof("From=%v Service=%v Feedback=%v", remoteAddr, service, n)
+		return
+	case BACKUP_DATABASE_URL:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		n, err := self.backend.Backup(w)
+		if err != nil {
+			self.loggers[LOGGER_WEB].Errorf("From=%v Backup failed after %v bytes: %v", remoteAddr, n, err)
+			if n == 0 {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%v\r\n", err)
+			}
+			return
+		}
+		self.loggers[LOGGER_WEB].Infof("From=%v Backup of %v bytes", remoteAddr, n)
+		return
+	case CHECK_DATABASE_URL:
+		r.ParseForm()
+		fix := r.Form.Get("fix") == "true"
+		if fix && r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "fix=true requires POST\r\n")
+			return
+		}
+		problems, err := self.backend.CheckDatabase(fix)
+		if err != nil {
+			self.loggers[LOGGER_WEB].Errorf("From=%v Fix=%v Check failed: %v", remoteAddr, fix, err)
+			if problems == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%v\r\n", err)
+				return
+			}
+		}
+		for _, p := range problems {
+			self.loggers[LOGGER_WEB].Infof("From=%v %v", remoteAddr, p)
+		}
+		self.loggers[LOGGER_WEB].Infof("From=%v Fix=%v Check found %v problems", remoteAddr, fix, len(problems))
+		if problems == nil {
+			problems = []*DatabaseProblem{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(problems)
+		return
+	case CACHE_STATS_URL:
+		stats := self.backend.CacheStats()
+		if stats == nil {
+			fmt.Fprintf(w, "NoCache\r\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	case EXPORT_DATABASE_URL:
+		r.ParseForm()
+		services := splitServices(r.Form["service"])
+		// Credentials are only exported in clear with redact=false
+		redact := r.Form.Get("redact") != "false"
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		n, err := self.backend.ExportDatabase(w, services, redact)
+		if err != nil {
+			self.loggers[LOGGER_WEB].Errorf("From=%v Services=%v Export failed after %v records: %v", remoteAddr, services, n, err)
+			if n == 0 {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%v\r\n", err)
+			}
+			return
+		}
+		self.loggers[LOGGER_WEB].Infof("From=%v Services=%v Redact=%v Exported %v records", remoteAddr, services, redact, n)
+		return
+	case IMPORT_DATABASE_URL:
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "import requires POST\r\n")
+			return
+		}
+		self.waitGroup.Add(1)
+		defer self.waitGroup.Done()
+		// The body is the export, not a form
+		query := r.URL.Query()
+		services := splitServices(query["service"])
+		dryRun := query.Get("dryrun") == "true"
+		stats, err := self.backend.ImportDatabase(r.Body, services, dryRun)
+		ret := map[string]interface{}{"stats": stats}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			self.loggers[LOGGER_WEB].Errorf("From=%v Services=%v DryRun=%v Import failed: %v %+v", remoteAddr, services, dryRun, err, stats)
+			ret["error"] = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			self.loggers[LOGGER_WEB].Infof("From=%v Services=%v DryRun=%v Imported %+v", remoteAddr, services, dryRun, stats)
+		}
+		json.NewEncoder(w).Encode(ret)
+		return
 	case VERSION_INFO_URL:
 		fmt.Fprintf(w, "%v\r\n", self.version)
 		self.loggers[LOGGER_WEB].Infof("Checked version from %v", remoteAddr)
@@ -382,6 +523,18 @@ func (self *RestAPI) Run(addr string, stopChan chan<- bool) {
 	http.Handle(REMOVE_PUSH_SERVICE_PROVIDER_TO_SERVICE_URL, self)
 	http.Handle(PUSH_NOTIFICATION_URL, self)
 	http.Handle(QUERY_NUMBER_OF_DELIVERY_POINTS_URL, self)
+	http.Handle(QUERY_CREDENTIAL_STATUS_URL, self)
+	http.Handle(CHECK_FEEDBACK_URL, self)
+	http.Handle(BACKUP_DATABASE_URL, self)
+	http.Handle(CHECK_DATABASE_URL, self)
+	http.Handle(EXPORT_DATABASE_URL, self)
+	http.Handle(IMPORT_DATABASE_URL, self)
+	http.Handle(CACHE_STATS_URL, self)
+	// Clients hold their connection open on this one, so it does not
+	// go through ServeHTTP and does not delay /stop.
+	if live := LiveHandler(); live != nil {
+		http.Handle(LIVE_CONNECTION_URL, live)
+	}
 	self.stopChan = stopChan
 	err := http.ListenAndServe(addr, nil)
 	if err != nil {
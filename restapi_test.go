@@ -0,0 +1,123 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rafaelbandeira3/uniqush-push/fakeprovider"
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func call(api *RestAPI, path string, form url.Values) string {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w.Body.String()
+}
+
+func TestRestAPIWithMemoryDatabase(t *testing.T) {
+	gcm := fakeprovider.NewGCM()
+	defer gcm.Close()
+
+	backend, _ := newTestBackEnd(t, map[string]string{
+		"pushservicetype": "gcm",
+		"service":         "test",
+		"projectid":       "test",
+		"apikey":          "key",
+		"serviceurl":      gcm.URL(),
+	})
+	api := NewRestAPI(GetPushServiceManager(), backend.loggers, "test", backend)
+
+	out := call(api, ADD_DELIVERY_POINT_TO_SERVICE_URL, url.Values{
+		"pushservicetype": {"gcm"},
+		"service":         {"test"},
+		"subscriber":      {"bob"},
+		"regid":           {"regid-of-bob"},
+	})
+	if !strings.Contains(out, "Success!") {
+		t.Fatalf("Cannot subscribe: %v", out)
+	}
+	if out = call(api, QUERY_NUMBER_OF_DELIVERY_POINTS_URL, url.Values{"service": {"test"}, "subscriber": {"bob"}}); out != "1\r\n" {
+		t.Errorf("Expected 1 delivery point, got %q", out)
+	}
+
+	out = call(api, PUSH_NOTIFICATION_URL, url.Values{
+		"service":    {"test"},
+		"subscriber": {"bob"},
+		"msg":        {"Hello"},
+	})
+	msgs := gcm.Messages()
+	if len(msgs) != 1 || msgs[0].Token != "regid-of-bob" {
+		t.Errorf("Message not received: %v", out)
+	}
+
+	if out = call(api, BACKUP_DATABASE_URL, nil); !strings.Contains(out, "regid-of-bob") {
+		t.Errorf("Delivery point not in the backup: %q", out)
+	}
+
+	out = call(api, EXPORT_DATABASE_URL, url.Values{"service": {"test"}, "redact": {"true"}})
+	if !strings.Contains(out, "regid-of-bob") || strings.Contains(out, `"apikey":`) {
+		t.Errorf("Bad export: %q", out)
+	}
+	if out = call(api, EXPORT_DATABASE_URL, url.Values{"service": {"test"}}); strings.Contains(out, `"apikey":`) {
+		t.Errorf("Credentials exported without redact=false: %q", out)
+	}
+	if out = call(api, EXPORT_DATABASE_URL, url.Values{"service": {"test"}, "redact": {"false"}}); !strings.Contains(out, `"apikey":`) {
+		t.Errorf("Credentials not exported with redact=false: %q", out)
+	}
+	req, _ := http.NewRequest("GET", IMPORT_DATABASE_URL+"?dryrun=true", strings.NewReader(out))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET imported the database: %v %q", w.Code, w.Body.String())
+	}
+	req, _ = http.NewRequest("POST", IMPORT_DATABASE_URL+"?dryrun=true", strings.NewReader(out))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"subscriptions":1`) {
+		t.Errorf("Bad import: %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRestAPIFixDatabaseRequiresPost(t *testing.T) {
+	backend, _ := newTestBackEnd(t, map[string]string{
+		"pushservicetype": "gcm",
+		"service":         "test",
+		"projectid":       "test",
+		"apikey":          "key",
+	})
+	api := NewRestAPI(GetPushServiceManager(), backend.loggers, "test", backend)
+
+	for _, method := range []string{"GET", "POST"} {
+		req, _ := http.NewRequest(method, CHECK_DATABASE_URL+"?fix=true", strings.NewReader(""))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if method == "GET" && w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET fixed the database: %v %v", w.Code, w.Body.String())
+		}
+		if method == "POST" && strings.TrimSpace(w.Body.String()) != "[]" {
+			t.Errorf("POST did not check the database: %v %v", w.Code, w.Body.String())
+		}
+	}
+}
@@ -19,13 +19,17 @@ package srv
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	. "github.com/rafaelbandeira3/uniqush-push/push"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,16 +49,22 @@ type pspLockResponse struct {
 type pspLockRequest struct {
 	psp    *PushServiceProvider
 	respCh chan<- *pspLockResponse
+	// The provider rejected the token of psp
+	rejected bool
 }
 
 type admPushService struct {
 	pspLock chan *pspLockRequest
+	clients *httpClientManager
 }
 
 func newADMPushService() *admPushService {
 	ret := new(admPushService)
 	ret.pspLock = make(chan *pspLockRequest)
-	go admPspLocker(ret.pspLock)
+	ret.clients = newHTTPClientManager(nil)
+	go pspTokenLocker(ret.pspLock, func(psp *PushServiceProvider) error {
+		return requestToken(ret.clients.get(psp), psp)
+	})
 	return ret
 }
 
@@ -63,10 +73,17 @@ func InstallADM() {
 	psm.RegisterPushServiceType(newADMPushService())
 }
 
-func (self *admPushService) Finalize() {}
+func (self *admPushService) Finalize() {
+	self.clients.closeAll()
+}
 func (self *admPushService) Name() string {
 	return "adm"
 }
+
+func (self *admPushService) CredentialFields() []string {
+	return []string{"clientsecret", "token"}
+}
+
 func (self *admPushService) SetErrorReportChan(errChan chan<- error) {
 	return
 }
@@ -90,7 +107,12 @@ func (self *admPushService) BuildPushServiceProviderFromMap(kv map[string]string
 		return errors.New("NoClientSecrete")
 	}
 
-	return nil
+	// serviceurl is the prefix of the URLs of the registration ids
+	err := buildEndpointsFromMap(kv, psp, "tokenurl", "serviceurl")
+	if err != nil {
+		return err
+	}
+	return buildHTTPClientOptionsFromMap(kv, psp)
 }
 
 func (self *admPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
@@ -113,8 +135,13 @@ func (self *admPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *
 	return nil
 }
 
-func admPspLocker(lockChan <-chan *pspLockRequest) {
+// pspTokenLocker serializes the token requests of the psps sharing the
+// same clientid, so that they share one cached access token.
+func pspTokenLocker(lockChan <-chan *pspLockRequest, requestToken func(psp *PushServiceProvider) error) {
 	pspLockMap := make(map[string]*PushServiceProvider, 10)
+	// Tokens rejected by the provider before they expired, by clientid.
+	// Other copies of the psp, e.g. in the database, may still have them.
+	rejected := make(map[string]string, 10)
 	for req := range lockChan {
 		var ok bool
 		var clientid string
@@ -127,10 +154,27 @@ func admPspLocker(lockChan <-chan *pspLockRequest) {
 			continue
 		}
 
-		if psp, ok = pspLockMap[clientid]; !ok {
+		if req.rejected {
+			token := psp.VolatileData["token"]
+			rejected[clientid] = token
+			if cached, ok := pspLockMap[clientid]; ok && cached.VolatileData["token"] == token {
+				delete(pspLockMap, clientid)
+			}
+			resp.psp = psp
+			req.respCh <- resp
+			continue
+		}
+
+		// The options of the psp, e.g. its endpoints, may have changed
+		// since its token was requested.
+		if psp, ok = pspLockMap[clientid]; !ok || !sameADMOptions(psp, req.psp) {
 			psp = req.psp
 			pspLockMap[clientid] = psp
 		}
+		if token, ok := rejected[clientid]; ok && psp.VolatileData["token"] == token {
+			delete(psp.VolatileData, "token")
+			delete(psp.VolatileData, "expire")
+		}
 		resp.err = requestToken(psp)
 		resp.psp = psp
 		if resp.err != nil {
@@ -144,6 +188,25 @@ func admPspLocker(lockChan <-chan *pspLockRequest) {
 	}
 }
 
+// sameADMOptions compares two psps, except for their tokens.
+func sameADMOptions(a, b *PushServiceProvider) bool {
+	if a.Name() != b.Name() {
+		return false
+	}
+	for _, data := range []map[string]string{a.VolatileData, b.VolatileData} {
+		for k, _ := range data {
+			switch k {
+			case "token", "expire", "type":
+				continue
+			}
+			if a.VolatileData[k] != b.VolatileData[k] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 type tokenSuccObj struct {
 	Token  string `json:"access_token"`
 	Expire int    `json:"expires_in"`
@@ -156,7 +219,7 @@ type tokenFailObj struct {
 	Description string `json:"error_description"`
 }
 
-func requestToken(psp *PushServiceProvider) error {
+func requestToken(client *pspHTTPClient, psp *PushServiceProvider) error {
 	var ok bool
 	var clientid string
 	var cserect string
@@ -185,14 +248,13 @@ func requestToken(psp *PushServiceProvider) error {
 	form.Set("scope", "messaging:push")
 	form.Set("client_id", clientid)
 	form.Set("client_secret", cserect)
-	req, err := http.NewRequest("POST", admTokenURL, bytes.NewBufferString(form.Encode()))
+	req, err := http.NewRequest("POST", pspEndpoint(psp, "tokenurl", "admtoken"), bytes.NewBufferString(form.Encode()))
 	if err != nil {
 		return fmt.Errorf("NewRequest error: %v", err)
 	}
 	defer req.Body.Close()
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("Do error: %v", err)
@@ -240,6 +302,10 @@ type admMessage struct {
 	MD5      string                 `json:"md5,omitempty"`
 }
 
+// notifToMessage builds the ADM message of notif. msggroup (or
+// consolidationkey) and ttl (or expiresafter, in seconds) become
+// consolidationKey and expiresAfter. The md5 checksum of the data is
+// sent so that the device can check it.
 func notifToMessage(notif *Notification) (msg *admMessage, err error) {
 	if notif == nil || len(notif.Data) == 0 {
 		err = NewBadNotificationWithDetails("empty notification")
@@ -250,12 +316,16 @@ func notifToMessage(notif *Notification) (msg *admMessage, err error) {
 	msg.Data = make(map[string]interface{}, len(notif.Data))
 	for k, v := range notif.Data {
 		switch k {
-		case "msggroup":
-			msg.MsgGroup = v.(string)
-		case "ttl":
-			ttl, err := strconv.ParseInt(v.(string), 10, 64)
-			if err != nil {
-				continue
+		case "msggroup", "consolidationkey":
+			if group, ok := v.(string); ok {
+				msg.MsgGroup = group
+			}
+		case "ttl", "expiresafter":
+			str, _ := v.(string)
+			ttl, e := strconv.ParseInt(str, 10, 64)
+			if e != nil || ttl < 0 {
+				err = NewBadNotificationWithDetails(fmt.Sprintf("invalid %v: %v", k, v))
+				return
 			}
 			msg.TTL = ttl
 		default:
@@ -266,16 +336,47 @@ func notifToMessage(notif *Notification) (msg *admMessage, err error) {
 		err = NewBadNotificationWithDetails("empty notification")
 		return
 	}
+	msg.MD5 = admDataMD5(msg.Data)
+	return
+}
+
+// admDataMD5 computes the checksum of ADM: the base64 encoded MD5 of
+// the key:value pairs sorted by key and joined by commas. Only string
+// values are supported, otherwise it returns an empty string.
+func admDataMD5(data map[string]interface{}) string {
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		if _, ok := v.(string); !ok {
+			return ""
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + ":" + data[k].(string)
+	}
+	sum := md5.Sum([]byte(strings.Join(pairs, ",")))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// admRegId returns the registration id of dp, which may have been
+// replaced by ADM.
+func admRegId(dp *DeliveryPoint) (regid string, ok bool) {
+	if regid, ok = dp.VolatileData["regid"]; ok && len(regid) > 0 {
+		return
+	}
+	regid, ok = dp.FixedData["regid"]
 	return
 }
 
-func admURL(dp *DeliveryPoint) (url string, err error) {
+func admURL(psp *PushServiceProvider, dp *DeliveryPoint) (url string, err error) {
 	if dp == nil {
 		err = fmt.Errorf("nil dp")
 		return
 	}
-	if regid, ok := dp.FixedData["regid"]; ok {
-		url = fmt.Sprintf("%v%v/messages", admServiceURL, regid)
+	if regid, ok := admRegId(dp); ok {
+		url = fmt.Sprintf("%v%v/messages", pspEndpoint(psp, "serviceurl", "adm"), regid)
 	} else {
 		err = NewBadDeliveryPointWithDetails(dp, "empty delivery point")
 	}
@@ -289,7 +390,7 @@ func admNewRequest(psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (re
 		err = NewBadPushServiceProviderWithDetails(psp, "NoToken")
 		return
 	}
-	url, err := admURL(dp)
+	url, err := admURL(psp, dp)
 	if err != nil {
 		return
 	}
@@ -312,81 +413,103 @@ type admPushFailResponse struct {
 	Reason string `json:"reason"`
 }
 
-func admSinglePush(psp *PushServiceProvider, dp *DeliveryPoint, data []byte, notif *Notification) (string, error) {
-	client := &http.Client{}
+type admPushSuccResponse struct {
+	RegId string `json:"registrationID"`
+}
+
+// admSinglePush sends data to dp. It returns the id of the request and
+// the new registration id of dp, if ADM changed it.
+func admSinglePush(client *pspHTTPClient, psp *PushServiceProvider, dp *DeliveryPoint, data []byte, notif *Notification) (id string, newRegId string, err error) {
 	req, err := admNewRequest(psp, dp, data)
 	if err != nil {
-		return "", err
+		return
 	}
 	defer req.Body.Close()
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			err = NewRetryErrorWithReason(psp, dp, notif, 3*time.Second, err)
+		}
+		return
 	}
 	defer resp.Body.Close()
 
-	id := resp.Header.Get("x-amzn-RequestId")
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 503 || resp.StatusCode == 500 || resp.StatusCode == 429 {
-			// By default, we retry after one minute.
-			retryAfter := resp.Header.Get("Retry-After")
-			retrySecond := 60
-			if retryAfter != "" {
-				retrySecond, err = strconv.Atoi(retryAfter)
-				if err != nil {
-					retrySecond = 60
-				}
+	id = resp.Header.Get("x-amzn-RequestId")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 200 {
+		var succ admPushSuccResponse
+		if json.Unmarshal(body, &succ) == nil && len(succ.RegId) > 0 {
+			if regid, _ := admRegId(dp); regid != succ.RegId {
+				newRegId = succ.RegId
 			}
-			retryDuration := time.Duration(retrySecond) * time.Second
-			err = NewRetryError(psp, dp, notif, retryDuration)
-			return id, err
-		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-
-		var fail admPushFailResponse
-		err = json.Unmarshal(body, &fail)
-		if err != nil {
-			err = fmt.Errorf("%v: %v", resp.StatusCode, string(body))
-			return "", err
 		}
+		return
+	}
 
-		reason := strings.ToLower(fail.Reason)
+	switch resp.StatusCode {
+	case 429, 500, 503:
+		// Throttled or unavailable. By default, we retry after one
+		// minute.
+		err = NewRetryError(psp, dp, notif, retryAfter(resp, 60*time.Second))
+		return
+	}
 
-		switch reason {
-		case "messagetoolarge":
-			err = NewBadNotificationWithDetails("MessageTooLarge")
-		case "invalidregistrationid":
-			err = NewBadDeliveryPointWithDetails(dp, "InvalidRegistrationId")
-		case "accesstokenexpired":
-			// retry would fix it.
-			err = NewRetryError(psp, dp, notif, 10*time.Second)
-		default:
-			err = fmt.Errorf("%v: %v", resp.StatusCode, fail.Reason)
-		}
+	var fail admPushFailResponse
+	err = json.Unmarshal(body, &fail)
+	if err != nil {
+		err = fmt.Errorf("%v: %v", resp.StatusCode, string(body))
+		return
+	}
 
-		return "", err
+	reason := strings.ToLower(fail.Reason)
+
+	switch reason {
+	case "messagetoolarge":
+		err = NewBadNotificationWithDetails("MessageTooLarge")
+	case "invalidregistrationid":
+		err = NewBadDeliveryPointWithDetails(dp, "InvalidRegistrationId")
+	case "unregistered":
+		err = NewUnsubscribeUpdate(psp, dp)
+	case "accesstokenexpired":
+		// retry would fix it.
+		err = NewRetryError(psp, dp, notif, 10*time.Second)
+	case "maxratepersecondexceeded", "deviceratelimitexceeded":
+		err = NewRetryError(psp, dp, notif, retryAfter(resp, 60*time.Second))
+	default:
+		err = fmt.Errorf("%v: %v", resp.StatusCode, fail.Reason)
 	}
-	return id, nil
+	return
 }
 
-func (self *admPushService) lockPsp(psp *PushServiceProvider) (*PushServiceProvider, error) {
+func lockPsp(lockChan chan<- *pspLockRequest, psp *PushServiceProvider) (*PushServiceProvider, error) {
 	respCh := make(chan *pspLockResponse)
 	req := &pspLockRequest{
 		psp:    psp,
 		respCh: respCh,
 	}
 
-	self.pspLock <- req
+	lockChan <- req
 
 	resp := <-respCh
 
 	return resp.psp, resp.err
 }
 
+// rejectToken tells the locker that the provider rejected the token of
+// psp, so that a new one is requested next time.
+func rejectToken(lockChan chan<- *pspLockRequest, psp *PushServiceProvider) {
+	respCh := make(chan *pspLockResponse)
+	lockChan <- &pspLockRequest{
+		psp:      psp,
+		respCh:   respCh,
+		rejected: true,
+	}
+	<-respCh
+}
+
 func (self *admPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
 	defer close(resQueue)
 	defer func() {
@@ -399,7 +522,7 @@ func (self *admPushService) Push(psp *PushServiceProvider, dpQueue <-chan *Deliv
 	res.Provider = psp
 
 	var err error
-	psp, err = self.lockPsp(psp)
+	psp, err = lockPsp(self.pspLock, psp)
 	if err != nil {
 		res.Err = err
 		resQueue <- res
@@ -421,19 +544,52 @@ func (self *admPushService) Push(psp *PushServiceProvider, dpQueue <-chan *Deliv
 		return
 	}
 
+	// At most maxinflight workers send the messages. They are
+	// started on demand.
+	client := self.clients.get(psp)
+	maxWorkers := pspIntOption(psp, "maxinflight", defaultMaxInFlight)
+	nrWorkers := 0
+	jobs := make(chan *DeliveryPoint)
 	wg := sync.WaitGroup{}
 
 	for dp := range dpQueue {
-		wg.Add(1)
-		res := new(PushResult)
-		res.Content = notif
-		res.Provider = psp
-		res.Destination = dp
-		go func() {
-			res.MsgId, res.Err = admSinglePush(psp, dp, data, notif)
-			resQueue <- res
-			wg.Done()
-		}()
+		if nrWorkers < maxWorkers {
+			nrWorkers++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for dp := range jobs {
+					self.singlePush(client, psp, dp, data, notif, resQueue)
+				}
+			}()
+		}
+		jobs <- dp
 	}
+	close(jobs)
 	wg.Wait()
 }
+
+func (self *admPushService) singlePush(client *pspHTTPClient, psp *PushServiceProvider, dp *DeliveryPoint, data []byte, notif *Notification, resQueue chan<- *PushResult) {
+	res := new(PushResult)
+	res.Content = notif
+	res.Provider = psp
+	res.Destination = dp
+
+	msgid, newRegId, err := admSinglePush(client, psp, dp, data, notif)
+	if err != nil {
+		res.Err = err
+		resQueue <- res
+		return
+	}
+	if newRegId != "" {
+		dp.VolatileData["regid"] = newRegId
+		update := new(PushResult)
+		update.Content = notif
+		update.Provider = psp
+		update.Destination = dp
+		update.Err = NewDeliveryPointUpdate(dp)
+		resQueue <- update
+	}
+	res.MsgId = msgid
+	resQueue <- res
+}
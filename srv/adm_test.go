@@ -0,0 +1,66 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func TestADMMessage(t *testing.T) {
+	notif := NewEmptyNotification()
+	notif.Data["a"] = "1"
+	notif.Data["b"] = "2"
+	notif.Data["consolidationkey"] = "news"
+	notif.Data["expiresafter"] = "3600"
+
+	msg, err := notifToMessage(notif)
+	if err != nil {
+		t.Fatalf("Cannot build message: %v", err)
+	}
+	if msg.MsgGroup != "news" || msg.TTL != 3600 || len(msg.Data) != 2 {
+		t.Errorf("Bad message: %+v", msg)
+	}
+	// base64(md5("a:1,b:2"))
+	if msg.MD5 != "Xvb142mSeo7pSjdDDASyeA==" {
+		t.Errorf("Bad md5: %v", msg.MD5)
+	}
+
+	notif.Data["ttl"] = "soon"
+	if _, err = notifToMessage(notif); err == nil {
+		t.Errorf("Invalid ttl accepted")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: make(http.Header)}
+	if d := retryAfter(resp, time.Minute); d != time.Minute {
+		t.Errorf("Expected the default delay, got %v", d)
+	}
+	resp.Header.Set("Retry-After", "120")
+	if d := retryAfter(resp, time.Minute); d != 2*time.Minute {
+		t.Errorf("Expected 2m, got %v", d)
+	}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d := retryAfter(resp, time.Minute); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Expected about 1h, got %v", d)
+	}
+}
@@ -20,6 +20,7 @@ package srv
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -35,15 +36,18 @@ import (
 	"time"
 
 	. "github.com/rafaelbandeira3/uniqush-push/push"
-	"github.com/uniqush/cache"
 	"github.com/uniqush/connpool"
 )
 
 const (
-	maxPayLoadSize int = 256
-	maxNrConn      int = 13
-
-	// in Minutes
+	// Can be changed per psp with maxpayloadsize
+	defaultMaxPayLoadSize int = 256
+	// VoIP notifications may be as large as 5KB
+	maxAllowedPayLoadSize int = 5120
+	maxNrConn             int = 13
+
+	// in Minutes. Can be changed per psp with feedbackperiod, 0 to
+	// check the feedback only on demand.
 	feedbackCheckPeriod int = 10
 	// in Seconds
 	maxWaitTime int = 20
@@ -73,6 +77,10 @@ type apnsResult struct {
 	msgId  uint32
 	status uint8
 	err    error
+
+	// Notifications dropped by APNS after an error response.
+	// They should be sent again on another connection.
+	resend [][]byte
 }
 
 type apnsPushService struct {
@@ -98,6 +106,10 @@ func (p *apnsPushService) Name() string {
 	return "apns"
 }
 
+func (p *apnsPushService) CredentialFields() []string {
+	return []string{"credential"}
+}
+
 func (p *apnsPushService) Finalize() {
 	close(p.reqChan)
 }
@@ -114,19 +126,7 @@ func (p *apnsPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 		return errors.New("NoService")
 	}
 
-	if cert, ok := kv["cert"]; ok && len(cert) > 0 {
-		psp.FixedData["cert"] = cert
-	} else {
-		return errors.New("NoCertificate")
-	}
-
-	if key, ok := kv["key"]; ok && len(key) > 0 {
-		psp.FixedData["key"] = key
-	} else {
-		return errors.New("NoPrivateKey")
-	}
-
-	_, err := tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	err := buildCertificateFromMap(kv, psp)
 	if err != nil {
 		return err
 	}
@@ -136,9 +136,26 @@ func (p *apnsPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 			psp.VolatileData["skipverify"] = "true"
 		}
 	}
+	if size, ok := kv["maxpayloadsize"]; ok && len(size) > 0 {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 || n > maxAllowedPayLoadSize {
+			return fmt.Errorf("Invalid maxpayloadsize: %v", size)
+		}
+		psp.VolatileData["maxpayloadsize"] = size
+	}
+	if period, ok := kv["feedbackperiod"]; ok && len(period) > 0 {
+		n, err := strconv.Atoi(period)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid feedbackperiod: %v", period)
+		}
+		psp.VolatileData["feedbackperiod"] = period
+	}
+	if addr, ok := kv["feedbackaddr"]; ok && len(addr) > 0 {
+		psp.VolatileData["feedbackaddr"] = addr
+	}
 	if sandbox, ok := kv["sandbox"]; ok {
 		if sandbox == "true" {
-			psp.VolatileData["addr"] = "gateway.sandbox.push.apple.com:2195"
+			psp.VolatileData["addr"] = apnsSandboxGateway
 			return nil
 		}
 	}
@@ -146,10 +163,59 @@ func (p *apnsPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 		psp.VolatileData["addr"] = addr
 		return nil
 	}
-	psp.VolatileData["addr"] = "gateway.push.apple.com:2195"
+	psp.VolatileData["addr"] = apnsGateway
 	return nil
 }
 
+// apnsAddr returns the address of the gateway of psp. The default
+// gateways may be changed with SetEndpoint().
+func apnsAddr(psp *PushServiceProvider) string {
+	switch addr := psp.VolatileData["addr"]; addr {
+	case apnsGateway:
+		return endpoint("apns")
+	case apnsSandboxGateway:
+		return endpoint("apnssandbox")
+	default:
+		return addr
+	}
+}
+
+func apnsFeedbackAddr(psp *PushServiceProvider) string {
+	if addr, ok := psp.VolatileData["feedbackaddr"]; ok && len(addr) > 0 {
+		return addr
+	}
+	switch addr := psp.VolatileData["addr"]; addr {
+	case apnsGateway:
+		return endpoint("apnsfeedback")
+	case apnsSandboxGateway:
+		return endpoint("apnssandboxfeedback")
+	default:
+		ae := strings.Split(addr, ":")
+		return fmt.Sprintf("%v:2196", ae[0])
+	}
+}
+
+func apnsMaxPayLoadSize(psp *PushServiceProvider) int {
+	if size, ok := psp.VolatileData["maxpayloadsize"]; ok {
+		if n, err := strconv.Atoi(size); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultMaxPayLoadSize
+}
+
+func (p *apnsPushService) CredentialExpiry(psp *PushServiceProvider) (time.Time, error) {
+	cert, err := loadCertificate(psp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
+
 func (p *apnsPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
 	if service, ok := kv["service"]; ok && len(service) > 0 {
 		dp.FixedData["service"] = service
@@ -200,6 +266,10 @@ func apnsresToError(apnsres *apnsResult, psp *PushServiceProvider, dp *DeliveryP
 		// err = NewBadDeliveryPointWithDetails(req.dp, "Invalid Token")
 		// This token is invalid, we should unsubscribe this device.
 		err = NewUnsubscribeUpdate(psp, dp)
+	case 10:
+		// Shutdown. The notification is the last one sent
+		// before APNS closed the connection.
+		err = nil
 	default:
 		err = fmt.Errorf("Unknown Error: %d", apnsres.status)
 	}
@@ -238,7 +308,7 @@ func (self *apnsPushService) Push(psp *PushServiceProvider, dpQueue <-chan *Deli
 	req.psp = psp
 	req.payload, err = toAPNSPayload(notif)
 
-	if err == nil && len(req.payload) > maxPayLoadSize {
+	if err == nil && len(req.payload) > apnsMaxPayLoadSize(psp) {
 		err = NewBadNotificationWithDetails("Invalid payload size")
 	}
 
@@ -401,7 +471,7 @@ type apnsConnManager struct {
 
 func newAPNSConnManager(psp *PushServiceProvider, resultChan chan *apnsResult) *apnsConnManager {
 	manager := new(apnsConnManager)
-	manager.cert, manager.err = tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+	manager.cert, manager.err = loadCertificate(psp)
 	if manager.err != nil {
 		return manager
 	}
@@ -410,7 +480,7 @@ func newAPNSConnManager(psp *PushServiceProvider, resultChan chan *apnsResult) *
 		InsecureSkipVerify: false,
 	}
 
-	manager.addr = psp.VolatileData["addr"]
+	manager.addr = apnsAddr(psp)
 	if skip, ok := psp.VolatileData["skipverify"]; ok {
 		if skip == "true" {
 			manager.conf.InsecureSkipVerify = true
@@ -445,8 +515,84 @@ func (self *apnsConnManager) NewConn() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	go resultCollector(self.psp, self.resultChan, tlsconn)
-	return tlsconn, nil
+	conn := newAPNSConn(tlsconn)
+	go resultCollector(self.psp, self.resultChan, conn)
+	return conn, nil
+}
+
+type apnsSentNotification struct {
+	msgId  uint32
+	pdu    []byte
+	sentAt time.Time
+}
+
+// apnsConn remembers the notifications recently written to a
+// connection. After an error response, APNS closes the connection and
+// drops every notification sent after the failing one.
+type apnsConn struct {
+	net.Conn
+	lock   sync.Mutex
+	broken bool
+	sent   []*apnsSentNotification
+}
+
+func newAPNSConn(conn net.Conn) *apnsConn {
+	ret := new(apnsConn)
+	ret.Conn = conn
+	ret.sent = make([]*apnsSentNotification, 0, 16)
+	return ret
+}
+
+func (self *apnsConn) Write(b []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.broken {
+		return 0, errors.New("connection closed by APNS")
+	}
+	n, err := self.Conn.Write(b)
+	if err != nil || n != len(b) || len(b) < 5 || b[0] != 1 {
+		return n, err
+	}
+
+	now := time.Now()
+	// Anything older than this is assumed to be delivered. See clearRequest()
+	keepAfter := now.Add(-time.Duration(maxWaitTime+2) * time.Second)
+	i := 0
+	for i < len(self.sent) && self.sent[i].sentAt.Before(keepAfter) {
+		i++
+	}
+	self.sent = self.sent[i:]
+
+	pdu := make([]byte, len(b))
+	copy(pdu, b)
+	sent := &apnsSentNotification{
+		msgId:  binary.BigEndian.Uint32(pdu[1:5]),
+		pdu:    pdu,
+		sentAt: now,
+	}
+	self.sent = append(self.sent, sent)
+	return n, nil
+}
+
+// dropAfter marks the connection as unusable and returns the
+// notifications written to it after the one with msgid. If msgid is no
+// longer known, there is no telling which ones were delivered, so
+// nothing is returned and found is false.
+func (self *apnsConn) dropAfter(msgid uint32) (ret [][]byte, found bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.broken = true
+	defer func() { self.sent = nil }()
+	for i, sent := range self.sent {
+		if sent.msgId == msgid {
+			ret = make([][]byte, 0, len(self.sent)-i-1)
+			for _, sent := range self.sent[i+1:] {
+				ret = append(ret, sent.pdu)
+			}
+			return ret, true
+		}
+	}
+	return nil, false
 }
 
 func (self *apnsConnManager) InitConn(conn net.Conn, n int) error {
@@ -467,9 +613,9 @@ func (self *apnsPushService) singlePush(payload, token []byte, expiry uint32, mi
 	// - device token length: 2
 	// - device token: 32 (vary)
 	// - payload length: 2
-	// - payload: vary (256 max)
+	// - payload: vary (256 by default, maxpayloadsize of the psp)
 	//
-	// In total, 301 bytes (max)
+	// In total, 301 bytes with the default payload size
 	var dataBuffer [2048]byte
 
 	buffer := bytes.NewBuffer(dataBuffer[:0])
@@ -521,9 +667,33 @@ func (self *apnsPushService) singlePush(payload, token []byte, expiry uint32, mi
 	conn.Close()
 }
 
+// resend writes the notifications dropped by APNS on another connection.
+func (self *apnsPushService) resend(pdus [][]byte, pool *connpool.Pool) {
+	for _, pdu := range pdus {
+		var err error
+		for nrRetries := 0; nrRetries < 3; nrRetries++ {
+			var conn net.Conn
+			conn, err = pool.Get()
+			if err != nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(time.Duration(maxWaitTime) * time.Second))
+			err = writen(conn, pdu)
+			conn.SetWriteDeadline(time.Time{})
+			conn.Close()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			self.errChan <- fmt.Errorf("Unable to resend notification %v: %v", binary.BigEndian.Uint32(pdu[1:5]), err)
+		}
+	}
+}
+
 func (self *apnsPushService) multiPush(req *pushRequest, pool *connpool.Pool) {
 	defer close(req.errChan)
-	if len(req.payload) > maxPayLoadSize {
+	if len(req.payload) > apnsMaxPayLoadSize(req.psp) {
 		req.errChan <- NewBadNotificationWithDetails("payload is too large")
 		return
 	}
@@ -554,12 +724,7 @@ func clearRequest(req *pushRequest, resChan chan *apnsResult) {
 	}
 }
 
-func connectFeedback(psp *PushServiceProvider) (net.Conn, error) {
-	cert, err := tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
-	if err != nil {
-		return nil, NewBadPushServiceProviderWithDetails(psp, err.Error())
-	}
-
+func connectFeedback(psp *PushServiceProvider, cert tls.Certificate) (net.Conn, error) {
 	conf := &tls.Config{
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: false,
@@ -571,16 +736,7 @@ func connectFeedback(psp *PushServiceProvider) (net.Conn, error) {
 		}
 	}
 
-	addr := "feedback.sandbox.push.apple.com:2196"
-	if psp.VolatileData["addr"] == "gateway.push.apple.com:2195" {
-		addr = "feedback.push.apple.com:2196"
-	} else if psp.VolatileData["addr"] == "gateway.sandbox.push.apple.com:2195" {
-		addr = "feedback.sandbox.push.apple.com:2196"
-	} else {
-		ae := strings.Split(psp.VolatileData["addr"], ":")
-		addr = fmt.Sprintf("%v:2196", ae[0])
-	}
-	tlsconn, err := tls.Dial("tcp", addr, conf)
+	tlsconn, err := tls.Dial("tcp", apnsFeedbackAddr(psp), conf)
 	if err != nil {
 		return nil, err
 	}
@@ -591,66 +747,87 @@ func connectFeedback(psp *PushServiceProvider) (net.Conn, error) {
 	return tlsconn, nil
 }
 
-func receiveFeedback(psp *PushServiceProvider) []string {
-	conn, err := connectFeedback(psp)
-	if conn == nil || err != nil {
-		return nil
+func receiveFeedback(psp *PushServiceProvider, cert tls.Certificate) ([]*FeedbackUpdate, error) {
+	conn, err := connectFeedback(psp, cert)
+	if err != nil {
+		return nil, err
 	}
-	defer func() {
-		if conn != nil {
-			conn.Close()
-		}
-	}()
+	defer conn.Close()
 
-	ret := make([]string, 0, 1)
+	ret := make([]*FeedbackUpdate, 0, 1)
 	for {
 		var unsubTime uint32
 		var tokenLen uint16
 
 		err := binary.Read(conn, binary.BigEndian, &unsubTime)
 		if err != nil {
-			return ret
+			return ret, nil
 		}
 		err = binary.Read(conn, binary.BigEndian, &tokenLen)
 		if err != nil {
-			return ret
+			return ret, nil
 		}
 		devtoken := make([]byte, int(tokenLen))
 
 		n, err := io.ReadFull(conn, devtoken)
 		if err != nil {
-			return ret
+			return ret, nil
 		}
 		if n != int(tokenLen) {
-			return ret
+			return ret, nil
 		}
 
 		devtokenstr := hex.EncodeToString(devtoken)
 		devtokenstr = strings.ToLower(devtokenstr)
-		ret = append(ret, devtokenstr)
+		feedback := &FeedbackUpdate{
+			Provider:  psp,
+			Key:       devtokenstr,
+			Timestamp: time.Unix(int64(unsubTime), 0),
+		}
+		ret = append(ret, feedback)
 	}
-	return ret
+	return ret, nil
 }
 
-func processFeedback(psp *PushServiceProvider, dpCache *cache.Cache, errChan chan<- error) {
-	keys := receiveFeedback(psp)
-	for _, token := range keys {
-		dpif := dpCache.Delete(token)
-		if dpif == nil {
+// feedbackChecker reports the feedback of APNS every period until stop
+// is closed.
+func feedbackChecker(psp *PushServiceProvider, cert tls.Certificate, period time.Duration, errChan chan<- error, stop <-chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(period):
+		}
+		updates, err := receiveFeedback(psp, cert)
+		if err != nil {
+			errChan <- NewInfof("Cannot connect to the feedback service of %v: %v", psp.Name(), err)
 			continue
 		}
-		if dp, ok := dpif.(*DeliveryPoint); ok {
-			err := NewUnsubscribeUpdate(psp, dp)
-			errChan <- err
+		for _, update := range updates {
+			errChan <- update
 		}
 	}
 }
 
-func feedbackChecker(psp *PushServiceProvider, dpCache *cache.Cache, errChan chan<- error) {
-	for {
-		time.Sleep(time.Duration(feedbackCheckPeriod) * time.Minute)
-		processFeedback(psp, dpCache, errChan)
+func (p *apnsPushService) DeliveryPointKey(dp *DeliveryPoint) string {
+	return strings.ToLower(dp.FixedData["devtoken"])
+}
+
+func (p *apnsPushService) CheckFeedback(psp *PushServiceProvider) ([]*FeedbackUpdate, error) {
+	cert, err := loadCertificate(psp)
+	if err != nil {
+		return nil, NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	return receiveFeedback(psp, cert)
+}
+
+func apnsFeedbackPeriod(psp *PushServiceProvider) time.Duration {
+	if period, ok := psp.VolatileData["feedbackperiod"]; ok {
+		if n, err := strconv.Atoi(period); err == nil && n >= 0 {
+			return time.Duration(n) * time.Minute
+		}
 	}
+	return time.Duration(feedbackCheckPeriod) * time.Minute
 }
 
 func (self *apnsPushService) pushWorker(psp *PushServiceProvider, reqChan chan *pushRequest) {
@@ -661,9 +838,11 @@ func (self *apnsPushService) pushWorker(psp *PushServiceProvider, reqChan chan *
 
 	workerid := fmt.Sprintf("workder-%v-%v", time.Now().Unix(), rand.Int63())
 
-	dpCache := cache.New(256, -1, 0*time.Second, nil)
-
-	go feedbackChecker(psp, dpCache, self.errChan)
+	stop := make(chan bool)
+	defer close(stop)
+	if period := apnsFeedbackPeriod(psp); manager.err == nil && period > 0 {
+		go feedbackChecker(psp, manager.cert, period, self.errChan, stop)
+	}
 
 	// XXX use a tree structure would be faster and more stable.
 	reqMap := make(map[uint32]*pushRequest, 1024)
@@ -680,11 +859,6 @@ func (self *apnsPushService) pushWorker(psp *PushServiceProvider, reqChan chan *
 				reqMap[mid] = req
 			}
 
-			for _, dp := range req.dpList {
-				if key, ok := dp.FixedData["devtoken"]; ok {
-					dpCache.Set(key, dp)
-				}
-			}
 			go self.multiPush(req, pool)
 			go clearRequest(req, resultChan)
 		case res := <-resultChan:
@@ -692,6 +866,9 @@ func (self *apnsPushService) pushWorker(psp *PushServiceProvider, reqChan chan *
 				fmt.Printf("[%v][%v] I was told to stop (res == nil)\n", time.Now(), workerid)
 				return
 			}
+			if len(res.resend) > 0 {
+				go self.resend(res.resend, pool)
+			}
 			if req, ok := reqMap[res.msgId]; ok {
 				delete(reqMap, res.msgId)
 				req.resChan <- res
@@ -750,15 +927,18 @@ func toAPNSPayload(n *Notification) ([]byte, error) {
 	payload := make(map[string]interface{})
 	aps := make(map[string]interface{})
 	alert := make(map[string]interface{})
+	var sound map[string]interface{}
 	for k, v := range n.Data {
 		switch k {
 		case "msg":
 			alert["body"] = v
+		case "title", "subtitle":
+			alert[k] = v
 		case "action-loc-key":
 			alert[k] = v
-		case "loc-key":
+		case "loc-key", "title-loc-key", "subtitle-loc-key":
 			alert[k] = v
-		case "loc-args":
+		case "loc-args", "title-loc-args", "subtitle-loc-args":
 			alert[k] = parseList(v.(string))
 		case "badge":
 			b, err := strconv.Atoi(v.(string))
@@ -769,8 +949,34 @@ func toAPNSPayload(n *Notification) ([]byte, error) {
 			}
 		case "sound":
 			aps["sound"] = v
+		case "sound-critical", "sound-volume":
+			// Critical alerts use a dictionary for the sound.
+			if sound == nil {
+				sound = make(map[string]interface{}, 3)
+			}
+			if k == "sound-critical" {
+				c, err := strconv.Atoi(v.(string))
+				if err != nil {
+					continue
+				}
+				sound["critical"] = c
+			} else {
+				vol, err := strconv.ParseFloat(v.(string), 64)
+				if err != nil || vol < 0.0 || vol > 1.0 {
+					continue
+				}
+				sound["volume"] = vol
+			}
 		case "content-available":
 			aps["content-available"] = v
+		case "mutable-content":
+			m, err := strconv.Atoi(v.(string))
+			if err != nil {
+				continue
+			}
+			aps[k] = m
+		case "category", "thread-id", "target-content-id":
+			aps[k] = v
 		case "img":
 			alert["launch-image"] = v
 		case "id":
@@ -784,13 +990,21 @@ func toAPNSPayload(n *Notification) ([]byte, error) {
 		}
 	}
 
+	if sound != nil {
+		if name, ok := aps["sound"]; ok {
+			sound["name"] = name
+		} else {
+			sound["name"] = "default"
+		}
+		aps["sound"] = sound
+	}
 	aps["alert"] = alert
 	payload["aps"] = aps
 	j, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
-	if len(j) > maxPayLoadSize {
+	if len(j) > maxAllowedPayLoadSize {
 		return nil, NewBadNotificationWithDetails("payload is too large")
 	}
 	return j, nil
@@ -804,7 +1018,7 @@ func (self *apnsPushService) updateCheckPoint(prefix string) {
 	self.checkPoint = time.Now()
 }
 
-func resultCollector(psp *PushServiceProvider, resChan chan<- *apnsResult, c net.Conn) {
+func resultCollector(psp *PushServiceProvider, resChan chan<- *apnsResult, c *apnsConn) {
 	defer c.Close()
 	var bufData [6]byte
 	for {
@@ -857,6 +1071,15 @@ func resultCollector(psp *PushServiceProvider, resChan chan<- *apnsResult, c net
 		res := new(apnsResult)
 		res.msgId = msgid
 		res.status = status
+		// APNS closes the connection after an error response.
+		resend, found := c.dropAfter(msgid)
+		if !found {
+			info := new(apnsResult)
+			info.err = NewInfof("Unknown notification %v failed on %v. The notifications sent after it are not resent", msgid, psp.Name())
+			resChan <- info
+		}
+		res.resend = resend
 		resChan <- res
+		return
 	}
 }
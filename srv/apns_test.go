@@ -0,0 +1,112 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func testAPNSPdu(msgid uint32) []byte {
+	pdu := make([]byte, 5, 16)
+	pdu[0] = 1
+	binary.BigEndian.PutUint32(pdu[1:], msgid)
+	return append(pdu, "payload"...)
+}
+
+func TestAPNSConnDropAfterError(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	conn := newAPNSConn(client)
+	defer conn.Close()
+	for _, id := range []uint32{7, 3, 9, 4} {
+		if err := writen(conn, testAPNSPdu(id)); err != nil {
+			t.Fatalf("Cannot write: %v", err)
+		}
+	}
+
+	dropped, found := conn.dropAfter(3)
+	if !found || len(dropped) != 2 {
+		t.Fatalf("Expected 2 dropped notifications, got %v", len(dropped))
+	}
+	for i, id := range []uint32{9, 4} {
+		if msgid := binary.BigEndian.Uint32(dropped[i][1:5]); msgid != id {
+			t.Errorf("Expected notification %v, got %v", id, msgid)
+		}
+	}
+
+	if err := writen(conn, testAPNSPdu(10)); err == nil {
+		t.Errorf("Wrote on a connection closed by APNS")
+	}
+}
+
+func TestAPNSConnDropAfterUnknownId(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	conn := newAPNSConn(client)
+	defer conn.Close()
+	for _, id := range []uint32{7, 3, 9} {
+		if err := writen(conn, testAPNSPdu(id)); err != nil {
+			t.Fatalf("Cannot write: %v", err)
+		}
+	}
+
+	// Possibly delivered already: nothing is resent
+	if dropped, found := conn.dropAfter(42); found || len(dropped) != 0 {
+		t.Errorf("Expected nothing to resend, got %v notifications", len(dropped))
+	}
+}
+
+func TestAPNSPayloadDictionary(t *testing.T) {
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	notif.Data["title"] = "Greetings"
+	notif.Data["title-loc-args"] = "a,b"
+	notif.Data["thread-id"] = "chat-1"
+	notif.Data["mutable-content"] = "1"
+	notif.Data["sound"] = "alarm.caf"
+	notif.Data["sound-critical"] = "1"
+	notif.Data["sound-volume"] = "0.5"
+	payload, err := toAPNSPayload(notif)
+	if err != nil {
+		t.Fatalf("Cannot build payload: %v", err)
+	}
+	expected := `{"aps":{"alert":{"body":"Hello","title":"Greetings","title-loc-args":["a","b"]},` +
+		`"mutable-content":1,"sound":{"critical":1,"name":"alarm.caf","volume":0.5},"thread-id":"chat-1"}}`
+	if string(payload) != expected {
+		t.Errorf("Bad payload: %s", payload)
+	}
+
+	psp := NewEmptyPushServiceProvider()
+	if apnsMaxPayLoadSize(psp) != defaultMaxPayLoadSize {
+		t.Errorf("Bad default payload size")
+	}
+	psp.VolatileData["maxpayloadsize"] = "4096"
+	if apnsMaxPayLoadSize(psp) != 4096 {
+		t.Errorf("maxpayloadsize is ignored")
+	}
+}
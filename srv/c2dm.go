@@ -36,10 +36,12 @@ const (
 )
 
 type c2dmPushService struct {
+	clients *httpClientManager
 }
 
 func newC2DMPushService() *c2dmPushService {
 	ret := new(c2dmPushService)
+	ret.clients = newHTTPClientManager(&tls.Config{InsecureSkipVerify: true})
 	return ret
 }
 
@@ -48,7 +50,9 @@ func InstallC2DM() {
 	psm.RegisterPushServiceType(newC2DMPushService())
 }
 
-func (p *c2dmPushService) Finalize() {}
+func (p *c2dmPushService) Finalize() {
+	p.clients.closeAll()
+}
 
 func (p *c2dmPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 	psp *PushServiceProvider) error {
@@ -69,7 +73,11 @@ func (p *c2dmPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 	} else {
 		return errors.New("NoAuthToken")
 	}
-	return nil
+	err := buildEndpointsFromMap(kv, psp, "serviceurl")
+	if err != nil {
+		return err
+	}
+	return buildHTTPClientOptionsFromMap(kv, psp)
 }
 
 func (p *c2dmPushService) BuildDeliveryPointFromMap(kv map[string]string,
@@ -103,6 +111,10 @@ func (p *c2dmPushService) Name() string {
 	return "c2dm"
 }
 
+func (p *c2dmPushService) CredentialFields() []string {
+	return []string{"authtoken"}
+}
+
 func (p *c2dmPushService) singlePush(psp *PushServiceProvider, dp *DeliveryPoint, n *Notification) (string, error) {
 	if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != p.Name() {
 		return "", NewIncompatibleError()
@@ -142,7 +154,7 @@ func (p *c2dmPushService) singlePush(psp *PushServiceProvider, dp *DeliveryPoint
 		}
 	}
 
-	req, err := http.NewRequest("POST", c2dmServiceURL, strings.NewReader(data.Encode()))
+	req, err := http.NewRequest("POST", pspEndpoint(psp, "serviceurl", "c2dm"), strings.NewReader(data.Encode()))
 	if err != nil {
 		return "", err
 	}
@@ -152,9 +164,7 @@ func (p *c2dmPushService) singlePush(psp *PushServiceProvider, dp *DeliveryPoint
 	req.Header.Set("Authorization", "GoogleLogin auth="+authtoken)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	conf := &tls.Config{InsecureSkipVerify: true}
-	tr := &http.Transport{TLSClientConfig: conf}
-	client := &http.Client{Transport: tr}
+	client := p.clients.get(psp)
 
 	r, e20 := client.Do(req)
 	if e20 != nil {
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Inline credentials of push service providers are stored in the
+// database encrypted with this key. See SetCredentialKey()
+var credentialKey []byte
+
+// SetCredentialKey sets the passphrase used to encrypt the inline
+// credentials of push service providers. It is hashed once into the
+// AES key, without salt or stretching, so it must be a random secret
+// (e.g. 32 bytes from /dev/urandom) rather than a memorable password.
+func SetCredentialKey(passphrase string) {
+	if passphrase == "" {
+		credentialKey = nil
+		return
+	}
+	key := sha256.Sum256([]byte(passphrase))
+	credentialKey = key[:]
+}
+
+func credentialCipher() (cipher.AEAD, error) {
+	if credentialKey == nil {
+		return nil, errors.New("NoCredentialKey")
+	}
+	block, err := aes.NewCipher(credentialKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealCredential encrypts plain and returns it base64 encoded, nonce
+// first.
+func sealCredential(plain []byte) (string, error) {
+	aead, err := credentialCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openCredential(sealed string) ([]byte, error) {
+	aead, err := credentialCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("BadCredential")
+	}
+	nonce := data[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("BadCredential: wrong key?")
+	}
+	return plain, nil
+}
+
+func isInlinePEM(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN")
+}
+
+// pkcs12ToPEM converts a base64 encoded PKCS#12 blob into a PEM bundle
+// of the certificate chain and the private key, leaf certificate
+// first.
+func pkcs12ToPEM(p12, passphrase string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(p12)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := pkcs12.ToPEM(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*pem.Block
+	var key *pem.Block
+	for _, b := range blocks {
+		if b.Type == "CERTIFICATE" {
+			certs = append(certs, b)
+		} else if strings.HasSuffix(b.Type, "PRIVATE KEY") && key == nil {
+			key = b
+		}
+	}
+	if key == nil || len(certs) == 0 {
+		return nil, errors.New("No certificate or private key in PKCS#12")
+	}
+
+	// The chain is not ordered in PKCS#12. Find the leaf certificate,
+	// which must come first.
+	for i, _ := range certs {
+		buf := new(bytes.Buffer)
+		pem.Encode(buf, certs[i])
+		for j, c := range certs {
+			if j != i {
+				pem.Encode(buf, c)
+			}
+		}
+		pem.Encode(buf, key)
+		bundle := buf.Bytes()
+		if _, err := tls.X509KeyPair(bundle, bundle); err == nil {
+			return bundle, nil
+		}
+	}
+	return nil, errors.New("No certificate in PKCS#12 matches the private key")
+}
+
+// buildCertificateFromMap reads the certificate and the private key of
+// a psp. They are either the paths of PEM files (cert and key), inline
+// PEM (cert and key) or a base64 encoded PKCS#12 blob (p12 and
+// passphrase). Inline credentials are stored encrypted in the
+// volatile data, with the fingerprint of the certificate in the fixed
+// data.
+func buildCertificateFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	var bundle []byte
+	var err error
+	if p12, ok := kv["p12"]; ok && len(p12) > 0 {
+		bundle, err = pkcs12ToPEM(p12, kv["passphrase"])
+		if err != nil {
+			return err
+		}
+	} else {
+		cert, ok := kv["cert"]
+		if !ok || len(cert) == 0 {
+			return errors.New("NoCertificate")
+		}
+		key, ok := kv["key"]
+		if !ok || len(key) == 0 {
+			return errors.New("NoPrivateKey")
+		}
+		if isInlinePEM(cert) != isInlinePEM(key) {
+			return errors.New("cert and key must both be paths or both be inline PEM")
+		}
+		if !isInlinePEM(cert) {
+			psp.FixedData["cert"] = cert
+			psp.FixedData["key"] = key
+			_, err = tls.LoadX509KeyPair(cert, key)
+			return err
+		}
+		bundle = []byte(cert + "\n" + key)
+	}
+
+	cert, err := tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealCredential(bundle)
+	if err != nil {
+		return err
+	}
+	fingerprint := sha1.Sum(cert.Certificate[0])
+	psp.FixedData["certfingerprint"] = hex.EncodeToString(fingerprint[:])
+	psp.VolatileData["credential"] = sealed
+	return nil
+}
+
+// loadCertificate returns the certificate of a psp built by
+// buildCertificateFromMap()
+func loadCertificate(psp *PushServiceProvider) (tls.Certificate, error) {
+	if sealed, ok := psp.VolatileData["credential"]; ok {
+		bundle, err := openCredential(sealed)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(bundle, bundle)
+	}
+	return tls.LoadX509KeyPair(psp.FixedData["cert"], psp.FixedData["key"])
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func testCertificatePEM(t *testing.T, notAfter time.Time) (string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %v", err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Cannot marshal key: %v", err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+	return string(cert), string(key)
+}
+
+func TestInlineCertificate(t *testing.T) {
+	SetCredentialKey("secret")
+	defer SetCredentialKey("")
+	cert, key := testCertificatePEM(t, time.Now().Add(24*time.Hour))
+
+	psp := NewEmptyPushServiceProvider()
+	err := buildCertificateFromMap(map[string]string{"cert": cert, "key": key}, psp)
+	if err != nil {
+		t.Fatalf("Cannot build certificate: %v", err)
+	}
+	if _, ok := psp.FixedData["key"]; ok {
+		t.Errorf("Private key stored in fixed data")
+	}
+	if strings.Contains(psp.VolatileData["credential"], "PRIVATE KEY") {
+		t.Errorf("Credential is not encrypted")
+	}
+	if len(psp.FixedData["certfingerprint"]) != 40 {
+		t.Errorf("Bad fingerprint: %v", psp.FixedData["certfingerprint"])
+	}
+	if _, err := loadCertificate(psp); err != nil {
+		t.Errorf("Cannot load certificate: %v", err)
+	}
+
+	SetCredentialKey("wrong")
+	if _, err := loadCertificate(psp); err == nil {
+		t.Errorf("Loaded certificate with a wrong key")
+	}
+
+	err = buildCertificateFromMap(map[string]string{"cert": cert, "key": "/etc/uniqush/key.pem"}, NewEmptyPushServiceProvider())
+	if err == nil || !strings.Contains(err.Error(), "both be paths") {
+		t.Errorf("Expected inline cert with a key file to be rejected, got %v", err)
+	}
+}
+
+func TestAPNSCredentialExpiry(t *testing.T) {
+	SetCredentialKey("secret")
+	defer SetCredentialKey("")
+	notAfter := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	cert, key := testCertificatePEM(t, notAfter)
+
+	psp := NewEmptyPushServiceProvider()
+	err := buildCertificateFromMap(map[string]string{"cert": cert, "key": key}, psp)
+	if err != nil {
+		t.Fatalf("Cannot build certificate: %v", err)
+	}
+	pst := newAPNSPushService()
+	defer pst.Finalize()
+	expiry, err := pst.CredentialExpiry(psp)
+	if err != nil {
+		t.Fatalf("Cannot get expiry: %v", err)
+	}
+	if !expiry.Equal(notAfter) {
+		t.Errorf("Expected expiry %v, got %v", notAfter, expiry)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	apnsGateway                string = "gateway.push.apple.com:2195"
+	apnsSandboxGateway         string = "gateway.sandbox.push.apple.com:2195"
+	apnsFeedbackGateway        string = "feedback.push.apple.com:2196"
+	apnsSandboxFeedbackGateway string = "feedback.sandbox.push.apple.com:2196"
+)
+
+// Default endpoints of the push services by name
+var defaultEndpoints = map[string]string{
+	"gcm":                 gcmServiceURL,
+	"adm":                 admServiceURL,
+	"admtoken":            admTokenURL,
+	"c2dm":                c2dmServiceURL,
+	"hms":                 hmsServiceURL,
+	"hmstoken":            hmsTokenURL,
+	"apns":                apnsGateway,
+	"apnssandbox":         apnsSandboxGateway,
+	"apnsfeedback":        apnsFeedbackGateway,
+	"apnssandboxfeedback": apnsSandboxFeedbackGateway,
+}
+
+var endpointLock sync.RWMutex
+var endpoints = make(map[string]string, len(defaultEndpoints))
+
+// SetEndpoint changes the endpoint of a push service, e.g. to run
+// against fake providers: gcm, adm, admtoken, c2dm, hms and hmstoken are
+// URLs, apns, apnssandbox, apnsfeedback and apnssandboxfeedback are
+// host:port. An empty addr restores the default. Push service providers
+// may still override it.
+func SetEndpoint(name, addr string) error {
+	if _, ok := defaultEndpoints[name]; !ok {
+		return fmt.Errorf("Unknown endpoint: %v", name)
+	}
+	endpointLock.Lock()
+	defer endpointLock.Unlock()
+	if addr == "" {
+		delete(endpoints, name)
+		return nil
+	}
+	endpoints[name] = addr
+	return nil
+}
+
+func endpoint(name string) string {
+	endpointLock.RLock()
+	defer endpointLock.RUnlock()
+	if addr, ok := endpoints[name]; ok {
+		return addr
+	}
+	return defaultEndpoints[name]
+}
+
+// pspEndpoint returns the URL stored under opt in the psp, or the
+// endpoint name otherwise.
+func pspEndpoint(psp *PushServiceProvider, opt, name string) string {
+	if u, ok := psp.VolatileData[opt]; ok && len(u) > 0 {
+		return u
+	}
+	return endpoint(name)
+}
+
+// buildEndpointsFromMap copies the URLs overriding the endpoints of a
+// psp, e.g. serviceurl.
+func buildEndpointsFromMap(kv map[string]string, psp *PushServiceProvider, opts ...string) error {
+	for _, opt := range opts {
+		v, ok := kv[opt]
+		if !ok || len(v) == 0 {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid %v: %v", opt, v)
+		}
+		psp.VolatileData[opt] = v
+	}
+	return nil
+}
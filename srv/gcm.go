@@ -36,10 +36,12 @@ const (
 )
 
 type gcmPushService struct {
+	clients *httpClientManager
 }
 
 func newGCMPushService() *gcmPushService {
 	ret := new(gcmPushService)
+	ret.clients = newHTTPClientManager(&tls.Config{InsecureSkipVerify: false})
 	return ret
 }
 
@@ -48,7 +50,9 @@ func InstallGCM() {
 	psm.RegisterPushServiceType(newGCMPushService())
 }
 
-func (p *gcmPushService) Finalize() {}
+func (p *gcmPushService) Finalize() {
+	p.clients.closeAll()
+}
 
 func (p *gcmPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 	psp *PushServiceProvider) error {
@@ -70,7 +74,11 @@ func (p *gcmPushService) BuildPushServiceProviderFromMap(kv map[string]string,
 		return errors.New("NoAPIKey")
 	}
 
-	return nil
+	err := buildEndpointsFromMap(kv, psp, "serviceurl")
+	if err != nil {
+		return err
+	}
+	return buildHTTPClientOptionsFromMap(kv, psp)
 }
 
 func (p *gcmPushService) BuildDeliveryPointFromMap(kv map[string]string,
@@ -101,12 +109,22 @@ func (p *gcmPushService) Name() string {
 	return "gcm"
 }
 
+func (p *gcmPushService) CredentialFields() []string {
+	return []string{"apikey"}
+}
+
 type gcmData struct {
-	RegIDs         []string               `json:"registration_ids"`
-	CollapseKey    string                 `json:"collapse_key,omitempty"`
-	Data           map[string]interface{} `json:"data"`
-	DelayWhileIdle bool                   `json:"delay_while_idle,omitempty"`
-	TimeToLive     uint                   `json:"time_to_live,omitempty"`
+	RegIDs                []string               `json:"registration_ids"`
+	CollapseKey           string                 `json:"collapse_key,omitempty"`
+	Data                  map[string]interface{} `json:"data,omitempty"`
+	Notification          map[string]interface{} `json:"notification,omitempty"`
+	DelayWhileIdle        bool                   `json:"delay_while_idle,omitempty"`
+	TimeToLive            uint                   `json:"time_to_live,omitempty"`
+	Priority              string                 `json:"priority,omitempty"`
+	RestrictedPackageName string                 `json:"restricted_package_name,omitempty"`
+	ContentAvailable      bool                   `json:"content_available,omitempty"`
+	MutableContent        bool                   `json:"mutable_content,omitempty"`
+	DryRun                bool                   `json:"dry_run,omitempty"`
 }
 
 func (d *gcmData) String() string {
@@ -125,19 +143,16 @@ type gcmResult struct {
 	Results      []map[string]string `json:"results"`
 }
 
-func (self *gcmPushService) multicast(psp *PushServiceProvider, dpList []*DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
-	if len(dpList) == 0 {
-		return
-	}
-
-	regIds := make([]string, 0, len(dpList))
-
-	for _, dp := range dpList {
-		regIds = append(regIds, dp.VolatileData["regid"])
-	}
+// toGCMData builds the message without its receivers.
+//
+// The notification may have a notification payload, given as
+// notification[title], notification[body], etc. msgtype chooses between
+// data-only (data), notification-only (notification) or combined
+// (combined) messages. By default, the message is combined if it has a
+// notification payload, data-only otherwise.
+func toGCMData(notif *Notification) (*gcmData, error) {
 	msg := notif.Data
 	data := new(gcmData)
-	data.RegIDs = regIds
 
 	// TTL: default is one hour
 	data.TimeToLive = 60 * 60
@@ -151,6 +166,7 @@ func (self *gcmPushService) multicast(psp *PushServiceProvider, dpList []*Delive
 
 	nr_elem := len(msg)
 	data.Data = make(map[string]interface{}, nr_elem)
+	msgtype := ""
 
 	for k, v := range msg {
 		switch k {
@@ -162,11 +178,92 @@ func (self *gcmPushService) multicast(psp *PushServiceProvider, dpList []*Delive
 				continue
 			}
 			data.TimeToLive = uint(ttl)
+		case "msgtype":
+			msgtype = fmt.Sprintf("%v", v)
+		case "notification":
+			fields, ok := v.(map[string]string)
+			if !ok {
+				return nil, NewBadNotificationWithDetails("notification should be given as notification[field]")
+			}
+			data.Notification = make(map[string]interface{}, len(fields))
+			for field, value := range fields {
+				switch field {
+				case "body_loc_args", "title_loc_args":
+					data.Notification[field] = parseList(value)
+				default:
+					data.Notification[field] = value
+				}
+			}
+		case "priority":
+			p := fmt.Sprintf("%v", v)
+			if p != "high" && p != "normal" {
+				return nil, NewBadNotificationWithDetails("priority should be high or normal")
+			}
+			data.Priority = p
+		case "restricted_package_name":
+			data.RestrictedPackageName = fmt.Sprintf("%v", v)
+		case "content_available", "mutable_content", "dry_run":
+			b, err := strconv.ParseBool(fmt.Sprintf("%v", v))
+			if err != nil {
+				return nil, NewBadNotificationWithDetails(fmt.Sprintf("%v should be true or false", k))
+			}
+			switch k {
+			case "content_available":
+				data.ContentAvailable = b
+			case "mutable_content":
+				data.MutableContent = b
+			default:
+				data.DryRun = b
+			}
 		default:
 			data.Data[k] = v
 		}
 	}
 
+	switch msgtype {
+	case "":
+	case "data":
+		data.Notification = nil
+	case "notification":
+		if len(data.Notification) == 0 {
+			return nil, NewBadNotificationWithDetails("notification-only message without notification payload")
+		}
+		data.Data = nil
+	case "combined":
+		if len(data.Notification) == 0 {
+			return nil, NewBadNotificationWithDetails("combined message without notification payload")
+		}
+	default:
+		return nil, NewBadNotificationWithDetails("msgtype should be data, notification or combined")
+	}
+	return data, nil
+}
+
+func (self *gcmPushService) multicast(psp *PushServiceProvider, dpList []*DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	if len(dpList) == 0 {
+		return
+	}
+
+	regIds := make([]string, 0, len(dpList))
+
+	for _, dp := range dpList {
+		regIds = append(regIds, dp.VolatileData["regid"])
+	}
+	data, e0 := toGCMData(notif)
+	if e0 != nil {
+		for _, dp := range dpList {
+			res := new(PushResult)
+			res.Provider = psp
+			res.Content = notif
+
+			res.Err = e0
+			res.Destination = dp
+			resQueue <- res
+		}
+		return
+	}
+	data.RegIDs = regIds
+
 	jdata, e0 := json.Marshal(data)
 	if e0 != nil {
 		for _, dp := range dpList {
@@ -181,7 +278,7 @@ func (self *gcmPushService) multicast(psp *PushServiceProvider, dpList []*Delive
 		return
 	}
 
-	req, e1 := http.NewRequest("POST", gcmServiceURL, bytes.NewReader(jdata))
+	req, e1 := http.NewRequest("POST", pspEndpoint(psp, "serviceurl", "gcm"), bytes.NewReader(jdata))
 	if e1 != nil {
 		for _, dp := range dpList {
 			res := new(PushResult)
@@ -201,9 +298,7 @@ func (self *gcmPushService) multicast(psp *PushServiceProvider, dpList []*Delive
 	req.Header.Set("Authorization", "key="+apikey)
 	req.Header.Set("Content-Type", "application/json")
 
-	conf := &tls.Config{InsecureSkipVerify: false}
-	tr := &http.Transport{TLSClientConfig: conf}
-	client := &http.Client{Transport: tr}
+	client := self.clients.get(psp)
 
 	r, e2 := client.Do(req)
 	if e2 != nil {
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func TestGCMMessageTypes(t *testing.T) {
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	notif.Data["priority"] = "high"
+	notif.Data["dry_run"] = "true"
+	notif.Data["notification"] = map[string]string{
+		"title":          "Greetings",
+		"title_loc_args": "a,b",
+	}
+
+	data, err := toGCMData(notif)
+	if err != nil {
+		t.Fatalf("Cannot build message: %v", err)
+	}
+	b, _ := json.Marshal(data)
+	expected := `{"registration_ids":null,"data":{"msg":"Hello"},` +
+		`"notification":{"title":"Greetings","title_loc_args":["a","b"]},` +
+		`"time_to_live":3600,"priority":"high","dry_run":true}`
+	if string(b) != expected {
+		t.Errorf("Bad combined message: %s", b)
+	}
+
+	notif.Data["msgtype"] = "notification"
+	data, err = toGCMData(notif)
+	if err != nil || data.Data != nil || data.Notification == nil {
+		t.Errorf("Bad notification-only message: %v %v", data, err)
+	}
+
+	notif.Data["msgtype"] = "data"
+	data, err = toGCMData(notif)
+	if err != nil || data.Data == nil || data.Notification != nil {
+		t.Errorf("Bad data-only message: %v %v", data, err)
+	}
+
+	notif.Data["priority"] = "urgent"
+	if _, err = toGCMData(notif); err == nil {
+		t.Errorf("Accepted a bad priority")
+	}
+}
+
+// Stand-in for the GCM server which accepts every message.
+func newGCMStandIn() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data gcmData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		result := gcmResult{Success: uint(len(data.RegIDs))}
+		for i := range data.RegIDs {
+			result.Results = append(result.Results, map[string]string{"message_id": fmt.Sprint(i)})
+		}
+		json.NewEncoder(w).Encode(&result)
+	}))
+}
+
+func BenchmarkGCMMulticast(b *testing.B) {
+	server := newGCMStandIn()
+	defer server.Close()
+
+	pst := newGCMPushService()
+	defer pst.Finalize()
+
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(pst)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": pst.Name(),
+		"service":         "bench",
+		"projectid":       "bench",
+		"apikey":          "key",
+		"serviceurl":      server.URL,
+		"maxinflight":     "16",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	dpList := make([]*DeliveryPoint, 100)
+	for i := range dpList {
+		dpList[i] = NewEmptyDeliveryPoint()
+		dpList[i].VolatileData["regid"] = fmt.Sprint("regid", i)
+	}
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resQueue := make(chan *PushResult, len(dpList))
+			pst.multicast(psp, dpList, resQueue, notif)
+			close(resQueue)
+			for res := range resQueue {
+				if res.Err != nil {
+					b.Fatal(res.Err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	hmsTokenURL   string = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	hmsServiceURL string = "https://push-api.cloud.huawei.com/v1/" // + app id + /messages:send
+
+	hmsMaxNrDst int = 1000
+)
+
+// Result codes of HMS Push Kit
+const (
+	hmsSuccess              string = "80000000"
+	hmsPartialSuccess       string = "80100000"
+	hmsInvalidParameter     string = "80100001"
+	hmsInvalidMessage       string = "80100003"
+	hmsAuthFailed           string = "80200001"
+	hmsTokenExpired         string = "80200003"
+	hmsNoPermission         string = "80300002"
+	hmsAllTokensInvalid     string = "80300007"
+	hmsMessageTooLarge      string = "80300008"
+	hmsTooManyTokens        string = "80300010"
+	hmsHighPriorityExceeded string = "80300011"
+	hmsInternalError        string = "81000001"
+)
+
+type hmsPushService struct {
+	pspLock chan *pspLockRequest
+	clients *httpClientManager
+}
+
+func newHMSPushService() *hmsPushService {
+	ret := new(hmsPushService)
+	ret.pspLock = make(chan *pspLockRequest)
+	ret.clients = newHTTPClientManager(nil)
+	go pspTokenLocker(ret.pspLock, func(psp *PushServiceProvider) error {
+		return hmsRequestToken(ret.clients.get(psp), psp)
+	})
+	return ret
+}
+
+func InstallHMS() {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(newHMSPushService())
+}
+
+func (self *hmsPushService) Finalize() {
+	self.clients.closeAll()
+}
+func (self *hmsPushService) Name() string {
+	return "hms"
+}
+
+func (self *hmsPushService) CredentialFields() []string {
+	return []string{"clientsecret", "token"}
+}
+
+func (self *hmsPushService) SetErrorReportChan(errChan chan<- error) {
+	return
+}
+
+func (self *hmsPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	// The OAuth client id of an HMS app is its app id.
+	if clientid, ok := kv["clientid"]; ok && len(clientid) > 0 {
+		psp.FixedData["clientid"] = clientid
+	} else {
+		return errors.New("NoClientID")
+	}
+
+	if clientsecret, ok := kv["clientsecret"]; ok && len(clientsecret) > 0 {
+		psp.FixedData["clientsecret"] = clientsecret
+	} else {
+		return errors.New("NoClientSecrete")
+	}
+
+	// serviceurl is followed by the app id
+	err := buildEndpointsFromMap(kv, psp, "tokenurl", "serviceurl")
+	if err != nil {
+		return err
+	}
+	return buildHTTPClientOptionsFromMap(kv, psp)
+}
+
+func (self *hmsPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		dp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	if sub, ok := kv["subscriber"]; ok && len(sub) > 0 {
+		dp.FixedData["subscriber"] = sub
+	} else {
+		return errors.New("NoSubscriber")
+	}
+	if token, ok := kv["regid"]; ok && len(token) > 0 {
+		dp.FixedData["regid"] = token
+	} else {
+		return errors.New("NoRegId")
+	}
+
+	return nil
+}
+
+type hmsTokenFailObj struct {
+	Reason      int    `json:"error"`
+	SubReason   int    `json:"sub_error"`
+	Description string `json:"error_description"`
+}
+
+func hmsRequestToken(client *pspHTTPClient, psp *PushServiceProvider) error {
+	var ok bool
+	var clientid string
+	var csecret string
+
+	if _, ok = psp.VolatileData["token"]; ok {
+		if exp, ok := psp.VolatileData["expire"]; ok {
+			unixsec, err := strconv.ParseInt(exp, 10, 64)
+			if err == nil {
+				deadline := time.Unix(unixsec, int64(0))
+				if deadline.After(time.Now()) {
+					return nil
+				}
+			}
+		}
+	}
+
+	if clientid, ok = psp.FixedData["clientid"]; !ok {
+		return NewBadPushServiceProviderWithDetails(psp, "NoClientID")
+	}
+	if csecret, ok = psp.FixedData["clientsecret"]; !ok {
+		return NewBadPushServiceProviderWithDetails(psp, "NoClientSecrete")
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientid)
+	form.Set("client_secret", csecret)
+	req, err := http.NewRequest("POST", pspEndpoint(psp, "tokenurl", "hmstoken"), bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("NewRequest error: %v", err)
+	}
+	defer req.Body.Close()
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Do error: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	if resp.StatusCode != 200 {
+		var fail hmsTokenFailObj
+		err = json.Unmarshal(content, &fail)
+		if err != nil {
+			return NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v: %v", resp.StatusCode, string(content)))
+		}
+		return NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v:%v/%v (%v)", resp.StatusCode, fail.Reason, fail.SubReason, fail.Description))
+	}
+
+	var succ tokenSuccObj
+	err = json.Unmarshal(content, &succ)
+
+	if err != nil {
+		return NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+
+	expire := time.Now().Add(time.Duration(succ.Expire-60) * time.Second)
+
+	psp.VolatileData["expire"] = fmt.Sprintf("%v", expire.Unix())
+	psp.VolatileData["token"] = succ.Token
+	psp.VolatileData["type"] = succ.Type
+	return NewPushServiceProviderUpdate(psp)
+}
+
+type hmsAndroidConfig struct {
+	// nil when the notification has no msggroup, as 0 is a valid key.
+	CollapseKey *int   `json:"collapse_key,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+}
+
+type hmsMessage struct {
+	// Data is the notification encoded in JSON. HMS wants a string.
+	Data    string            `json:"data"`
+	Android *hmsAndroidConfig `json:"android,omitempty"`
+	Tokens  []string          `json:"token"`
+}
+
+type hmsRequest struct {
+	ValidateOnly bool        `json:"validate_only"`
+	Message      *hmsMessage `json:"message"`
+}
+
+type hmsResponse struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestId string `json:"requestId"`
+}
+
+// On partial success, the msg field of the response is itself an
+// encoded JSON object listing the rejected tokens.
+type hmsPartialResult struct {
+	Success       int      `json:"success"`
+	Failure       int      `json:"failure"`
+	IllegalTokens []string `json:"illegal_tokens"`
+}
+
+func notifToHMSMessage(notif *Notification) (msg *hmsMessage, err error) {
+	if notif == nil || len(notif.Data) == 0 {
+		err = NewBadNotificationWithDetails("empty notification")
+		return
+	}
+	msg = new(hmsMessage)
+	data := make(map[string]interface{}, len(notif.Data))
+	android := new(hmsAndroidConfig)
+	// TTL: default is one hour
+	android.TTL = "3600s"
+	for k, v := range notif.Data {
+		switch k {
+		case "msggroup":
+			// HMS only accepts integers as collapse keys.
+			ckey, err := strconv.Atoi(fmt.Sprintf("%v", v))
+			if err != nil || ckey < -1 || ckey > 100 {
+				continue
+			}
+			android.CollapseKey = &ckey
+		case "ttl":
+			ttl, err := strconv.ParseUint(fmt.Sprintf("%v", v), 10, 32)
+			if err != nil {
+				continue
+			}
+			android.TTL = fmt.Sprintf("%vs", ttl)
+		default:
+			data[k] = v
+		}
+	}
+	if len(data) == 0 {
+		err = NewBadNotificationWithDetails("empty notification")
+		return
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	msg.Data = string(b)
+	msg.Android = android
+	return
+}
+
+// hmsSendAll reports one result per delivery point. The message is
+// considered sent to the delivery points for which mkErr returns nil.
+func hmsSendAll(resQueue chan<- *PushResult, psp *PushServiceProvider, dpList []*DeliveryPoint, notif *Notification, msgid string, mkErr func(dp *DeliveryPoint) error) {
+	for _, dp := range dpList {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Destination = dp
+		res.Content = notif
+		res.Err = mkErr(dp)
+		if res.Err == nil {
+			res.MsgId = msgid
+		}
+		resQueue <- res
+	}
+}
+
+func hmsRetryAfter(resp *http.Response) time.Duration {
+	after := 5 * time.Second
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if sec, err := strconv.Atoi(retryAfter); err == nil {
+			after = time.Duration(sec) * time.Second
+		}
+	}
+	return after
+}
+
+func (self *hmsPushService) multicast(psp *PushServiceProvider, dpList []*DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	if len(dpList) == 0 {
+		return
+	}
+
+	res := new(PushResult)
+	res.Provider = psp
+	res.Content = notif
+	psp, err := lockPsp(self.pspLock, psp)
+	if err != nil {
+		res.Err = err
+		resQueue <- res
+		if _, ok := err.(*PushServiceProviderUpdate); !ok {
+			return
+		}
+	}
+
+	msg, err := notifToHMSMessage(notif)
+	if err != nil {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Content = notif
+		res.Err = err
+		resQueue <- res
+		return
+	}
+	msg.Tokens = make([]string, len(dpList))
+	for i, dp := range dpList {
+		msg.Tokens[i] = dp.FixedData["regid"]
+	}
+
+	jdata, err := json.Marshal(&hmsRequest{Message: msg})
+	if err != nil {
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error { return err })
+		return
+	}
+
+	serviceURL := fmt.Sprintf("%v%v/messages:send", pspEndpoint(psp, "serviceurl", "hms"), psp.FixedData["clientid"])
+	req, err := http.NewRequest("POST", serviceURL, bytes.NewReader(jdata))
+	if err != nil {
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error { return err })
+		return
+	}
+	defer req.Body.Close()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+psp.VolatileData["token"])
+
+	r, err := self.clients.get(psp).Do(req)
+	if err != nil {
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				return NewRetryErrorWithReason(psp, dp, notif, 3*time.Second, err)
+			}
+			return err
+		})
+		return
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode >= 500 || r.StatusCode == 429 {
+		after := hmsRetryAfter(r)
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error {
+			return NewRetryError(psp, dp, notif, after)
+		})
+		return
+	}
+
+	contents, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error { return err })
+		return
+	}
+	var result hmsResponse
+	err = json.Unmarshal(contents, &result)
+	if err != nil {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Content = notif
+		res.Err = fmt.Errorf("%v: %v", r.StatusCode, string(contents))
+		resQueue <- res
+		return
+	}
+
+	msgid := fmt.Sprintf("hms:%v-%v", psp.Name(), result.RequestId)
+	switch result.Code {
+	case hmsSuccess:
+		hmsSendAll(resQueue, psp, dpList, notif, msgid, func(dp *DeliveryPoint) error { return nil })
+		return
+	case hmsPartialSuccess:
+		var partial hmsPartialResult
+		illegal := make(map[string]bool, 10)
+		if json.Unmarshal([]byte(result.Msg), &partial) == nil {
+			for _, token := range partial.IllegalTokens {
+				illegal[token] = true
+			}
+		}
+		hmsSendAll(resQueue, psp, dpList, notif, msgid, func(dp *DeliveryPoint) error {
+			if illegal[dp.FixedData["regid"]] {
+				return NewUnsubscribeUpdate(psp, dp)
+			}
+			return nil
+		})
+		return
+	case hmsAllTokensInvalid:
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error {
+			return NewUnsubscribeUpdate(psp, dp)
+		})
+		return
+	case hmsAuthFailed, hmsTokenExpired:
+		// retry with a new token would fix it.
+		rejectToken(self.pspLock, psp)
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error {
+			return NewRetryError(psp, dp, notif, 10*time.Second)
+		})
+		return
+	case hmsInternalError, hmsHighPriorityExceeded:
+		after := hmsRetryAfter(r)
+		hmsSendAll(resQueue, psp, dpList, notif, "", func(dp *DeliveryPoint) error {
+			return NewRetryError(psp, dp, notif, after)
+		})
+		return
+	}
+
+	var reterr error
+	switch result.Code {
+	case hmsInvalidParameter, hmsInvalidMessage, hmsTooManyTokens:
+		reterr = NewBadNotificationWithDetails(result.Msg)
+	case hmsMessageTooLarge:
+		reterr = NewBadNotificationWithDetails("MessageTooLarge")
+	case hmsNoPermission:
+		reterr = NewBadPushServiceProviderWithDetails(psp, result.Msg)
+	default:
+		reterr = fmt.Errorf("HMSError %v: %v", result.Code, result.Msg)
+	}
+	res = new(PushResult)
+	res.Provider = psp
+	res.Content = notif
+	res.MsgId = msgid
+	res.Err = reterr
+	resQueue <- res
+}
+
+func (self *hmsPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	dpList := make([]*DeliveryPoint, 0, hmsMaxNrDst)
+	for dp := range dpQueue {
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != self.Name() {
+			res := new(PushResult)
+			res.Provider = psp
+			res.Destination = dp
+			res.Content = notif
+			res.Err = NewIncompatibleError()
+			resQueue <- res
+			continue
+		}
+		if _, ok := dp.FixedData["regid"]; !ok {
+			res := new(PushResult)
+			res.Provider = psp
+			res.Destination = dp
+			res.Content = notif
+			res.Err = NewBadDeliveryPoint(dp)
+			resQueue <- res
+			continue
+		}
+		dpList = append(dpList, dp)
+
+		if len(dpList) >= hmsMaxNrDst {
+			self.multicast(psp, dpList, resQueue, notif)
+			dpList = dpList[:0]
+		}
+	}
+	if len(dpList) > 0 {
+		self.multicast(psp, dpList, resQueue, notif)
+	}
+
+	close(resQueue)
+}
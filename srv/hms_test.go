@@ -0,0 +1,258 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// Stand-in for HMS. Tokens are t1, t2... and code is the result of
+// every message sent with the last one. Tokens named bad are illegal.
+type hmsStandIn struct {
+	lock    sync.Mutex
+	tokens  int
+	batches []int
+	code    string
+}
+
+func (self *hmsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if r.URL.Path == "/token" {
+		self.tokens++
+		json.NewEncoder(w).Encode(&tokenSuccObj{
+			Token:  fmt.Sprintf("t%v", self.tokens),
+			Expire: 3600,
+			Type:   "Bearer",
+		})
+		return
+	}
+	if r.URL.Path != "/app/messages:send" {
+		w.WriteHeader(404)
+		return
+	}
+	var req hmsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	self.batches = append(self.batches, len(req.Message.Tokens))
+	code := self.code
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer t%v", self.tokens) {
+		code = hmsTokenExpired
+	}
+	resp := &hmsResponse{Code: code, RequestId: "req"}
+	if code == hmsSuccess {
+		partial := hmsPartialResult{}
+		for _, token := range req.Message.Tokens {
+			if token == "bad" {
+				partial.IllegalTokens = append(partial.IllegalTokens, token)
+			}
+		}
+		if len(partial.IllegalTokens) > 0 {
+			msg, _ := json.Marshal(&partial)
+			resp.Code = hmsPartialSuccess
+			resp.Msg = string(msg)
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newHMSTest(t *testing.T) (*hmsPushService, *hmsStandIn, *httptest.Server, *PushServiceProvider) {
+	standIn := &hmsStandIn{code: hmsSuccess}
+	server := httptest.NewServer(standIn)
+	pst := newHMSPushService()
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(pst)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": pst.Name(),
+		"service":         "myservice",
+		"clientid":        "app",
+		"clientsecret":    "secret",
+		"tokenurl":        server.URL + "/token",
+		"serviceurl":      server.URL + "/",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+	return pst, standIn, server, psp
+}
+
+func hmsPushAll(t *testing.T, pst *hmsPushService, psp *PushServiceProvider, regids ...string) []*PushResult {
+	psm := GetPushServiceManager()
+	dpQueue := make(chan *DeliveryPoint)
+	resQueue := make(chan *PushResult)
+	go func() {
+		for i, regid := range regids {
+			dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+				"pushservicetype": pst.Name(),
+				"service":         "myservice",
+				"subscriber":      fmt.Sprintf("user%v", i),
+				"regid":           regid,
+			})
+			if err != nil {
+				t.Errorf("Cannot build dp: %v", err)
+				continue
+			}
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	go pst.Push(psp, dpQueue, resQueue, notif)
+	ret := make([]*PushResult, 0, len(regids))
+	for res := range resQueue {
+		ret = append(ret, res)
+	}
+	return ret
+}
+
+func TestHMSPushInBatches(t *testing.T) {
+	pst, standIn, server, psp := newHMSTest(t)
+	defer server.Close()
+	defer pst.Finalize()
+
+	regids := make([]string, 2*hmsMaxNrDst+500)
+	for i := range regids {
+		regids[i] = fmt.Sprintf("regid%v", i)
+	}
+	regids[10] = "bad"
+	results := hmsPushAll(t, pst, psp, regids...)
+
+	updates, unsubscribed, sent := 0, 0, 0
+	for _, res := range results {
+		switch res.Err.(type) {
+		case nil:
+			if !strings.HasPrefix(res.MsgId, "hms:") {
+				t.Errorf("Bad message id: %v", res.MsgId)
+			}
+			sent++
+		case *PushServiceProviderUpdate:
+			updates++
+		case *UnsubscribeUpdate:
+			unsubscribed++
+		default:
+			t.Errorf("Push failed: %v", res.Err)
+		}
+	}
+	// The token is requested once and shared by the batches
+	if standIn.tokens != 1 || updates != 1 {
+		t.Errorf("%v tokens requested, %v updates", standIn.tokens, updates)
+	}
+	if unsubscribed != 1 || sent != len(regids)-1 {
+		t.Errorf("%v sent, %v unsubscribed", sent, unsubscribed)
+	}
+	if fmt.Sprint(standIn.batches) != "[1000 1000 500]" {
+		t.Errorf("Bad batches: %v", standIn.batches)
+	}
+}
+
+func TestHMSTokenRejected(t *testing.T) {
+	pst, standIn, server, psp := newHMSTest(t)
+	defer server.Close()
+	defer pst.Finalize()
+
+	hmsPushAll(t, pst, psp, "regid")
+	// HMS revokes t1 before it expires
+	standIn.lock.Lock()
+	standIn.tokens++
+	standIn.lock.Unlock()
+
+	results := hmsPushAll(t, pst, psp, "regid")
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %v", len(results))
+	}
+	retry, ok := results[0].Err.(*RetryError)
+	if !ok {
+		t.Fatalf("Expected retry error, got %v", results[0].Err)
+	}
+
+	// Both the retry and the copy of the psp in the database get a new token
+	for _, p := range []*PushServiceProvider{retry.Provider, psp} {
+		results = hmsPushAll(t, pst, p, "regid")
+		for _, res := range results {
+			switch res.Err.(type) {
+			case nil, *PushServiceProviderUpdate:
+			default:
+				t.Errorf("Push failed: %v", res.Err)
+			}
+		}
+	}
+	if standIn.tokens != 3 {
+		t.Errorf("Expected a new token, %v tokens", standIn.tokens)
+	}
+}
+
+func TestHMSResultCodes(t *testing.T) {
+	pst, standIn, server, psp := newHMSTest(t)
+	defer server.Close()
+	defer pst.Finalize()
+
+	for code, expected := range map[string]string{
+		hmsAllTokensInvalid:     "*push.UnsubscribeUpdate",
+		hmsInternalError:        "*push.RetryError",
+		hmsHighPriorityExceeded: "*push.RetryError",
+		hmsInvalidMessage:       "*push.BadNotification",
+		hmsMessageTooLarge:      "*push.BadNotification",
+		hmsNoPermission:         "*push.BadPushServiceProvider",
+		"80000042":              "*errors.errorString",
+	} {
+		standIn.lock.Lock()
+		standIn.code = code
+		standIn.lock.Unlock()
+		for _, res := range hmsPushAll(t, pst, psp, "regid") {
+			if _, ok := res.Err.(*PushServiceProviderUpdate); ok {
+				continue
+			}
+			if got := fmt.Sprintf("%T", res.Err); got != expected {
+				t.Errorf("%v: expected %v, got %v", code, expected, got)
+			}
+		}
+	}
+}
+
+func TestHMSCollapseKey(t *testing.T) {
+	for msggroup, expected := range map[string]string{
+		"0":    `"collapse_key":0`,
+		"42":   `"collapse_key":42`,
+		"none": `"android":{"ttl":"3600s"}`,
+	} {
+		notif := NewEmptyNotification()
+		notif.Data["msg"] = "Hello"
+		if msggroup != "none" {
+			notif.Data["msggroup"] = msggroup
+		}
+		msg, err := notifToHMSMessage(notif)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(msg)
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("%v: expected %v in %v", msggroup, expected, string(b))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	// in Seconds. Can be changed per psp with timeout
+	defaultHTTPTimeout int = 30
+	// Can be changed per psp with maxinflight
+	defaultMaxInFlight int = 100
+)
+
+// buildHTTPClientOptionsFromMap reads the options of the HTTP client of
+// a psp: timeout in seconds and maxinflight, the maximum number of
+// concurrent requests.
+func buildHTTPClientOptionsFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	for _, opt := range []string{"timeout", "maxinflight"} {
+		if v, ok := kv[opt]; ok && len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("Invalid %v: %v", opt, v)
+			}
+			psp.VolatileData[opt] = v
+		}
+	}
+	return nil
+}
+
+func pspIntOption(psp *PushServiceProvider, opt string, def int) int {
+	if v, ok := psp.VolatileData[opt]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// retryAfter reads the Retry-After header of resp, either in seconds
+// or as an HTTP date. It returns def if there is none.
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return def
+}
+
+// pspHTTPClient is shared by all the requests sent through a psp, so
+// that connections are kept alive between batches.
+type pspHTTPClient struct {
+	client      *http.Client
+	transport   *http.Transport
+	timeout     int
+	maxInFlight int
+	slots       chan bool
+}
+
+// releasingBody frees the slot of the request once its response is
+// closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (self *releasingBody) Close() error {
+	err := self.ReadCloser.Close()
+	self.once.Do(self.release)
+	return err
+}
+
+// Do sends req once less than maxinflight requests of the psp are
+// pending. The caller must close the body of the response.
+func (self *pspHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	self.slots <- true
+	release := func() { <-self.slots }
+	resp, err := self.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// httpClientManager keeps one pspHTTPClient per psp.
+type httpClientManager struct {
+	tlsConfig *tls.Config
+	lock      sync.Mutex
+	clients   map[string]*pspHTTPClient
+}
+
+func newHTTPClientManager(tlsConfig *tls.Config) *httpClientManager {
+	ret := new(httpClientManager)
+	ret.tlsConfig = tlsConfig
+	ret.clients = make(map[string]*pspHTTPClient, 10)
+	return ret
+}
+
+func (self *httpClientManager) newClient(timeout, maxInFlight int) *pspHTTPClient {
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(timeout) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     self.tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxInFlight,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	ret := new(pspHTTPClient)
+	ret.transport = tr
+	ret.client = &http.Client{
+		Transport: tr,
+		Timeout:   time.Duration(timeout) * time.Second,
+	}
+	ret.timeout = timeout
+	ret.maxInFlight = maxInFlight
+	ret.slots = make(chan bool, maxInFlight)
+	return ret
+}
+
+// get returns the client of psp, or a new one if the options of psp
+// changed.
+func (self *httpClientManager) get(psp *PushServiceProvider) *pspHTTPClient {
+	timeout := pspIntOption(psp, "timeout", defaultHTTPTimeout)
+	maxInFlight := pspIntOption(psp, "maxinflight", defaultMaxInFlight)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	client, ok := self.clients[psp.Name()]
+	if ok && client.timeout == timeout && client.maxInFlight == maxInFlight {
+		return client
+	}
+	if ok {
+		client.transport.CloseIdleConnections()
+	}
+	client = self.newClient(timeout, maxInFlight)
+	self.clients[psp.Name()] = client
+	return client
+}
+
+func (self *httpClientManager) closeAll() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for name, client := range self.clients {
+		client.transport.CloseIdleConnections()
+		delete(self.clients, name)
+	}
+}
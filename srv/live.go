@@ -0,0 +1,547 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	websocketGUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  uint8 = 0x1
+	wsOpClose uint8 = 0x8
+	wsOpPing  uint8 = 0x9
+	wsOpPong  uint8 = 0xA
+
+	// in Seconds
+	liveWriteTimeout int = 10
+	liveHeartbeat    int = 30
+)
+
+// A live connection is a long-lived connection opened by a client
+// to uniqush, either with WebSocket or with Server-Sent Events.
+type liveConn interface {
+	Send(msg []byte) error
+	Close()
+}
+
+/*********************/
+
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+	closed bool
+}
+
+func (self *wsConn) writeFrame(opcode uint8, payload []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return io.ErrClosedPipe
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	n := len(payload)
+	switch {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	self.conn.SetWriteDeadline(time.Now().Add(time.Duration(liveWriteTimeout) * time.Second))
+	defer self.conn.SetWriteDeadline(time.Time{})
+	err := writen(self.conn, header)
+	if err != nil {
+		return err
+	}
+	return writen(self.conn, payload)
+}
+
+func (self *wsConn) Send(msg []byte) error {
+	return self.writeFrame(wsOpText, msg)
+}
+
+func (self *wsConn) Close() {
+	self.writeFrame(wsOpClose, nil)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.conn.Close()
+}
+
+func (self *wsConn) readFrame() (opcode uint8, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(self.reader, head[:]); err != nil {
+		return
+	}
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var l uint16
+		err = binary.Read(self.reader, binary.BigEndian, &l)
+		n = uint64(l)
+	case 127:
+		err = binary.Read(self.reader, binary.BigEndian, &n)
+	}
+	if err != nil {
+		return
+	}
+	// Clients only send control frames to us. Anything bigger is abuse.
+	if n > 4096 {
+		err = errors.New("frame too large")
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(self.reader, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(self.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// serve reads the frames sent by the client until the connection is
+// closed. Only control frames are meaningful to us.
+func (self *wsConn) serve() {
+	for {
+		opcode, payload, err := self.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpPing:
+			self.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			return
+		}
+	}
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("not a websocket handshake")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.New()
+	io.WriteString(hash, key+websocketGUID)
+	accept := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if err = writen(conn, []byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+/*********************/
+
+type sseConn struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	lock    sync.Mutex
+	closed  bool
+	done    chan bool
+}
+
+func (self *sseConn) write(data string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return io.ErrClosedPipe
+	}
+	_, err := io.WriteString(self.w, data)
+	if err != nil {
+		return err
+	}
+	self.flusher.Flush()
+	return nil
+}
+
+func (self *sseConn) Send(msg []byte) error {
+	return self.write("data: " + string(msg) + "\n\n")
+}
+
+func (self *sseConn) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		self.closed = true
+		close(self.done)
+	}
+}
+
+// serve blocks until either the client goes away or the connection
+// is closed by us. The ResponseWriter must not be used after that.
+func (self *sseConn) serve(r *http.Request) {
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			self.Close()
+			return
+		case <-self.done:
+			return
+		case <-time.After(time.Duration(liveHeartbeat) * time.Second):
+			// A comment line keeps proxies from closing an idle stream.
+			if err := self.write(": ping\n\n"); err != nil {
+				self.Close()
+				return
+			}
+		}
+	}
+}
+
+/*********************/
+
+type livePushService struct {
+	lock sync.RWMutex
+	// Keyed by connKey()
+	conns  map[string]map[liveConn]bool
+	nextId uint64
+	// Signs the tokens of the connection ids, see connectionToken()
+	key []byte
+}
+
+var liveService *livePushService
+
+func newLivePushService() *livePushService {
+	ret := new(livePushService)
+	ret.conns = make(map[string]map[liveConn]bool, 1024)
+	ret.key = make([]byte, sha256.Size)
+	io.ReadFull(rand.Reader, ret.key)
+	return ret
+}
+
+// SetLiveKey sets the secret signing the tokens of live connections, so
+// that clients may resume their connection id on another instance of
+// uniqush-push sharing the secret, or after a restart. Without secret,
+// a random one is used.
+func SetLiveKey(secret string) {
+	if liveService == nil || secret == "" {
+		return
+	}
+	key := sha256.Sum256([]byte(secret))
+	liveService.lock.Lock()
+	liveService.key = key[:]
+	liveService.lock.Unlock()
+}
+
+func InstallLive() {
+	liveService = newLivePushService()
+	GetPushServiceManager().RegisterPushServiceType(liveService)
+}
+
+// LiveHandler returns the handler accepting live connections from
+// clients, or nil if the live push service type is not installed.
+func LiveHandler() http.Handler {
+	if liveService == nil {
+		return nil
+	}
+	return liveService
+}
+
+func (self *livePushService) Name() string {
+	return "live"
+}
+
+func (self *livePushService) Finalize() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for id, conns := range self.conns {
+		for conn, _ := range conns {
+			conn.Close()
+		}
+		delete(self.conns, id)
+	}
+}
+
+func (self *livePushService) SetErrorReportChan(errChan chan<- error) {
+	return
+}
+
+func (self *livePushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	return nil
+}
+
+func (self *livePushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		dp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	if sub, ok := kv["subscriber"]; ok && len(sub) > 0 {
+		dp.FixedData["subscriber"] = sub
+	} else {
+		return errors.New("NoSubscriber")
+	}
+	if connid, ok := kv["connid"]; ok && len(connid) > 0 {
+		dp.FixedData["connid"] = connid
+	} else {
+		return errors.New("NoConnectionID")
+	}
+	return nil
+}
+
+// The same connection id may be used by different services
+func connKey(service, id string) string {
+	return service + "\x00" + id
+}
+
+func (self *livePushService) register(service, id string, conn liveConn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := connKey(service, id)
+	conns, ok := self.conns[key]
+	if !ok {
+		conns = make(map[liveConn]bool, 1)
+		self.conns[key] = conns
+	}
+	conns[conn] = true
+}
+
+func (self *livePushService) unregister(service, id string, conn liveConn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := connKey(service, id)
+	if conns, ok := self.conns[key]; ok {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(self.conns, key)
+		}
+	}
+}
+
+func (self *livePushService) connections(service, id string) []liveConn {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	conns := self.conns[connKey(service, id)]
+	ret := make([]liveConn, 0, len(conns))
+	for conn, _ := range conns {
+		ret = append(ret, conn)
+	}
+	return ret
+}
+
+func newConnectionId() string {
+	var d [16]byte
+	io.ReadFull(rand.Reader, d[:])
+	return base64.URLEncoding.EncodeToString(d[:])
+}
+
+func (self *livePushService) signature(service, id string) []byte {
+	self.lock.RLock()
+	mac := hmac.New(sha256.New, self.key)
+	self.lock.RUnlock()
+	mac.Write([]byte(connKey(service, id)))
+	return mac.Sum(nil)
+}
+
+// connectionToken proves that the connection id of service was assigned
+// by uniqush-push.
+func (self *livePushService) connectionToken(service, id string) string {
+	return id + "." + base64.URLEncoding.EncodeToString(self.signature(service, id))
+}
+
+// connectionOfToken returns the connection id of a token of service, if
+// valid.
+func (self *livePushService) connectionOfToken(service, token string) (string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return "", false
+	}
+	sig, err := base64.URLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return "", false
+	}
+	id := token[:i]
+	return id, hmac.Equal(sig, self.signature(service, id))
+}
+
+// ServeHTTP accepts a live connection to the service parameter, and
+// assigns it a random id. The first message sent to the client holds
+// this id, the connid to use when subscribing, and a token. To keep its
+// id across reconnections, the client gives this token as the token
+// parameter.
+func (self *livePushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	service := r.Form.Get("service")
+	if service == "" {
+		http.Error(w, "NoService", http.StatusBadRequest)
+		return
+	}
+	var id string
+	if token := r.Form.Get("token"); token != "" {
+		var ok bool
+		id, ok = self.connectionOfToken(service, token)
+		if !ok {
+			http.Error(w, "InvalidToken", http.StatusForbidden)
+			return
+		}
+	} else {
+		id = newConnectionId()
+	}
+	hello, _ := json.Marshal(map[string]string{
+		"connid": id,
+		"token":  self.connectionToken(service, id),
+	})
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if conn.Send(hello) != nil {
+			conn.Close()
+			return
+		}
+		self.register(service, id, conn)
+		conn.serve()
+		self.unregister(service, id, conn)
+		conn.Close()
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	conn := &sseConn{w: w, flusher: flusher, done: make(chan bool)}
+	if conn.Send(hello) != nil {
+		return
+	}
+	self.register(service, id, conn)
+	conn.serve(r)
+	self.unregister(service, id, conn)
+}
+
+func (self *livePushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	defer close(resQueue)
+
+	payload, err := json.Marshal(notif.Data)
+	if err != nil {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Content = notif
+		res.Err = NewBadNotificationWithDetails(err.Error())
+		resQueue <- res
+		for _ = range dpQueue {
+		}
+		return
+	}
+
+	for dp := range dpQueue {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Destination = dp
+		res.Content = notif
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != self.Name() {
+			res.Err = NewIncompatibleError()
+			resQueue <- res
+			continue
+		}
+		connid, ok := dp.FixedData["connid"]
+		if !ok {
+			res.Err = NewBadDeliveryPointWithDetails(dp, "NoConnectionID")
+			resQueue <- res
+			continue
+		}
+
+		// The client may have several connections open under the
+		// same id. It is online as long as one of them accepts
+		// the message.
+		delivered := false
+		for _, conn := range self.connections(dp.FixedData["service"], connid) {
+			if conn.Send(payload) != nil {
+				self.unregister(dp.FixedData["service"], connid, conn)
+				conn.Close()
+				continue
+			}
+			delivered = true
+		}
+		if !delivered {
+			res.Err = NewOfflineError(dp)
+		} else {
+			mid := atomic.AddUint64(&self.nextId, 1)
+			res.MsgId = fmt.Sprintf("live:%v-%v", psp.Name(), mid)
+		}
+		resQueue <- res
+	}
+}
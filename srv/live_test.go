@@ -0,0 +1,227 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+func buildLivePeers(t *testing.T, pst *livePushService, connids ...string) (*PushServiceProvider, []*DeliveryPoint) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(pst)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "live",
+		"service":         "myservice",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+	dps := make([]*DeliveryPoint, 0, len(connids))
+	for _, connid := range connids {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+			"pushservicetype": "live",
+			"service":         "myservice",
+			"subscriber":      "user",
+			"connid":          connid,
+		})
+		if err != nil {
+			t.Fatalf("Cannot build delivery point: %v", err)
+		}
+		dps = append(dps, dp)
+	}
+	return psp, dps
+}
+
+func livePushAll(pst *livePushService, psp *PushServiceProvider, dps []*DeliveryPoint, notif *Notification) []*PushResult {
+	dpQueue := make(chan *DeliveryPoint)
+	resQueue := make(chan *PushResult)
+	go func() {
+		for _, dp := range dps {
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	go pst.Push(psp, dpQueue, resQueue, notif)
+	ret := make([]*PushResult, 0, len(dps))
+	for res := range resQueue {
+		ret = append(ret, res)
+	}
+	return ret
+}
+
+func waitForConnection(pst *livePushService, id string) {
+	for i := 0; i < 100 && len(pst.connections("myservice", id)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connectSSE opens a Server-Sent Events connection and returns its hello
+// message.
+func connectSSE(t *testing.T, url string) (*http.Response, *bufio.Reader, map[string]string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Cannot connect: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return resp, nil, nil
+	}
+	reader := bufio.NewReader(resp.Body)
+	line, _ := reader.ReadString('\n')
+	reader.ReadString('\n')
+	hello := make(map[string]string)
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &hello)
+	if err != nil || hello["connid"] == "" || hello["token"] == "" {
+		t.Fatalf("Bad hello message: %v", line)
+	}
+	return resp, reader, hello
+}
+
+func TestLiveServerSentEvents(t *testing.T) {
+	pst := newLivePushService()
+	server := httptest.NewServer(pst)
+	defer server.Close()
+	defer pst.Finalize()
+
+	resp, reader, hello := connectSSE(t, server.URL+"?service=myservice")
+	defer resp.Body.Close()
+	waitForConnection(pst, hello["connid"])
+
+	psp, dps := buildLivePeers(t, pst, hello["connid"], "gone-client")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	results := livePushAll(pst, psp, dps, notif)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %v", len(results))
+	}
+	if results[0].Err != nil {
+		t.Errorf("Push failed: %v", results[0].Err)
+	}
+	if _, ok := results[1].Err.(*OfflineError); !ok {
+		t.Errorf("Expected offline error, got %v", results[1].Err)
+	}
+
+	line, _ := reader.ReadString('\n')
+	if line != "data: {\"msg\":\"Hello\"}\n" {
+		t.Errorf("Bad event: %q", line)
+	}
+}
+
+func TestLiveWebSocket(t *testing.T) {
+	pst := newLivePushService()
+	server := httptest.NewServer(pst)
+	defer server.Close()
+	defer pst.Finalize()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Cannot connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /?service=myservice HTTP/1.1\r\nHost: localhost\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Bad handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Bad handshake status: %v", resp.StatusCode)
+	}
+	// Example from RFC 6455
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Bad Sec-WebSocket-Accept: %v", accept)
+	}
+
+	readText := func() string {
+		var head [2]byte
+		io.ReadFull(reader, head[:])
+		if head[0] != 0x80|wsOpText {
+			t.Fatalf("Unexpected frame: %x", head[0])
+		}
+		payload := make([]byte, int(head[1]&0x7f))
+		io.ReadFull(reader, payload)
+		return string(payload)
+	}
+	hello := make(map[string]string)
+	if err := json.Unmarshal([]byte(readText()), &hello); err != nil || hello["connid"] == "" {
+		t.Fatalf("Bad hello message: %v", hello)
+	}
+	waitForConnection(pst, hello["connid"])
+
+	psp, dps := buildLivePeers(t, pst, hello["connid"])
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	results := livePushAll(pst, psp, dps, notif)
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("Push failed: %v", results)
+	}
+	if msg := readText(); msg != `{"msg":"Hello"}` {
+		t.Errorf("Bad message: %v", msg)
+	}
+}
+
+func TestLiveConnectionIds(t *testing.T) {
+	pst := newLivePushService()
+	server := httptest.NewServer(pst)
+	defer server.Close()
+	defer pst.Finalize()
+
+	// Clients cannot choose their id
+	resp, _, hello := connectSSE(t, server.URL+"?service=myservice&id=someone")
+	resp.Body.Close()
+	if hello["connid"] == "someone" {
+		t.Errorf("Client chose its connection id")
+	}
+
+	// but resume it with its token
+	resp, _, again := connectSSE(t, server.URL+"?service=myservice&token="+hello["token"])
+	resp.Body.Close()
+	if again["connid"] != hello["connid"] {
+		t.Errorf("Connection id %v not resumed, got %v", hello["connid"], again["connid"])
+	}
+
+	forged := []string{
+		"someone." + strings.SplitN(hello["token"], ".", 2)[1],
+		hello["connid"] + ".AAAA",
+		hello["connid"],
+	}
+	for _, token := range forged {
+		resp, _, _ = connectSSE(t, server.URL+"?service=myservice&token="+token)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Token %v accepted", token)
+		}
+	}
+	// Tokens are bound to their service
+	resp, _, _ = connectSSE(t, server.URL+"?service=other&token="+hello["token"])
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Token of another service accepted")
+	}
+}
@@ -0,0 +1,566 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	mqttCONNECT    uint8 = 1
+	mqttCONNACK    uint8 = 2
+	mqttPUBLISH    uint8 = 3
+	mqttPUBACK     uint8 = 4
+	mqttPINGREQ    uint8 = 12
+	mqttPINGRESP   uint8 = 13
+	mqttDISCONNECT uint8 = 14
+
+	// in Seconds
+	mqttKeepAlive   int = 60
+	mqttWaitTimeout int = 20
+)
+
+var mqttConnackErrors = []string{
+	"",
+	"unacceptable protocol version",
+	"identifier rejected",
+	"server unavailable",
+	"bad user name or password",
+	"not authorized",
+}
+
+// mqttConn is a connection to an MQTT broker speaking MQTT 3.1.1.
+// Only the subset of the protocol needed to publish is implemented.
+type mqttConn struct {
+	conn    net.Conn
+	wlock   sync.Mutex
+	lock    sync.Mutex
+	nextId  uint16
+	pending map[uint16]chan error
+	err     error
+	done    chan bool
+}
+
+func mqttEncodeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func mqttWritePacket(w io.Writer, header uint8, body []byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte(header)
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	buf.Write(body)
+	return writen(w, buf.Bytes())
+}
+
+func mqttReadPacket(r *bufio.Reader) (header uint8, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	n := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i >= 4 {
+			err = errors.New("malformed remaining length")
+			return
+		}
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		n += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func dialMQTT(psp *PushServiceProvider) (*mqttConn, error) {
+	u, err := url.Parse(psp.FixedData["broker"])
+	if err != nil {
+		return nil, NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	timeout := time.Duration(mqttWaitTimeout) * time.Second
+	var conn net.Conn
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts":
+		conf := &tls.Config{}
+		if psp.VolatileData["skipverify"] == "true" {
+			conf.InsecureSkipVerify = true
+		}
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, conf)
+	default:
+		conn, err = net.DialTimeout("tcp", u.Host, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mqttEncodeString(&body, "MQTT")
+	// protocol level 4: MQTT 3.1.1
+	body.WriteByte(4)
+	// clean session
+	flags := uint8(0x02)
+	username, hasUser := psp.FixedData["username"]
+	if hasUser {
+		flags |= 0x80
+		if _, ok := psp.VolatileData["password"]; ok {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(mqttKeepAlive))
+	clientid := psp.VolatileData["clientid"]
+	if clientid == "" {
+		clientid = fmt.Sprintf("uniqush-%x", rand.Int63())
+	}
+	mqttEncodeString(&body, clientid)
+	if hasUser {
+		mqttEncodeString(&body, username)
+		if password, ok := psp.VolatileData["password"]; ok {
+			mqttEncodeString(&body, password)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = mqttWritePacket(conn, mqttCONNECT<<4, body.Bytes())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	header, ack, err := mqttReadPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if header>>4 != mqttCONNACK || len(ack) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("MQTT broker sent an unexpected packet: %v", header>>4)
+	}
+	if code := int(ack[1]); code != 0 {
+		conn.Close()
+		reason := fmt.Sprintf("connection refused: %v", code)
+		if code < len(mqttConnackErrors) {
+			reason = "connection refused: " + mqttConnackErrors[code]
+		}
+		return nil, NewBadPushServiceProviderWithDetails(psp, reason)
+	}
+
+	ret := new(mqttConn)
+	ret.conn = conn
+	ret.nextId = 1
+	ret.pending = make(map[uint16]chan error, 16)
+	ret.done = make(chan bool)
+	go ret.readLoop(reader)
+	go ret.keepAlive()
+	return ret, nil
+}
+
+func (self *mqttConn) closeWithError(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err != nil {
+		return
+	}
+	self.err = err
+	close(self.done)
+	self.conn.Close()
+	for id, ch := range self.pending {
+		ch <- err
+		delete(self.pending, id)
+	}
+}
+
+func (self *mqttConn) Err() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.err
+}
+
+func (self *mqttConn) Close() {
+	self.wlock.Lock()
+	mqttWritePacket(self.conn, mqttDISCONNECT<<4, nil)
+	self.wlock.Unlock()
+	self.closeWithError(errors.New("connection closed"))
+}
+
+func (self *mqttConn) readLoop(reader *bufio.Reader) {
+	for {
+		header, body, err := mqttReadPacket(reader)
+		if err != nil {
+			self.closeWithError(fmt.Errorf("Connection closed by MQTT broker: %v", err))
+			return
+		}
+		switch header >> 4 {
+		case mqttPUBACK:
+			if len(body) < 2 {
+				continue
+			}
+			id := binary.BigEndian.Uint16(body)
+			self.lock.Lock()
+			if ch, ok := self.pending[id]; ok {
+				delete(self.pending, id)
+				ch <- nil
+			}
+			self.lock.Unlock()
+		case mqttPINGRESP:
+		}
+	}
+}
+
+func (self *mqttConn) keepAlive() {
+	period := time.Duration(mqttKeepAlive/2) * time.Second
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-time.After(period):
+			self.wlock.Lock()
+			err := mqttWritePacket(self.conn, mqttPINGREQ<<4, nil)
+			self.wlock.Unlock()
+			if err != nil {
+				self.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+// Publish sends the payload to the topic. With QoS 1, it waits for
+// the PUBACK of the broker. It returns the packet id of the message.
+func (self *mqttConn) Publish(topic string, qos uint8, payload []byte) (uint16, error) {
+	var id uint16
+	var ackChan chan error
+
+	var body bytes.Buffer
+	mqttEncodeString(&body, topic)
+	if qos > 0 {
+		ackChan = make(chan error, 1)
+		self.lock.Lock()
+		if self.err != nil {
+			self.lock.Unlock()
+			return 0, self.err
+		}
+		id = self.nextId
+		self.nextId++
+		if self.nextId == 0 {
+			self.nextId = 1
+		}
+		self.pending[id] = ackChan
+		self.lock.Unlock()
+		binary.Write(&body, binary.BigEndian, id)
+	}
+	body.Write(payload)
+
+	self.wlock.Lock()
+	self.conn.SetWriteDeadline(time.Now().Add(time.Duration(mqttWaitTimeout) * time.Second))
+	err := mqttWritePacket(self.conn, mqttPUBLISH<<4|qos<<1, body.Bytes())
+	self.conn.SetWriteDeadline(time.Time{})
+	self.wlock.Unlock()
+	if err != nil {
+		self.closeWithError(err)
+		return id, err
+	}
+	if qos == 0 {
+		return id, nil
+	}
+
+	select {
+	case err = <-ackChan:
+	case <-time.After(time.Duration(mqttWaitTimeout) * time.Second):
+		self.lock.Lock()
+		delete(self.pending, id)
+		self.lock.Unlock()
+		err = errors.New("timeout waiting for PUBACK")
+	}
+	return id, err
+}
+
+type mqttConnInfo struct {
+	psp  *PushServiceProvider
+	conn *mqttConn
+}
+
+type mqttPushService struct {
+	lock    sync.Mutex
+	connMap map[string]*mqttConnInfo
+
+	// Packet ids are 0 with QoS 0 and reused across connections, so
+	// message ids are numbered by the service instead.
+	nextId uint64
+}
+
+func newMQTTPushService() *mqttPushService {
+	ret := new(mqttPushService)
+	ret.connMap = make(map[string]*mqttConnInfo, 10)
+	return ret
+}
+
+func InstallMQTT() {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(newMQTTPushService())
+}
+
+func (self *mqttPushService) Finalize() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for name, info := range self.connMap {
+		info.conn.Close()
+		delete(self.connMap, name)
+	}
+}
+
+func (self *mqttPushService) Name() string {
+	return "mqtt"
+}
+
+func (self *mqttPushService) CredentialFields() []string {
+	return []string{"password"}
+}
+
+func (self *mqttPushService) SetErrorReportChan(errChan chan<- error) {
+	return
+}
+
+func (self *mqttPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if broker, ok := kv["broker"]; ok && len(broker) > 0 {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return fmt.Errorf("Invalid broker URL: %v", err)
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts":
+		default:
+			return fmt.Errorf("Invalid broker URL: unsupported scheme %v", u.Scheme)
+		}
+		if u.Port() == "" {
+			if u.Scheme == "tcp" || u.Scheme == "mqtt" {
+				u.Host = net.JoinHostPort(u.Host, "1883")
+			} else {
+				u.Host = net.JoinHostPort(u.Host, "8883")
+			}
+		}
+		psp.FixedData["broker"] = u.Scheme + "://" + u.Host
+	} else {
+		return errors.New("NoBroker")
+	}
+
+	if username, ok := kv["username"]; ok && len(username) > 0 {
+		psp.FixedData["username"] = username
+		if password, ok := kv["password"]; ok {
+			psp.VolatileData["password"] = password
+		}
+	}
+
+	psp.VolatileData["qos"] = "1"
+	if qos, ok := kv["qos"]; ok && len(qos) > 0 {
+		if qos != "0" && qos != "1" {
+			return fmt.Errorf("Unsupported QoS: %v", qos)
+		}
+		psp.VolatileData["qos"] = qos
+	}
+
+	if clientid, ok := kv["clientid"]; ok && len(clientid) > 0 {
+		psp.VolatileData["clientid"] = clientid
+	}
+	if skip, ok := kv["skipverify"]; ok {
+		if skip == "true" {
+			psp.VolatileData["skipverify"] = "true"
+		}
+	}
+	return nil
+}
+
+func (self *mqttPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		dp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	if sub, ok := kv["subscriber"]; ok && len(sub) > 0 {
+		dp.FixedData["subscriber"] = sub
+	} else {
+		return errors.New("NoSubscriber")
+	}
+	if topic, ok := kv["topic"]; ok && len(topic) > 0 {
+		if strings.ContainsAny(topic, "#+") {
+			return errors.New("Invalid delivery point: wildcards are not allowed in topic")
+		}
+		dp.FixedData["topic"] = topic
+	} else {
+		return errors.New("NoTopic")
+	}
+	return nil
+}
+
+// pooledConn returns the usable pooled connection of the psp, if any,
+// or the stale one it removed from the pool, to be closed once unlocked.
+// self.lock must be held.
+func (self *mqttPushService) pooledConn(psp *PushServiceProvider) (conn, stale *mqttConn) {
+	info, ok := self.connMap[psp.Name()]
+	if !ok {
+		return nil, nil
+	}
+	if info.conn.Err() == nil && samePsp(info.psp, psp) {
+		return info.conn, nil
+	}
+	delete(self.connMap, psp.Name())
+	return nil, info.conn
+}
+
+// getConn returns the pooled connection of the psp, and connects to
+// the broker if there is no usable one. The broker is dialed without
+// the lock, so that an unreachable broker does not stall the others.
+func (self *mqttPushService) getConn(psp *PushServiceProvider) (*mqttConn, error) {
+	self.lock.Lock()
+	conn, stale := self.pooledConn(psp)
+	self.lock.Unlock()
+	if stale != nil {
+		stale.Close()
+	}
+	if conn != nil {
+		return conn, nil
+	}
+	conn, err := dialMQTT(psp)
+	if err != nil {
+		return nil, err
+	}
+	self.lock.Lock()
+	pooled, stale := self.pooledConn(psp)
+	if pooled == nil {
+		self.connMap[psp.Name()] = &mqttConnInfo{psp: psp, conn: conn}
+	}
+	self.lock.Unlock()
+	if stale != nil {
+		stale.Close()
+	}
+	// Connected meanwhile by another push
+	if pooled != nil {
+		conn.Close()
+		return pooled, nil
+	}
+	return conn, nil
+}
+
+func (self *mqttPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	defer close(resQueue)
+
+	payload, err := json.Marshal(notif.Data)
+	if err != nil {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Content = notif
+		res.Err = NewBadNotificationWithDetails(err.Error())
+		resQueue <- res
+		for _ = range dpQueue {
+		}
+		return
+	}
+
+	qos := uint8(1)
+	if q, err := strconv.Atoi(psp.VolatileData["qos"]); err == nil {
+		qos = uint8(q)
+	}
+
+	wg := new(sync.WaitGroup)
+	for dp := range dpQueue {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Destination = dp
+		res.Content = notif
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != self.Name() {
+			res.Err = NewIncompatibleError()
+			resQueue <- res
+			continue
+		}
+		topic, ok := dp.FixedData["topic"]
+		if !ok {
+			res.Err = NewBadDeliveryPointWithDetails(dp, "NoTopic")
+			resQueue <- res
+			continue
+		}
+		conn, err := self.getConn(psp)
+		if err != nil {
+			if _, ok := err.(*BadPushServiceProvider); ok {
+				res.Err = err
+			} else {
+				res.Err = NewRetryErrorWithReason(psp, dp, notif, 5*time.Second, err)
+			}
+			resQueue <- res
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := conn.Publish(topic, qos, payload)
+			if err != nil {
+				res.Err = NewRetryErrorWithReason(psp, dp, notif, 5*time.Second, err)
+			} else {
+				res.MsgId = fmt.Sprintf("mqtt:%v-%v", psp.Name(), atomic.AddUint64(&self.nextId, 1))
+			}
+			resQueue <- res
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttBroker is an embedded broker which acknowledges every
+// message, except the ones sent to dropTopic: it closes the
+// connection instead.
+type mqttBroker struct {
+	ln        net.Listener
+	lock      sync.Mutex
+	messages  []*mqttMessage
+	nrConns   int
+	dropTopic string
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	broker := &mqttBroker{ln: ln}
+	go broker.serve()
+	return broker
+}
+
+func (self *mqttBroker) serve() {
+	for {
+		conn, err := self.ln.Accept()
+		if err != nil {
+			return
+		}
+		self.lock.Lock()
+		self.nrConns++
+		self.lock.Unlock()
+		go self.handle(conn)
+	}
+}
+
+func (self *mqttBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttCONNECT:
+			mqttWritePacket(conn, mqttCONNACK<<4, []byte{0, 0})
+		case mqttPINGREQ:
+			mqttWritePacket(conn, mqttPINGRESP<<4, nil)
+		case mqttDISCONNECT:
+			return
+		case mqttPUBLISH:
+			qos := (header >> 1) & 0x03
+			n := int(binary.BigEndian.Uint16(body))
+			msg := &mqttMessage{topic: string(body[2 : 2+n])}
+			body = body[2+n:]
+			var id []byte
+			if qos > 0 {
+				id = body[:2]
+				body = body[2:]
+			}
+			msg.payload = body
+			if msg.topic == self.dropTopic {
+				return
+			}
+			self.lock.Lock()
+			self.messages = append(self.messages, msg)
+			self.lock.Unlock()
+			if qos > 0 {
+				mqttWritePacket(conn, mqttPUBACK<<4, id)
+			}
+		}
+	}
+}
+
+func (self *mqttBroker) Close() {
+	self.ln.Close()
+}
+
+func buildMQTTPeers(t *testing.T, broker string, topics ...string) (*PushServiceProvider, []*DeliveryPoint) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(newMQTTPushService())
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "mqtt",
+		"service":         "myservice",
+		"broker":          broker,
+		"qos":             "1",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+	dps := make([]*DeliveryPoint, 0, len(topics))
+	for _, topic := range topics {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+			"pushservicetype": "mqtt",
+			"service":         "myservice",
+			"subscriber":      "device",
+			"topic":           topic,
+		})
+		if err != nil {
+			t.Fatalf("Cannot build delivery point: %v", err)
+		}
+		dps = append(dps, dp)
+	}
+	return psp, dps
+}
+
+func mqttPushAll(pst *mqttPushService, psp *PushServiceProvider, dps []*DeliveryPoint, notif *Notification) map[string]*PushResult {
+	dpQueue := make(chan *DeliveryPoint)
+	resQueue := make(chan *PushResult)
+	go func() {
+		for _, dp := range dps {
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	go pst.Push(psp, dpQueue, resQueue, notif)
+	ret := make(map[string]*PushResult, len(dps))
+	for res := range resQueue {
+		ret[res.Destination.FixedData["topic"]] = res
+	}
+	return ret
+}
+
+func TestMQTTPublish(t *testing.T) {
+	broker := newMQTTBroker(t)
+	defer broker.Close()
+
+	psp, dps := buildMQTTPeers(t, "tcp://"+broker.ln.Addr().String(), "devices/1", "devices/2")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	pst := newMQTTPushService()
+	defer pst.Finalize()
+	for i := 0; i < 2; i++ {
+		results := mqttPushAll(pst, psp, dps, notif)
+		for topic, res := range results {
+			if res.Err != nil {
+				t.Errorf("Push to %v failed: %v", topic, res.Err)
+			}
+		}
+	}
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.nrConns != 1 {
+		t.Errorf("Expected one pooled connection, got %v", broker.nrConns)
+	}
+	if len(broker.messages) != 4 {
+		t.Fatalf("Expected 4 messages, got %v", len(broker.messages))
+	}
+	var data map[string]string
+	if err := json.Unmarshal(broker.messages[0].payload, &data); err != nil {
+		t.Fatalf("Bad payload: %v", err)
+	}
+	if data["msg"] != "Hello" {
+		t.Errorf("Bad payload: %v", data)
+	}
+}
+
+func TestMQTTPubackFailure(t *testing.T) {
+	broker := newMQTTBroker(t)
+	defer broker.Close()
+	broker.dropTopic = "devices/broken"
+
+	psp, dps := buildMQTTPeers(t, "tcp://"+broker.ln.Addr().String(), "devices/broken")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	pst := newMQTTPushService()
+	defer pst.Finalize()
+	results := mqttPushAll(pst, psp, dps, notif)
+	res, ok := results["devices/broken"]
+	if !ok {
+		t.Fatalf("No result")
+	}
+	if _, ok := res.Err.(*RetryError); !ok {
+		t.Errorf("Expected retry error, got %v", res.Err)
+	}
+}
+
+func TestMQTTMessageIdsQoS0(t *testing.T) {
+	broker := newMQTTBroker(t)
+	defer broker.Close()
+
+	psp, dps := buildMQTTPeers(t, "tcp://"+broker.ln.Addr().String(), "devices/1", "devices/2", "devices/3")
+	psp.VolatileData["qos"] = "0"
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	pst := newMQTTPushService()
+	defer pst.Finalize()
+	ids := make(map[string]bool, len(dps))
+	for topic, res := range mqttPushAll(pst, psp, dps, notif) {
+		if res.Err != nil {
+			t.Errorf("Push to %v failed: %v", topic, res.Err)
+		}
+		if ids[res.MsgId] {
+			t.Errorf("Message id %v used twice", res.MsgId)
+		}
+		ids[res.MsgId] = true
+	}
+}
@@ -0,0 +1,619 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// A plugin is an external executable implementing a push service type.
+// uniqush starts it and talks to it through its stdin and stdout. Each
+// message is a JSON object on its own line. uniqush sends requests:
+//
+//	{"id": 1, "method": "build_psp", "params": {"data": {...}}}
+//	{"id": 2, "method": "build_dp", "params": {"data": {...}}}
+//	{"id": 3, "method": "push", "params": {"provider": peer, "destinations": [peer, ...], "notification": {...}}}
+//
+// where a peer is {"fixed": {...}, "volatile": {...}}. The plugin
+// answers each request with the same id, in any order:
+//
+//	{"id": 1, "result": {"fixed": {...}, "volatile": {...}, "credentials": ["apikey"]}}
+//	{"id": 2, "error": "NoRegId"}
+//	{"id": 3, "result": {"provider": peer, "results": [result, ...]}}
+//
+// A push response contains one result per destination, in the same
+// order. A result is {"msgid": "...", "error": "...", "details": "...",
+// "after": seconds, "destination": peer}. The error is empty on success,
+// or one of retry, unsubscribe, bad_delivery_point,
+// bad_push_service_provider, bad_notification or any other message.
+// If the plugin returns a destination (resp. a provider), its volatile
+// data replaces the stored one. The credentials of a push service
+// provider lists the keys of its secret data, left out of redacted
+// exports.
+//
+// Anything written to stderr goes to uniqush's stderr. If the plugin
+// exits, the requests in flight fail and it is started again on the
+// next request. A plugin which does not answer pluginMaxTimeouts
+// requests in a row is killed, and started again too.
+
+const (
+	pluginBatchSize int = 100
+	// in Seconds
+	pluginCallTimeout int = 60
+	pluginMaxBackoff  int = 60
+	pluginMaxTimeouts int = 3
+)
+
+var errPluginExited = errors.New("plugin exited")
+
+type pluginPeer struct {
+	Fixed    map[string]string `json:"fixed"`
+	Volatile map[string]string `json:"volatile"`
+	// Only returned by build_psp
+	Credentials []string `json:"credentials,omitempty"`
+}
+
+type pluginRequest struct {
+	Id     uint64      `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type pluginResponse struct {
+	Id     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+type pluginBuildParams struct {
+	Data map[string]string `json:"data"`
+}
+
+type pluginPushParams struct {
+	Provider     *pluginPeer            `json:"provider"`
+	Destinations []*pluginPeer          `json:"destinations"`
+	Notification map[string]interface{} `json:"notification"`
+}
+
+type pluginPushResult struct {
+	MsgId       string      `json:"msgid"`
+	Error       string      `json:"error"`
+	Details     string      `json:"details"`
+	After       int         `json:"after"`
+	Destination *pluginPeer `json:"destination"`
+}
+
+type pluginPushResponse struct {
+	Provider *pluginPeer         `json:"provider"`
+	Results  []*pluginPushResult `json:"results"`
+}
+
+// pluginProcess is the running executable of a plugin. It is
+// (re)started on demand.
+type pluginProcess struct {
+	path string
+	args []string
+
+	lock  sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// Requests for writeRequests(), and closed when cmd exits
+	requests  chan []byte
+	exited    chan bool
+	pending   map[uint64]chan *pluginResponse
+	nextId    uint64
+	startedAt time.Time
+	nextStart time.Time
+	backoff   time.Duration
+	closed    bool
+	// Requests without response in a row
+	timeouts int
+	timeout  time.Duration
+	errChan  chan<- error
+
+	// limits the number of requests in flight
+	slots chan bool
+}
+
+func newPluginProcess(path string, args []string, maxConcurrency int) *pluginProcess {
+	if maxConcurrency <= 0 {
+		maxConcurrency = 1
+	}
+	ret := new(pluginProcess)
+	ret.path = path
+	ret.args = args
+	ret.pending = make(map[uint64]chan *pluginResponse, maxConcurrency)
+	ret.slots = make(chan bool, maxConcurrency)
+	ret.timeout = time.Duration(pluginCallTimeout) * time.Second
+	return ret
+}
+
+// report sends err to the error channel of the push service, if any.
+func (self *pluginProcess) report(err error) {
+	self.lock.Lock()
+	errChan := self.errChan
+	self.lock.Unlock()
+	if errChan != nil {
+		errChan <- err
+	}
+}
+
+// start should be called with the lock held.
+func (self *pluginProcess) start() error {
+	if self.cmd != nil {
+		return nil
+	}
+	if self.closed {
+		return errors.New("plugin is stopped")
+	}
+	if time.Now().Before(self.nextStart) {
+		return fmt.Errorf("plugin %v crashed. Restarting in %v", self.path, self.nextStart.Sub(time.Now()))
+	}
+	cmd := exec.Command(self.path, self.args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		self.crashed()
+		return err
+	}
+	self.cmd = cmd
+	self.stdin = stdin
+	self.requests = make(chan []byte, cap(self.slots))
+	self.exited = make(chan bool)
+	self.startedAt = time.Now()
+	self.timeouts = 0
+	go self.writeRequests(stdin, self.requests, self.exited)
+	go self.readResponses(cmd, stdout)
+	return nil
+}
+
+// writeRequests writes the requests to the stdin of the plugin until it
+// exits. Callers never write themselves: a plugin blocked writing its
+// stdout stops reading its stdin, and they would block while holding
+// the lock needed to read the responses.
+func (self *pluginProcess) writeRequests(stdin io.Writer, requests <-chan []byte, exited <-chan bool) {
+	for {
+		select {
+		case line := <-requests:
+			// On error, the plugin is exiting, and its requests fail
+			// once readResponses() sees it.
+			writen(stdin, line)
+		case <-exited:
+			return
+		}
+	}
+}
+
+// crashed computes when the plugin may be started again. The delay
+// doubles each time the plugin dies shortly after being started.
+func (self *pluginProcess) crashed() {
+	if time.Since(self.startedAt) > time.Duration(pluginMaxBackoff)*time.Second {
+		self.backoff = 0
+	}
+	if self.backoff == 0 {
+		self.backoff = 1 * time.Second
+	} else {
+		self.backoff *= 2
+		if self.backoff > time.Duration(pluginMaxBackoff)*time.Second {
+			self.backoff = time.Duration(pluginMaxBackoff) * time.Second
+		}
+	}
+	self.nextStart = time.Now().Add(self.backoff)
+}
+
+func (self *pluginProcess) readResponses(cmd *exec.Cmd, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		resp := new(pluginResponse)
+		if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+			self.report(fmt.Errorf("plugin %v: bad response: %v", self.path, err))
+			continue
+		}
+		self.lock.Lock()
+		self.timeouts = 0
+		if ch, ok := self.pending[resp.Id]; ok {
+			delete(self.pending, resp.Id)
+			ch <- resp
+		}
+		self.lock.Unlock()
+	}
+
+	self.lock.Lock()
+	if self.cmd == cmd {
+		self.cmd = nil
+		self.stdin.Close()
+		close(self.exited)
+		for id, ch := range self.pending {
+			ch <- nil
+			delete(self.pending, id)
+		}
+		if !self.closed {
+			self.crashed()
+		}
+	}
+	self.lock.Unlock()
+	cmd.Wait()
+}
+
+// call sends one request to the plugin and decodes the result into
+// result. It fails with errPluginExited if the plugin dies meanwhile.
+func (self *pluginProcess) call(method string, params interface{}, result interface{}) error {
+	self.slots <- true
+	defer func() { <-self.slots }()
+
+	ch := make(chan *pluginResponse, 1)
+	self.lock.Lock()
+	if err := self.start(); err != nil {
+		self.lock.Unlock()
+		return err
+	}
+	self.nextId++
+	id := self.nextId
+	line, err := json.Marshal(&pluginRequest{Id: id, Method: method, Params: params})
+	if err != nil {
+		self.lock.Unlock()
+		return err
+	}
+	self.pending[id] = ch
+	cmd, requests, exited := self.cmd, self.requests, self.exited
+	self.lock.Unlock()
+
+	timeout := time.After(self.timeout)
+	var resp *pluginResponse
+	select {
+	case requests <- append(line, '\n'):
+		select {
+		case resp = <-ch:
+		case <-timeout:
+			self.timedOut(id, cmd)
+			return fmt.Errorf("plugin %v: timeout", self.path)
+		}
+	case resp = <-ch:
+		// Exited before reading the request
+	case <-exited:
+		resp = <-ch
+	case <-timeout:
+		self.timedOut(id, cmd)
+		return fmt.Errorf("plugin %v: timeout", self.path)
+	}
+	if resp == nil {
+		return errPluginExited
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// timedOut forgets the request id, and kills the plugin cmd after
+// pluginMaxTimeouts requests in a row without response. It is then
+// started again like after a crash.
+func (self *pluginProcess) timedOut(id uint64, cmd *exec.Cmd) {
+	self.lock.Lock()
+	delete(self.pending, id)
+	if self.cmd != cmd {
+		self.lock.Unlock()
+		return
+	}
+	self.timeouts++
+	if self.timeouts < pluginMaxTimeouts {
+		self.lock.Unlock()
+		return
+	}
+	self.timeouts = 0
+	self.lock.Unlock()
+	self.report(fmt.Errorf("plugin %v: %v requests without response. Killing it", self.path, pluginMaxTimeouts))
+	cmd.Process.Kill()
+}
+
+func (self *pluginProcess) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	if self.cmd != nil {
+		// Plugins should exit once their stdin is closed.
+		self.stdin.Close()
+	}
+}
+
+/*********************/
+
+type pluginPushService struct {
+	name    string
+	process *pluginProcess
+
+	// The keys of the secret data of the push service providers, as
+	// configured or returned by build_psp
+	credentialsLock sync.RWMutex
+	credentials     map[string]bool
+}
+
+// InstallPlugin registers a push service type implemented by the
+// executable at path. At most maxConcurrency requests are sent to the
+// plugin at the same time. credentials are the keys of the secret data
+// of its push service providers.
+func InstallPlugin(name, path string, args []string, maxConcurrency int, credentials []string) {
+	psm := GetPushServiceManager()
+	pst := newPluginPushService(name, path, args, maxConcurrency)
+	pst.addCredentialFields(credentials)
+	psm.RegisterPushServiceType(pst)
+}
+
+func newPluginPushService(name, path string, args []string, maxConcurrency int) *pluginPushService {
+	ret := new(pluginPushService)
+	ret.name = name
+	ret.process = newPluginProcess(path, args, maxConcurrency)
+	ret.credentials = make(map[string]bool)
+	return ret
+}
+
+func (self *pluginPushService) addCredentialFields(fields []string) {
+	self.credentialsLock.Lock()
+	defer self.credentialsLock.Unlock()
+	for _, field := range fields {
+		self.credentials[field] = true
+	}
+}
+
+func (self *pluginPushService) CredentialFields() []string {
+	self.credentialsLock.RLock()
+	defer self.credentialsLock.RUnlock()
+	ret := make([]string, 0, len(self.credentials))
+	for field := range self.credentials {
+		ret = append(ret, field)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (self *pluginPushService) Name() string {
+	return self.name
+}
+
+func (self *pluginPushService) Finalize() {
+	self.process.Close()
+}
+
+func (self *pluginPushService) SetErrorReportChan(errChan chan<- error) {
+	self.process.lock.Lock()
+	defer self.process.lock.Unlock()
+	self.process.errChan = errChan
+}
+
+func copyPluginPeer(peer *pluginPeer, fixed, volatile map[string]string) {
+	if peer == nil {
+		return
+	}
+	for k, v := range peer.Fixed {
+		fixed[k] = v
+	}
+	for k, v := range peer.Volatile {
+		volatile[k] = v
+	}
+}
+
+func (self *pluginPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	peer := new(pluginPeer)
+	err := self.process.call("build_psp", &pluginBuildParams{Data: kv}, peer)
+	if err != nil {
+		return err
+	}
+	self.addCredentialFields(peer.Credentials)
+	copyPluginPeer(peer, psp.FixedData, psp.VolatileData)
+	return nil
+}
+
+func (self *pluginPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	peer := new(pluginPeer)
+	err := self.process.call("build_dp", &pluginBuildParams{Data: kv}, peer)
+	if err != nil {
+		return err
+	}
+	copyPluginPeer(peer, dp.FixedData, dp.VolatileData)
+	return nil
+}
+
+func pluginResultToError(r *pluginPushResult, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification) error {
+	switch r.Error {
+	case "":
+		return nil
+	case "retry":
+		after := time.Duration(r.After) * time.Second
+		if r.Details != "" {
+			return NewRetryErrorWithReason(psp, dp, notif, after, errors.New(r.Details))
+		}
+		return NewRetryError(psp, dp, notif, after)
+	case "unsubscribe":
+		return NewUnsubscribeUpdate(psp, dp)
+	case "bad_delivery_point":
+		return NewBadDeliveryPointWithDetails(dp, r.Details)
+	case "bad_push_service_provider":
+		return NewBadPushServiceProviderWithDetails(psp, r.Details)
+	case "bad_notification":
+		return NewBadNotificationWithDetails(r.Details)
+	}
+	if r.Details != "" {
+		return fmt.Errorf("%v: %v", r.Error, r.Details)
+	}
+	return errors.New(r.Error)
+}
+
+// pluginUpdates collects the volatile data returned by the batches of a
+// push, sent in parallel. They are applied once all batches are done, so
+// that the push service provider and the delivery points are only
+// changed by one goroutine.
+type pluginUpdates struct {
+	lock         sync.Mutex
+	provider     map[string]string
+	destinations []*DeliveryPoint
+	volatile     []map[string]string
+}
+
+func (self *pluginUpdates) updateProvider(volatile map[string]string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.provider == nil {
+		self.provider = make(map[string]string, len(volatile))
+	}
+	for k, v := range volatile {
+		self.provider[k] = v
+	}
+}
+
+func (self *pluginUpdates) updateDestination(dp *DeliveryPoint, volatile map[string]string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.destinations = append(self.destinations, dp)
+	self.volatile = append(self.volatile, volatile)
+}
+
+// apply changes psp and the delivery points, and reports their updates.
+func (self *pluginUpdates) apply(psp *PushServiceProvider, resQueue chan<- *PushResult, notif *Notification) {
+	if self.provider != nil {
+		for k, v := range self.provider {
+			psp.VolatileData[k] = v
+		}
+		res := new(PushResult)
+		res.Provider = psp
+		res.Content = notif
+		res.Err = NewPushServiceProviderUpdate(psp)
+		resQueue <- res
+	}
+	for i, dp := range self.destinations {
+		for k, v := range self.volatile[i] {
+			dp.VolatileData[k] = v
+		}
+		update := new(PushResult)
+		update.Provider = psp
+		update.Destination = dp
+		update.Content = notif
+		update.Err = NewDeliveryPointUpdate(dp)
+		resQueue <- update
+	}
+}
+
+func (self *pluginPushService) multicast(psp *PushServiceProvider, provider *pluginPeer, dpList []*DeliveryPoint, resQueue chan<- *PushResult, notif *Notification, updates *pluginUpdates) {
+	params := new(pluginPushParams)
+	params.Provider = provider
+	params.Destinations = make([]*pluginPeer, len(dpList))
+	for i, dp := range dpList {
+		params.Destinations[i] = &pluginPeer{Fixed: dp.FixedData, Volatile: dp.VolatileData}
+	}
+	params.Notification = notif.Data
+
+	resp := new(pluginPushResponse)
+	err := self.process.call("push", params, resp)
+	if err != nil {
+		for _, dp := range dpList {
+			res := new(PushResult)
+			res.Provider = psp
+			res.Destination = dp
+			res.Content = notif
+			res.Err = NewRetryErrorWithReason(psp, dp, notif, 5*time.Second, err)
+			resQueue <- res
+		}
+		return
+	}
+
+	if resp.Provider != nil {
+		updates.updateProvider(resp.Provider.Volatile)
+	}
+
+	for i, dp := range dpList {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Destination = dp
+		res.Content = notif
+		if i >= len(resp.Results) || resp.Results[i] == nil {
+			res.Err = fmt.Errorf("plugin %v returned no result", self.name)
+			resQueue <- res
+			continue
+		}
+		r := resp.Results[i]
+		if r.Destination != nil {
+			updates.updateDestination(dp, r.Destination.Volatile)
+		}
+		res.Err = pluginResultToError(r, psp, dp, notif)
+		if res.Err == nil {
+			res.MsgId = fmt.Sprintf("%v:%v-%v", self.name, psp.Name(), r.MsgId)
+		}
+		resQueue <- res
+	}
+}
+
+func (self *pluginPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	// Batches are sent in parallel, and any of them may update the
+	// psp. Send a snapshot of it instead.
+	provider := &pluginPeer{
+		Fixed:    make(map[string]string, len(psp.FixedData)),
+		Volatile: make(map[string]string, len(psp.VolatileData)),
+	}
+	copyPluginPeer(&pluginPeer{Fixed: psp.FixedData, Volatile: psp.VolatileData}, provider.Fixed, provider.Volatile)
+
+	wg := new(sync.WaitGroup)
+	updates := new(pluginUpdates)
+	dpList := make([]*DeliveryPoint, 0, pluginBatchSize)
+	for dp := range dpQueue {
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != self.Name() {
+			res := new(PushResult)
+			res.Provider = psp
+			res.Destination = dp
+			res.Content = notif
+			res.Err = NewIncompatibleError()
+			resQueue <- res
+			continue
+		}
+		dpList = append(dpList, dp)
+		if len(dpList) >= pluginBatchSize {
+			wg.Add(1)
+			go func(dpList []*DeliveryPoint) {
+				self.multicast(psp, provider, dpList, resQueue, notif, updates)
+				wg.Done()
+			}(dpList)
+			dpList = make([]*DeliveryPoint, 0, pluginBatchSize)
+		}
+	}
+	if len(dpList) > 0 {
+		self.multicast(psp, provider, dpList, resQueue, notif, updates)
+	}
+	wg.Wait()
+	updates.apply(psp, resQueue, notif)
+	close(resQueue)
+}
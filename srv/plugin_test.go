@@ -0,0 +1,279 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// TestPluginHelperProcess is not a real test. It is the plugin
+// started by the other tests.
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("UNIQUSH_TEST_PLUGIN") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req struct {
+			Id     uint64          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(scanner.Bytes(), &req)
+		resp := map[string]interface{}{"id": req.Id}
+		switch req.Method {
+		case "build_psp", "build_dp":
+			var params pluginBuildParams
+			json.Unmarshal(req.Params, &params)
+			peer := &pluginPeer{Fixed: map[string]string{}, Volatile: map[string]string{}}
+			for _, k := range []string{"service", "subscriber", "regid", "secret"} {
+				if v, ok := params.Data[k]; ok {
+					peer.Fixed[k] = v
+				}
+			}
+			if req.Method == "build_psp" {
+				peer.Credentials = []string{"secret"}
+			}
+			if req.Method == "build_dp" && peer.Fixed["regid"] == "" {
+				resp["error"] = "NoRegId"
+			} else {
+				resp["result"] = peer
+			}
+		case "push":
+			var params pluginPushParams
+			json.Unmarshal(req.Params, &params)
+			results := make([]*pluginPushResult, 0, len(params.Destinations))
+			var provider *pluginPeer
+			for i, dp := range params.Destinations {
+				switch dp.Fixed["regid"] {
+				case "crash":
+					os.Exit(1)
+				case "hang":
+					continue
+				case "gone":
+					results = append(results, &pluginPushResult{Error: "unsubscribe"})
+				case "update":
+					provider = &pluginPeer{Volatile: map[string]string{"token": "new"}}
+					results = append(results, &pluginPushResult{
+						MsgId:       fmt.Sprintf("%v", i),
+						Destination: &pluginPeer{Volatile: map[string]string{"canonical": "new"}},
+					})
+				default:
+					results = append(results, &pluginPushResult{MsgId: fmt.Sprintf("%v", i)})
+				}
+			}
+			if len(results) == 0 {
+				continue
+			}
+			resp["result"] = &pluginPushResponse{Provider: provider, Results: results}
+		}
+		line, _ := json.Marshal(resp)
+		fmt.Printf("%s\n", line)
+	}
+	os.Exit(0)
+}
+
+func newTestPlugin(t *testing.T) *pluginPushService {
+	os.Setenv("UNIQUSH_TEST_PLUGIN", "1")
+	pst := newPluginPushService("testplugin", os.Args[0], []string{"-test.run=TestPluginHelperProcess"}, 2)
+	GetPushServiceManager().RegisterPushServiceType(pst)
+	return pst
+}
+
+func buildPluginPeers(t *testing.T, regids ...string) (*PushServiceProvider, []*DeliveryPoint) {
+	psm := GetPushServiceManager()
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "testplugin",
+		"service":         "myservice",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+	dps := make([]*DeliveryPoint, 0, len(regids))
+	for _, regid := range regids {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+			"pushservicetype": "testplugin",
+			"service":         "myservice",
+			"subscriber":      "user",
+			"regid":           regid,
+		})
+		if err != nil {
+			t.Fatalf("Cannot build delivery point: %v", err)
+		}
+		dps = append(dps, dp)
+	}
+	return psp, dps
+}
+
+func pluginPushAll(pst *pluginPushService, psp *PushServiceProvider, dps []*DeliveryPoint, notif *Notification) []*PushResult {
+	dpQueue := make(chan *DeliveryPoint)
+	resQueue := make(chan *PushResult)
+	go func() {
+		for _, dp := range dps {
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	go pst.Push(psp, dpQueue, resQueue, notif)
+	ret := make([]*PushResult, 0, len(dps))
+	for res := range resQueue {
+		ret = append(ret, res)
+	}
+	return ret
+}
+
+func TestPluginBuildAndPush(t *testing.T) {
+	pst := newTestPlugin(t)
+	defer pst.Finalize()
+
+	_, err := GetPushServiceManager().BuildDeliveryPointFromMap(map[string]string{
+		"pushservicetype": "testplugin",
+		"service":         "myservice",
+		"subscriber":      "user",
+	})
+	if err == nil || err.Error() != "NoRegId" {
+		t.Errorf("Expected the error of the plugin, got %v", err)
+	}
+
+	psp, dps := buildPluginPeers(t, "good", "gone")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	results := pluginPushAll(pst, psp, dps, notif)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %v", len(results))
+	}
+	if results[0].Err != nil || results[0].MsgId == "" {
+		t.Errorf("Push failed: %v", results[0].Err)
+	}
+	if _, ok := results[1].Err.(*UnsubscribeUpdate); !ok {
+		t.Errorf("Expected unsubscribe update, got %v", results[1].Err)
+	}
+}
+
+func TestPluginRestartAfterCrash(t *testing.T) {
+	pst := newTestPlugin(t)
+	defer pst.Finalize()
+
+	psp, dps := buildPluginPeers(t, "crash")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	results := pluginPushAll(pst, psp, dps, notif)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %v", len(results))
+	}
+	if _, ok := results[0].Err.(*RetryError); !ok {
+		t.Errorf("Expected retry error, got %v", results[0].Err)
+	}
+
+	// The first restart is delayed by one second.
+	time.Sleep(1100 * time.Millisecond)
+	_, dps = buildPluginPeers(t, "good")
+	results = pluginPushAll(pst, psp, dps, notif)
+	if len(results) != 1 || results[0].Err != nil {
+		t.Errorf("Plugin was not restarted: %v", results)
+	}
+}
+
+func TestPluginUpdates(t *testing.T) {
+	pst := newTestPlugin(t)
+	defer pst.Finalize()
+
+	// Several batches in parallel, each one updating the psp
+	regids := make([]string, 3*pluginBatchSize)
+	for i := range regids {
+		regids[i] = "update"
+	}
+	psp, dps := buildPluginPeers(t, regids...)
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	results := pluginPushAll(pst, psp, dps, notif)
+	pspUpdates, dpUpdates := 0, 0
+	for _, res := range results {
+		switch res.Err.(type) {
+		case *PushServiceProviderUpdate:
+			pspUpdates++
+		case *DeliveryPointUpdate:
+			dpUpdates++
+		case nil:
+		default:
+			t.Errorf("Push failed: %v", res.Err)
+		}
+	}
+	if pspUpdates != 1 || dpUpdates != len(dps) {
+		t.Errorf("Expected 1 psp update and %v dp updates, got %v and %v", len(dps), pspUpdates, dpUpdates)
+	}
+	if psp.VolatileData["token"] != "new" {
+		t.Errorf("psp not updated")
+	}
+	for _, dp := range dps {
+		if dp.VolatileData["canonical"] != "new" {
+			t.Fatalf("dp not updated")
+		}
+	}
+}
+
+func TestPluginKilledAfterTimeouts(t *testing.T) {
+	pst := newTestPlugin(t)
+	defer pst.Finalize()
+	pst.process.timeout = 100 * time.Millisecond
+
+	psp, dps := buildPluginPeers(t, "hang")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	for i := 0; i < pluginMaxTimeouts; i++ {
+		results := pluginPushAll(pst, psp, dps, notif)
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %v", len(results))
+		}
+		if _, ok := results[0].Err.(*RetryError); !ok {
+			t.Errorf("Expected retry error, got %v", results[0].Err)
+		}
+	}
+
+	// Killed, then restarted one second later
+	time.Sleep(1100 * time.Millisecond)
+	_, dps = buildPluginPeers(t, "good")
+	results := pluginPushAll(pst, psp, dps, notif)
+	if len(results) != 1 || results[0].Err != nil {
+		t.Errorf("Plugin was not restarted: %v", results)
+	}
+}
+
+func TestPluginCredentialFields(t *testing.T) {
+	pst := newTestPlugin(t)
+	defer pst.Finalize()
+	psp, err := GetPushServiceManager().BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "testplugin",
+		"service":         "myservice",
+		"secret":          "password",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+	fields := psp.CredentialFields()
+	if len(fields) != 1 || fields[0] != "secret" {
+		t.Errorf("Expected the credentials of the plugin, got %v", fields)
+	}
+}
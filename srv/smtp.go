@@ -0,0 +1,403 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	// in Seconds
+	smtpDialTimeout int = 20
+)
+
+type smtpPushService struct {
+}
+
+func newSMTPPushService() *smtpPushService {
+	ret := new(smtpPushService)
+	return ret
+}
+
+func InstallSMTP() {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(newSMTPPushService())
+}
+
+func (self *smtpPushService) Finalize() {}
+func (self *smtpPushService) Name() string {
+	return "smtp"
+}
+
+func (self *smtpPushService) CredentialFields() []string {
+	return []string{"password"}
+}
+
+func (self *smtpPushService) SetErrorReportChan(errChan chan<- error) {
+	return
+}
+
+func (self *smtpPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if addr, ok := kv["addr"]; ok && len(addr) > 0 {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Invalid SMTP server address: %v", err)
+		}
+		psp.FixedData["addr"] = addr
+	} else {
+		return errors.New("NoServerAddress")
+	}
+
+	if from, ok := kv["from"]; ok && len(from) > 0 {
+		if _, err := mail.ParseAddress(from); err != nil {
+			return fmt.Errorf("Invalid from address: %v", err)
+		}
+		psp.FixedData["from"] = from
+	} else {
+		return errors.New("NoFromAddress")
+	}
+
+	if username, ok := kv["username"]; ok && len(username) > 0 {
+		psp.FixedData["username"] = username
+		if password, ok := kv["password"]; ok {
+			psp.VolatileData["password"] = password
+		} else {
+			return errors.New("NoPassword")
+		}
+	}
+
+	if skip, ok := kv["skipverify"]; ok {
+		if skip == "true" {
+			psp.VolatileData["skipverify"] = "true"
+		}
+	}
+	return nil
+}
+
+func (self *smtpPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		dp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	if sub, ok := kv["subscriber"]; ok && len(sub) > 0 {
+		dp.FixedData["subscriber"] = sub
+	} else {
+		return errors.New("NoSubscriber")
+	}
+	if email, ok := kv["email"]; ok && len(email) > 0 {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return fmt.Errorf("Invalid delivery point: bad email address. %v", err)
+		}
+		dp.FixedData["email"] = strings.ToLower(addr.Address)
+	} else {
+		return errors.New("NoEmail")
+	}
+	return nil
+}
+
+// smtpDial connects to the SMTP server of the psp, upgrades the
+// connection with STARTTLS if the server supports it, and
+// authenticates if the psp has credentials.
+func smtpDial(psp *PushServiceProvider) (*smtp.Client, error) {
+	addr := psp.FixedData["addr"]
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(smtpDialTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		conf := &tls.Config{ServerName: host}
+		if psp.VolatileData["skipverify"] == "true" {
+			conf.InsecureSkipVerify = true
+		}
+		if err = client.StartTLS(conf); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if username, ok := psp.FixedData["username"]; ok {
+		auth := smtp.PlainAuth("", username, psp.VolatileData["password"], host)
+		if err = client.Auth(auth); err != nil {
+			client.Close()
+			return nil, NewBadPushServiceProviderWithDetails(psp, err.Error())
+		}
+	}
+	return client, nil
+}
+
+func smtpMessageId(from string) string {
+	var d [16]byte
+	io.ReadFull(rand.Reader, d[:])
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	return fmt.Sprintf("%x.%x@%v", time.Now().UnixNano(), d[:], domain)
+}
+
+func notifToText(notif *Notification, key string) string {
+	if v, ok := notif.Data[key]; ok && v != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+func textToHTML(title, msg string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<html><body>")
+	if title != "" {
+		fmt.Fprintf(&buf, "<h3>%v</h3>", html.EscapeString(title))
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		fmt.Fprintf(&buf, "<p>%v</p>", html.EscapeString(line))
+	}
+	buf.WriteString("</body></html>")
+	return buf.String()
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// toSMTPMessage renders a notification into a multipart/alternative
+// message containing both a plain text and an HTML version.
+func toSMTPMessage(from, to, msgid string, notif *Notification) ([]byte, error) {
+	title := notifToText(notif, "title")
+	msg := notifToText(notif, "msg")
+	if title == "" && msg == "" {
+		return nil, NewBadNotificationWithDetails("empty notification")
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	header := make(textproto.MIMEHeader, 7)
+	header.Set("From", from)
+	header.Set("To", to)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", title))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+msgid+">")
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	for _, k := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"} {
+		fmt.Fprintf(&buf, "%v: %v\r\n", k, header.Get(k))
+	}
+	buf.WriteString("\r\n")
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", msg},
+		{"text/html; charset=utf-8", textToHTML(title, msg)},
+	}
+	for _, p := range parts {
+		ph := make(textproto.MIMEHeader, 2)
+		ph.Set("Content-Type", p.contentType)
+		ph.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := mw.CreatePart(ph)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(w, p.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// smtpConnReusable tells whether the connection can still be used
+// after the server replied with err.
+func smtpConnReusable(err error) bool {
+	if terr, ok := err.(*textproto.Error); ok {
+		// 421: The server is closing the connection.
+		return terr.Code != 421
+	}
+	return false
+}
+
+// smtpStepError is an error replied to one of the commands sending a
+// message. The same code means different things depending on the
+// command: a 550 to RCPT is a bad address, to MAIL a bad sender.
+type smtpStepError struct {
+	step string
+	err  error
+}
+
+func (self *smtpStepError) Error() string {
+	return fmt.Sprintf("%v: %v", self.step, self.err)
+}
+
+func smtpErrorToPushError(err *smtpStepError, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification) error {
+	terr, ok := err.err.(*textproto.Error)
+	if !ok || (terr.Code >= 400 && terr.Code < 500) {
+		return NewRetryErrorWithReason(psp, dp, notif, 5*time.Second, err)
+	}
+	switch err.step {
+	case "RCPT":
+		if terr.Code == 550 || terr.Code == 551 || terr.Code == 553 {
+			// Mailbox unavailable. The address is no longer valid.
+			return NewUnsubscribeUpdate(psp, dp)
+		}
+		return NewBadDeliveryPointWithDetails(dp, terr.Msg)
+	case "MAIL":
+		// The server does not accept mails from this sender.
+		return NewBadPushServiceProviderWithDetails(psp, terr.Msg)
+	}
+	// The content was rejected, e.g. as spam.
+	return NewBadNotificationWithDetails(terr.Msg)
+}
+
+func smtpSinglePush(client *smtp.Client, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification) (string, error) {
+	from := psp.FixedData["from"]
+	to := dp.FixedData["email"]
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", NewBadPushServiceProviderWithDetails(psp, err.Error())
+	}
+	msgid := smtpMessageId(fromAddr.Address)
+	data, err := toSMTPMessage(from, to, msgid, notif)
+	if err != nil {
+		return "", err
+	}
+	if err = client.Mail(fromAddr.Address); err != nil {
+		return "", &smtpStepError{"MAIL", err}
+	}
+	if err = client.Rcpt(to); err != nil {
+		client.Reset()
+		return "", &smtpStepError{"RCPT", err}
+	}
+	w, err := client.Data()
+	if err != nil {
+		client.Reset()
+		return "", &smtpStepError{"DATA", err}
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return "", &smtpStepError{"DATA", err}
+	}
+	if err = w.Close(); err != nil {
+		return "", &smtpStepError{"DATA", err}
+	}
+	return msgid, nil
+}
+
+func (self *smtpPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	defer close(resQueue)
+
+	// The connection is opened lazily and kept for all delivery
+	// points in this batch. It is reopened if the server drops it.
+	var client *smtp.Client
+	defer func() {
+		if client != nil {
+			client.Quit()
+		}
+	}()
+
+	for dp := range dpQueue {
+		res := new(PushResult)
+		res.Provider = psp
+		res.Destination = dp
+		res.Content = notif
+
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != self.Name() {
+			res.Err = NewIncompatibleError()
+			resQueue <- res
+			continue
+		}
+		if _, ok := dp.FixedData["email"]; !ok {
+			res.Err = NewBadDeliveryPointWithDetails(dp, "NoEmail")
+			resQueue <- res
+			continue
+		}
+
+		if client == nil {
+			var err error
+			client, err = smtpDial(psp)
+			if err != nil {
+				client = nil
+				if _, ok := err.(*BadPushServiceProvider); ok {
+					res.Err = err
+				} else {
+					res.Err = NewRetryErrorWithReason(psp, dp, notif, 5*time.Second, err)
+				}
+				resQueue <- res
+				continue
+			}
+		}
+
+		msgid, err := smtpSinglePush(client, psp, dp, notif)
+		if err != nil {
+			reusable := true
+			switch e := err.(type) {
+			case *smtpStepError:
+				res.Err = smtpErrorToPushError(e, psp, dp, notif)
+				reusable = smtpConnReusable(e.err)
+			default:
+				res.Err = err
+			}
+			if !reusable {
+				client.Close()
+				client = nil
+			}
+			resQueue <- res
+			continue
+		}
+		res.MsgId = fmt.Sprintf("smtp:%v-%v", psp.Name(), msgid)
+		resQueue <- res
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// smtpSink is a minimal SMTP server which accepts every message
+// and records it. If set, mailReply and dataReply are replied to MAIL
+// and at the end of DATA instead.
+type smtpSink struct {
+	ln        net.Listener
+	lock      sync.Mutex
+	rcpts     []string
+	messages  []string
+	nrConns   int
+	reject    map[string]bool
+	mailReply string
+	dataReply string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	sink := &smtpSink{ln: ln, reject: make(map[string]bool)}
+	go sink.serve()
+	return sink
+}
+
+func (self *smtpSink) serve() {
+	for {
+		conn, err := self.ln.Accept()
+		if err != nil {
+			return
+		}
+		self.lock.Lock()
+		self.nrConns++
+		self.lock.Unlock()
+		go self.handle(conn)
+	}
+}
+
+func (self *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost ESMTP sink\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprintf(conn, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "MAIL FROM:") && self.mailReply != "":
+			fmt.Fprintf(conn, "%v\r\n", self.mailReply)
+		case strings.HasPrefix(cmd, "MAIL FROM:"), cmd == "RSET", cmd == "NOOP":
+			fmt.Fprintf(conn, "250 OK\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpt := strings.Trim(line[len("RCPT TO:"):], "<> ")
+			self.lock.Lock()
+			rejected := self.reject[rcpt]
+			if !rejected {
+				self.rcpts = append(self.rcpts, rcpt)
+			}
+			self.lock.Unlock()
+			if rejected {
+				fmt.Fprintf(conn, "550 No such user\r\n")
+			} else {
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		case cmd == "DATA":
+			fmt.Fprintf(conn, "354 Go ahead\r\n")
+			var msg []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				l = strings.TrimRight(l, "\r\n")
+				if l == "." {
+					break
+				}
+				msg = append(msg, l)
+			}
+			if self.dataReply != "" {
+				fmt.Fprintf(conn, "%v\r\n", self.dataReply)
+				continue
+			}
+			self.lock.Lock()
+			self.messages = append(self.messages, strings.Join(msg, "\n"))
+			self.lock.Unlock()
+			fmt.Fprintf(conn, "250 Queued\r\n")
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "502 Not implemented\r\n")
+		}
+	}
+}
+
+func (self *smtpSink) Close() {
+	self.ln.Close()
+}
+
+func buildSMTPPeers(t *testing.T, addr string, emails ...string) (*PushServiceProvider, []*DeliveryPoint) {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(newSMTPPushService())
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": "smtp",
+		"service":         "myservice",
+		"addr":            addr,
+		"from":            "Uniqush <noreply@example.com>",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+	dps := make([]*DeliveryPoint, 0, len(emails))
+	for _, email := range emails {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+			"pushservicetype": "smtp",
+			"service":         "myservice",
+			"subscriber":      "user",
+			"email":           email,
+		})
+		if err != nil {
+			t.Fatalf("Cannot build delivery point: %v", err)
+		}
+		dps = append(dps, dp)
+	}
+	return psp, dps
+}
+
+func smtpPushAll(psp *PushServiceProvider, dps []*DeliveryPoint, notif *Notification) []*PushResult {
+	dpQueue := make(chan *DeliveryPoint)
+	resQueue := make(chan *PushResult)
+	go func() {
+		for _, dp := range dps {
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	go newSMTPPushService().Push(psp, dpQueue, resQueue, notif)
+	ret := make([]*PushResult, 0, len(dps))
+	for res := range resQueue {
+		ret = append(ret, res)
+	}
+	return ret
+}
+
+func TestSMTPPushBatch(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.Close()
+
+	psp, dps := buildSMTPPeers(t, sink.ln.Addr().String(), "alice@example.com", "bob@example.com")
+	notif := NewEmptyNotification()
+	notif.Data["title"] = "Hello"
+	notif.Data["msg"] = "<b>World</b>"
+
+	results := smtpPushAll(psp, dps, notif)
+	if len(results) != len(dps) {
+		t.Fatalf("Expected %v results, got %v", len(dps), len(results))
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("Push failed: %v", res.Err)
+		}
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.nrConns != 1 {
+		t.Errorf("Expected one connection for the batch, got %v", sink.nrConns)
+	}
+	if len(sink.messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(sink.messages))
+	}
+	msg := sink.messages[0]
+	if !strings.Contains(msg, "Subject: Hello") {
+		t.Errorf("Missing subject: %v", msg)
+	}
+	if !strings.Contains(msg, "text/plain") || !strings.Contains(msg, "text/html") {
+		t.Errorf("Expected both plain text and html parts: %v", msg)
+	}
+	if !strings.Contains(msg, "&lt;b&gt;World&lt;/b&gt;") {
+		t.Errorf("Message should be escaped in the html part: %v", msg)
+	}
+}
+
+func TestSMTPPushRejectedRecipient(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.Close()
+	sink.reject["gone@example.com"] = true
+
+	psp, dps := buildSMTPPeers(t, sink.ln.Addr().String(), "gone@example.com", "bob@example.com")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	results := smtpPushAll(psp, dps, notif)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %v", len(results))
+	}
+	if _, ok := results[0].Err.(*UnsubscribeUpdate); !ok {
+		t.Errorf("Expected unsubscribe update, got %v", results[0].Err)
+	}
+	if results[1].Err != nil {
+		t.Errorf("The connection should survive a rejected recipient: %v", results[1].Err)
+	}
+}
+
+func TestSMTPPushRejectedSender(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.Close()
+	sink.mailReply = "550 Sender rejected"
+
+	psp, dps := buildSMTPPeers(t, sink.ln.Addr().String(), "alice@example.com", "bob@example.com")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	for _, res := range smtpPushAll(psp, dps, notif) {
+		if _, ok := res.Err.(*BadPushServiceProvider); !ok {
+			t.Errorf("Expected bad push service provider, got %v", res.Err)
+		}
+	}
+}
+
+func TestSMTPPushRejectedContent(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.Close()
+	sink.dataReply = "550 Looks like spam"
+
+	psp, dps := buildSMTPPeers(t, sink.ln.Addr().String(), "alice@example.com", "bob@example.com")
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+
+	for _, res := range smtpPushAll(psp, dps, notif) {
+		if _, ok := res.Err.(*BadNotification); !ok {
+			t.Errorf("Expected bad notification, got %v", res.Err)
+		}
+	}
+
+	sink = newSMTPSink(t)
+	defer sink.Close()
+	sink.dataReply = "451 Try again later"
+	psp, dps = buildSMTPPeers(t, sink.ln.Addr().String(), "alice@example.com", "bob@example.com")
+	for _, res := range smtpPushAll(psp, dps, notif) {
+		if _, ok := res.Err.(*RetryError); !ok {
+			t.Errorf("Expected retry error, got %v", res.Err)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+const (
+	snsServiceURL string = "https://sns.%v.amazonaws.com/"
+	snsAPIVersion string = "2010-03-31"
+)
+
+type snsPushService struct {
+	clients *httpClientManager
+}
+
+func newSNSPushService() *snsPushService {
+	ret := new(snsPushService)
+	ret.clients = newHTTPClientManager(nil)
+	return ret
+}
+
+func InstallSNS() {
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(newSNSPushService())
+}
+
+func (self *snsPushService) Finalize() {
+	self.clients.closeAll()
+}
+func (self *snsPushService) Name() string {
+	return "sns"
+}
+
+func (self *snsPushService) CredentialFields() []string {
+	return []string{"secretkey"}
+}
+
+func (self *snsPushService) SetErrorReportChan(errChan chan<- error) {
+	return
+}
+
+// parseSNSArn splits arn:aws:sns:<region>:<account>:<resource> and
+// returns the region and the parts of the resource, e.g.
+// [endpoint GCM myapp 1234-abcd] for an endpoint.
+func parseSNSArn(arn string) (region string, resource []string, err error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		err = fmt.Errorf("bad SNS ARN: %v", arn)
+		return
+	}
+	region = parts[3]
+	resource = strings.Split(parts[5], "/")
+	return
+}
+
+func (self *snsPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+
+	if app, ok := kv["platformapp"]; ok && len(app) > 0 {
+		region, resource, err := parseSNSArn(app)
+		if err != nil {
+			return err
+		}
+		if len(resource) != 3 || resource[0] != "app" {
+			return fmt.Errorf("not a platform application ARN: %v", app)
+		}
+		psp.FixedData["platformapp"] = app
+		psp.FixedData["region"] = region
+	} else {
+		return errors.New("NoPlatformApplication")
+	}
+
+	if region, ok := kv["region"]; ok && len(region) > 0 {
+		psp.FixedData["region"] = region
+	}
+
+	if accesskey, ok := kv["accesskey"]; ok && len(accesskey) > 0 {
+		psp.FixedData["accesskey"] = accesskey
+	} else {
+		return errors.New("NoAccessKey")
+	}
+
+	if secretkey, ok := kv["secretkey"]; ok && len(secretkey) > 0 {
+		psp.VolatileData["secretkey"] = secretkey
+	} else {
+		return errors.New("NoSecretKey")
+	}
+
+	// serviceurl replaces the endpoint of the region
+	err := buildEndpointsFromMap(kv, psp, "serviceurl")
+	if err != nil {
+		return err
+	}
+	return buildHTTPClientOptionsFromMap(kv, psp)
+}
+
+func (self *snsPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		dp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	if sub, ok := kv["subscriber"]; ok && len(sub) > 0 {
+		dp.FixedData["subscriber"] = sub
+	} else {
+		return errors.New("NoSubscriber")
+	}
+	if endpoint, ok := kv["endpointarn"]; ok && len(endpoint) > 0 {
+		_, resource, err := parseSNSArn(endpoint)
+		if err != nil {
+			return fmt.Errorf("Invalid delivery point: %v", err)
+		}
+		if len(resource) != 4 || resource[0] != "endpoint" {
+			return fmt.Errorf("Invalid delivery point: not an endpoint ARN: %v", endpoint)
+		}
+		dp.FixedData["endpointarn"] = endpoint
+	} else {
+		return errors.New("NoEndpointARN")
+	}
+	return nil
+}
+
+/*********************/
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// awsURIEncode encodes s as required by Signature Version 4: only
+// unreserved characters are left as they are.
+func awsURIEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// signAWSRequestV4 adds the headers of Signature Version 4 to req.
+// body is the payload of the request.
+func signAWSRequestV4(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzdate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzdate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{
+		"host":       host,
+		"x-amz-date": amzdate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for k, _ := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + strings.TrimSpace(headers[k]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k, _ := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
+
+/*********************/
+
+type snsPublishResponse struct {
+	MessageId string `xml:"PublishResult>MessageId"`
+}
+
+type snsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// toSNSMessage builds the message for the platform of the endpoint.
+// SNS sends the value keyed by the platform name, or the default one.
+func toSNSMessage(platform string, notif *Notification) (string, error) {
+	msg := make(map[string]string, 2)
+	var payload []byte
+	var err error
+	switch platform {
+	case "APNS", "APNS_SANDBOX", "APNS_VOIP", "APNS_VOIP_SANDBOX":
+		payload, err = toAPNSPayload(notif)
+	case "GCM", "ADM", "BAIDU", "MPNS", "WNS":
+		payload, err = json.Marshal(map[string]interface{}{"data": notif.Data})
+	default:
+		payload, err = json.Marshal(notif.Data)
+	}
+	if err != nil {
+		return "", err
+	}
+	msg[platform] = string(payload)
+	if m, ok := notif.Data["msg"]; ok {
+		msg["default"] = fmt.Sprintf("%v", m)
+	} else {
+		msg["default"] = string(payload)
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func snsErrorToPushError(code, message string, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification) error {
+	switch code {
+	case "EndpointDisabled", "NotFound":
+		// The device uninstalled the app, or the endpoint was deleted.
+		return NewUnsubscribeUpdate(psp, dp)
+	case "InvalidParameter", "InvalidParameterValue":
+		if strings.Contains(message, "TargetArn") {
+			return NewBadDeliveryPointWithDetails(dp, message)
+		}
+		return NewBadNotificationWithDetails(message)
+	case "AuthorizationError", "InvalidClientTokenId", "SignatureDoesNotMatch", "PlatformApplicationDisabled":
+		return NewBadPushServiceProviderWithDetails(psp, fmt.Sprintf("%v: %v", code, message))
+	case "Throttling", "ThrottledException", "InternalError", "InternalFailure", "ServiceUnavailable", "KMSThrottling":
+		return NewRetryErrorWithReason(psp, dp, notif, 5*time.Second, fmt.Errorf("%v: %v", code, message))
+	}
+	return fmt.Errorf("SNSError %v: %v", code, message)
+}
+
+func snsSinglePush(client *pspHTTPClient, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification) (string, error) {
+	endpoint := dp.FixedData["endpointarn"]
+	_, resource, err := parseSNSArn(endpoint)
+	if err != nil || len(resource) != 4 {
+		return "", NewBadDeliveryPointWithDetails(dp, "bad endpoint ARN")
+	}
+	message, err := toSNSMessage(resource[1], notif)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("Action", "Publish")
+	form.Set("Version", snsAPIVersion)
+	form.Set("TargetArn", endpoint)
+	form.Set("MessageStructure", "json")
+	form.Set("Message", message)
+	body := []byte(form.Encode())
+
+	region := psp.FixedData["region"]
+	serviceURL, ok := psp.VolatileData["serviceurl"]
+	if !ok {
+		serviceURL = fmt.Sprintf(snsServiceURL, region)
+	}
+	req, err := http.NewRequest("POST", serviceURL, strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequestV4(req, body, region, "sns", psp.FixedData["accesskey"], psp.VolatileData["secretkey"], time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+			return "", NewRetryErrorWithReason(psp, dp, notif, 3*time.Second, err)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", NewRetryErrorWithReason(psp, dp, notif, 3*time.Second, err)
+	}
+
+	if resp.StatusCode != 200 {
+		var fail snsErrorResponse
+		if xml.Unmarshal(content, &fail) != nil || fail.Code == "" {
+			if resp.StatusCode >= 500 {
+				return "", NewRetryError(psp, dp, notif, 5*time.Second)
+			}
+			return "", fmt.Errorf("%v: %v", resp.StatusCode, string(content))
+		}
+		return "", snsErrorToPushError(fail.Code, fail.Message, psp, dp, notif)
+	}
+
+	var succ snsPublishResponse
+	err = xml.Unmarshal(content, &succ)
+	if err != nil {
+		return "", err
+	}
+	return succ.MessageId, nil
+}
+
+func (self *snsPushService) singlePush(client *pspHTTPClient, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification, resQueue chan<- *PushResult) {
+	res := new(PushResult)
+	res.Provider = psp
+	res.Destination = dp
+	res.Content = notif
+	msgid, err := snsSinglePush(client, psp, dp, notif)
+	if err != nil {
+		res.Err = err
+	} else {
+		res.MsgId = fmt.Sprintf("sns:%v-%v", psp.Name(), msgid)
+	}
+	resQueue <- res
+}
+
+func (self *snsPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+	// At most maxinflight workers send the messages. They are
+	// started on demand.
+	client := self.clients.get(psp)
+	maxWorkers := pspIntOption(psp, "maxinflight", defaultMaxInFlight)
+	nrWorkers := 0
+	jobs := make(chan *DeliveryPoint)
+	wg := sync.WaitGroup{}
+
+	for dp := range dpQueue {
+		if psp.PushServiceName() != dp.PushServiceName() || psp.PushServiceName() != self.Name() {
+			res := new(PushResult)
+			res.Provider = psp
+			res.Destination = dp
+			res.Content = notif
+			res.Err = NewIncompatibleError()
+			resQueue <- res
+			continue
+		}
+		if nrWorkers < maxWorkers {
+			nrWorkers++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for dp := range jobs {
+					self.singlePush(client, psp, dp, notif, resQueue)
+				}
+			}()
+		}
+		jobs <- dp
+	}
+	close(jobs)
+	wg.Wait()
+	close(resQueue)
+}
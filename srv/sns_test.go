@@ -0,0 +1,164 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/rafaelbandeira3/uniqush-push/push"
+)
+
+// Example from the documentation of Signature Version 4
+func TestSignAWSRequestV4(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequestV4(req, []byte{}, "us-east-1", "iam", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Bad signature: %v", auth)
+	}
+}
+
+func TestSNSErrors(t *testing.T) {
+	pst := newSNSPushService()
+	dp := NewEmptyDeliveryPoint()
+	err := pst.BuildDeliveryPointFromMap(map[string]string{
+		"service":     "myservice",
+		"subscriber":  "user",
+		"endpointarn": "arn:aws:sns:us-east-1:123456789012:app/GCM/myapp",
+	}, dp)
+	if err == nil {
+		t.Errorf("Accepted a platform application ARN as an endpoint")
+	}
+
+	err = snsErrorToPushError("EndpointDisabled", "Endpoint is disabled", nil, nil, nil)
+	if _, ok := err.(*UnsubscribeUpdate); !ok {
+		t.Errorf("Expected unsubscribe update, got %v", err)
+	}
+	err = snsErrorToPushError("Throttling", "Rate exceeded", nil, nil, nil)
+	if _, ok := err.(*RetryError); !ok {
+		t.Errorf("Expected retry error, got %v", err)
+	}
+}
+
+func TestSNSPush(t *testing.T) {
+	lock := sync.Mutex{}
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond)
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(403)
+			return
+		}
+		target := r.FormValue("TargetArn")
+		if strings.HasSuffix(target, "/gone") {
+			w.WriteHeader(400)
+			fmt.Fprint(w, "<ErrorResponse><Error><Code>EndpointDisabled</Code><Message>Endpoint is disabled</Message></Error></ErrorResponse>")
+			return
+		}
+		fmt.Fprintf(w, "<PublishResponse><PublishResult><MessageId>%v</MessageId></PublishResult></PublishResponse>", target[strings.LastIndex(target, "/")+1:])
+	}))
+	defer server.Close()
+
+	pst := newSNSPushService()
+	defer pst.Finalize()
+	psm := GetPushServiceManager()
+	psm.RegisterPushServiceType(pst)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{
+		"pushservicetype": pst.Name(),
+		"service":         "myservice",
+		"platformapp":     "arn:aws:sns:us-east-1:123456789012:app/GCM/myapp",
+		"accesskey":       "AKIDEXAMPLE",
+		"secretkey":       "secret",
+		"serviceurl":      server.URL,
+		"maxinflight":     "8",
+	})
+	if err != nil {
+		t.Fatalf("Cannot build psp: %v", err)
+	}
+
+	nrDps := 200
+	dpQueue := make(chan *DeliveryPoint)
+	resQueue := make(chan *PushResult)
+	go func() {
+		for i := 0; i < nrDps; i++ {
+			id := fmt.Sprint(i)
+			if i == 10 {
+				id = "gone"
+			}
+			dp, err := psm.BuildDeliveryPointFromMap(map[string]string{
+				"pushservicetype": pst.Name(),
+				"service":         "myservice",
+				"subscriber":      "user" + id,
+				"endpointarn":     "arn:aws:sns:us-east-1:123456789012:endpoint/GCM/myapp/" + id,
+			})
+			if err != nil {
+				t.Errorf("Cannot build dp: %v", err)
+				continue
+			}
+			dpQueue <- dp
+		}
+		close(dpQueue)
+	}()
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "Hello"
+	go pst.Push(psp, dpQueue, resQueue, notif)
+
+	sent, unsubscribed := 0, 0
+	for res := range resQueue {
+		switch res.Err.(type) {
+		case nil:
+			if res.MsgId != fmt.Sprintf("sns:%v-%v", psp.Name(), strings.TrimPrefix(res.Destination.FixedData["subscriber"], "user")) {
+				t.Errorf("Bad message id: %v", res.MsgId)
+			}
+			sent++
+		case *UnsubscribeUpdate:
+			unsubscribed++
+		default:
+			t.Errorf("Push failed: %v", res.Err)
+		}
+	}
+	if sent != nrDps-1 || unsubscribed != 1 {
+		t.Errorf("%v sent, %v unsubscribed", sent, unsubscribed)
+	}
+	if maxInFlight > 8 {
+		t.Errorf("%v requests in flight", maxInFlight)
+	}
+}